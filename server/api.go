@@ -0,0 +1,564 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// ==== JSON API ====
+//
+// /api/v1/ exposes the library as JSON for scripts. It runs on the same
+// library operations as the admin pages and honours the same roles,
+// category access and API token scopes. Errors are returned as
+// {"error": "...", "status": N}.
+
+const apiBase = "/api/v1/"
+
+// maxThumbUpload caps a thumbnail PUT. It is well above the size the
+// validator warns about so a large photo can still be stored and fixed later.
+const maxThumbUpload = 16 << 20
+
+// Collection names below a category, outermost first. The last level holds
+// the items that carry a video.
+var (
+	movieLevels  = []string{"movies"}
+	seriesLevels = []string{"series", "seasons", "episodes"}
+)
+
+type apiCategory struct {
+	Name string `json:"name"`
+	Type string `json:"type"` // "movies" or "series"
+}
+
+// apiNode is an item in the library along with the names of its children,
+// if it has any.
+type apiNode struct {
+	itemInfo
+	Children []string `json:"children,omitempty"`
+}
+
+type apiMetadata struct {
+	ShortDesc *string `json:"short_description"`
+	LongDesc  *string `json:"long_description"`
+}
+
+type apiCreate struct {
+	Name      string `json:"name"`
+	UploadID  string `json:"upload_id"`
+	ShortDesc string `json:"short_description"`
+	LongDesc  string `json:"long_description"`
+}
+
+func categoryType(name string) string {
+	if strings.EqualFold(name, "movies") {
+		return "movies"
+	}
+	return "series"
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		logFor("api").Error("JSON encode failed", "err", err)
+	}
+}
+
+func apiError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]interface{}{"error": msg, "status": status})
+}
+
+// apiFailed maps a library error to a status code.
+func apiFailed(w http.ResponseWriter, err error) {
+	switch {
+	case isInputError(err):
+		apiError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, errNotFound):
+		apiError(w, http.StatusNotFound, "not found")
+	case errors.Is(err, errExists):
+		apiError(w, http.StatusConflict, "already exists")
+	case errors.Is(err, errUploadBusy):
+		apiError(w, http.StatusLocked, err.Error())
+	case errors.As(err, new(*http.MaxBytesError)):
+		apiError(w, http.StatusRequestEntityTooLarge, "request body too large")
+	default:
+		logFor("api").Error("request failed", "err", err)
+		apiError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+func apiForbidden(w http.ResponseWriter) {
+	apiError(w, http.StatusForbidden, "your role, access list or token scopes do not allow this")
+}
+
+func apiMethodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+}
+
+// apiAuth accepts an API token or a browser session. Sessions still need
+// the CSRF token for anything that changes data.
+func apiAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if bearerToken(r) != "" {
+			if t := currentAPIToken(r); t != nil && users.get(t.Username) != nil {
+				next(w, r)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="ChannelForge"`)
+			apiError(w, http.StatusUnauthorized, "invalid or expired API token")
+			return
+		}
+		sess := currentSession(r)
+		if sess == nil || users.get(sess.Username) == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="ChannelForge"`)
+			apiError(w, http.StatusUnauthorized, "authentication required")
+			return
+		}
+		if !csrfSafeMethod(r.Method) && !validCSRF(r, sess.CSRF) {
+			apiError(w, http.StatusForbidden, "missing or invalid CSRF token")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// apiPerm is requirePerm for API endpoints.
+func apiPerm(p permission, next http.HandlerFunc) http.HandlerFunc {
+	return apiAuth(func(w http.ResponseWriter, r *http.Request) {
+		if !currentUser(r).can(p) {
+			apiForbidden(w)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// decodeJSON reads a small JSON request body into v.
+func decodeJSON(r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(io.LimitReader(r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return badInput("invalid JSON body: %v", err)
+	}
+	return nil
+}
+
+func isMultipart(r *http.Request) bool {
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return ct == "multipart/form-data"
+}
+
+func apiHandler(root string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		me := currentUser(r)
+		rest := strings.Trim(strings.TrimPrefix(r.URL.Path, apiBase), "/")
+		if rest == "" {
+			writeJSON(w, http.StatusOK, map[string]string{
+				"version": "v1",
+				"openapi": apiBase + "openapi.json",
+				"user":    me.Username,
+			})
+			return
+		}
+		segs := strings.Split(rest, "/")
+		if segs[0] != "categories" {
+			apiError(w, http.StatusNotFound, "unknown endpoint")
+			return
+		}
+		if len(segs) == 1 {
+			apiCategories(root, me, w, r)
+			return
+		}
+
+		cat := segs[1]
+		if !me.canSeeCategory(cat) {
+			apiForbidden(w)
+			return
+		}
+		catPath, err := libPath(root, cat)
+		if err != nil {
+			apiFailed(w, err)
+			return
+		}
+		levels := seriesLevels
+		if categoryType(cat) == "movies" {
+			levels = movieLevels
+		}
+		if len(segs) == 2 {
+			apiCategoryEntry(root, cat, levels[0], me, w, r)
+			return
+		}
+
+		// Walk down /{collection}/{name} pairs, e.g. series/X/seasons/Y
+		dir, rest2 := catPath, segs[2:]
+		for level := 0; level < len(levels); level++ {
+			if rest2[0] != levels[level] {
+				break
+			}
+			leaf := level == len(levels)-1
+			child := ""
+			if !leaf {
+				child = levels[level+1]
+			}
+			if len(rest2) == 1 {
+				apiCollection(dir, cat, level == 0, leaf, me, w, r)
+				return
+			}
+			name := rest2[1]
+			if level == 0 && !me.canAccess(cat, name) {
+				apiForbidden(w)
+				return
+			}
+			if dir, err = libPath(dir, name); err != nil {
+				apiFailed(w, err)
+				return
+			}
+			switch {
+			case len(rest2) == 2:
+				apiEntry(dir, child, me, w, r)
+				return
+			case len(rest2) == 3 && rest2[2] == "metadata":
+				apiEntryMetadata(dir, me, w, r)
+				return
+			case len(rest2) == 3 && rest2[2] == "thumbnail":
+				apiEntryThumbnail(dir, me, w, r)
+				return
+			}
+			rest2 = rest2[2:]
+		}
+		apiError(w, http.StatusNotFound, "unknown endpoint")
+	}
+}
+
+// apiCategories serves /categories.
+func apiCategories(root string, me *User, w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		cats, err := listCategories(root)
+		if err != nil {
+			apiFailed(w, err)
+			return
+		}
+		out := []apiCategory{}
+		for _, c := range cats {
+			if me.canSeeCategory(c) {
+				out = append(out, apiCategory{Name: c, Type: categoryType(c)})
+			}
+		}
+		writeJSON(w, http.StatusOK, out)
+	case "POST":
+		if !me.can(permCreate) || me.restricted() {
+			apiForbidden(w)
+			return
+		}
+		var req apiCreate
+		if err := decodeJSON(r, &req); err != nil {
+			apiFailed(w, err)
+			return
+		}
+		name := strings.TrimSpace(req.Name)
+		if _, err := audited(r).createFolder(root, name); err != nil {
+			apiFailed(w, err)
+			return
+		}
+		w.Header().Set("Location", apiBase+"categories/"+url.PathEscape(name))
+		writeJSON(w, http.StatusCreated, apiCategory{Name: name, Type: categoryType(name)})
+	default:
+		apiMethodNotAllowed(w, "GET, POST")
+	}
+}
+
+// apiCategoryEntry serves /categories/{cat}.
+func apiCategoryEntry(root, cat, coll string, me *User, w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		catPath, _ := libPath(root, cat)
+		names, err := listFolders(catPath)
+		if err != nil {
+			apiFailed(w, err)
+			return
+		}
+		out := map[string]interface{}{"name": cat, "type": categoryType(cat)}
+		visible := []string{}
+		for _, n := range names {
+			if me.canAccess(cat, n) {
+				visible = append(visible, n)
+			}
+		}
+		out[coll] = visible
+		writeJSON(w, http.StatusOK, out)
+	case "DELETE":
+		if !me.can(permDelete) || !me.canAccess(cat, "") {
+			apiForbidden(w)
+			return
+		}
+		if err := audited(r).deleteFolder(root, cat); err != nil {
+			apiFailed(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		apiMethodNotAllowed(w, "GET, DELETE")
+	}
+}
+
+// apiCollection lists or adds to the folders in dir. Leaf collections hold
+// movies or episodes, which are created together with their video.
+func apiCollection(dir, cat string, top, leaf bool, me *User, w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		names, err := listFolders(dir)
+		if err != nil {
+			apiFailed(w, err)
+			return
+		}
+		out := []*itemInfo{}
+		for _, n := range names {
+			if top && !me.canAccess(cat, n) {
+				continue
+			}
+			if info, err := readItem(filepath.Join(dir, n)); err == nil {
+				out = append(out, info)
+			}
+		}
+		writeJSON(w, http.StatusOK, out)
+	case "POST":
+		need := permCreate
+		if leaf {
+			need = permUpload
+		}
+		if !me.can(need) {
+			apiForbidden(w)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+		req, up, cleanup, err := apiReadCreate(r)
+		defer cleanup()
+		if err != nil {
+			apiFailed(w, err)
+			return
+		}
+		name := strings.TrimSpace(req.Name)
+		if top && !me.canAccess(cat, name) {
+			apiForbidden(w)
+			return
+		}
+		full, err := libPath(dir, name)
+		if err != nil {
+			apiFailed(w, err)
+			return
+		}
+		if leaf {
+			if _, err := readItem(full); err == nil {
+				apiFailed(w, errExists)
+				return
+			}
+			_, err = audited(r).saveItem(dir, name, up)
+		} else if _, err = audited(r).createFolder(dir, name); err == nil && (req.ShortDesc != "" || req.LongDesc != "") {
+			err = audited(r).setDescription(full, req.ShortDesc, req.LongDesc)
+		}
+		if err != nil {
+			apiFailed(w, err)
+			return
+		}
+		info, err := readItem(full)
+		if err != nil {
+			apiFailed(w, err)
+			return
+		}
+		w.Header().Set("Location", strings.TrimSuffix(r.URL.EscapedPath(), "/")+"/"+url.PathEscape(name))
+		writeJSON(w, http.StatusCreated, info)
+	default:
+		apiMethodNotAllowed(w, "GET, POST")
+	}
+}
+
+// apiReadCreate reads a create request, either JSON or a multipart form
+// with the video and thumbnail attached.
+func apiReadCreate(r *http.Request) (apiCreate, itemUpload, func(), error) {
+	var req apiCreate
+	var files []io.Closer
+	cleanup := func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+	if isMultipart(r) {
+		if err := r.ParseMultipartForm(100 << 20); err != nil {
+			return req, itemUpload{}, cleanup, badInput("invalid form: %v", err)
+		}
+		req = apiCreate{
+			Name:      r.FormValue("name"),
+			UploadID:  strings.TrimSpace(r.FormValue("upload_id")),
+			ShortDesc: r.FormValue("short_description"),
+			LongDesc:  r.FormValue("long_description"),
+		}
+	} else if err := decodeJSON(r, &req); err != nil {
+		return req, itemUpload{}, cleanup, err
+	}
+	up := itemUpload{
+		UploadID:  req.UploadID,
+		Owner:     checkSession(r),
+		ShortDesc: req.ShortDesc,
+		LongDesc:  req.LongDesc,
+	}
+	if r.MultipartForm != nil {
+		if video, vhead, err := r.FormFile("video"); err == nil {
+			files = append(files, video)
+			up.Video, up.VideoName = video, vhead.Filename
+		}
+		if thumb, thead, err := r.FormFile("thumbnail"); err == nil && thead.Filename != "" {
+			files = append(files, thumb)
+			up.Thumb, up.ThumbName = thumb, thead.Filename
+		}
+	}
+	return req, up, cleanup, nil
+}
+
+// apiEntry serves a single series, season, movie or episode.
+func apiEntry(dir, child string, me *User, w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		info, err := readItem(dir)
+		if err != nil {
+			apiFailed(w, err)
+			return
+		}
+		node := apiNode{itemInfo: *info}
+		if child != "" {
+			node.Children, _ = listFolders(dir)
+		}
+		writeJSON(w, http.StatusOK, node)
+	case "DELETE":
+		if !me.can(permDelete) {
+			apiForbidden(w)
+			return
+		}
+		if err := audited(r).deleteFolder(filepath.Dir(dir), filepath.Base(dir)); err != nil {
+			apiFailed(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		apiMethodNotAllowed(w, "GET, DELETE")
+	}
+}
+
+// apiEntryMetadata serves .../metadata. PUT replaces both descriptions,
+// PATCH only the ones given.
+func apiEntryMetadata(dir string, me *User, w http.ResponseWriter, r *http.Request) {
+	info, err := readItem(dir)
+	if err != nil {
+		apiFailed(w, err)
+		return
+	}
+	switch r.Method {
+	case "GET":
+	case "PUT", "PATCH":
+		if !me.can(permUpload) {
+			apiForbidden(w)
+			return
+		}
+		var req apiMetadata
+		if err := decodeJSON(r, &req); err != nil {
+			apiFailed(w, err)
+			return
+		}
+		if r.Method == "PUT" {
+			info.ShortDesc, info.LongDesc = "", ""
+		}
+		if req.ShortDesc != nil {
+			info.ShortDesc = *req.ShortDesc
+		}
+		if req.LongDesc != nil {
+			info.LongDesc = *req.LongDesc
+		}
+		if err := audited(r).setDescription(dir, info.ShortDesc, info.LongDesc); err != nil {
+			apiFailed(w, err)
+			return
+		}
+	default:
+		apiMethodNotAllowed(w, "GET, PUT, PATCH")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{
+		"short_description": info.ShortDesc,
+		"long_description":  info.LongDesc,
+	})
+}
+
+// apiEntryThumbnail serves .../thumbnail. Uploads are either a multipart
+// form with a "thumbnail" file or a raw image/jpeg or image/png body.
+func apiEntryThumbnail(dir string, me *User, w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD":
+		info, err := readItem(dir)
+		if err != nil {
+			apiFailed(w, err)
+			return
+		}
+		if info.Thumbnail == "" {
+			apiError(w, http.StatusNotFound, "no thumbnail")
+			return
+		}
+		http.ServeFile(w, r, filepath.Join(dir, info.Thumbnail))
+	case "PUT":
+		if !me.can(permUpload) {
+			apiForbidden(w)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxThumbUpload)
+		var body io.Reader
+		var filename string
+		if isMultipart(r) {
+			f, head, err := r.FormFile("thumbnail")
+			if errors.As(err, new(*http.MaxBytesError)) {
+				apiFailed(w, err)
+				return
+			} else if err != nil {
+				apiError(w, http.StatusBadRequest, "missing thumbnail file")
+				return
+			}
+			defer f.Close()
+			body, filename = f, head.Filename
+		} else {
+			switch ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct {
+			case "image/jpeg":
+				filename = "thumb.jpg"
+			case "image/png":
+				filename = "thumb.png"
+			default:
+				apiError(w, http.StatusUnsupportedMediaType, "thumbnail must be image/jpeg or image/png")
+				return
+			}
+			body = r.Body
+		}
+		if err := audited(r).setThumbnail(dir, filename, body); err != nil {
+			apiFailed(w, err)
+			return
+		}
+		info, err := readItem(dir)
+		if err != nil {
+			apiFailed(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, info)
+	default:
+		apiMethodNotAllowed(w, "GET, PUT")
+	}
+}
+
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	server, _ := json.Marshal(baseURL(r) + strings.TrimSuffix(apiBase, "/"))
+	w.Header().Set("Content-Type", "application/json")
+	io.WriteString(w, strings.Replace(openAPISpec, `"/api/v1"`, string(server), 1))
+}
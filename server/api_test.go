@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAPIThumbnailSizeCap(t *testing.T) {
+	s := newTestServer(t)
+	put := func(body []byte, contentType string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("PUT", apiBase+"categories/Movies/movies/Film/thumbnail", bytes.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+		r.Header.Set("X-CSRF-Token", s.csrf)
+		r.AddCookie(s.cookie)
+		w := httptest.NewRecorder()
+		apiAuth(apiHandler(s.root))(w, r)
+		return w
+	}
+	thumb := filepath.Join(s.root, "Movies", "Film", "thumb.png")
+
+	if w := put(make([]byte, maxThumbUpload+1), "image/png"); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized raw thumbnail: got %d, want 413: %s", w.Code, w.Body)
+	}
+	if _, err := os.Stat(thumb); err == nil {
+		t.Error("oversized thumbnail was stored")
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreateFormFile("thumbnail", "thumb.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(make([]byte, maxThumbUpload+1))
+	mw.Close()
+	if w := put(body.Bytes(), mw.FormDataContentType()); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized multipart thumbnail: got %d, want 413: %s", w.Code, w.Body)
+	}
+
+	if w := put([]byte("png"), "image/png"); w.Code != http.StatusOK {
+		t.Errorf("small thumbnail: got %d: %s", w.Code, w.Body)
+	}
+	if _, err := os.Stat(thumb); err != nil {
+		t.Error("small thumbnail was not stored:", err)
+	}
+}
+
+func TestOpenAPIServerURL(t *testing.T) {
+	keepSettings(t)
+	tests := []struct {
+		base, public string
+		want         string
+	}{
+		{"", "", "http://tv.lan:8080/api/v1"},
+		{"/media", "", "http://tv.lan:8080/media/api/v1"},
+		{"/tv", "https://media.example.com/tv", "https://media.example.com/tv/api/v1"},
+	}
+	for _, tt := range tests {
+		basePath, publicBaseURL = tt.base, tt.public
+		r := httptest.NewRequest("GET", apiBase+"openapi.json", nil)
+		r.Host = "tv.lan:8080"
+		w := httptest.NewRecorder()
+		openAPIHandler(w, r)
+		var spec struct {
+			OpenAPI string `json:"openapi"`
+			Servers []struct {
+				URL string `json:"url"`
+			} `json:"servers"`
+			Paths map[string]interface{} `json:"paths"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &spec); err != nil {
+			t.Fatalf("%q: spec doesn't parse: %v", tt.base, err)
+		}
+		if spec.OpenAPI == "" || len(spec.Paths) == 0 {
+			t.Errorf("%q: spec lacks its version or paths", tt.base)
+		}
+		if len(spec.Servers) != 1 || spec.Servers[0].URL != tt.want {
+			t.Errorf("base path %q, base URL %q: servers = %+v, want %q", tt.base, tt.public, spec.Servers, tt.want)
+		}
+	}
+}
+
+func TestAPIErrorShape(t *testing.T) {
+	s := newTestServer(t)
+	tests := []struct {
+		method, target, body string
+		want                 int
+	}{
+		{"POST", apiBase + "categories", `{"name": `, http.StatusBadRequest},
+		{"POST", apiBase + "categories", `{"name": "../outside"}`, http.StatusBadRequest},
+		{"GET", apiBase + "categories/Movies/movies/Nope", "", http.StatusNotFound},
+		{"GET", apiBase + "nothing", "", http.StatusNotFound},
+		{"POST", apiBase + "categories", `{"name": "Movies"}`, http.StatusConflict},
+		{"POST", apiBase + "categories/TV/series", `{"name": "Show"}`, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		w := s.api(t, tt.method, tt.target, tt.body)
+		if w.Code != tt.want {
+			t.Errorf("%s %s: got %d, want %d: %s", tt.method, tt.target, w.Code, tt.want, w.Body)
+			continue
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s %s: Content-Type %q", tt.method, tt.target, ct)
+		}
+		var body map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Errorf("%s %s: %v: %s", tt.method, tt.target, err, w.Body)
+			continue
+		}
+		msg, _ := body["error"].(string)
+		if len(body) != 2 || msg == "" || body["status"] != float64(tt.want) {
+			t.Errorf("%s %s: body %s is not {\"error\": ..., \"status\": %d}", tt.method, tt.target, w.Body, tt.want)
+		}
+	}
+}
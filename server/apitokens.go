@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ==== API TOKENS ====
+//
+// Personal tokens let scripts use the admin endpoints without a browser.
+// They are sent as "Authorization: Bearer <token>" and act as their owner,
+// limited to the token's scopes. Like sessions, only a hash of each token
+// is kept on disk.
+
+const apiTokenFile = "apitokens.json"
+
+const apiTokenPrefix = "cf_"
+
+// apiScopes lists what a token may be allowed to do and the permission each
+// scope grants. A token never has more rights than its owner's role.
+var apiScopes = []struct {
+	Name string
+	Desc string
+	Perm permission
+}{
+	{"read-library", "List categories, series, seasons and episodes", permView},
+	{"upload", "Upload videos, thumbnails and descriptions", permUpload},
+	{"create", "Create categories, series and seasons", permCreate},
+	{"delete", "Delete content", permDelete},
+}
+
+func scopeAllows(scopes []string, p permission) bool {
+	for _, s := range scopes {
+		for _, def := range apiScopes {
+			if def.Name == s && def.Perm == p {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type apiToken struct {
+	ID       string    `json:"id"` // short public identifier, used for revoking
+	Username string    `json:"username"`
+	Name     string    `json:"name"`
+	Scopes   []string  `json:"scopes"`
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires,omitempty"` // zero means never
+	LastUsed time.Time `json:"last_used,omitempty"`
+}
+
+func (t *apiToken) expired(now time.Time) bool {
+	return !t.Expires.IsZero() && now.After(t.Expires)
+}
+
+type apiTokenStore struct {
+	mu     sync.Mutex
+	path   string
+	byHash map[string]*apiToken
+}
+
+var apiTokens = &apiTokenStore{path: apiTokenFile, byHash: make(map[string]*apiToken)}
+
+func (s *apiTokenStore) load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	byHash := make(map[string]*apiToken)
+	if err := json.Unmarshal(b, &byHash); err != nil {
+		return err
+	}
+	s.byHash = byHash
+	return nil
+}
+
+func (s *apiTokenStore) saveLocked() {
+	if !storeWritable() {
+		return
+	}
+	b, err := json.MarshalIndent(s.byHash, "", "  ")
+	if err == nil {
+		tmp := s.path + ".tmp"
+		if err = os.WriteFile(tmp, b, 0600); err == nil {
+			err = os.Rename(tmp, s.path)
+		}
+	}
+	if err != nil {
+		logFor("auth").Error("failed to save API tokens", "err", err)
+	}
+}
+
+// create issues a new token and returns its secret value, which is only
+// ever shown once.
+func (s *apiTokenStore) create(username, name string, scopes []string, lifetime time.Duration) string {
+	token := apiTokenPrefix + newSessionToken()
+	h := hashToken(token)
+	now := time.Now()
+	t := &apiToken{ID: h[:16], Username: username, Name: name, Scopes: scopes, Created: now}
+	if lifetime > 0 {
+		t.Expires = now.Add(lifetime)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byHash[h] = t
+	s.saveLocked()
+	return token
+}
+
+// lookup returns a copy of the live token and records its use.
+func (s *apiTokenStore) lookup(token string) *apiToken {
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		return nil
+	}
+	h := hashToken(token)
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.byHash[h]
+	if !ok || t.expired(now) {
+		return nil
+	}
+	if now.Sub(t.LastUsed) > time.Minute {
+		t.LastUsed = now
+		s.saveLocked()
+	}
+	c := *t
+	return &c
+}
+
+// revoke deletes the token with the given public ID if it belongs to
+// username.
+func (s *apiTokenStore) revoke(username, id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for h, t := range s.byHash {
+		if t.ID == id && t.Username == username {
+			delete(s.byHash, h)
+			s.saveLocked()
+			return true
+		}
+	}
+	return false
+}
+
+func (s *apiTokenStore) revokeUser(username string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for h, t := range s.byHash {
+		if t.Username == username {
+			delete(s.byHash, h)
+		}
+	}
+	s.saveLocked()
+}
+
+// listFor returns the user's tokens, newest first. Expired ones are kept
+// so the owner can see why a script stopped working.
+func (s *apiTokenStore) listFor(username string) []apiToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []apiToken
+	for _, t := range s.byHash {
+		if t.Username == username {
+			out = append(out, *t)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Created.After(out[j].Created) })
+	return out
+}
+
+// bearerToken returns the token from the Authorization header, if any.
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "Bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	return ""
+}
+
+// currentAPIToken returns the valid token the request was made with, or nil.
+func currentAPIToken(r *http.Request) *apiToken {
+	if token := bearerToken(r); token != "" {
+		return apiTokens.lookup(token)
+	}
+	return nil
+}
+
+func unauthorizedToken(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="ChannelForge"`)
+	http.Error(w, "Invalid or expired API token", http.StatusUnauthorized)
+}
+
+// browserOnly keeps API tokens away from pages that manage the account
+// itself, so a leaked token can't be used to mint more tokens.
+func browserOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if bearerToken(r) != "" {
+			http.Error(w, "Forbidden: not available to API tokens", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+var tokensPage = template.Must(template.New("tokens").Parse(`
+<html><head><title>API Tokens</title>` + css + `</head><body>
+<nav>
+  <a href="/admin">Dashboard</a>
+  <a href="/admin/account">My Account</a>
+  <a href="/logout">Logout</a>
+</nav>
+<div class="card">
+<h2>API Tokens</h2>
+{{if .Error}}<div class="error">{{.Error}}</div>{{end}}
+{{if .NewToken}}
+  <p>Your new token is shown below. Copy it now; it won't be shown again.</p>
+  <p><code>{{.NewToken}}</code></p>
+  <p><small>Send it as <code>Authorization: Bearer &lt;token&gt;</code>.</small></p>
+{{end}}
+{{if .Tokens}}
+  <table>
+    <tr><th>Name</th><th>Scopes</th><th>Created</th><th>Expires</th><th>Last Used</th><th></th></tr>
+    {{range .Tokens}}
+      <tr>
+        <td>{{.Name}}</td>
+        <td>{{range $i, $s := .Scopes}}{{if $i}}, {{end}}{{$s}}{{end}}</td>
+        <td>{{.Created.Format "2006-01-02"}}</td>
+        <td>{{if .Expires.IsZero}}Never{{else}}{{.Expires.Format "2006-01-02"}}{{end}}</td>
+        <td>{{if .LastUsed.IsZero}}Never{{else}}{{.LastUsed.Format "2006-01-02 15:04"}}{{end}}</td>
+        <td>
+          <form method="POST" action="/admin/tokens" style="display:inline">` + csrfInput + `
+            <input type="hidden" name="action" value="revoke">
+            <input type="hidden" name="id" value="{{.ID}}">
+            <button type="submit" class="btn" onclick="return confirm('Revoke token {{.Name}}?')">Revoke</button>
+          </form>
+        </td>
+      </tr>
+    {{end}}
+  </table>
+{{else}}
+  <p>You have no API tokens.</p>
+{{end}}
+<h3>New Token</h3>
+<form method="POST" action="/admin/tokens">` + csrfInput + `
+  <input type="hidden" name="action" value="create">
+  <label>Name <input name="name" required placeholder="e.g. ingest script"></label>
+  <p>Scopes</p>
+  {{range .Scopes}}
+    <label><input type="checkbox" name="scope" value="{{.Name}}"> {{.Name}} &mdash; {{.Desc}}</label>
+  {{end}}
+  <label>Expires
+    <select name="expires">
+      <option value="30">In 30 days</option>
+      <option value="90" selected>In 90 days</option>
+      <option value="365">In a year</option>
+      <option value="0">Never</option>
+    </select>
+  </label>
+  <button type="submit">Create Token</button>
+</form>
+</div>
+</body></html>
+`))
+
+func tokensHandler(w http.ResponseWriter, r *http.Request) {
+	me := currentUser(r)
+	data := map[string]interface{}{}
+	// Only offer scopes the user's role could use anyway
+	var scopes []interface{}
+	for _, s := range apiScopes {
+		if me.can(s.Perm) {
+			scopes = append(scopes, s)
+		}
+	}
+	data["Scopes"] = scopes
+	switch r.Method {
+	case "GET":
+	case "POST":
+		switch r.FormValue("action") {
+		case "create":
+			name := strings.TrimSpace(r.FormValue("name"))
+			var chosen []string
+			for _, s := range apiScopes {
+				for _, v := range r.Form["scope"] {
+					if v == s.Name && me.can(s.Perm) {
+						chosen = append(chosen, s.Name)
+					}
+				}
+			}
+			days, err := strconv.Atoi(r.FormValue("expires"))
+			switch {
+			case name == "":
+				data["Error"] = "Name is required"
+			case len(chosen) == 0:
+				data["Error"] = "Choose at least one scope"
+			case err != nil || days < 0:
+				data["Error"] = "Invalid expiry"
+			default:
+				data["NewToken"] = apiTokens.create(me.Username, name, chosen, time.Duration(days)*24*time.Hour)
+			}
+		case "revoke":
+			if !apiTokens.revoke(me.Username, r.FormValue("id")) {
+				data["Error"] = "Token not found"
+			}
+		default:
+			data["Error"] = "Unknown action"
+		}
+	default:
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	data["Tokens"] = apiTokens.listFor(me.Username)
+	renderPage(w, r, tokensPage, data)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// bearer sends a request with an API token instead of the session cookie.
+func bearer(s *testServer, token, method, target, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "http://localhost/", strings.NewReader(body))
+	r.URL.Path = target
+	r.Header.Set("Authorization", "Bearer "+token)
+	if strings.HasPrefix(body, "{") {
+		r.Header.Set("Content-Type", "application/json")
+	} else {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	w := httptest.NewRecorder()
+	if strings.HasPrefix(target, apiBase) {
+		apiAuth(apiHandler(s.root))(w, r)
+	} else {
+		requireLogin(catRouter(s.root))(w, r)
+	}
+	return w
+}
+
+func TestReadScopedTokenRefusesWrites(t *testing.T) {
+	s := newTestServer(t)
+	token := apiTokens.create("admin", "reader", []string{"read-library"}, time.Hour)
+
+	if w := bearer(s, token, "GET", apiBase+"categories/TV/series", ""); w.Code != http.StatusOK {
+		t.Fatalf("read with a read token: got %d", w.Code)
+	}
+	before := s.snapshot(t)
+	for _, tt := range []struct{ method, target, body string }{
+		{"POST", apiBase + "categories", `{"name":"Docs"}`},
+		{"POST", apiBase + "categories/TV/series", `{"name":"New Show"}`},
+		{"DELETE", apiBase + "categories/Movies/movies/Film", ""},
+		{"PUT", apiBase + "categories/Movies/movies/Film/metadata", `{"short_description":"x"}`},
+		{"POST", "/admin/cat/TV/series/Show/delseason", url.Values{"seasonname": {"Season 1"}}.Encode()},
+		{"POST", "/admin/cat/TV/newseries", url.Values{"seriesname": {"New Show"}}.Encode()},
+	} {
+		if w := bearer(s, token, tt.method, tt.target, tt.body); w.Code != http.StatusForbidden {
+			t.Errorf("%s %s with a read token: got %d, want 403", tt.method, tt.target, w.Code)
+		}
+	}
+	assertUnchanged(t, before, s.snapshot(t))
+
+	// A token never has more rights than its owner
+	s.as(t, "viewer", RoleViewer)
+	wide := apiTokens.create("viewer", "wide", []string{"read-library", "delete"}, 0)
+	if w := bearer(s, wide, "DELETE", apiBase+"categories/Movies/movies/Film", ""); w.Code != http.StatusForbidden {
+		t.Errorf("viewer's delete token: got %d, want 403", w.Code)
+	}
+	deleter := apiTokens.create("admin", "deleter", []string{"delete"}, 0)
+	if w := bearer(s, deleter, "DELETE", apiBase+"categories/Movies/movies/Film", ""); w.Code != http.StatusNoContent {
+		t.Errorf("delete with a delete token: got %d", w.Code)
+	}
+	if _, err := os.Stat(filepath.Join(s.root, "Movies", "Film")); !os.IsNotExist(err) {
+		t.Error("film still there")
+	}
+}
+
+func TestTokenExpiryAndRevoke(t *testing.T) {
+	s := newTestServer(t)
+	token := apiTokens.create("admin", "short", []string{"read-library"}, time.Hour)
+	apiTokens.mu.Lock()
+	apiTokens.byHash[hashToken(token)].Expires = time.Now().Add(-time.Second)
+	apiTokens.mu.Unlock()
+	if w := bearer(s, token, "GET", apiBase+"categories", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("expired token: got %d, want 401", w.Code)
+	}
+
+	token = apiTokens.create("admin", "revoked", []string{"read-library"}, 0)
+	id := apiTokens.lookup(token).ID
+	if apiTokens.revoke("someone", id) {
+		t.Error("revoked another user's token")
+	}
+	if !apiTokens.revoke("admin", id) {
+		t.Fatal("revoke failed")
+	}
+	if w := bearer(s, token, "GET", apiBase+"categories", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("revoked token: got %d, want 401", w.Code)
+	}
+	if w := bearer(s, "cf_made-up", "GET", apiBase+"categories", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("unknown token: got %d, want 401", w.Code)
+	}
+}
+
+func TestTokensCannotManageAccount(t *testing.T) {
+	newTestServer(t)
+	token := apiTokens.create("admin", "all", []string{"read-library", "upload", "create", "delete"}, 0)
+	for target, h := range map[string]http.HandlerFunc{"/admin/tokens": tokensHandler, "/admin/account": accountHandler} {
+		r := httptest.NewRequest("POST", target, strings.NewReader("action=create&name=more&scope=delete&expires=0&current=x&password=xxxxxx"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		requireLogin(browserOnly(h))(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("POST %s with a token: got %d, want 403", target, w.Code)
+		}
+	}
+	if n := len(apiTokens.listFor("admin")); n != 1 {
+		t.Errorf("admin has %d tokens, want 1", n)
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	osuser "os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ==== AUDIT LOG ====
+//
+// Every change to the library, the users and the devices is appended to
+// auditFile as one JSON object per line. Nothing ever rewrites the file, so
+// the admin page and the export read it front to back.
+
+const (
+	auditFile      = "audit.log"
+	auditPageLimit = 500
+)
+
+type auditEntry struct {
+	Time   time.Time   `json:"time"`
+	User   string      `json:"user"`
+	IP     string      `json:"ip"`
+	Action string      `json:"action"`
+	Target string      `json:"target"`
+	Before interface{} `json:"before,omitempty"`
+	After  interface{} `json:"after,omitempty"`
+}
+
+func (e auditEntry) BeforeJSON() string { return indentJSON(e.Before) }
+func (e auditEntry) AfterJSON() string  { return indentJSON(e.After) }
+
+func indentJSON(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	b, _ := json.MarshalIndent(v, "", "  ")
+	return string(b)
+}
+
+type auditStore struct {
+	mu   sync.Mutex
+	path string
+	root string // library paths are logged relative to this
+}
+
+var auditLog = &auditStore{path: auditFile}
+
+func (a *auditStore) append(e auditEntry) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		logFor("audit").Error("failed to encode audit entry", "err", err)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		logFor("audit").Error("failed to write audit log", "err", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		logFor("audit").Error("failed to write audit log", "err", err)
+	}
+}
+
+// auditFilter selects entries; empty fields match everything.
+type auditFilter struct {
+	User   string
+	Action string
+	Target string // substring
+	Since  time.Time
+}
+
+func (f auditFilter) match(e *auditEntry) bool {
+	return (f.User == "" || e.User == f.User) &&
+		(f.Action == "" || e.Action == f.Action) &&
+		(f.Target == "" || strings.Contains(strings.ToLower(e.Target), strings.ToLower(f.Target))) &&
+		(f.Since.IsZero() || !e.Time.Before(f.Since))
+}
+
+// each calls fn with every entry matching f, oldest first, along with the
+// line it was read from. The file is only ever appended to, so it is read
+// without the lock, up to where it ended when opened: fn may be slow (an
+// export going out to a client) and must not hold up every audited change.
+// A line caught half written is skipped like any other that doesn't parse.
+func (a *auditStore) each(f auditFilter, fn func(e *auditEntry, line []byte)) error {
+	file, err := os.Open(a.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	sc := bufio.NewScanner(io.LimitReader(file, fi.Size()))
+	sc.Buffer(make([]byte, 64*1024), 4<<20)
+	for sc.Scan() {
+		var e auditEntry
+		if json.Unmarshal(sc.Bytes(), &e) != nil {
+			continue
+		}
+		if f.match(&e) {
+			fn(&e, sc.Bytes())
+		}
+	}
+	return sc.Err()
+}
+
+// recent returns up to limit matching entries, newest first.
+func (a *auditStore) recent(f auditFilter, limit int) ([]auditEntry, error) {
+	var out []auditEntry
+	err := a.each(f, func(e *auditEntry, _ []byte) {
+		out = append(out, *e)
+		if len(out) > limit {
+			out = out[1:]
+		}
+	})
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out, err
+}
+
+// audit records a change made by the user behind r.
+func audit(r *http.Request, action, target string, before, after interface{}) {
+	user := ""
+	if u := currentUser(r); u != nil {
+		user = u.Username
+	}
+	auditLog.append(auditEntry{
+		Time:   time.Now().UTC(),
+		User:   user,
+		IP:     clientIP(r),
+		Action: action,
+		Target: target,
+		Before: before,
+		After:  after,
+	})
+}
+
+// auditCommand records a change made with one of the command line tools,
+// under the name of the system account that ran it.
+func auditCommand(action, target string, before, after interface{}) {
+	who := "cli"
+	if u, err := osuser.Current(); err == nil {
+		who = "cli:" + u.Username
+	}
+	auditLog.append(auditEntry{
+		Time:   time.Now().UTC(),
+		User:   who,
+		Action: action,
+		Target: target,
+		Before: before,
+		After:  after,
+	})
+}
+
+// libraryTarget names a library path the way the audit log shows it.
+func libraryTarget(full string) string {
+	if rel, err := filepath.Rel(auditLog.root, full); err == nil && !strings.HasPrefix(rel, "..") {
+		return filepath.ToSlash(rel)
+	}
+	return full
+}
+
+// itemState is what the log keeps of a folder before and after a change,
+// or nil if there is no such folder.
+func itemState(full string) interface{} {
+	info, err := readItem(full)
+	if err != nil {
+		return nil
+	}
+	return info
+}
+
+// auditedLibrary runs the library operations on behalf of a request and
+// logs the ones that succeed.
+type auditedLibrary struct{ r *http.Request }
+
+func audited(r *http.Request) auditedLibrary { return auditedLibrary{r} }
+
+func (l auditedLibrary) createFolder(parent, name string) (string, error) {
+	full, err := createFolder(parent, name)
+	if err == nil {
+		audit(l.r, "create", libraryTarget(full), nil, itemState(full))
+	}
+	return full, err
+}
+
+func (l auditedLibrary) deleteFolder(parent, name string) error {
+	var before interface{}
+	full, err := libPath(parent, name)
+	if err == nil {
+		before = itemState(full)
+	}
+	if err = deleteFolder(parent, name); err == nil {
+		audit(l.r, "delete", libraryTarget(full), before, nil)
+	}
+	return err
+}
+
+func (l auditedLibrary) saveItem(parent, name string, up itemUpload) (string, error) {
+	var before interface{}
+	if full, err := libPath(parent, strings.TrimSpace(name)); err == nil {
+		before = itemState(full)
+	}
+	dir, err := saveItem(parent, name, up)
+	if err == nil {
+		audit(l.r, "upload", libraryTarget(dir), before, itemState(dir))
+	}
+	return dir, err
+}
+
+func (l auditedLibrary) setDescription(dir, short, long string) error {
+	before := itemState(dir)
+	err := setDescription(dir, short, long)
+	if err == nil {
+		audit(l.r, "edit", libraryTarget(dir), before, itemState(dir))
+	}
+	return err
+}
+
+func (l auditedLibrary) setThumbnail(dir, filename string, img io.Reader) error {
+	before := itemState(dir)
+	err := setThumbnail(dir, filename, img)
+	if err == nil {
+		audit(l.r, "thumbnail", libraryTarget(dir), before, itemState(dir))
+	}
+	return err
+}
+
+// userState is what the log keeps of an account; never its secrets.
+type userState struct {
+	Role      Role     `json:"role"`
+	Access    []string `json:"access,omitempty"`
+	TwoFactor bool     `json:"two_factor"`
+}
+
+func userAuditState(name string) interface{} {
+	u := users.get(name)
+	if u == nil {
+		return nil
+	}
+	return &userState{Role: u.Role, Access: u.Access, TwoFactor: u.TOTPSecret != ""}
+}
+
+var auditPage = template.Must(template.New("audit").Parse(`
+<html><head><title>Audit Log - Admin</title>` + css + `</head><body>
+<nav>
+  <a href="/admin">Dashboard</a>
+  <a href="/admin/users">Users</a>
+  <a href="/logout">Logout</a>
+</nav>
+<div class="card">
+<h2>Audit Log</h2>
+<form method="GET" action="/admin/audit">
+  <label>User <input name="user" value="{{.Filter.User}}"></label>
+  <label>Action
+    <select name="action">
+      <option value="">Any</option>
+      {{range .Actions}}<option value="{{.}}"{{if eq . $.Filter.Action}} selected{{end}}>{{.}}</option>{{end}}
+    </select>
+  </label>
+  <label>Target contains <input name="target" value="{{.Filter.Target}}"></label>
+  <label>Since <input type="date" name="since" value="{{.Since}}"></label>
+  <button type="submit">Filter</button>
+  <a class="btn" href="{{.ExportURL}}">Export JSON Lines</a>
+</form>
+{{if .Error}}<div class="error">{{.Error}}</div>{{end}}
+{{if .Entries}}
+  <table>
+    <tr><th>Time (UTC)</th><th>User</th><th>Address</th><th>Action</th><th>Target</th><th>Change</th></tr>
+    {{range .Entries}}
+      <tr>
+        <td>{{.Time.Format "2006-01-02 15:04:05"}}</td>
+        <td>{{.User}}</td>
+        <td>{{.IP}}</td>
+        <td>{{.Action}}</td>
+        <td>{{.Target}}</td>
+        <td>{{if or .Before .After}}<details><summary>Details</summary>
+          {{with .BeforeJSON}}<p>Before:</p><pre>{{.}}</pre>{{end}}
+          {{with .AfterJSON}}<p>After:</p><pre>{{.}}</pre>{{end}}
+        </details>{{end}}</td>
+      </tr>
+    {{end}}
+  </table>
+  {{if .Truncated}}<p>Showing the newest {{len .Entries}} entries; narrow the filter or export to see more.</p>{{end}}
+{{else}}
+  <p>No matching entries.</p>
+{{end}}
+</div>
+</body></html>
+`))
+
+var auditActions = []string{
+	"create", "upload", "bulk-upload", "import", "edit", "thumbnail", "delete", "restore", "purge",
+	"user-add", "user-access", "user-role", "user-reset", "user-reset2fa", "user-signout", "user-delete",
+	"user-password", "user-totp-enable", "user-totp-disable",
+	"device-add", "device-activate", "device-rename", "device-revoke",
+}
+
+// auditHandler shows the log, or exports it with ?format=jsonl.
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	q := r.URL.Query()
+	f := auditFilter{
+		User:   strings.TrimSpace(q.Get("user")),
+		Action: q.Get("action"),
+		Target: strings.TrimSpace(q.Get("target")),
+	}
+	data := map[string]interface{}{"Filter": f, "Actions": auditActions, "Since": q.Get("since")}
+	if s := q.Get("since"); s != "" {
+		t, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			data["Error"] = "Invalid date"
+		}
+		f.Since = t
+	}
+	if q.Get("format") == "jsonl" {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="audit.jsonl"`)
+		err := auditLog.each(f, func(_ *auditEntry, line []byte) {
+			w.Write(line)
+			w.Write([]byte{'\n'})
+		})
+		if err != nil {
+			logFor("audit").ErrorContext(r.Context(), "audit export failed", "err", err)
+		}
+		return
+	}
+	// Built here whole: the template would escape an encoded query as one value
+	q.Set("format", "jsonl")
+	data["ExportURL"] = template.URL("/admin/audit?" + q.Encode())
+	entries, err := auditLog.recent(f, auditPageLimit+1)
+	if err != nil {
+		data["Error"] = "Failed to read the audit log: " + err.Error()
+	}
+	if len(entries) > auditPageLimit {
+		entries = entries[:auditPageLimit]
+		data["Truncated"] = true
+	}
+	data["Entries"] = entries
+	renderPage(w, r, auditPage, data)
+}
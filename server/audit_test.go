@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditExportDoesNotBlockAppend(t *testing.T) {
+	a := &auditStore{path: filepath.Join(t.TempDir(), auditFile)}
+	a.append(auditEntry{Time: time.Now(), User: "admin", Action: "create", Target: "Movies/Film"})
+
+	// An export whose client has stopped reading
+	stalled, release := make(chan bool), make(chan bool)
+	go a.each(auditFilter{}, func(*auditEntry, []byte) {
+		close(stalled)
+		<-release
+	})
+	defer close(release)
+	<-stalled
+
+	appended := make(chan bool)
+	go func() {
+		a.append(auditEntry{Time: time.Now(), User: "admin", Action: "delete", Target: "Movies/Film"})
+		close(appended)
+	}()
+	select {
+	case <-appended:
+	case <-time.After(5 * time.Second):
+		t.Fatal("append waited for a stalled export")
+	}
+
+	var actions []string
+	a.each(auditFilter{}, func(e *auditEntry, _ []byte) { actions = append(actions, e.Action) })
+	if len(actions) != 2 || actions[0] != "create" || actions[1] != "delete" {
+		t.Errorf("log holds %q", actions)
+	}
+}
+
+// lastAudit returns the newest entry in the test server's log.
+func lastAudit(t *testing.T) auditEntry {
+	t.Helper()
+	entries, err := auditLog.recent(auditFilter{}, 1)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("audit log: %v, %d entries", err, len(entries))
+	}
+	return entries[0]
+}
+
+// stateField reads a field of the before or after state kept with an entry.
+func stateField(state interface{}, key string) interface{} {
+	m, _ := state.(map[string]interface{})
+	return m[key]
+}
+
+func TestWebChangesAreAudited(t *testing.T) {
+	s := newTestServer(t)
+	check := func(action, target string, before, after bool) auditEntry {
+		t.Helper()
+		e := lastAudit(t)
+		if e.Action != action || e.Target != target || e.User != "admin" || e.IP != "192.0.2.1" {
+			t.Errorf("got %s %s by %s from %s, want %s %s by admin from 192.0.2.1", e.Action, e.Target, e.User, e.IP, action, target)
+		}
+		if (e.Before != nil) != before || (e.After != nil) != after {
+			t.Errorf("%s %s: before %v, after %v", action, target, e.Before, e.After)
+		}
+		return e
+	}
+
+	if w := s.postForm(t, "/admin/cat/TV/newseries", url.Values{"seriesname": {"New Show"}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("newseries: got %d", w.Code)
+	}
+	e := check("create", "TV/New Show", false, true)
+	if stateField(e.After, "name") != "New Show" {
+		t.Errorf("create kept %v", e.After)
+	}
+
+	w := s.postMultipart(t, "/admin/cat/Movies/upload", []formPart{
+		{name: "moviename", body: "Film"},
+		{name: "video", filename: "new.mp4", body: "a newer video"},
+	})
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("upload: got %d: %s", w.Code, w.Body)
+	}
+	e = check("upload", "Movies/Film", true, true)
+	if stateField(e.Before, "video") != "film.mp4" || stateField(e.After, "video") != "new.mp4" {
+		t.Errorf("upload kept video %v before, %v after", stateField(e.Before, "video"), stateField(e.After, "video"))
+	}
+
+	if w := s.postForm(t, "/admin/cat/Movies/delmovie", url.Values{"moviename": {"Film"}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("delmovie: got %d", w.Code)
+	}
+	e = check("delete", "Movies/Film", true, false)
+	if stateField(e.Before, "name") != "Film" {
+		t.Errorf("delete kept %v", e.Before)
+	}
+
+	form := url.Values{"action": {"add"}, "username": {"bob"}, "password": {"bobs password"}, "role": {string(RoleViewer)}}
+	if w := s.postForm(t, "/admin/users", form); w.Code != http.StatusSeeOther {
+		t.Fatalf("user add: got %d: %s", w.Code, w.Body)
+	}
+	check("user-add", "user:bob", false, true)
+	form = url.Values{"action": {"role"}, "username": {"bob"}, "role": {string(RoleEditor)}}
+	if w := s.postForm(t, "/admin/users", form); w.Code != http.StatusSeeOther {
+		t.Fatalf("user role: got %d", w.Code)
+	}
+	e = check("user-role", "user:bob", true, true)
+	if stateField(e.Before, "role") != string(RoleViewer) || stateField(e.After, "role") != string(RoleEditor) {
+		t.Errorf("role change kept %v to %v", e.Before, e.After)
+	}
+	if strings.Contains(fmt.Sprint(e.Before, e.After), "password") {
+		t.Errorf("user entry holds a secret: %v %v", e.Before, e.After)
+	}
+
+	// Changes to one's own account are logged like an admin's
+	form = url.Values{"current": {"correct horse battery"}, "password": {"a new password"}}
+	if w := s.postForm(t, "/admin/account", form); !strings.Contains(w.Body.String(), "Password changed") {
+		t.Fatalf("password change: got %d", w.Code)
+	}
+	check("user-password", "user:admin", false, false)
+}
+
+func TestAuditFilters(t *testing.T) {
+	s := newTestServer(t)
+	old := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for _, e := range []auditEntry{
+		{Time: old, User: "bob", Action: "delete", Target: "Movies/Old"},
+		{Time: time.Now().UTC(), User: "bob", Action: "delete", Target: "Movies/Film"},
+		{Time: time.Now().UTC(), User: "bob", Action: "create", Target: "TV/Show"},
+		{Time: time.Now().UTC(), User: "alice", Action: "delete", Target: "TV/Show"},
+	} {
+		auditLog.append(e)
+	}
+
+	tests := []struct {
+		query string
+		want  []string // targets, oldest first
+	}{
+		{"", []string{"Movies/Old", "Movies/Film", "TV/Show", "TV/Show"}},
+		{"user=bob&action=delete", []string{"Movies/Old", "Movies/Film"}},
+		{"target=movies", []string{"Movies/Old", "Movies/Film"}},
+		{"user=alice", []string{"TV/Show"}},
+		{"action=delete&since=2025-01-01", []string{"Movies/Film", "TV/Show"}},
+	}
+	for _, tt := range tests {
+		w := s.do(httptest.NewRequest("GET", "/admin/audit?"+tt.query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%q: got %d", tt.query, w.Code)
+		}
+		page := w.Body.String()
+		rows := strings.Count(page, "<tr>") - 1
+		if rows != len(tt.want) {
+			t.Errorf("%q: page shows %d entries, want %d", tt.query, rows, len(tt.want))
+		}
+
+		// The page's export link keeps the filter
+		m := regexp.MustCompile(`href="(/admin/audit\?[^"]*)">Export`).FindStringSubmatch(page)
+		if m == nil {
+			t.Fatalf("%q: no export link", tt.query)
+		}
+		link := html.UnescapeString(m[1])
+		w = s.do(httptest.NewRequest("GET", link, nil))
+		if ct := w.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+			t.Fatalf("%q: export link %s gave %s", tt.query, link, ct)
+		}
+		var got []string
+		for _, line := range strings.Split(strings.TrimSpace(w.Body.String()), "\n") {
+			var e auditEntry
+			if line != "" && json.Unmarshal([]byte(line), &e) == nil {
+				got = append(got, e.Target)
+			}
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%q: export has %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestAuditPageNeedsUsersPermission(t *testing.T) {
+	s := newTestServer(t)
+	editor := s.as(t, "editor", RoleEditor)
+	if w := editor.get(t, "/admin/audit"); w.Code != http.StatusForbidden {
+		t.Errorf("editor GET /admin/audit: got %d", w.Code)
+	}
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Bulk uploads: many files (or a dropped folder) in a single streamed
+// multipart request. Each video becomes its own movie or episode folder,
+// named from the filename, and .srt/.jpg/.png/.txt files sharing the video's
+// stem are stored next to it.
+
+type bulkMode int
+
+const (
+	bulkMovies bulkMode = iota // base is a movies category
+	bulkSeries                 // base is a series category; files come as Series/Season/file
+	bulkSeason                 // base is a season folder
+)
+
+var bulkSiblingExts = map[string]bool{".srt": true, ".jpg": true, ".png": true, ".txt": true}
+
+var (
+	reSeasonEp  = regexp.MustCompile(`(?i)\bs(\d{1,2})[ ._-]*e(\d{1,3})\b`)
+	reCrossEp   = regexp.MustCompile(`(?i)\b(\d{1,2})x(\d{1,3})\b`)
+	reEpOnly    = regexp.MustCompile(`(?i)\b(?:episode|ep|e)[ ._-]*(\d{1,3})\b`)
+	reLeadingEp = regexp.MustCompile(`^(\d{1,3})\b`)
+	reJunk      = regexp.MustCompile(`(?i)\b(480p|576p|720p|1080p|2160p|4k|x264|x265|h264|h265|hevc|web-?dl|webrip|bluray|brrip|hdtv|dvdrip)\b`)
+	reSpaces    = regexp.MustCompile(`\s+`)
+)
+
+type bulkResult struct {
+	File   string
+	Target string
+	Error  string
+}
+
+type bulkGroup struct {
+	dir      string
+	created  []string // folders made for the group, innermost first
+	hasVideo bool
+	files    []int // indexes into results
+}
+
+var bulkResultPage = template.Must(template.New("bulkresult").Parse(`
+<html><head><title>Bulk Upload</title>` + css + `</head><body>
+<nav>
+  <a href="/admin">Dashboard</a>
+  <a href="{{.Back}}">Back</a>
+  <a href="/logout">Logout</a>
+</nav>
+<div class="card">
+<h2>Bulk Upload Results</h2>
+{{if .Error}}<div class="error">{{.Error}}</div>{{end}}
+<p>{{.OK}} of {{len .Results}} files saved.</p>
+<table>
+  <tr><th>File</th><th>Saved As</th><th>Status</th></tr>
+  {{range .Results}}
+    <tr>
+      <td>{{.File}}</td>
+      <td>{{.Target}}</td>
+      <td>{{if .Error}}<span class="error">{{.Error}}</span>{{else}}OK{{end}}</td>
+    </tr>
+  {{end}}
+</table>
+<a href="{{.Back}}" class="btn">Continue</a>
+</div>
+</body></html>
+`))
+
+// bulkForm is the upload box shared by the category and season pages. The
+// surrounding template provides the form action.
+const bulkForm = `
+    <input type="file" name="files" multiple>
+    <label><input type="checkbox" data-bulk-dir> Select a whole folder instead</label>
+    <div class="dropzone">…or drop files and folders here</div>
+    <div class="progress"><progress max="100" value="0"></progress><span>0%</span></div>
+    <button type="submit">Upload All</button>
+`
+
+// bulkJS walks dropped folders, sends every file with its relative path and
+// replaces the page with the server's per-file report.
+var bulkJS = `<script>
+(function() {
+  function walk(entry, prefix, out) {
+    return new Promise(function(resolve) {
+      if (entry.isFile) {
+        entry.file(function(f) { out.push({file: f, path: prefix + f.name}); resolve(); }, resolve);
+        return;
+      }
+      var reader = entry.createReader(), all = [];
+      (function next() {
+        reader.readEntries(function(batch) {
+          if (!batch.length) {
+            Promise.all(all.map(function(e) { return walk(e, prefix + entry.name + '/', out); })).then(resolve);
+            return;
+          }
+          all = all.concat(Array.prototype.slice.call(batch));
+          next();
+        }, resolve);
+      })();
+    });
+  }
+  document.querySelectorAll('form[data-bulk]').forEach(function(form) {
+    var input = form.querySelector('input[name=files]');
+    var zone = form.querySelector('.dropzone');
+    var dropped = [];
+    form.querySelector('[data-bulk-dir]').addEventListener('change', function(e) {
+      if (e.target.checked) input.setAttribute('webkitdirectory', '');
+      else input.removeAttribute('webkitdirectory');
+    });
+    zone.addEventListener('dragover', function(e) { e.preventDefault(); zone.classList.add('over'); });
+    zone.addEventListener('dragleave', function() { zone.classList.remove('over'); });
+    zone.addEventListener('drop', async function(e) {
+      e.preventDefault();
+      zone.classList.remove('over');
+      var entries = Array.prototype.map.call(e.dataTransfer.items, function(i) { return i.webkitGetAsEntry(); });
+      for (var i = 0; i < entries.length; i++) if (entries[i]) await walk(entries[i], '', dropped);
+      zone.textContent = dropped.length + ' files ready';
+    });
+    form.addEventListener('submit', function(ev) {
+      ev.preventDefault();
+      var fd = new FormData();
+      form.querySelectorAll('input[type=hidden]').forEach(function(h) { fd.append(h.name, h.value); });
+      var list = dropped.slice();
+      Array.prototype.forEach.call(input.files, function(f) { list.push({file: f, path: f.webkitRelativePath || f.name}); });
+      if (!list.length) return;
+      list.forEach(function(it) { fd.append('path', it.path); fd.append('files', it.file); });
+      var box = form.querySelector('.progress');
+      var bar = box.querySelector('progress'), label = box.querySelector('span');
+      box.style.display = 'block';
+      form.querySelector('button').disabled = true;
+      var x = new XMLHttpRequest();
+      x.open('POST', form.action);
+      x.setRequestHeader('X-CSRF-Token', form.querySelector('input[name=` + csrfField + `]').value);
+      x.upload.onprogress = function(e) {
+        var pct = Math.floor(e.loaded * 100 / e.total);
+        bar.value = pct; label.textContent = pct + '%';
+      };
+      x.onload = function() { document.open(); document.write(x.responseText); document.close(); };
+      x.onerror = function() { label.textContent = 'Error: network error'; form.querySelector('button').disabled = false; };
+      x.send(fd);
+    });
+  });
+})();
+</script>`
+
+// cleanTitle turns a release-style filename fragment into a readable title.
+func cleanTitle(s string) string {
+	s = strings.NewReplacer(".", " ", "_", " ").Replace(s)
+	if loc := reJunk.FindStringIndex(s); loc != nil {
+		s = s[:loc[0]]
+	}
+	s = reSpaces.ReplaceAllString(s, " ")
+	return strings.Trim(s, " -[]()")
+}
+
+// parseEpisodeName extracts season and episode numbers and the episode title
+// from a filename stem. Numbers are 0 when not found.
+func parseEpisodeName(stem string) (season, episode int, title string) {
+	norm := strings.NewReplacer(".", " ", "_", " ").Replace(stem)
+	for _, re := range []*regexp.Regexp{reSeasonEp, reCrossEp, reEpOnly, reLeadingEp} {
+		m := re.FindStringSubmatchIndex(norm)
+		if m == nil {
+			continue
+		}
+		nums := []int{}
+		for i := 2; i+1 < len(m); i += 2 {
+			n, _ := strconv.Atoi(norm[m[i]:m[i+1]])
+			nums = append(nums, n)
+		}
+		if len(nums) == 2 {
+			season, episode = nums[0], nums[1]
+		} else {
+			episode = nums[0]
+		}
+		return season, episode, cleanTitle(norm[m[1]:])
+	}
+	return 0, 0, cleanTitle(norm)
+}
+
+// episodeFolderName names an episode folder so that episodes sort in order.
+func episodeFolderName(stem string) (string, int) {
+	season, ep, title := parseEpisodeName(stem)
+	if ep == 0 {
+		if title == "" {
+			return stem, season
+		}
+		return title, season
+	}
+	name := fmt.Sprintf("Episode %02d", ep)
+	if title != "" {
+		name += " - " + title
+	}
+	return name, season
+}
+
+// bulkStem returns the name used to pair a file with its video. Subtitles
+// may carry a language tag, as in "Episode.en.srt".
+func bulkStem(name string) string {
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	if strings.EqualFold(ext, ".srt") {
+		if lang := filepath.Ext(stem); len(lang) == 3 || len(lang) == 4 {
+			stem = strings.TrimSuffix(stem, lang)
+		}
+	}
+	return stem
+}
+
+// bulkTarget works out which folder under base a file belongs in, from its
+// path relative to what the user selected.
+func bulkTarget(mode bulkMode, base, rel string) (string, error) {
+	rel = path.Clean(strings.ReplaceAll(rel, "\\", "/"))
+	parts := strings.Split(strings.TrimPrefix(rel, "/"), "/")
+	for _, p := range parts {
+		if err := safeName(p); err != nil {
+			return "", err
+		}
+	}
+	file := parts[len(parts)-1]
+	dirs := parts[:len(parts)-1]
+	stem := bulkStem(file)
+	switch mode {
+	case bulkMovies:
+		name := cleanTitle(stem)
+		if name == "" {
+			name = stem
+		}
+		return resolvePath(base, name)
+	case bulkSeason:
+		name, _ := episodeFolderName(stem)
+		return resolvePath(base, name)
+	case bulkSeries:
+		if len(dirs) == 0 {
+			return "", fmt.Errorf("not inside a series folder")
+		}
+		name, seasonNum := episodeFolderName(stem)
+		season := "Season 1"
+		if len(dirs) > 1 {
+			season = dirs[1]
+		} else if seasonNum > 0 {
+			season = fmt.Sprintf("Season %d", seasonNum)
+		}
+		return resolvePath(base, dirs[0], season, name)
+	}
+	return "", fmt.Errorf("unknown upload mode")
+}
+
+// handleBulkUpload streams a multipart request of "path"/"files" pairs
+// straight to disk and renders a per-file report.
+func handleBulkUpload(mode bulkMode, base, back string, w http.ResponseWriter, r *http.Request) {
+	data := map[string]interface{}{"Back": back}
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	next, err := bulkFiles(r)
+	if err != nil {
+		data["Error"] = "Error parsing form"
+		renderPage(w, r, bulkResultPage, data)
+		return
+	}
+	var results []bulkResult
+	groups := make(map[string]*bulkGroup)
+	for {
+		rel, body, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			data["Error"] = "Upload interrupted: " + err.Error()
+			break
+		}
+		res, g, extra := bulkSaveFile(mode, base, rel, body, groups)
+		if extra {
+			g.files = append(g.files, len(results))
+		}
+		results = append(results, res)
+		body.Close()
+	}
+
+	// Extras that never got a video would only make empty entries in the feed.
+	for _, g := range groups {
+		if g.hasVideo {
+			continue
+		}
+		for _, i := range g.files {
+			if results[i].Error == "" {
+				os.Remove(filepath.Join(g.dir, filepath.Base(results[i].Target)))
+				results[i].Error = "no matching video"
+			}
+		}
+	}
+	// Folders this upload made that ended up empty go too. A series folder
+	// may be shared by several groups, so deeper folders go first.
+	var created []string
+	for _, g := range groups {
+		created = append(created, g.created...)
+	}
+	sort.Slice(created, func(i, j int) bool { return len(created[i]) > len(created[j]) })
+	for _, dir := range created {
+		os.Remove(dir)
+	}
+	ok := 0
+	for _, res := range results {
+		if res.Error == "" {
+			ok++
+		}
+	}
+	logFor("uploads").InfoContext(r.Context(), "bulk upload", "folder", base, "saved", ok, "files", len(results))
+	if ok > 0 {
+		var saved []string
+		for _, res := range results {
+			if res.Error == "" {
+				saved = append(saved, res.Target)
+			}
+		}
+		audit(r, "bulk-upload", libraryTarget(base), nil, map[string][]string{"files": saved})
+	}
+	data["Results"] = results
+	data["OK"] = ok
+	renderPage(w, r, bulkResultPage, data)
+}
+
+// bulkFiles returns an iterator over the uploaded files and their relative
+// paths. Normally the body is streamed part by part; if something already
+// parsed the form (a browser posting without the upload script), the parsed
+// files are used instead.
+func bulkFiles(r *http.Request) (func() (string, io.ReadCloser, error), error) {
+	if r.MultipartForm != nil {
+		files := r.MultipartForm.File["files"]
+		paths := r.MultipartForm.Value["path"]
+		i := 0
+		return func() (string, io.ReadCloser, error) {
+			if i >= len(files) {
+				return "", nil, io.EOF
+			}
+			fh := files[i]
+			rel := fh.Filename
+			if i < len(paths) && paths[i] != "" {
+				rel = paths[i]
+			}
+			i++
+			f, err := fh.Open()
+			return rel, f, err
+		}, nil
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	relPath := ""
+	return func() (string, io.ReadCloser, error) {
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				return "", nil, err
+			}
+			if part.FormName() == "path" {
+				b, _ := io.ReadAll(io.LimitReader(part, 4096))
+				relPath = string(b)
+				continue
+			}
+			if part.FormName() != "files" || part.FileName() == "" {
+				continue
+			}
+			rel := relPath
+			relPath = ""
+			if rel == "" {
+				rel = part.FileName()
+			}
+			return rel, part, nil
+		}
+	}, nil
+}
+
+// missingDirs returns dir and its parents below base that don't exist yet,
+// innermost first.
+func missingDirs(base, dir string) []string {
+	var out []string
+	for d := dir; len(d) > len(base); d = filepath.Dir(d) {
+		if _, err := os.Lstat(d); !os.IsNotExist(err) {
+			break
+		}
+		out = append(out, d)
+	}
+	return out
+}
+
+// bulkSaveFile stores one file and reports whether it was a sibling that
+// still needs a video in its group.
+func bulkSaveFile(mode bulkMode, base, rel string, part io.Reader, groups map[string]*bulkGroup) (bulkResult, *bulkGroup, bool) {
+	res := bulkResult{File: rel}
+	name := path.Base(strings.ReplaceAll(rel, "\\", "/"))
+	ext := strings.ToLower(filepath.Ext(name))
+	isVideo := ext == ".mp4"
+	if !isVideo && !bulkSiblingExts[ext] {
+		res.Error = "unsupported file type"
+		return res, nil, false
+	}
+	dir, err := bulkTarget(mode, base, rel)
+	if err != nil {
+		res.Error = err.Error()
+		return res, nil, false
+	}
+	g := groups[dir]
+	if g == nil {
+		g = &bulkGroup{dir: dir, created: missingDirs(base, dir)}
+		g.hasVideo = dirHasVideo(dir)
+		groups[dir] = g
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		res.Error = "failed to create folder"
+		return res, nil, false
+	}
+	target, err := resolveUpload(dir, name)
+	if err != nil {
+		res.Error = err.Error()
+		return res, nil, false
+	}
+	if rp, err := filepath.Rel(base, target); err == nil {
+		res.Target = rp
+	}
+	if _, err := os.Stat(target); err == nil {
+		res.Error = "already exists"
+		return res, nil, false
+	}
+	if err := saveUploadedFile(part, target); err != nil {
+		os.Remove(target)
+		res.Error = "failed to save: " + err.Error()
+		return res, nil, false
+	}
+	if isVideo {
+		if fi, err := os.Stat(target); err == nil {
+			uploadSizes.observe(float64(fi.Size()))
+		}
+		g.hasVideo = true
+		return res, g, false
+	}
+	return res, g, true
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseEpisodeName(t *testing.T) {
+	tests := []struct {
+		stem            string
+		season, episode int
+		title           string
+	}{
+		{"Show.S01E02.Pilot.720p.WEB-DL", 1, 2, "Pilot"},
+		{"s2e10", 2, 10, ""},
+		{"The Expanse S03 E05 Title", 3, 5, "Title"},
+		{"show 1x02 - The Return", 1, 2, "The Return"},
+		{"Episode 3", 0, 3, ""},
+		{"Ep.04.Finale", 0, 4, "Finale"},
+		{"07 Something", 0, 7, "Something"},
+		{"Documentary", 0, 0, "Documentary"},
+		{"Movie_2020_1080p", 0, 0, "Movie 2020"},
+	}
+	for _, tt := range tests {
+		season, episode, title := parseEpisodeName(tt.stem)
+		if season != tt.season || episode != tt.episode || title != tt.title {
+			t.Errorf("parseEpisodeName(%q) = %d, %d, %q; want %d, %d, %q",
+				tt.stem, season, episode, title, tt.season, tt.episode, tt.title)
+		}
+	}
+}
+
+func TestBulkStem(t *testing.T) {
+	tests := []struct{ name, want string }{
+		{"Pilot.mp4", "Pilot"},
+		{"Pilot.en.srt", "Pilot"},
+		{"Pilot.eng.srt", "Pilot"},
+		{"Pilot.srt", "Pilot"},
+		{"Pilot.S01E01.srt", "Pilot.S01E01"},
+		{"Pilot.en.jpg", "Pilot.en"},
+	}
+	for _, tt := range tests {
+		if got := bulkStem(tt.name); got != tt.want {
+			t.Errorf("bulkStem(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBulkTarget(t *testing.T) {
+	root, _ := newTestTree(t)
+	movies := filepath.Join(root, "Movies")
+	tv := filepath.Join(root, "TV")
+	season := filepath.Join(tv, "Show", "Season 1")
+	tests := []struct {
+		mode bulkMode
+		base string
+		rel  string
+		want string // relative to base, empty when it must fail
+	}{
+		{bulkMovies, movies, "Heat.mp4", "Heat"},
+		{bulkMovies, movies, "picked/Heat.mp4", "Heat"},
+		{bulkMovies, movies, "../../evil.mp4", ""},
+		{bulkMovies, movies, "picked/../../evil.mp4", ""},
+		{bulkMovies, movies, ".hidden/Heat.mp4", ""},
+		{bulkMovies, movies, "AUX/Heat.mp4", ""},
+		{bulkMovies, movies, "Escape.mp4", ""},
+		{bulkMovies, movies, "Dangling.mp4", ""},
+		{bulkSeries, tv, "Show/Season 2/Pilot.mp4", "Show/Season 2/Pilot"},
+		{bulkSeries, tv, "Pilot.mp4", ""},
+		{bulkSeries, tv, "../Show/Season 1/Pilot.mp4", ""},
+		{bulkSeries, tv, "Escape/Season 1/Pilot.mp4", ""},
+		{bulkSeries, tv, "Show/Escape/Pilot.mp4", ""},
+		{bulkSeries, tv, `Show\..\..\Pilot.mp4`, ""},
+		{bulkSeason, season, "Pilot.mp4", "Pilot"},
+		{bulkSeason, season, "../Pilot.mp4", ""},
+		{bulkSeason, season, "Escape.mp4", ""},
+	}
+	for _, tt := range tests {
+		got, err := bulkTarget(tt.mode, tt.base, tt.rel)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("bulkTarget(%q) = %q, want an error", tt.rel, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("bulkTarget(%q): %v", tt.rel, err)
+		} else if got != filepath.Join(tt.base, filepath.FromSlash(tt.want)) {
+			t.Errorf("bulkTarget(%q) = %q, want %q", tt.rel, got, tt.want)
+		}
+	}
+}
+
+func TestBulkTargetNames(t *testing.T) {
+	base := t.TempDir()
+	tests := []struct {
+		mode bulkMode
+		rel  string
+		want string // relative to base
+	}{
+		{bulkMovies, "Heat.1995.1080p.BluRay.mp4", "Heat 1995"},
+		{bulkMovies, "Heat.en.srt", "Heat"},
+		{bulkSeason, "Show.S01E02.Pilot.mp4", "Episode 02 - Pilot"},
+		{bulkSeason, "Show.S01E02.Pilot.en.srt", "Episode 02 - Pilot"},
+		{bulkSeason, "Episode 3.mp4", "Episode 03"},
+		{bulkSeason, "Bonus.mp4", "Bonus"},
+		{bulkSeries, "Show/Show.S02E03.Title.mp4", "Show/Season 2/Episode 03 - Title"},
+		{bulkSeries, "Show/2x03.mp4", "Show/Season 2/Episode 03"},
+		{bulkSeries, "Show/Episode 3.mp4", "Show/Season 1/Episode 03"},
+		{bulkSeries, "Show/Specials/S00E01.mp4", "Show/Specials/Episode 01"},
+	}
+	for _, tt := range tests {
+		got, err := bulkTarget(tt.mode, base, tt.rel)
+		if err != nil {
+			t.Errorf("bulkTarget(%q): %v", tt.rel, err)
+		} else if got != filepath.Join(base, filepath.FromSlash(tt.want)) {
+			t.Errorf("bulkTarget(%q) = %q, want %q", tt.rel, got, tt.want)
+		}
+	}
+}
+
+func TestBulkUploadRefusesBadPaths(t *testing.T) {
+	s := newTestServer(t)
+	routes := []struct {
+		target string
+		bad    []string
+	}{
+		{"/admin/cat/Movies/bulkupload", []string{
+			"../../evil.mp4",
+			"../Movies/evil.mp4",
+			"picked/../../evil.mp4",
+			`..\..\evil.mp4`,
+			".hidden/evil.mp4",
+			".evil.mp4",
+			"CON/evil.mp4",
+			"Escape.mp4",
+			"Dangling.mp4",
+		}},
+		{"/admin/cat/TV/bulkupload", []string{
+			"evil.mp4",
+			"../Movies/Season 1/evil.mp4",
+			"Escape/Season 1/evil.mp4",
+			"Show/Escape/evil.mp4",
+			".uploads/Season 1/evil.mp4",
+			"Show/Season 1/../../../evil.mp4",
+		}},
+		{"/admin/cat/TV/series/Show/season/Season 1/bulkupload", []string{
+			"../evil.mp4",
+			"Escape.mp4",
+			"LPT1.mp4",
+		}},
+	}
+	for _, rt := range routes {
+		for _, rel := range rt.bad {
+			before := s.snapshot(t)
+			s.postMultipart(t, rt.target, []formPart{
+				{name: "path", body: rel},
+				{name: "files", filename: "evil.mp4", body: "evil"},
+			})
+			assertUnchanged(t, before, s.snapshot(t))
+		}
+	}
+
+	w := s.postMultipart(t, "/admin/cat/TV/bulkupload", []formPart{
+		{name: "path", body: "Show/Season 2/Pilot.mp4"},
+		{name: "files", filename: "Pilot.mp4", body: "pilot"},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("bulk upload: got %d", w.Code)
+	}
+	if _, err := os.Stat(filepath.Join(s.root, "TV", "Show", "Season 2", "Pilot")); err != nil {
+		t.Errorf("bulk upload of a good path: %v", err)
+	}
+}
+
+func TestBulkUploadDropsOrphans(t *testing.T) {
+	s := newTestServer(t)
+	season := filepath.Join(s.root, "TV", "Show", "Season 1")
+	if err := os.Mkdir(filepath.Join(season, "Extras"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	w := s.postMultipart(t, "/admin/cat/TV/series/Show/season/Season 1/bulkupload", []formPart{
+		{name: "path", body: "Lost.en.srt"},
+		{name: "files", filename: "Lost.en.srt", body: "subs"},
+		{name: "path", body: "Episode 2.en.srt"},
+		{name: "files", filename: "Episode 2.en.srt", body: "subs"},
+		{name: "path", body: "Episode 2.mp4"},
+		{name: "files", filename: "Episode 2.mp4", body: "video"},
+		{name: "path", body: "Extras.txt"},
+		{name: "files", filename: "Extras.txt", body: "notes"},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("bulk upload: got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "no matching video") {
+		t.Error("the orphan was not reported")
+	}
+
+	// A sibling uploaded before its video is kept
+	for _, name := range []string{"Episode 02/Episode 2.en.srt", "Episode 02/Episode 2.mp4"} {
+		if _, err := os.Stat(filepath.Join(season, filepath.FromSlash(name))); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	// An orphan goes, along with the folder made for it
+	if _, err := os.Stat(filepath.Join(season, "Lost")); err == nil {
+		t.Error("the folder made for an orphan was kept")
+	}
+	// ... but never a folder that was already there
+	if entries, err := os.ReadDir(filepath.Join(season, "Extras")); err != nil || len(entries) != 0 {
+		t.Errorf("existing folder: %v, holds %d files", err, len(entries))
+	}
+}
+
+func TestBulkSeriesUploadRemovesEmptyFolders(t *testing.T) {
+	s := newTestServer(t)
+	tv := filepath.Join(s.root, "TV")
+	w := s.postMultipart(t, "/admin/cat/TV/bulkupload", []formPart{
+		{name: "path", body: "New Show/Season 1/Lost.en.srt"},
+		{name: "files", filename: "Lost.en.srt", body: "subs"},
+		{name: "path", body: "New Show/Season 2/Gone.jpg"},
+		{name: "files", filename: "Gone.jpg", body: "art"},
+		{name: "path", body: "Show/Season 2/Lost.en.srt"},
+		{name: "files", filename: "Lost.en.srt", body: "subs"},
+		{name: "path", body: "Kept/Season 1/Pilot.mp4"},
+		{name: "files", filename: "Pilot.mp4", body: "video"},
+		{name: "path", body: "Kept/Season 2/Lost.en.srt"},
+		{name: "files", filename: "Lost.en.srt", body: "subs"},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("bulk upload: got %d", w.Code)
+	}
+	for path, want := range map[string]bool{
+		"New Show":                false,
+		"Show/Season 2":           false,
+		"Show/Season 1/Episode 1": true,
+		"Kept/Season 1/Pilot":     true,
+		"Kept/Season 2":           false,
+	} {
+		_, err := os.Stat(filepath.Join(tv, filepath.FromSlash(path)))
+		if (err == nil) != want {
+			t.Errorf("%s exists = %v, want %v", path, err == nil, want)
+		}
+	}
+}
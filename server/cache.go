@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// ==== READ-ONLY LIBRARY ====
+//
+// The feed fills in what a folder lacks: a thumbnail taken from the video
+// and a description made from the name. Normally those are written next to
+// the content. With library.read_only set the library is never written to
+// (it may be a read-only NAS mount); generated files go to the cache
+// directory under the same content path instead, and /content/ serves them
+// from there as if they were in the library.
+
+const cacheDirName = "cache"
+
+var (
+	readOnlyLibrary bool
+	cacheDir        string // default <data_dir>/cache
+)
+
+// generatedPath is where a generated file called name belongs for the
+// library folder dir, whose content path is segments.
+func generatedPath(dir string, segments []string, name string) string {
+	if !readOnlyLibrary {
+		return filepath.Join(dir, name)
+	}
+	return filepath.Join(cacheDir, filepath.Join(segments...), name)
+}
+
+// needsGenerating reports whether the generated file is missing or, in the
+// cache, older than the file it was made from.
+func needsGenerating(target, source string) bool {
+	fi, err := os.Stat(target)
+	if err != nil {
+		return true
+	}
+	if !readOnlyLibrary || source == "" {
+		return false
+	}
+	si, err := os.Stat(source)
+	return err == nil && si.ModTime().After(fi.ModTime())
+}
+
+// generate makes a file for dir with create unless an up to date one
+// exists. source is what it's made from, if anything.
+func generate(dir string, segments []string, name, source string, create func(path string) error) error {
+	target := generatedPath(dir, segments, name)
+	if !needsGenerating(target, source) {
+		return nil
+	}
+	if readOnlyLibrary {
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+	}
+	return create(target)
+}
+
+// serveCached answers a /content/ request for a file the library doesn't
+// have from the cache, reporting whether it did.
+func serveCached(w http.ResponseWriter, r *http.Request, root, rel string) bool {
+	if !readOnlyLibrary {
+		return false
+	}
+	if _, err := os.Stat(filepath.Join(root, filepath.FromSlash(rel))); !os.IsNotExist(err) {
+		return false
+	}
+	f, err := os.Open(filepath.Join(cacheDir, filepath.FromSlash(rel)))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		return false
+	}
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+	return true
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newReadOnlyLibrary sets up a library with nothing generated yet and
+// turns on library.read_only with a cache of its own.
+func newReadOnlyLibrary(t *testing.T) (root string) {
+	t.Helper()
+	root = filepath.Join(t.TempDir(), "library")
+	for _, dir := range []string{
+		filepath.Join(root, "Movies", "Film"),
+		filepath.Join(root, "TV", "Show", "Season 1", "Episode 1"),
+	} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.WriteFile(filepath.Join(root, "Movies", "Film", "film.mp4"), []byte("film"), 0644)
+	os.WriteFile(filepath.Join(root, "TV", "Show", "Season 1", "Episode 1", "ep.mp4"), []byte("episode"), 0644)
+
+	oldRO, oldCache, oldFFmpeg, oldFFprobe := readOnlyLibrary, cacheDir, ffmpegPath, ffprobePath
+	t.Cleanup(func() {
+		readOnlyLibrary, cacheDir, ffmpegPath, ffprobePath = oldRO, oldCache, oldFFmpeg, oldFFprobe
+	})
+	readOnlyLibrary, cacheDir = true, filepath.Join(t.TempDir(), cacheDirName)
+	ffmpegPath = filepath.Join(t.TempDir(), "no-ffmpeg")
+	ffprobePath = filepath.Join(t.TempDir(), "no-ffprobe")
+	return root
+}
+
+func TestReadOnlyFeedWritesToCache(t *testing.T) {
+	root := newReadOnlyLibrary(t)
+	before := snapshotTree(t, root)
+	feed, err := BuildFeed(root, "http://roku.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertUnchanged(t, before, snapshotTree(t, root))
+
+	var show *Series
+	for _, c := range feed.Categories {
+		for i := range c.Series {
+			if c.Series[i].Name == "Show" {
+				show = &c.Series[i]
+			}
+		}
+	}
+	if show == nil || show.ShortDesc != "Show" {
+		t.Fatalf("series in the feed: %+v", show)
+	}
+	for _, name := range []string{"Movies/Film/desc.txt", "TV/Show/desc.txt", "TV/Show/thumb.jpg", "TV/Show/Season 1/thumb.jpg"} {
+		if _, err := os.Stat(filepath.Join(cacheDir, filepath.FromSlash(name))); err != nil {
+			t.Errorf("not in the cache: %v", err)
+		}
+	}
+
+	// The generated artwork is served as if it were in the library
+	thumb := strings.TrimPrefix(show.Thumbnail, "http://roku.test")
+	w := httptest.NewRecorder()
+	contentHandler(root).ServeHTTP(w, httptest.NewRequest("GET", thumb, nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/jpeg" {
+		t.Errorf("GET %s: %d %s", thumb, w.Code, w.Header().Get("Content-Type"))
+	}
+}
+
+func TestReadOnlyRefusesWrites(t *testing.T) {
+	root := newReadOnlyLibrary(t)
+	old := cfg
+	t.Cleanup(func() { cfg = old })
+	cfg.Root, cfg.DataDir = root, t.TempDir()
+
+	cfg.Mode = "web"
+	if !containsProblem(validateConfig(true), "only works in file mode") {
+		t.Error("a read-only library was accepted for the web UI")
+	}
+	cfg.Mode = "combined"
+	if !containsProblem(validateConfig(true), "only works in file mode") {
+		t.Error("a read-only library was accepted in combined mode")
+	}
+	cfg.Mode = "file"
+	if containsProblem(validateConfig(true), "only works in file mode") {
+		t.Error("a read-only library was refused in file mode")
+	}
+	cfg.DataDir = filepath.Join(root, ".channelforge")
+	if !containsProblem(validateConfig(false), "data_dir outside the library") {
+		t.Error("a data directory inside a read-only library was accepted")
+	}
+
+	before := snapshotTree(t, root)
+	if err := importCommand(flag.NewFlagSet("import", flag.ContinueOnError))([]string{"-"}); err == nil || !strings.Contains(err.Error(), "read-only") {
+		t.Errorf("import into a read-only library: %v", err)
+	}
+	assertUnchanged(t, before, snapshotTree(t, root))
+}
+
+func containsProblem(problems []string, s string) bool {
+	for _, p := range problems {
+		if strings.Contains(p, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,639 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// ==== COMMAND LINE TOOLS ====
+//
+// Subcommands work on the library and the data directory directly, without
+// starting a server, for cron jobs and scripts:
+//
+//	server scan --root /srv/media
+//	server user add --role editor alice < password.txt
+//
+// They read the same settings as the server (--config, --root, the
+// CHANNELFORGE_* variables, ...). A running server keeps accounts,
+// sessions and devices in memory and writes them back over any change made
+// here, so the user and device commands that change them refuse to run
+// while it is up (see serverPIDFile).
+
+type command struct {
+	name  string
+	args  string
+	help  string
+	setup func(fs *flag.FlagSet) func(args []string) error // adds flags, returns the runner
+}
+
+var commands = []*command{
+	{"scan", "", "Read the whole library the way the feed does, filling in missing descriptions and artwork", scanCommand},
+	{"validate", "", "Check the settings and the library, listing problems; exits 1 if there are errors", validateCommand},
+	{"feed", "", "Print the feed", feedCommand},
+	{"thumbs", "", "Generate artwork for folders that have none (into the cache for a read-only library)", thumbsCommand},
+	{"user add", "NAME", "Create an account; the password is read from standard input", userAddCommand},
+	{"user passwd", "NAME", "Set an account's password, read from standard input", userPasswdCommand},
+	{"user list", "", "List the accounts", userListCommand},
+	{"device add", "NAME", "Create a device key for the feed and print it", deviceAddCommand},
+	{"device list", "", "List the devices", deviceListCommand},
+	{"device revoke", "ID", "Remove a device so its key stops working", deviceRevokeCommand},
+	{"import", "ARCHIVE", "Unpack an archive made by export into the library", importCommand},
+	{"export", "ARCHIVE", "Write the library to a .tar.gz archive (- for standard output)", exportCommand},
+}
+
+var errUsage = errors.New("usage")
+
+// findCommand picks the command named at the start of args and returns it
+// with the arguments that follow.
+func findCommand(args []string) (*command, []string) {
+	for _, c := range commands {
+		words := strings.Fields(c.name)
+		if len(args) >= len(words) && strings.Join(args[:len(words)], " ") == c.name {
+			return c, args[len(words):]
+		}
+	}
+	return nil, nil
+}
+
+// runCommand runs a subcommand and returns the exit status.
+func runCommand(args []string) int {
+	c, rest := findCommand(args)
+	if c == nil {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", strings.Join(args, " "))
+		printUsage()
+		return 2
+	}
+	fs := flag.NewFlagSet("server "+c.name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: server %s [options] %s\n\n%s.\n\nOptions:\n", c.name, c.args, c.help)
+		fs.PrintDefaults()
+	}
+	run := c.setup(fs)
+	if err := loadCommandConfig(fs, rest); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := run(fs.Args()); err != nil {
+		if err == errUsage {
+			fs.Usage()
+			return 2
+		}
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	return 0
+}
+
+// commandBaseURL is the base for feed links when there's no request to
+// take it from.
+func commandBaseURL() string {
+	if publicBaseURL != "" {
+		return publicBaseURL
+	}
+	host, port, _ := net.SplitHostPort(cfg.Addr)
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "localhost"
+	}
+	return listenScheme() + "://" + net.JoinHostPort(host, port) + basePath
+}
+
+func scanCommand(fs *flag.FlagSet) func([]string) error {
+	return func(args []string) error {
+		if len(args) != 0 {
+			return errUsage
+		}
+		warnMissingTools()
+		start := time.Now()
+		feed, err := BuildFeed(cfg.Root, commandBaseURL())
+		if err != nil {
+			return err
+		}
+		var series, seasons, videos, noDuration int
+		count := func(items []Item) {
+			for _, it := range items {
+				videos++
+				if it.Content.Video.Duration == 0 {
+					noDuration++
+				}
+			}
+		}
+		for _, c := range feed.Categories {
+			count(c.Items)
+			for _, s := range c.Series {
+				series++
+				for _, se := range s.Seasons {
+					seasons++
+					count(se.Items)
+				}
+			}
+		}
+		fmt.Printf("Scanned %s in %s: %d categories, %d series, %d seasons, %d videos\n",
+			cfg.Root, time.Since(start).Round(time.Millisecond), len(feed.Categories), series, seasons, videos)
+		if noDuration > 0 {
+			fmt.Printf("%d videos have no duration; run validate for details\n", noDuration)
+		}
+		return nil
+	}
+}
+
+func validateCommand(fs *flag.FlagSet) func([]string) error {
+	return func(args []string) error {
+		if len(args) != 0 {
+			return errUsage
+		}
+		issues, err := validateLibrary(cfg.Root)
+		if err != nil {
+			return err
+		}
+		errs := 0
+		for _, i := range issues {
+			where := i.Path()
+			if where == "" {
+				where = cfg.Root
+			}
+			fmt.Printf("%-7s  %s: %s\n", strings.ToUpper(i.Severity), where, i.Problem)
+			if i.Severity == severityError {
+				errs++
+			}
+		}
+		if errs > 0 {
+			return fmt.Errorf("%d errors, %d warnings", errs, len(issues)-errs)
+		}
+		if len(issues) > 0 {
+			fmt.Printf("No errors, %d warnings\n", len(issues))
+		} else {
+			fmt.Println("Settings and library OK")
+		}
+		return nil
+	}
+}
+
+func feedCommand(fs *flag.FlagSet) func([]string) error {
+	format := fs.String("format", "xml", "Feed format (xml)")
+	out := fs.String("o", "", "Write the feed to this file instead of standard output")
+	return func(args []string) error {
+		if len(args) != 0 {
+			return errUsage
+		}
+		write, ok := feedFormats[*format]
+		if !ok {
+			return fmt.Errorf("unknown format %q", *format)
+		}
+		if signContentURLs {
+			if err := loadURLSecret(); err != nil {
+				return fmt.Errorf("URL signing key: %w", err)
+			}
+		}
+		warnMissingTools()
+		feed, err := BuildFeed(cfg.Root, commandBaseURL())
+		if err != nil {
+			return err
+		}
+		if *out == "" {
+			return write(os.Stdout, feed)
+		}
+		return writeFileAtomic(*out, func(w io.Writer) error { return write(w, feed) })
+	}
+}
+
+func thumbsCommand(fs *flag.FlagSet) func([]string) error {
+	dryRun := fs.Bool("n", false, "Only list the folders that would get artwork")
+	return func(args []string) error {
+		if len(args) != 0 {
+			return errUsage
+		}
+		if !*dryRun {
+			warnMissingTools()
+		}
+		made, failed := 0, 0
+		err := walkLibrary(cfg.Root, func(dir, kind string, names []string) {
+			info, err := readItem(dir)
+			if err != nil || info.Thumbnail != "" {
+				return
+			}
+			// Movies and episodes without a video have nothing to show yet
+			if info.Video == "" && (kind == kindMovie || kind == kindEpisode) {
+				return
+			}
+			source := ""
+			if info.Video != "" {
+				source = filepath.Join(dir, info.Video)
+			}
+			rel := strings.Join(names, "/") + "/thumb.jpg"
+			if !needsGenerating(generatedPath(dir, names, "thumb.jpg"), source) {
+				return
+			}
+			if *dryRun {
+				fmt.Println(rel)
+				return
+			}
+			err = generate(dir, names, "thumb.jpg", source, func(thumbPath string) error {
+				if source != "" {
+					return extractFrameAsJPG(source, thumbPath)
+				}
+				createDefaultJPG(thumbPath, names[len(names)-1])
+				return nil
+			})
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", rel, err)
+				failed++
+				return
+			}
+			fmt.Println("Created", rel)
+			made++
+		})
+		if err != nil {
+			return err
+		}
+		if !*dryRun {
+			fmt.Printf("%d thumbnails created\n", made)
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d thumbnails could not be made", failed)
+		}
+		return nil
+	}
+}
+
+// readPassword reads one line from standard input, prompting when it's a
+// terminal.
+func readPassword() (string, error) {
+	if fi, err := os.Stdin.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		fmt.Fprint(os.Stderr, "Password: ")
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", errors.New("no password on standard input")
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if len(password) < 5 {
+		return "", errors.New("password too short")
+	}
+	return password, nil
+}
+
+func userAddCommand(fs *flag.FlagSet) func([]string) error {
+	role := fs.String("role", "", "admin, editor, uploader or viewer (default admin for the first account, viewer after that)")
+	return func(args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		if err := requireStoppedServer(); err != nil {
+			return err
+		}
+		if err := users.load(); err != nil {
+			return err
+		}
+		name := strings.TrimSpace(args[0])
+		if len(name) < 3 {
+			return errors.New("username too short")
+		}
+		r := Role(*role)
+		if r == "" {
+			r = RoleViewer
+			if users.count() == 0 {
+				r = RoleAdmin
+			}
+		}
+		if !validRole(r) {
+			return fmt.Errorf("unknown role %q", *role)
+		}
+		if users.get(name) != nil {
+			return errUserExists
+		}
+		password, err := readPassword()
+		if err != nil {
+			return err
+		}
+		if err := users.add(name, password, r); err != nil {
+			return err
+		}
+		auditCommand("user-add", "user:"+name, nil, userAuditState(name))
+		fmt.Printf("Added %s (%s)\n", name, r)
+		return nil
+	}
+}
+
+func userPasswdCommand(fs *flag.FlagSet) func([]string) error {
+	return func(args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		if err := requireStoppedServer(); err != nil {
+			return err
+		}
+		if err := users.load(); err != nil {
+			return err
+		}
+		if users.get(args[0]) == nil {
+			return errUserNotFound
+		}
+		if err := sessions.load(); err != nil {
+			return err
+		}
+		if err := apiTokens.load(); err != nil {
+			return err
+		}
+		password, err := readPassword()
+		if err != nil {
+			return err
+		}
+		if err := users.setPassword(args[0], password); err != nil {
+			return err
+		}
+		// As on the users page: whoever knew the old password is signed out
+		sessions.revokeUser(args[0], "")
+		apiTokens.revokeUser(args[0])
+		state := userAuditState(args[0])
+		auditCommand("user-reset", "user:"+args[0], state, state)
+		fmt.Println("Password changed for", args[0])
+		return nil
+	}
+}
+
+func userListCommand(fs *flag.FlagSet) func([]string) error {
+	return func(args []string) error {
+		if len(args) != 0 {
+			return errUsage
+		}
+		if err := users.load(); err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tROLE\t2FA\tACCESS")
+		for _, u := range users.list() {
+			twoFactor, access := "no", "everything"
+			if u.TOTPSecret != "" {
+				twoFactor = "yes"
+			}
+			if len(u.Access) > 0 {
+				access = strings.Join(u.Access, ", ")
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", u.Username, u.Role, twoFactor, access)
+		}
+		return tw.Flush()
+	}
+}
+
+// The device commands are the only way to hand out keys in file mode,
+// which has no devices page.
+
+func deviceAddCommand(fs *flag.FlagSet) func([]string) error {
+	return func(args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		if err := requireStoppedServer(); err != nil {
+			return err
+		}
+		if err := devices.load(); err != nil {
+			return err
+		}
+		name := strings.TrimSpace(args[0])
+		if name == "" {
+			return errors.New("name is required")
+		}
+		key := devices.create(name)
+		auditCommand("device-add", "device:"+hashToken(key)[:16], nil, map[string]string{"name": name})
+		fmt.Printf("Key for %s, shown only this once:\n%s\n\nPoint the device at:\n%s/feed.xml?key=%s\n",
+			name, key, commandBaseURL(), url.QueryEscape(key))
+		return nil
+	}
+}
+
+func deviceListCommand(fs *flag.FlagSet) func([]string) error {
+	return func(args []string) error {
+		if len(args) != 0 {
+			return errUsage
+		}
+		if err := devices.load(); err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tADDED\tLAST SEEN\tADDRESS")
+		for _, d := range devices.list() {
+			seen := "never"
+			if !d.LastSeen.IsZero() {
+				seen = d.LastSeen.Format("2006-01-02 15:04")
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", d.ID, d.Name, d.Created.Format("2006-01-02"), seen, d.LastIP)
+		}
+		return tw.Flush()
+	}
+}
+
+func deviceRevokeCommand(fs *flag.FlagSet) func([]string) error {
+	return func(args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		if err := requireStoppedServer(); err != nil {
+			return err
+		}
+		if err := devices.load(); err != nil {
+			return err
+		}
+		before := devices.get(args[0])
+		if !devices.revoke(args[0]) {
+			return fmt.Errorf("no device with ID %q (see device list)", args[0])
+		}
+		auditCommand("device-revoke", "device:"+args[0], before, nil)
+		fmt.Println("Revoked", before.Name)
+		return nil
+	}
+}
+
+func exportCommand(fs *flag.FlagSet) func([]string) error {
+	return func(args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		if args[0] == "-" {
+			return exportLibrary(os.Stdout)
+		}
+		if err := writeFileAtomic(args[0], exportLibrary); err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "Exported", cfg.Root, "to", args[0])
+		return nil
+	}
+}
+
+// exportLibrary writes the visible part of the library as a gzipped tar.
+// Hidden folders (the data directory, the trash, upload staging) and
+// symlinks are left out.
+func exportLibrary(w io.Writer) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	err := filepath.Walk(cfg.Root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == cfg.Root {
+			return nil
+		}
+		if isHiddenName(fi.Name()) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !fi.IsDir() && !fi.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(cfg.Root, p)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func importCommand(fs *flag.FlagSet) func([]string) error {
+	overwrite := fs.Bool("overwrite", false, "Replace files that already exist in the library")
+	return func(args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		if readOnlyLibrary {
+			return errors.New("the library is read-only (library.read_only)")
+		}
+		var in io.Reader = os.Stdin
+		if args[0] != "-" {
+			f, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			in = f
+		}
+		added, skipped, err := importLibrary(in, *overwrite)
+		if added > 0 {
+			auditCommand("import", filepath.Base(args[0]), nil, map[string]int{"files": added, "skipped": skipped})
+		}
+		fmt.Printf("Imported %d files, skipped %d\n", added, skipped)
+		return err
+	}
+}
+
+// importLibrary unpacks a gzipped tar into the library. Every name goes
+// through resolvePath, so an archive can't write outside the root or into
+// hidden folders.
+func importLibrary(r io.Reader, overwrite bool) (added, skipped int, err error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, 0, err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return added, skipped, nil
+		}
+		if err != nil {
+			return added, skipped, err
+		}
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+		if name == "." {
+			continue
+		}
+		segments := strings.Split(name, "/")
+		target, err := resolvePath(cfg.Root, segments...)
+		for _, seg := range segments {
+			if err == nil && isHiddenName(seg) {
+				err = errors.New("hidden names can't be imported")
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping %s: %v\n", hdr.Name, err)
+			skipped++
+			continue
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return added, skipped, err
+			}
+		case tar.TypeReg:
+			if _, err := os.Stat(target); err == nil && !overwrite {
+				fmt.Fprintf(os.Stderr, "Skipping %s: already exists\n", hdr.Name)
+				skipped++
+				continue
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return added, skipped, err
+			}
+			if err := writeFileAtomic(target, func(w io.Writer) error {
+				_, err := io.Copy(w, tr)
+				return err
+			}); err != nil {
+				return added, skipped, err
+			}
+			os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+			added++
+		default:
+			fmt.Fprintf(os.Stderr, "Skipping %s: not a file or folder\n", hdr.Name)
+			skipped++
+		}
+	}
+}
+
+// writeFileAtomic writes a file through a temporary one next to it, so
+// readers never see it half written.
+func writeFileAtomic(target string, write func(io.Writer) error) error {
+	tmp := filepath.Join(filepath.Dir(target), ".tmp-"+filepath.Base(target))
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, target)
+}
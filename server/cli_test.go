@@ -0,0 +1,180 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withStdin runs f with standard input reading input.
+func withStdin(t *testing.T, input string, f func()) {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "stdin")
+	if err := os.WriteFile(name, []byte(input), 0600); err != nil {
+		t.Fatal(err)
+	}
+	in, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	old := os.Stdin
+	os.Stdin = in
+	defer func() { os.Stdin = old }()
+	f()
+}
+
+func TestUserPasswdSignsOut(t *testing.T) {
+	newTestServer(t)
+	token := apiTokens.create("admin", "script", nil, 0)
+	var err error
+	withStdin(t, "a new password\n", func() {
+		err = userPasswdCommand(nil)([]string{"admin"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if users.authenticate("admin", "a new password") == nil {
+		t.Error("password was not changed")
+	}
+
+	// What a server started afterwards would load
+	if err := sessions.load(); err != nil {
+		t.Fatal(err)
+	}
+	if err := apiTokens.load(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(sessions.listFor("admin")); n != 0 {
+		t.Errorf("%d sessions survived a password change", n)
+	}
+	if apiTokens.lookup(token) != nil {
+		t.Error("API token survived a password change")
+	}
+}
+
+func TestImportRefusesBadNames(t *testing.T) {
+	s := newTestServer(t)
+	bad := []string{
+		"../evil.txt",
+		"Movies/../../evil.txt",
+		"/../evil.txt",
+		".channelforge/webuser.json",
+		".uploads/x.bin",
+		"Movies/.hidden/evil.txt",
+		"Movies/Film/.evil.txt",
+		"Movies/CON/evil.mp4",
+		"Movies/Film/trailing.",
+		"Escape/evil.txt",
+		"Movies/Escape/evil.txt",
+		"TV/Show/Season 1/Escape/evil.txt",
+		"Movies/Dangling",
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	add := func(name, body string) {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(body)), ModTime: time.Now(), Typeflag: tar.TypeReg})
+		io.WriteString(tw, body)
+	}
+	for _, name := range bad {
+		add(name, "evil")
+	}
+	tw.WriteHeader(&tar.Header{Name: "Movies/Link", Linkname: "../../outside", Typeflag: tar.TypeSymlink, ModTime: time.Now()})
+	add("Movies/Imported/imported.mp4", "good")
+	tw.Close()
+	gz.Close()
+
+	added, skipped, err := importLibrary(&buf, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 1 || skipped != len(bad)+1 {
+		t.Errorf("got %d added and %d skipped, want 1 and %d", added, skipped, len(bad)+1)
+	}
+	if _, err := os.Stat(filepath.Join(s.root, "Movies", "Imported", "imported.mp4")); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Lstat(filepath.Join(s.root, "Movies", "Link")); err == nil {
+		t.Error("symlink was imported")
+	}
+	assertOutsideUntouched(t, s)
+	filepath.Walk(s.root, func(p string, fi os.FileInfo, err error) error {
+		if err == nil && strings.HasPrefix(fi.Name(), "evil") {
+			t.Errorf("%s was imported", p)
+		}
+		return nil
+	})
+}
+
+func TestAccountCommandsNeedStoppedServer(t *testing.T) {
+	if !handoffSupported {
+		t.Skip("no process check on this system")
+	}
+	newTestServer(t)
+	writePID := func(pid int) {
+		if err := os.WriteFile(dataPath(serverPIDFile), []byte(strconv.Itoa(pid)+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run := func() error {
+		var err error
+		withStdin(t, "a new password\n", func() {
+			err = userPasswdCommand(nil)([]string{"admin"})
+		})
+		return err
+	}
+
+	// The test binary's parent stands in for a live server
+	writePID(os.Getppid())
+	if err := run(); err == nil || !strings.Contains(err.Error(), "running") {
+		t.Fatalf("user passwd with a server running: %v", err)
+	}
+	if err := deviceAddCommand(nil)([]string{"Den"}); err == nil {
+		t.Error("device add ran with a server running")
+	}
+	if users.authenticate("admin", "a new password") != nil || len(devices.list()) != 0 {
+		t.Fatal("a command changed the data with a server running")
+	}
+
+	// A PID file left by a crashed server doesn't get in the way
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	writePID(cmd.Process.Pid)
+	if err := run(); err != nil {
+		t.Fatalf("user passwd with a stale PID file: %v", err)
+	}
+	os.Remove(dataPath(serverPIDFile))
+	if err := deviceAddCommand(nil)([]string{"Den"}); err != nil {
+		t.Fatalf("device add without a PID file: %v", err)
+	}
+}
+
+func TestPIDFileKeptAfterHandoff(t *testing.T) {
+	newTestServer(t)
+	writePIDFile()
+	if pid, err := readPIDFile(); err != nil || pid != os.Getpid() {
+		t.Fatalf("PID file has %d, %v", pid, err)
+	}
+	removePIDFile()
+	if _, err := os.Stat(dataPath(serverPIDFile)); !os.IsNotExist(err) {
+		t.Fatal("PID file not removed at exit")
+	}
+
+	// The new process wrote its PID; the old one leaves it alone
+	os.WriteFile(dataPath(serverPIDFile), []byte("1\n"), 0644)
+	removePIDFile()
+	if pid, _ := readPIDFile(); pid != 1 {
+		t.Error("the old process removed the new one's PID file")
+	}
+}
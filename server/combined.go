@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ==== COMBINED MODE ====
+//
+// Combined mode runs the feed and the admin UI in one process over the same
+// library, each on its own address: the public listener answers devices
+// only (the feed, content, activation and the CA certificate), while the
+// admin listener serves everything and can be bound to localhost or a VPN
+// interface.
+
+type adminListenerKey struct{}
+
+// devicesOnly hides everything but the device side of the server.
+func devicesOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isDevicePath(r.URL.Path) {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// onAdminListener marks requests that came in on the admin listener.
+func onAdminListener(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), adminListenerKey{}, true)))
+	})
+}
+
+func isAdminRequest(r *http.Request) bool {
+	return r.Context().Value(adminListenerKey{}) != nil
+}
+
+// publicURL is where devices find the feed, for links shown in the admin
+// UI.
+func publicURL(r *http.Request) string {
+	if !isAdminRequest(r) {
+		return baseURL(r)
+	}
+	if publicBaseURL != "" {
+		return publicBaseURL
+	}
+	return listenerURL(r, cfg.Addr)
+}
+
+// adminURL is where people manage the server, for links handed to devices.
+func adminURL(r *http.Request) string {
+	if cfg.Mode != "combined" || isAdminRequest(r) {
+		return baseURL(r)
+	}
+	return listenerURL(r, cfg.AdminAddr)
+}
+
+// listenerURL guesses the URL of the listener on addr from a request that
+// reached the other one: same host unless addr names a specific one.
+func listenerURL(r *http.Request, addr string) string {
+	scheme := "http"
+	if tlsEnabled() {
+		scheme = "https"
+	}
+	host, port, _ := net.SplitHostPort(addr)
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = r.Host
+		if h := forwarded(r, "X-Forwarded-Host"); h != "" {
+			host = h
+		}
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+	}
+	if (scheme == "http" && port == "80") || (scheme == "https" && port == "443") {
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+	} else {
+		host = net.JoinHostPort(host, port)
+	}
+	return scheme + "://" + host + basePath
+}
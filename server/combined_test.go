@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCombinedModeListeners(t *testing.T) {
+	old := cfg
+	t.Cleanup(func() { cfg = old })
+	cfg.Mode, cfg.Addr, cfg.AdminAddr = "combined", ":8080", "127.0.0.1:8081"
+	mux := http.NewServeMux()
+	mux.HandleFunc("/feed.xml", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "feed for "+publicURL(r))
+	})
+	mux.HandleFunc("/admin", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "admin, feed at "+publicURL(r))
+	})
+	mux.HandleFunc("/activate/code", activateCodeHandler)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "root")
+	})
+
+	specs := listenerSpecs(mux, cfg.Addr, false)
+	if len(specs) != 2 || specs[0].addr != cfg.Addr || specs[1].addr != cfg.AdminAddr {
+		t.Fatalf("listeners: %+v", specs)
+	}
+	public := httptest.NewServer(specs[0].handler)
+	defer public.Close()
+	admin := httptest.NewServer(specs[1].handler)
+	defer admin.Close()
+
+	get := func(base, path string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(base + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	// Devices get the feed on the public listener, nothing else
+	if code, body := get(public.URL, "/feed.xml"); code != http.StatusOK || body != "feed for "+public.URL {
+		t.Errorf("public feed: %d %q", code, body)
+	}
+	for _, path := range []string{"/admin", "/", "/login", "/api/v1/categories"} {
+		if code, _ := get(public.URL, path); code != http.StatusNotFound {
+			t.Errorf("public %s: got %d, want 404", path, code)
+		}
+	}
+
+	// The admin listener serves everything, pointing at the public one for
+	// the feed
+	if code, body := get(admin.URL, "/admin"); code != http.StatusOK || body != "admin, feed at http://127.0.0.1:8080" {
+		t.Errorf("admin page: %d %q", code, body)
+	}
+	if code, _ := get(admin.URL, "/feed.xml"); code != http.StatusOK {
+		t.Errorf("feed on the admin listener: got %d", code)
+	}
+
+	// A device pairing on the public listener is sent to the admin one
+	pending := activations.byPoll
+	t.Cleanup(func() { activations.byPoll = pending })
+	activations.byPoll = make(map[string]*activation)
+	resp, err := http.Post(public.URL+"/activate/code", "application/x-www-form-urlencoded", strings.NewReader("model=Roku"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var code struct {
+		URL string `json:"activation_url"`
+	}
+	json.NewDecoder(resp.Body).Decode(&code)
+	if code.URL != "http://127.0.0.1:8081/admin/activate" {
+		t.Errorf("activation URL %q", code.URL)
+	}
+}
@@ -0,0 +1,647 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ==== CONFIGURATION ====
+//
+// Settings come from, in increasing priority: the defaults below, the file
+// named by --config (or CHANNELFORGE_CONFIG), CHANNELFORGE_* environment
+// variables and command line flags. Every setting has a key such as
+// "listen.addr"; its environment variable is the key in upper case with
+// dots as underscores, e.g. CHANNELFORGE_LISTEN_ADDR. See
+// channelforge.example.toml.
+//
+// The file is a small subset of TOML: [sections], key = value, strings,
+// numbers, booleans and single-line arrays of strings.
+
+const (
+	configEnvPrefix = "CHANNELFORGE_"
+	dataDirName     = ".channelforge"
+)
+
+type serverConfig struct {
+	Mode           string
+	Root           string
+	DataDir        string
+	Addr           string
+	AdminAddr      string
+	TrustedProxies string
+	API            bool
+	Activation     bool
+	Trash          bool
+}
+
+var cfg = serverConfig{
+	Root:  ".",
+	Addr:  "0.0.0.0:8080",
+	API:   true,
+	Trash: true,
+}
+
+// configFile is the --config file the settings were read from, if any.
+var configFile string
+
+var (
+	ffmpegPath      = "ffmpeg"
+	ffprobePath     = "ffprobe"
+	thumbnailOffset = 10 * time.Second
+	dataDir         string // where accounts, keys and logs live
+)
+
+type settingKind int
+
+const (
+	kindString settingKind = iota
+	kindBool
+	kindDuration
+	kindSize
+	kindInt
+)
+
+type setting struct {
+	key   string
+	flag  string // command line flag, if there is one
+	kind  settingKind
+	ptr   interface{}
+	usage string
+}
+
+var settings = []*setting{
+	{"mode", "", kindString, &cfg.Mode, `"web", "file" or "combined"`},
+	{"root", "root", kindString, &cfg.Root, "Root directory for content (used in both modes)"},
+	{"data_dir", "data-dir", kindString, &cfg.DataDir, "Directory for accounts, keys and logs (default <root>/" + dataDirName + ")"},
+	{"library.read_only", "read-only", kindBool, &readOnlyLibrary, "Never write into the library; generated artwork and descriptions go to the cache directory"},
+	{"library.cache_dir", "cache-dir", kindString, &cacheDir, "Where a read-only library's generated files are kept (default <data_dir>/" + cacheDirName + ")"},
+	{"listen.addr", "addr", kindString, &cfg.Addr, "Address to listen on"},
+	{"listen.admin_addr", "admin-addr", kindString, &cfg.AdminAddr, "In combined mode, address of the admin UI, e.g. 127.0.0.1:8081"},
+	{"listen.http_addr", "http-addr", kindString, &plainHTTPAddr, "With HTTPS, also serve the feed over plain HTTP here and redirect browsers"},
+	{"url.base_url", "base-url", kindString, &publicBaseURL, "Public URL of the server used in feed links, may include a sub-path (default: taken from each request)"},
+	{"url.base_path", "base-path", kindString, &basePath, "Serve everything below this sub-path, e.g. /media"},
+	{"url.trusted_proxies", "trusted-proxies", kindString, &cfg.TrustedProxies, "Comma separated proxy addresses/CIDRs whose X-Forwarded-* headers are believed"},
+	{"tls.cert", "tls-cert", kindString, &tlsCertFile, "Serve HTTPS with this certificate file (needs --tls-key)"},
+	{"tls.key", "tls-key", kindString, &tlsKeyFile, "Private key file for --tls-cert"},
+	{"tls.self_signed", "tls-self-signed", kindBool, &tlsSelfSigned, "Serve HTTPS with a certificate from a generated local CA"},
+	{"ffmpeg.ffmpeg", "ffmpeg", kindString, &ffmpegPath, "ffmpeg command used to make thumbnails"},
+	{"ffmpeg.ffprobe", "ffprobe", kindString, &ffprobePath, "ffprobe command used to read video durations"},
+	{"ffmpeg.thumbnail_offset", "thumb-offset", kindDuration, &thumbnailOffset, "How far into a video generated thumbnails are taken"},
+	{"uploads.max_size", "max-upload", kindSize, &maxUploadSize, "Largest upload accepted, e.g. 50GB"},
+	{"uploads.expire_after", "", kindDuration, &tusLifetime, "How long unfinished resumable uploads are kept"},
+	{"auth.feed_auth", "feed-auth", kindBool, &feedKeyRequired, "Require an activated device (key) for /feed.xml and /content/"},
+	{"auth.sign_urls", "sign-urls", kindBool, &signContentURLs, "Sign thumbnail and video links in the feed with expiring tokens"},
+	{"auth.url_ttl", "url-ttl", kindDuration, &signedURLLifetime, "How long signed content links stay valid"},
+	{"auth.session_idle_timeout", "", kindDuration, &sessionIdleTimeout, "Sign out an admin session after this long without a request"},
+	{"auth.session_max_age", "", kindDuration, &sessionMaxAge, "Longest an admin session lasts, however busy"},
+	{"auth.login_user_threshold", "", kindInt, &loginUserThreshold, "Failed logins for one username before it is locked out"},
+	{"auth.login_ip_threshold", "", kindInt, &loginIPThreshold, "Failed logins from one address before it is locked out"},
+	{"log.format", "log-format", kindString, &logFormat, `"logfmt" or "json"`},
+	{"log.level", "log-level", kindString, &logLevel, "Least important messages logged: debug, info, warn or error"},
+	{"log.levels", "", kindString, &logLevels, `Levels for single subsystems, e.g. "access=warn,tools=debug"`},
+	{"log.file", "log-file", kindString, &logFile, "Log to this file instead of standard error (relative to data_dir)"},
+	{"log.access_file", "", kindString, &accessLogFile, "Write the access log to this file instead of the main log"},
+	{"log.max_size", "", kindSize, &logMaxSize, "Rotate log files when they reach this size (0 never rotates)"},
+	{"log.max_files", "", kindInt, &logMaxFiles, "How many rotated log files are kept"},
+	{"server.read_header_timeout", "", kindDuration, &readHeaderTimeout, "How long a client may take to send request headers"},
+	{"server.idle_timeout", "", kindDuration, &idleTimeout, "How long an idle keep-alive connection is kept open"},
+	{"server.write_timeout", "", kindDuration, &writeTimeout, "Longest time to send a response (0 for none; streams can take hours)"},
+	{"server.drain_timeout", "drain-timeout", kindDuration, &drainTimeout, "On SIGTERM/SIGINT, how long open requests may finish before they're cut off"},
+	{"server.handoff", "", kindBool, &handoffEnabled, "On SIGHUP, restart the executable and hand it the listening sockets"},
+	{"server.handoff_drain_timeout", "", kindDuration, &handoffDrainTimeout, "After a SIGHUP restart, how long the old process keeps serving open requests before cutting them off"},
+	{"health.min_free_disk", "", kindSize, &minFreeDisk, "/readyz fails when the library's disk has less free space than this"},
+	{"metrics.enabled", "", kindBool, &metricsEnabled, "Serve Prometheus metrics at /metrics"},
+	{"metrics.token", "", kindString, &metricsToken, "Bearer token /metrics requires, if set"},
+	{"features.api", "", kindBool, &cfg.API, "Serve the JSON API under /api/v1/"},
+	{"features.activation", "", kindBool, &cfg.Activation, "Let devices pair with an activation code; paired devices' keys are then required for /feed.xml and /content/"},
+	{"features.trash", "", kindBool, &cfg.Trash, "Move deleted items to the trash instead of removing them"},
+	{"features.trash_retention", "trash-retention", kindDuration, &trash.retention, "How long deleted items stay in the trash (0 keeps them until emptied)"},
+}
+
+func (s *setting) envName() string {
+	return configEnvPrefix + strings.ToUpper(strings.ReplaceAll(s.key, ".", "_"))
+}
+
+// set parses a value given as text.
+func (s *setting) set(raw string) error {
+	raw = strings.TrimSpace(raw)
+	switch s.kind {
+	case kindString:
+		*s.ptr.(*string) = raw
+	case kindBool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", raw)
+		}
+		*s.ptr.(*bool) = b
+	case kindDuration:
+		d, err := parseDuration(raw)
+		if err != nil {
+			return err
+		}
+		*s.ptr.(*time.Duration) = d
+	case kindSize:
+		n, err := parseSize(raw)
+		if err != nil {
+			return err
+		}
+		*s.ptr.(*int64) = n
+	case kindInt:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("%q is not a whole number", raw)
+		}
+		*s.ptr.(*int) = n
+	}
+	return nil
+}
+
+func (s *setting) String() string {
+	switch v := s.ptr.(type) {
+	case *string:
+		return *v
+	case *bool:
+		return strconv.FormatBool(*v)
+	case *time.Duration:
+		return v.String()
+	case *int64:
+		return strconv.FormatInt(*v, 10)
+	case *int:
+		return strconv.Itoa(*v)
+	}
+	return ""
+}
+
+// parseDuration accepts Go durations plus whole days ("30d").
+func parseDuration(s string) (time.Duration, error) {
+	if n, err := strconv.Atoi(strings.TrimSuffix(s, "d")); err == nil && strings.HasSuffix(s, "d") {
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a duration like 90s, 12h or 30d", s)
+	}
+	return d, nil
+}
+
+// parseSize accepts a byte count with an optional KB/MB/GB/TB suffix.
+func parseSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		mult   int64
+	}{{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}}
+	upper := strings.ToUpper(strings.TrimSpace(s))
+	mult := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(upper, u.suffix) {
+			upper, mult = strings.TrimSpace(strings.TrimSuffix(upper, u.suffix)), u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(upper, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q is not a size like 500MB or 50GB", s)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+// flagValue holds a command line value until the file and environment
+// have been read, so that flags win over both.
+type flagValue struct {
+	s     *setting
+	raw   string
+	given bool
+}
+
+func (f *flagValue) String() string {
+	if f == nil || f.s == nil {
+		return ""
+	}
+	return f.s.String()
+}
+
+func (f *flagValue) Set(v string) error {
+	f.raw, f.given = v, true
+	return nil
+}
+
+func (f *flagValue) IsBoolFlag() bool { return f.s != nil && f.s.kind == kindBool }
+
+// loadConfig fills in the settings from every source, checks them and
+// points the data files at the data directory. Problems are returned
+// together so they can be fixed in one go.
+func loadConfig() error {
+	fileMode := flag.Bool("file", false, "Serve feeds from a directory structure (filesystem mode)")
+	webMode := flag.Bool("web", false, "Start the web UI for uploads and management")
+	combinedMode := flag.Bool("combined", false, "Serve the feed on --addr and the web UI on --admin-addr")
+	apply := configFlags(flag.CommandLine)
+	flag.Parse()
+
+	problems := apply()
+	var modes []string
+	for mode, given := range map[string]bool{"file": *fileMode, "web": *webMode, "combined": *combinedMode} {
+		if given {
+			modes = append(modes, mode)
+		}
+	}
+	switch len(modes) {
+	case 0:
+	case 1:
+		cfg.Mode = modes[0]
+	default:
+		problems = append(problems, "only one of --file, --web and --combined can be used")
+	}
+	problems = append(problems, validateConfig(true)...)
+	if err := finishConfig(problems); err != nil {
+		return err
+	}
+	if err := setupLogging(); err != nil {
+		return fmt.Errorf("log file: %v", err)
+	}
+	warnMissingTools()
+	return nil
+}
+
+// loadCommandConfig is loadConfig for the command line tools, which take
+// the same settings but never listen.
+func loadCommandConfig(fs *flag.FlagSet, args []string) error {
+	apply := configFlags(fs)
+	fs.Parse(args)
+	problems := apply()
+	problems = append(problems, validateConfig(false)...)
+	return finishConfig(problems)
+}
+
+// configFlags adds --config and a flag per setting to fs. Once fs has been
+// parsed, the returned function applies the file, the environment and the
+// flags in that order.
+func configFlags(fs *flag.FlagSet) func() []string {
+	configPath := fs.String("config", os.Getenv(configEnvPrefix+"CONFIG"), "Read settings from this TOML file")
+	var flags []*flagValue
+	for _, s := range settings {
+		if s.flag != "" {
+			fv := &flagValue{s: s}
+			fs.Var(fv, s.flag, s.usage)
+			flags = append(flags, fv)
+		}
+	}
+	return func() []string {
+		var problems []string
+		configFile = *configPath
+		if *configPath != "" {
+			problems = append(problems, readConfigFile(*configPath)...)
+		}
+		for _, s := range settings {
+			if v, ok := os.LookupEnv(s.envName()); ok {
+				if err := s.set(v); err != nil {
+					problems = append(problems, fmt.Sprintf("%s: %v", s.envName(), err))
+				}
+			}
+		}
+		for _, fv := range flags {
+			if fv.given {
+				if err := fv.s.set(fv.raw); err != nil {
+					problems = append(problems, fmt.Sprintf("--%s: %v", fv.s.flag, err))
+				}
+			}
+		}
+		return problems
+	}
+}
+
+func finishConfig(problems []string) error {
+	if len(problems) > 0 {
+		return errors.New("invalid configuration:\n  - " + strings.Join(problems, "\n  - "))
+	}
+
+	// Pairing hands out keys, which are no use unless the feed asks for them.
+	// Keys alone would leave /content/ guessable, so they imply signing.
+	feedKeyRequired = feedKeyRequired || cfg.Activation
+	signContentURLs = signContentURLs || feedKeyRequired
+	if !cfg.Trash {
+		trash.retention = 0
+	}
+	// Only a setup that predates the data directory may have left files in
+	// the working directory
+	legacy := cfg.DataDir == "" && configFile == ""
+	if cfg.DataDir == "" {
+		cfg.DataDir = filepath.Join(cfg.Root, dataDirName)
+	}
+	if err := setDataDir(cfg.DataDir, legacy); err != nil {
+		return err
+	}
+	if readOnlyLibrary && cacheDir == "" {
+		cacheDir = dataPath(cacheDirName)
+	}
+	return nil
+}
+
+// insideDir reports whether path is dir or lies below it.
+func insideDir(dir, path string) bool {
+	d, err1 := filepath.Abs(dir)
+	p, err2 := filepath.Abs(path)
+	return err1 == nil && err2 == nil && pathWithin(d, p)
+}
+
+// warnMissingTools logs when ffmpeg or ffprobe can't be found.
+func warnMissingTools() {
+	if _, err := exec.LookPath(ffmpegPath); err != nil {
+		logFor("server").Warn("ffmpeg not found; thumbnails won't be generated", "path", ffmpegPath)
+	}
+	if _, err := exec.LookPath(ffprobePath); err != nil {
+		logFor("server").Warn("ffprobe not found; video durations will be missing from the feed", "path", ffprobePath)
+	}
+}
+
+// readConfigFile applies the settings in a config file.
+func readConfigFile(path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return []string{fmt.Sprintf("config file: %v", err)}
+	}
+	defer f.Close()
+	entries, err := parseConfig(f)
+	if err != nil {
+		return []string{fmt.Sprintf("%s: %v", path, err)}
+	}
+	byKey := make(map[string]*setting)
+	for _, s := range settings {
+		byKey[s.key] = s
+	}
+	var problems []string
+	for _, e := range entries {
+		s, ok := byKey[e.key]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s:%d: unknown setting %q", path, e.line, e.key))
+			continue
+		}
+		if err := s.set(e.value); err != nil {
+			problems = append(problems, fmt.Sprintf("%s:%d: %s: %v", path, e.line, e.key, err))
+		}
+	}
+	return problems
+}
+
+type configEntry struct {
+	key   string
+	value string
+	line  int
+}
+
+// parseConfig reads the TOML subset. Arrays come back comma separated.
+func parseConfig(r io.Reader) ([]configEntry, error) {
+	var out []configEntry
+	section := ""
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(stripComment(sc.Text()))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: bad section header", n)
+			}
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("line %d: expected key = value", n)
+		}
+		key := strings.TrimSpace(line[:eq])
+		if section != "" {
+			key = section + "." + key
+		}
+		value, err := parseConfigValue(strings.TrimSpace(line[eq+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		out = append(out, configEntry{key: key, value: value, line: n})
+	}
+	return out, sc.Err()
+}
+
+// stripComment drops a # comment that isn't inside quotes.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0 && c == '\\' && quote == '"':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func parseConfigValue(v string) (string, error) {
+	switch {
+	case v == "":
+		return "", errors.New("missing value")
+	case strings.HasPrefix(v, "["):
+		if !strings.HasSuffix(v, "]") {
+			return "", errors.New("arrays must be on one line")
+		}
+		var items []string
+		for _, item := range strings.Split(v[1:len(v)-1], ",") {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			s, err := parseConfigValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	case strings.HasPrefix(v, `"`):
+		s, err := strconv.Unquote(v)
+		if err != nil {
+			return "", fmt.Errorf("bad string %s", v)
+		}
+		return s, nil
+	case strings.HasPrefix(v, "'"):
+		if len(v) < 2 || !strings.HasSuffix(v, "'") {
+			return "", fmt.Errorf("bad string %s", v)
+		}
+		return v[1 : len(v)-1], nil
+	}
+	return v, nil
+}
+
+// validateConfig checks the combined settings. Listening is only checked
+// for the server.
+func validateConfig(server bool) []string {
+	var problems []string
+	add := func(format string, a ...interface{}) { problems = append(problems, fmt.Sprintf(format, a...)) }
+	if fi, err := os.Stat(cfg.Root); err != nil || !fi.IsDir() {
+		add("root %q is not a directory", cfg.Root)
+	}
+	if readOnlyLibrary {
+		if cfg.DataDir == "" || insideDir(cfg.Root, cfg.DataDir) {
+			add("library.read_only needs a data_dir outside the library")
+		}
+		if cacheDir != "" && insideDir(cfg.Root, cacheDir) {
+			add("library.cache_dir must be outside a read-only library")
+		}
+		if server && cfg.Mode != "file" {
+			add("library.read_only only works in file mode; the web UI edits the library")
+		}
+	} else if cacheDir != "" {
+		add("library.cache_dir is only used with library.read_only")
+	}
+	if server {
+		problems = append(problems, validateListen()...)
+	}
+	if err := configureBaseURL(); err != nil {
+		add("%v", err)
+	}
+	if err := setTrustedProxies(cfg.TrustedProxies); err != nil {
+		add("url.trusted_proxies: %v", err)
+	}
+	problems = append(problems, validateLogging()...)
+	if handoffEnabled && !handoffSupported {
+		add("server.handoff is not supported on this system")
+	}
+	for _, d := range []struct {
+		key string
+		v   time.Duration
+	}{
+		{"server.read_header_timeout", readHeaderTimeout},
+		{"server.idle_timeout", idleTimeout},
+		{"server.write_timeout", writeTimeout},
+		{"server.drain_timeout", drainTimeout},
+		{"server.handoff_drain_timeout", handoffDrainTimeout},
+	} {
+		if d.v < 0 {
+			add("%s can't be negative", d.key)
+		}
+	}
+	if thumbnailOffset < 0 {
+		add("ffmpeg.thumbnail_offset can't be negative")
+	}
+	if maxUploadSize <= 0 {
+		add("uploads.max_size must be more than zero")
+	}
+	if tusLifetime <= 0 {
+		add("uploads.expire_after must be more than zero")
+	}
+	if signedURLLifetime <= 0 {
+		add("auth.url_ttl must be more than zero")
+	}
+	if sessionIdleTimeout <= 0 || sessionMaxAge <= 0 {
+		add("auth.session_idle_timeout and auth.session_max_age must be more than zero")
+	}
+	if loginUserThreshold <= 0 || loginIPThreshold <= 0 {
+		add("auth.login_user_threshold and auth.login_ip_threshold must be more than zero")
+	}
+	if trash.retention < 0 {
+		add("features.trash_retention can't be negative")
+	}
+	return problems
+}
+
+// validateListen checks the mode and the listener settings.
+func validateListen() []string {
+	var problems []string
+	add := func(format string, a ...interface{}) { problems = append(problems, fmt.Sprintf(format, a...)) }
+	if cfg.Mode != "web" && cfg.Mode != "file" && cfg.Mode != "combined" {
+		add(`mode must be "web", "file" or "combined" (or pass --web / --file / --combined)`)
+	}
+	if _, _, err := net.SplitHostPort(cfg.Addr); err != nil {
+		add("listen.addr %q: %v", cfg.Addr, err)
+	}
+	if cfg.Mode == "combined" {
+		if cfg.AdminAddr == "" {
+			add("combined mode needs listen.admin_addr for the admin UI")
+		} else if _, _, err := net.SplitHostPort(cfg.AdminAddr); err != nil {
+			add("listen.admin_addr %q: %v", cfg.AdminAddr, err)
+		} else if cfg.AdminAddr == cfg.Addr {
+			add("listen.admin_addr must differ from listen.addr")
+		}
+	} else if cfg.AdminAddr != "" {
+		add("listen.admin_addr is only used in combined mode")
+	}
+	if (tlsCertFile == "") != (tlsKeyFile == "") {
+		add("tls.cert and tls.key must be given together")
+	}
+	if tlsCertFile != "" && tlsSelfSigned {
+		add("use either tls.cert/tls.key or tls.self_signed, not both")
+	}
+	for _, f := range []string{tlsCertFile, tlsKeyFile} {
+		if f != "" {
+			if _, err := os.Stat(f); err != nil {
+				add("tls: %v", err)
+			}
+		}
+	}
+	if plainHTTPAddr != "" {
+		if !tlsEnabled() {
+			add("listen.http_addr is only used together with HTTPS")
+		} else if _, _, err := net.SplitHostPort(plainHTTPAddr); err != nil {
+			add("listen.http_addr %q: %v", plainHTTPAddr, err)
+		}
+	}
+	return problems
+}
+
+func dataPath(name string) string {
+	return filepath.Join(dataDir, name)
+}
+
+// setDataDir points the stores at dir. Versions before the data directory
+// kept the accounts in the working directory; with migrate set, a userFile
+// found there is moved over, but never onto one already in dir. Nothing
+// else is worth carrying along: sessions and failures expire, and the rest
+// came after the data directory.
+func setDataDir(dir string, migrate bool) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("data directory: %w", err)
+	}
+	dataDir = dir
+	if target := dataPath(userFile); migrate && !sameFile(userFile, target) {
+		if _, err := os.Stat(userFile); err == nil {
+			from, _ := filepath.Abs(userFile)
+			if _, err := os.Stat(target); err == nil {
+				// Never overwrite: the one in the data directory is newer
+				logFor("server").Warn("ignoring old accounts file in the working directory; the data directory already has one",
+					"file", from, "using", target)
+			} else if err := os.Rename(userFile, target); err != nil {
+				return fmt.Errorf("moving %s into %s: %w (move it by hand)", from, dir, err)
+			} else {
+				logFor("server").Warn("moved old accounts file from the working directory into the data directory", "from", from, "to", target)
+			}
+		}
+	}
+	users.path = dataPath(userFile)
+	sessions.path = dataPath(sessionFile)
+	loginGuard.path = dataPath(loginFailureFile)
+	apiTokens.path = dataPath(apiTokenFile)
+	devices.path = dataPath(deviceFile)
+	auditLog.path = dataPath(auditFile)
+	return nil
+}
+
+func sameFile(a, b string) bool {
+	aa, err1 := filepath.Abs(a)
+	bb, err2 := filepath.Abs(b)
+	return err1 == nil && err2 == nil && aa == bb
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// keepSettings puts every setting back the way it was when the test ends.
+func keepSettings(t *testing.T) {
+	t.Helper()
+	saved := make(map[*setting]string)
+	for _, s := range settings {
+		saved[s] = s.String()
+	}
+	oldConfigFile := configFile
+	t.Cleanup(func() {
+		for s, v := range saved {
+			if err := s.set(v); err != nil {
+				t.Errorf("restoring %s: %v", s.key, err)
+			}
+		}
+		configFile = oldConfigFile
+	})
+}
+
+func TestParseConfig(t *testing.T) {
+	const file = `# a comment
+mode = "web"
+
+[listen]
+addr = "0.0.0.0:8080"   # trailing comment
+admin_addr = '127.0.0.1:8081'
+
+[url]
+base_path = "/media#not-a-comment"
+trusted_proxies = ["10.0.0.0/8", '192.168.1.1', ]
+[log]
+max_files = 5
+quoted = "say \"hi\""
+`
+	entries, err := parseConfig(strings.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []configEntry{
+		{"mode", "web", 2},
+		{"listen.addr", "0.0.0.0:8080", 5},
+		{"listen.admin_addr", "127.0.0.1:8081", 6},
+		{"url.base_path", "/media#not-a-comment", 9},
+		{"url.trusted_proxies", "10.0.0.0/8,192.168.1.1", 10},
+		{"log.max_files", "5", 12},
+		{"log.quoted", `say "hi"`, 13},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("got %d entries: %v", len(entries), entries)
+	}
+	for i, e := range entries {
+		if e != want[i] {
+			t.Errorf("entry %d = %+v, want %+v", i, e, want[i])
+		}
+	}
+
+	for _, bad := range []string{
+		"[listen",
+		"addr",
+		"addr =",
+		`addr = "unterminated`,
+		"addr = 'unterminated",
+		"proxies = [\"a\",\n\"b\"]",
+		`proxies = ["a", "b]`,
+	} {
+		if _, err := parseConfig(strings.NewReader(bad)); err == nil {
+			t.Errorf("parseConfig(%q) succeeded", bad)
+		} else if !strings.HasPrefix(err.Error(), "line ") {
+			t.Errorf("parseConfig(%q) = %v, want the line number", bad, err)
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Duration
+		ok   bool
+	}{
+		{"90s", 90 * time.Second, true},
+		{"12h", 12 * time.Hour, true},
+		{"1h30m", 90 * time.Minute, true},
+		{"30d", 30 * 24 * time.Hour, true},
+		{"0", 0, true},
+		{"0d", 0, true},
+		{"d", 0, false},
+		{"1.5d", 0, false},
+		{"12", 0, false},
+		{"soon", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseDuration(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseDuration(%q) = %v, %v; want %v, ok=%v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{"500", 500, true},
+		{"500B", 500, true},
+		{"1KB", 1 << 10, true},
+		{"100mb", 100 << 20, true},
+		{"50GB", 50 << 30, true},
+		{"1.5GB", 3 << 29, true},
+		{"2 TB", 2 << 40, true},
+		{"0", 0, true},
+		{"-1GB", 0, false},
+		{"GB", 0, false},
+		{"10 apples", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseSize(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseSize(%q) = %d, %v; want %d, ok=%v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	keepSettings(t)
+	file := filepath.Join(t.TempDir(), "channelforge.toml")
+	os.WriteFile(file, []byte(`
+[listen]
+addr = "file:1"
+[log]
+level = "warn"
+format = "json"
+[auth]
+url_ttl = "2h"
+`), 0644)
+	t.Setenv("CHANNELFORGE_CONFIG", file)
+	t.Setenv("CHANNELFORGE_LISTEN_ADDR", "env:1")
+	t.Setenv("CHANNELFORGE_LOG_LEVEL", "error")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	apply := configFlags(fs)
+	if err := fs.Parse([]string{"--addr", "flag:1"}); err != nil {
+		t.Fatal(err)
+	}
+	if problems := apply(); len(problems) != 0 {
+		t.Fatal(problems)
+	}
+	for name, got := range map[string][2]string{
+		"flag over env and file": {cfg.Addr, "flag:1"},
+		"env over file":          {logLevel, "error"},
+		"file over default":      {logFormat, "json"},
+	} {
+		if got[0] != got[1] {
+			t.Errorf("%s: got %q, want %q", name, got[0], got[1])
+		}
+	}
+	if signedURLLifetime != 2*time.Hour {
+		t.Errorf("url_ttl from the file = %v", signedURLLifetime)
+	}
+	if configFile != file {
+		t.Errorf("configFile = %q, want %q from CHANNELFORGE_CONFIG", configFile, file)
+	}
+}
+
+func TestConfigProblems(t *testing.T) {
+	keepSettings(t)
+	file := filepath.Join(t.TempDir(), "channelforge.toml")
+	os.WriteFile(file, []byte("[listen]\nport = 8080\n[uploads]\nmax_size = \"lots\"\n"), 0644)
+	t.Setenv("CHANNELFORGE_LOG_MAX_FILES", "many")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	apply := configFlags(fs)
+	fs.Parse([]string{"--config", file, "--read-only=maybe"})
+	problems := strings.Join(apply(), "\n")
+	for _, want := range []string{
+		file + `:2: unknown setting "listen.port"`,
+		file + `:4: uploads.max_size: "lots" is not a size`,
+		`CHANNELFORGE_LOG_MAX_FILES: "many" is not a whole number`,
+		`--read-only: "maybe" is not true or false`,
+	} {
+		if !strings.Contains(problems, want) {
+			t.Errorf("problems lack %q:\n%s", want, problems)
+		}
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	keepSettings(t)
+	root := t.TempDir()
+	tests := []struct {
+		name   string
+		change func()
+		want   string
+	}{
+		{"missing root", func() { cfg.Root = filepath.Join(root, "nope") }, "is not a directory"},
+		{"read-only without a data dir", func() { readOnlyLibrary, cfg.DataDir = true, "" }, "library.read_only needs a data_dir outside the library"},
+		{"read-only with the data dir inside", func() { readOnlyLibrary, cfg.DataDir = true, filepath.Join(root, "data") }, "library.read_only needs a data_dir outside the library"},
+		{"upload size", func() { maxUploadSize = 0 }, "uploads.max_size must be more than zero"},
+		{"upload expiry", func() { tusLifetime = 0 }, "uploads.expire_after must be more than zero"},
+		{"link lifetime", func() { signedURLLifetime = -time.Hour }, "auth.url_ttl must be more than zero"},
+		{"session timeout", func() { sessionMaxAge = 0 }, "auth.session_idle_timeout and auth.session_max_age must be more than zero"},
+		{"login threshold", func() { loginIPThreshold = 0 }, "auth.login_user_threshold and auth.login_ip_threshold must be more than zero"},
+		{"negative timeout", func() { writeTimeout = -time.Second }, "server.write_timeout can't be negative"},
+		{"trash retention", func() { trash.retention = -time.Hour }, "features.trash_retention can't be negative"},
+		{"log files", func() { logMaxFiles = -1 }, "log.max_files can't be negative"},
+	}
+	defaults := make(map[*setting]string)
+	for _, s := range settings {
+		defaults[s] = s.String()
+	}
+	reset := func() {
+		for s, v := range defaults {
+			s.set(v)
+		}
+		cfg.Root = root
+	}
+
+	reset()
+	if problems := validateConfig(false); len(problems) != 0 {
+		t.Fatalf("defaults have problems: %v", problems)
+	}
+	for _, tt := range tests {
+		reset()
+		tt.change()
+		problems := validateConfig(false)
+		if len(problems) != 1 || !strings.Contains(problems[0], tt.want) {
+			t.Errorf("%s: problems = %q, want one with %q", tt.name, problems, tt.want)
+		}
+	}
+}
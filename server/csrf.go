@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"html/template"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+)
+
+// ==== CSRF PROTECTION ====
+//
+// Every session carries a random CSRF token. Admin pages embed it in each
+// form (csrfInput) and scripts send it as the X-CSRF-Token header;
+// requireLogin rejects state-changing requests that don't echo it back.
+
+const (
+	csrfField     = "csrf_token"
+	csrfPeekLimit = 64 << 10 // how far into a multipart body the token is looked for
+)
+
+// csrfInput goes right after the opening tag of every admin POST form.
+// It uses $ so it also works inside range blocks.
+const csrfInput = `<input type="hidden" name="` + csrfField + `" value="{{$.CSRF}}">`
+
+var csrfFailPage = template.Must(template.New("csrffail").Parse(`
+<html><head><title>Request Blocked</title>` + css + `</head><body>
+<nav>
+  <a href="/admin">Dashboard</a>
+  <a href="/logout">Logout</a>
+</nav>
+<div class="card">
+<h2>Request Blocked</h2>
+<div class="error">This form was out of date or was not sent from this site.</div>
+<p>Nothing was changed. This happens if you submit a page that was opened before
+signing in again, or if another website tried to act on your behalf.</p>
+<p>Go back, reload the page and try again.</p>
+<a href="/admin" class="btn">Back to Dashboard</a>
+</div>
+</body></html>
+`))
+
+// csrfSafeMethod reports whether a request method cannot change anything.
+func csrfSafeMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+	return false
+}
+
+// csrfTokenFor returns the CSRF token of the request's session.
+func csrfTokenFor(r *http.Request) string {
+	if sess := currentSession(r); sess != nil {
+		return sess.CSRF
+	}
+	return ""
+}
+
+// validCSRF checks the header first so streamed uploads can be verified
+// without reading their body.
+func validCSRF(r *http.Request, expected string) bool {
+	got := r.Header.Get("X-CSRF-Token")
+	if got == "" && isMultipart(r) {
+		got = multipartCSRF(r)
+	} else if got == "" {
+		got = r.PostFormValue(csrfField)
+	}
+	return expected != "" && subtle.ConstantTimeCompare([]byte(got), []byte(expected)) == 1
+}
+
+// multipartCSRF reads the token from the first part of a multipart form,
+// where csrfInput puts it, and then puts back what it read. Parsing the
+// whole form here would buffer uploads before the handler can limit their
+// size or stream them.
+func multipartCSRF(r *http.Request) string {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || params["boundary"] == "" {
+		return ""
+	}
+	var seen bytes.Buffer
+	mr := multipart.NewReader(io.TeeReader(io.LimitReader(r.Body, csrfPeekLimit), &seen), params["boundary"])
+	token := ""
+	if p, err := mr.NextPart(); err == nil && p.FormName() == csrfField {
+		b, _ := io.ReadAll(io.LimitReader(p, 256))
+		token = string(b)
+	}
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(&seen, r.Body), r.Body}
+	return token
+}
+
+func csrfFailed(w http.ResponseWriter, r *http.Request) {
+	logFor("auth").WarnContext(r.Context(), "blocked request with missing or invalid CSRF token",
+		"method", r.Method, "path", r.URL.Path, "client_ip", clientIP(r))
+	w.WriteHeader(http.StatusForbidden)
+	csrfFailPage.Execute(w, nil)
+}
+
+// renderPage executes an admin template with the CSRF token added to data.
+func renderPage(w http.ResponseWriter, r *http.Request, t *template.Template, data map[string]interface{}) {
+	if data == nil {
+		data = make(map[string]interface{})
+	}
+	data["CSRF"] = csrfTokenFor(r)
+	data["BasePath"] = requestPrefix(r) // for scripts; links in attributes are rewritten by prefixWriter
+	if err := t.Execute(w, data); err != nil {
+		logFor("server").ErrorContext(r.Context(), "template failed", "template", t.Name(), "err", err)
+	}
+}
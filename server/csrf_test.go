@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestMultipartCSRF(t *testing.T) {
+	const token = "the-token"
+	video := strings.Repeat("v", 100<<10)
+	tests := []struct {
+		name  string
+		parts []formPart
+		ok    bool
+	}{
+		{"token first", []formPart{{name: csrfField, body: token}, {name: "video", filename: "a.mp4", body: video}}, true},
+		{"wrong token", []formPart{{name: csrfField, body: "other"}, {name: "video", filename: "a.mp4", body: video}}, false},
+		{"token after the file", []formPart{{name: "video", filename: "a.mp4", body: "small"}, {name: csrfField, body: token}}, false},
+		{"first part over the peek limit", []formPart{{name: "notes", body: video}, {name: csrfField, body: token}}, false},
+		{"part headers over the peek limit", []formPart{{name: csrfField + video, body: token}}, false},
+		{"token over the peek limit", []formPart{{name: csrfField, body: token + video}}, false},
+		{"no token", []formPart{{name: "video", filename: "a.mp4", body: video}}, false},
+	}
+	for _, tt := range tests {
+		body, ct := multipartBody(t, tt.parts)
+		src := bytes.NewReader(body)
+		r := httptest.NewRequest("POST", "/admin/cat/Movies/upload", src)
+		r.Header.Set("Content-Type", ct)
+		if got := validCSRF(r, token); got != tt.ok {
+			t.Errorf("%s: validCSRF = %v, want %v", tt.name, got, tt.ok)
+		}
+		if read := len(body) - src.Len(); read > csrfPeekLimit {
+			t.Errorf("%s: the check read %d bytes of the body", tt.name, read)
+		}
+
+		// The handler still gets the whole body
+		rest, err := io.ReadAll(r.Body)
+		if err != nil || !bytes.Equal(rest, body) {
+			t.Errorf("%s: body changed after the check (%d of %d bytes, %v)", tt.name, len(rest), len(body), err)
+		}
+	}
+}
+
+func TestMultipartCSRFLeavesFormParseable(t *testing.T) {
+	body, ct := multipartBody(t, []formPart{
+		{name: csrfField, body: "the-token"},
+		{name: "moviename", body: "Film"},
+		{name: "video", filename: "a.mp4", body: "video"},
+	})
+	r := httptest.NewRequest("POST", "/admin/cat/Movies/upload", bytes.NewReader(body))
+	r.Header.Set("Content-Type", ct)
+	if !validCSRF(r, "the-token") {
+		t.Fatal("token in the first part was refused")
+	}
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		t.Fatal(err)
+	}
+	if r.FormValue("moviename") != "Film" || r.FormValue(csrfField) != "the-token" {
+		t.Errorf("form values after the check: %v", r.MultipartForm.Value)
+	}
+	f, _, err := r.FormFile("video")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(f); string(b) != "video" {
+		t.Errorf("file after the check holds %q", b)
+	}
+}
+
+func TestValidCSRF(t *testing.T) {
+	form := func(v url.Values) *http.Request {
+		r := httptest.NewRequest("POST", "/admin/users", strings.NewReader(v.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return r
+	}
+	if !validCSRF(form(url.Values{csrfField: {"t"}}), "t") {
+		t.Error("form field refused")
+	}
+	if validCSRF(form(url.Values{csrfField: {"u"}}), "t") {
+		t.Error("wrong form field accepted")
+	}
+	r := form(url.Values{csrfField: {"u"}})
+	r.Header.Set("X-CSRF-Token", "t")
+	if !validCSRF(r, "t") {
+		t.Error("header refused")
+	}
+	if validCSRF(form(url.Values{csrfField: {""}}), "") {
+		t.Error("empty token accepted for a session without one")
+	}
+}
+
+func TestRequireLoginChecksCSRF(t *testing.T) {
+	s := newTestServer(t)
+	send := func(parts []formPart) int {
+		body, ct := multipartBody(t, parts)
+		r := httptest.NewRequest("POST", "/admin/cat/Movies/upload", bytes.NewReader(body))
+		r.Header.Set("Content-Type", ct)
+		r.AddCookie(s.cookie)
+		w := httptest.NewRecorder()
+		requireLogin(catRouter(s.root))(w, r)
+		return w.Code
+	}
+	if code := send([]formPart{{name: "moviename", body: "Evil"}, {name: csrfField, body: s.csrf}}); code != http.StatusForbidden {
+		t.Errorf("token after another part: got %d, want 403", code)
+	}
+	if code := send([]formPart{{name: csrfField, body: s.csrf}, {name: "moviename", body: "New"}}); code == http.StatusForbidden {
+		t.Error("token in the first part: got 403")
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ==== DEVICE KEYS ====
+//
+// With feed authentication on, which activation implies, /feed.xml only
+// answers devices that present one of these keys, either as ?key= on the
+// feed URL or in the X-Device-Key header. Keys are created by hand on the
+// devices page or with `server device add`, or handed out through activation
+// (pairing.go). Only hashes of the keys are stored.
+
+const deviceFile = "devices.json"
+
+var feedKeyRequired bool
+
+type device struct {
+	ID       string    `json:"id"` // short public identifier
+	Name     string    `json:"name"`
+	Created  time.Time `json:"created"`
+	LastSeen time.Time `json:"last_seen,omitempty"`
+	LastIP   string    `json:"last_ip,omitempty"`
+}
+
+type deviceStore struct {
+	mu     sync.Mutex
+	path   string
+	byHash map[string]*device
+}
+
+var devices = &deviceStore{path: deviceFile, byHash: make(map[string]*device)}
+
+func (s *deviceStore) load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	byHash := make(map[string]*device)
+	if err := json.Unmarshal(b, &byHash); err != nil {
+		return err
+	}
+	s.byHash = byHash
+	return nil
+}
+
+func (s *deviceStore) saveLocked() {
+	if !storeWritable() {
+		return
+	}
+	b, err := json.MarshalIndent(s.byHash, "", "  ")
+	if err == nil {
+		tmp := s.path + ".tmp"
+		if err = os.WriteFile(tmp, b, 0600); err == nil {
+			err = os.Rename(tmp, s.path)
+		}
+	}
+	if err != nil {
+		logFor("devices").Error("failed to save devices", "err", err)
+	}
+}
+
+// create registers a device and returns its key, which is only shown once.
+func (s *deviceStore) create(name string) string {
+	key := newSessionToken()
+	h := hashToken(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byHash[h] = &device{ID: h[:16], Name: name, Created: time.Now()}
+	s.saveLocked()
+	return key
+}
+
+// lookup returns a copy of the device owning key and records the visit.
+func (s *deviceStore) lookup(key string, r *http.Request) *device {
+	if key == "" {
+		return nil
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.byHash[hashToken(key)]
+	if !ok {
+		return nil
+	}
+	if ip := clientIP(r); now.Sub(d.LastSeen) > time.Minute || d.LastIP != ip {
+		d.LastSeen, d.LastIP = now, ip
+		s.saveLocked()
+	}
+	c := *d
+	return &c
+}
+
+func (s *deviceStore) revoke(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for h, d := range s.byHash {
+		if d.ID == id {
+			delete(s.byHash, h)
+			s.saveLocked()
+			return true
+		}
+	}
+	return false
+}
+
+func (s *deviceStore) rename(id, name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range s.byHash {
+		if d.ID == id {
+			d.Name = name
+			s.saveLocked()
+			return true
+		}
+	}
+	return false
+}
+
+// get returns a copy of the device with the given ID, or nil.
+func (s *deviceStore) get(id string) *device {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range s.byHash {
+		if d.ID == id {
+			c := *d
+			return &c
+		}
+	}
+	return nil
+}
+
+func (s *deviceStore) list() []device {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []device
+	for _, d := range s.byHash {
+		out = append(out, *d)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Created.Before(out[j].Created) })
+	return out
+}
+
+// loadFeedAuth prepares device keys and URL signing for either server mode.
+func loadFeedAuth() {
+	if err := devices.load(); err != nil {
+		fatal("devices", "failed to load devices", "err", err)
+	}
+	if feedKeyRequired && cfg.Mode == "file" && len(devices.list()) == 0 {
+		logFor("devices").Warn("feed authentication is on but no devices have keys; stop the server, add one with `server device add NAME` and start it again")
+	}
+	if signContentURLs {
+		if err := loadURLSecret(); err != nil {
+			fatal("devices", "failed to load URL signing key", "err", err)
+		}
+	}
+}
+
+// deviceKey returns the key a feed request was made with.
+func deviceKey(r *http.Request) string {
+	if k := r.Header.Get("X-Device-Key"); k != "" {
+		return k
+	}
+	return r.URL.Query().Get("key")
+}
+
+// requireDeviceKey guards the feed when feed authentication is on.
+func requireDeviceKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if feedKeyRequired && devices.lookup(deviceKey(r), r) == nil {
+			logFor("devices").WarnContext(r.Context(), "refused feed request with missing or unknown device key", "client_ip", clientIP(r))
+			http.Error(w, "Unauthorized: device key required", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+var devicesPage = template.Must(template.New("devices").Parse(`
+<html><head><title>Devices - Admin</title>` + css + `</head><body>
+<nav>
+  <a href="/admin">Dashboard</a>
+  <a href="/admin/users">Users</a>
+  <a href="/logout">Logout</a>
+</nav>
+<div class="card">
+<h2>Devices</h2>
+{{if .Required}}
+  <p>Feed authentication is <b>on</b>: only the devices below can load the feed.</p>
+{{else}}
+  <p>Feed authentication is off, so any device can load the feed. Start the server with
+  <code>--feed-auth</code>, or turn on <code>features.activation</code>, to require activated devices.</p>
+{{end}}
+{{if .Error}}<div class="error">{{.Error}}</div>{{end}}
+{{if .Message}}<p>{{.Message}}</p>{{end}}
+{{if .Activation}}
+<h3 id="activate">Activate a Device</h3>
+<p>Enter the code shown on the TV.</p>
+<form method="POST" action="/admin/devices">` + csrfInput + `
+  <input type="hidden" name="action" value="approve">
+  <label>Code <input name="code" required autocomplete="off" placeholder="ABCD-EFGH" value="{{.Code}}"></label>
+  <label>Name <input name="name" placeholder="e.g. Bedroom Roku"></label>
+  <button type="submit">Activate</button>
+</form>
+{{if .Pending}}
+  <p>Waiting for approval:</p>
+  <table>
+    <tr><th>Code</th><th>Device</th><th>Address</th><th>Requested</th><th></th></tr>
+    {{range .Pending}}
+      <tr>
+        <td>{{.Code}}</td>
+        <td>{{.Model}}</td>
+        <td>{{.IP}}</td>
+        <td>{{.Created.Format "15:04:05"}}</td>
+        <td>
+          <form method="POST" action="/admin/devices" style="display:inline">` + csrfInput + `
+            <input type="hidden" name="action" value="deny">
+            <input type="hidden" name="code" value="{{.Code}}">
+            <button type="submit" class="btn">Deny</button>
+          </form>
+        </td>
+      </tr>
+    {{end}}
+  </table>
+{{end}}
+{{end}}
+{{if .NewKey}}
+  <p>Key for <b>{{.NewName}}</b>. Copy it now; it won't be shown again. Point the device at:</p>
+  <p><code>{{.FeedURL}}</code></p>
+{{end}}
+{{if .Devices}}
+  <table>
+    <tr><th>Name</th><th>Added</th><th>Last Seen</th><th>Address</th><th></th></tr>
+    {{range .Devices}}
+      <tr>
+        <td>
+          <form method="POST" action="/admin/devices" style="display:inline">` + csrfInput + `
+            <input type="hidden" name="action" value="rename">
+            <input type="hidden" name="id" value="{{.ID}}">
+            <input name="name" value="{{.Name}}" required style="width:auto;margin:0">
+            <button type="submit" class="btn">Rename</button>
+          </form>
+        </td>
+        <td>{{.Created.Format "2006-01-02"}}</td>
+        <td>{{if .LastSeen.IsZero}}Never{{else}}{{.LastSeen.Format "2006-01-02 15:04"}}{{end}}</td>
+        <td>{{.LastIP}}</td>
+        <td>
+          <form method="POST" action="/admin/devices" style="display:inline">` + csrfInput + `
+            <input type="hidden" name="action" value="revoke">
+            <input type="hidden" name="id" value="{{.ID}}">
+            <button type="submit" class="btn" onclick="return confirm('Revoke {{.Name}}?')">Revoke</button>
+          </form>
+        </td>
+      </tr>
+    {{end}}
+  </table>
+{{else}}
+  <p>No devices yet.</p>
+{{end}}
+<h3>Add Device by Key</h3>
+<p>For devices that can't show an activation code, create a key and put it in the feed URL.</p>
+<form method="POST" action="/admin/devices">` + csrfInput + `
+  <input type="hidden" name="action" value="add">
+  <label>Name <input name="name" required placeholder="e.g. Living Room Roku"></label>
+  <button type="submit">Create Key</button>
+</form>
+</div>
+</body></html>
+`))
+
+func devicesHandler(w http.ResponseWriter, r *http.Request) {
+	data := map[string]interface{}{"Required": feedKeyRequired, "Activation": cfg.Activation, "Code": r.URL.Query().Get("code")}
+	switch r.Method {
+	case "GET":
+	case "POST":
+		switch r.FormValue("action") {
+		case "approve":
+			if err := approveActivation(r.FormValue("code"), strings.TrimSpace(r.FormValue("name"))); err != nil {
+				data["Error"] = "Could not activate: " + err.Error()
+			} else {
+				audit(r, "device-activate", "code:"+normalizeCode(r.FormValue("code")), nil, nil)
+				data["Message"] = "Device activated. It will load the feed within a few seconds."
+			}
+		case "deny":
+			denyActivation(r.FormValue("code"))
+		case "rename":
+			id := r.FormValue("id")
+			name := strings.TrimSpace(r.FormValue("name"))
+			before := devices.get(id)
+			if name == "" || !devices.rename(id, name) {
+				data["Error"] = "Could not rename device"
+				break
+			}
+			audit(r, "device-rename", "device:"+id, map[string]string{"name": before.Name}, map[string]string{"name": name})
+		case "add":
+			name := strings.TrimSpace(r.FormValue("name"))
+			if name == "" {
+				data["Error"] = "Name is required"
+				break
+			}
+			key := devices.create(name)
+			audit(r, "device-add", "device:"+hashToken(key)[:16], nil, map[string]string{"name": name})
+			data["NewKey"] = key
+			data["NewName"] = name
+			data["FeedURL"] = publicURL(r) + "/feed.xml?key=" + url.QueryEscape(key)
+		case "revoke":
+			id := r.FormValue("id")
+			before := devices.get(id)
+			if !devices.revoke(id) {
+				data["Error"] = "Device not found"
+				break
+			}
+			audit(r, "device-revoke", "device:"+id, before, nil)
+		default:
+			data["Error"] = "Unknown action"
+		}
+	default:
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	data["Devices"] = devices.list()
+	data["Pending"] = pendingActivations()
+	renderPage(w, r, devicesPage, data)
+}
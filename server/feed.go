@@ -7,14 +7,16 @@ import (
 	"image/color"
 	"image/draw"
 	"image/jpeg"
-	"log"
+	"io"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // XML structures
@@ -66,33 +68,55 @@ type Video struct {
 }
 
 func ServeFeedFromDir(root, addr string) {
-	http.HandleFunc("/feed.xml", func(w http.ResponseWriter, r *http.Request) {
-		feed, err := BuildFeed(root, r.Host)
+	loadFeedAuth()
+	http.Handle("/feed.xml", feedHandler(root))
+	http.Handle("/content/", contentHandler(root))
+	registerHealth(root)
+	registerMetrics(true)
+	logFor("server").Info("serving feed", "url", listenScheme()+"://"+addr+"/feed.xml")
+	serve(addr)
+}
+
+// feedHandler serves the Roku feed built from root.
+func feedHandler(root string) http.Handler {
+	return requireDeviceKey(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		feed, err := BuildFeed(root, baseURL(r))
+		recordFeedBuild(start, feed, err)
 		if err != nil {
 			http.Error(w, "Feed error: "+err.Error(), 500)
 			return
 		}
 		w.Header().Set("Content-Type", "application/xml")
-		enc := xml.NewEncoder(w)
-		enc.Indent("", "  ")
-		if err := enc.Encode(feed); err != nil {
-			log.Println("XML encode error:", err)
+		if err := writeFeedXML(w, feed); err != nil {
+			logFor("feed").ErrorContext(r.Context(), "XML encode failed", "err", err)
 		}
-	})
+	}))
+}
 
-	http.Handle("/content/", http.StripPrefix("/content/", http.FileServer(http.Dir(root))))
-	fmt.Printf("Serving feed and static files at http://%s/feed.xml\n", addr)
-	log.Fatal(http.ListenAndServe(addr, nil))
+// feedFormats are the ways a feed can be written out, by name.
+var feedFormats = map[string]func(io.Writer, *Feed) error{
+	"xml": writeFeedXML,
 }
 
-func BuildFeed(root, host string) (*Feed, error) {
+func writeFeedXML(w io.Writer, feed *Feed) error {
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(feed); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func BuildFeed(root, base string) (*Feed, error) {
 	cats, err := os.ReadDir(root)
 	if err != nil {
 		return nil, err
 	}
 	var feed Feed
 	for _, c := range cats {
-		if !c.IsDir() {
+		if !c.IsDir() || isHiddenName(c.Name()) {
 			continue
 		}
 		catName := c.Name()
@@ -105,9 +129,9 @@ func BuildFeed(root, host string) (*Feed, error) {
 				if !sub.IsDir() {
 					continue
 				}
-				item, err := buildMovieItem(filepath.Join(catPath, sub.Name()), host, catName, sub.Name())
+				item, err := buildMovieItem(filepath.Join(catPath, sub.Name()), base, catName, sub.Name())
 				if err != nil {
-					log.Println("Skipping movie:", sub.Name(), err)
+					logFor("feed").Warn("skipping movie", "name", sub.Name(), "err", err)
 					continue
 				}
 				items = append(items, item)
@@ -127,7 +151,7 @@ func BuildFeed(root, host string) (*Feed, error) {
 				sName := sdir.Name()
 				sPath := filepath.Join(catPath, sName)
 				var shortDesc, longDesc, thumbUrl string
-				loadDescAndThumbOrCreate(sPath, host, catName, sName, &shortDesc, &longDesc, &thumbUrl)
+				loadDescAndThumbOrCreate(sPath, base, []string{catName, sName}, sName, &shortDesc, &longDesc, &thumbUrl)
 				seasonDirs, _ := os.ReadDir(sPath)
 				var seasons []Season
 				for _, sedir := range seasonDirs {
@@ -137,10 +161,10 @@ func BuildFeed(root, host string) (*Feed, error) {
 					seasonName := sedir.Name()
 					seasonPath := filepath.Join(sPath, seasonName)
 					var sShort, sLong, sThumb string
-					loadDescAndThumbOrCreate(seasonPath, host, catName, sName+" "+seasonName, &sShort, &sLong, &sThumb)
-					eps, err := buildEpisodeItems(seasonPath, host, catName, sName, seasonName)
+					loadDescAndThumbOrCreate(seasonPath, base, []string{catName, sName, seasonName}, sName+" "+seasonName, &sShort, &sLong, &sThumb)
+					eps, err := buildEpisodeItems(seasonPath, base, catName, sName, seasonName)
 					if err != nil {
-						log.Println("Skipping season:", seasonName, err)
+						logFor("feed").Warn("skipping season", "series", sName, "season", seasonName, "err", err)
 						continue
 					}
 					seasons = append(seasons, Season{
@@ -170,13 +194,20 @@ func BuildFeed(root, host string) (*Feed, error) {
 
 // Helper: extract a frame from video and save as a JPEG
 func extractFrameAsJPG(videoPath, jpgPath string) error {
-	// Example: extract frame at 10 seconds (adjust as needed)
-	cmd := exec.Command("ffmpeg", "-y", "-ss", "10", "-i", videoPath, "-vframes", "1", "-q:v", "2", jpgPath)
-	return cmd.Run()
+	offset := strconv.FormatFloat(thumbnailOffset.Seconds(), 'f', -1, 64)
+	// Renamed into place once done, so a run killed half way leaves nothing.
+	// Being hidden, the file isn't taken for artwork meanwhile.
+	tmp := filepath.Join(filepath.Dir(jpgPath), "."+filepath.Base(jpgPath)+".part.jpg")
+	cmd := exec.Command(ffmpegPath, "-y", "-ss", offset, "-i", videoPath, "-vframes", "1", "-q:v", "2", tmp)
+	if _, err := runTool("ffmpeg", cmd); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, jpgPath)
 }
 
 // For Movies: each movie is a subfolder with media files inside
-func buildMovieItem(moviePath, host, category, movieName string) (Item, error) {
+func buildMovieItem(moviePath, base, category, movieName string) (Item, error) {
 	var item Item
 	var shortDesc, longDesc, videoFile, thumbFile string
 
@@ -186,6 +217,9 @@ func buildMovieItem(moviePath, host, category, movieName string) (Item, error) {
 	}
 	for _, f := range files {
 		name := f.Name()
+		if isHiddenName(name) {
+			continue // e.g. a thumbnail ffmpeg is still writing
+		}
 		lower := strings.ToLower(name)
 		fullPath := filepath.Join(moviePath, name)
 		switch {
@@ -210,23 +244,24 @@ func buildMovieItem(moviePath, host, category, movieName string) (Item, error) {
 	}
 
 	// If thumbFile doesn't exist, create one from video
+	segments := []string{category, movieName}
 	if thumbFile == "" && videoFile != "" {
 		thumbFile = "thumb.jpg"
-		thumbPath := filepath.Join(moviePath, thumbFile)
 		videoPath := filepath.Join(moviePath, videoFile)
-		_ = extractFrameAsJPG(videoPath, thumbPath)
+		_ = generate(moviePath, segments, thumbFile, videoPath, func(thumbPath string) error {
+			return extractFrameAsJPG(videoPath, thumbPath)
+		})
 	}
 
 	// If desc.txt doesn't exist, create one
 	if shortDesc == "" && longDesc == "" {
 		shortDesc = movieName
 		longDesc = movieName
-		descPath := filepath.Join(moviePath, "desc.txt")
-		_ = os.WriteFile(descPath, []byte(shortDesc+"\n"+longDesc), 0644)
+		_ = generate(moviePath, segments, "desc.txt", "", func(descPath string) error {
+			return os.WriteFile(descPath, []byte(shortDesc+"\n"+longDesc), 0644)
+		})
 	}
 
-	vidPath := encodeContentPath(category, movieName, videoFile)
-	thumbPath := encodeContentPath(category, movieName, thumbFile)
 
 	releaseDate := "1900-01-01"
 	fi, err := os.Stat(filepath.Join(moviePath, videoFile))
@@ -241,11 +276,11 @@ func buildMovieItem(moviePath, host, category, movieName string) (Item, error) {
 		Title:     strings.TrimSuffix(videoFile, filepath.Ext(videoFile)),
 		ShortDesc: shortDesc,
 		LongDesc:  longDesc,
-		Thumbnail: "http://" + host + "/content/" + thumbPath,
+		Thumbnail: contentURL(base, category, movieName, thumbFile),
 		ReleaseDate: releaseDate,
 		Content: VideoWrap{
 			Video: Video{
-				URL:          "http://" + host + "/content/" + vidPath,
+				URL:          contentURL(base, category, movieName, videoFile),
 				Quality:      "HD",
 				StreamFormat: "mp4",
 				Duration:     duration,
@@ -256,7 +291,7 @@ func buildMovieItem(moviePath, host, category, movieName string) (Item, error) {
 }
 
 // For TV shows: each episode is a subfolder inside a season
-func buildEpisodeItems(seasonPath, host, category, series, season string) ([]Item, error) {
+func buildEpisodeItems(seasonPath, base, category, series, season string) ([]Item, error) {
 	entries, err := os.ReadDir(seasonPath)
 	if err != nil {
 		return nil, err
@@ -264,11 +299,11 @@ func buildEpisodeItems(seasonPath, host, category, series, season string) ([]Ite
 	var items []Item
 	for _, entry := range entries {
 		if entry.IsDir() {
-			item, err := buildEpisodeItem(filepath.Join(seasonPath, entry.Name()), host, category, series, season, entry.Name())
+			item, err := buildEpisodeItem(filepath.Join(seasonPath, entry.Name()), base, category, series, season, entry.Name())
 			if err == nil {
 				items = append(items, item)
 			} else {
-				log.Println("Skipping episode:", entry.Name(), err)
+				logFor("feed").Warn("skipping episode", "name", entry.Name(), "err", err)
 			}
 		}
 	}
@@ -276,7 +311,7 @@ func buildEpisodeItems(seasonPath, host, category, series, season string) ([]Ite
 }
 
 // For nested episode folders (TV shows)
-func buildEpisodeItem(path, host, category, series, season, episode string) (Item, error) {
+func buildEpisodeItem(path, base, category, series, season, episode string) (Item, error) {
 	var item Item
 	var shortDesc, longDesc, videoFile, thumbFile string
 
@@ -286,6 +321,9 @@ func buildEpisodeItem(path, host, category, series, season, episode string) (Ite
 	}
 	for _, f := range files {
 		name := f.Name()
+		if isHiddenName(name) {
+			continue
+		}
 		lower := strings.ToLower(name)
 		fullPath := filepath.Join(path, name)
 		switch {
@@ -310,23 +348,24 @@ func buildEpisodeItem(path, host, category, series, season, episode string) (Ite
 	}
 
 	// If thumbFile doesn't exist, create one from video
+	segments := []string{category, series, season, episode}
 	if thumbFile == "" && videoFile != "" {
 		thumbFile = "thumb.jpg"
-		thumbPath := filepath.Join(path, thumbFile)
 		videoPath := filepath.Join(path, videoFile)
-		_ = extractFrameAsJPG(videoPath, thumbPath)
+		_ = generate(path, segments, thumbFile, videoPath, func(thumbPath string) error {
+			return extractFrameAsJPG(videoPath, thumbPath)
+		})
 	}
 
 	// If desc.txt doesn't exist, create one
 	if shortDesc == "" && longDesc == "" {
 		shortDesc = episode
 		longDesc = episode
-		descPath := filepath.Join(path, "desc.txt")
-		_ = os.WriteFile(descPath, []byte(shortDesc+"\n"+longDesc), 0644)
+		_ = generate(path, segments, "desc.txt", "", func(descPath string) error {
+			return os.WriteFile(descPath, []byte(shortDesc+"\n"+longDesc), 0644)
+		})
 	}
 
-	vidPath := encodeContentPath(category, series, season, episode, videoFile)
-	thumbPath := encodeContentPath(category, series, season, episode, thumbFile)
 
 	releaseDate := "1900-01-01"
 	fi, err := os.Stat(filepath.Join(path, videoFile))
@@ -341,11 +380,11 @@ func buildEpisodeItem(path, host, category, series, season, episode string) (Ite
 		Title:     strings.TrimSuffix(videoFile, filepath.Ext(videoFile)),
 		ShortDesc: shortDesc,
 		LongDesc:  longDesc,
-		Thumbnail: "http://" + host + "/content/" + thumbPath,
+		Thumbnail: contentURL(base, category, series, season, episode, thumbFile),
 		ReleaseDate: releaseDate,
 		Content: VideoWrap{
 			Video: Video{
-				URL:          "http://" + host + "/content/" + vidPath,
+				URL:          contentURL(base, category, series, season, episode, videoFile),
 				Quality:      "HD",
 				StreamFormat: "mp4",
 				Duration:     duration,
@@ -358,16 +397,18 @@ func buildEpisodeItem(path, host, category, series, season, episode string) (Ite
 // Loads description (.txt) and thumbnail (.jpg/.png) at the given path, for a series or season.
 // If the files do not exist, create them with defaults matching the name.
 // For series/seasons, if no video is present, makes a default color JPEG.
-func loadDescAndThumbOrCreate(basePath, host, category, name string, shortDesc *string, longDesc *string, thumbUrl *string) {
+// segments is the folder's path under /content/.
+func loadDescAndThumbOrCreate(basePath, base string, segments []string, name string, shortDesc *string, longDesc *string, thumbUrl *string) {
 	files, err := os.ReadDir(basePath)
 	if err != nil {
-		// Try to create the directory if missing
-		_ = os.MkdirAll(basePath, 0755)
 		files = []os.DirEntry{}
 	}
 
 	var descFile, thumbFile, videoFile string
 	for _, f := range files {
+		if isHiddenName(f.Name()) {
+			continue
+		}
 		lower := strings.ToLower(f.Name())
 		if strings.HasSuffix(lower, ".txt") && (strings.Contains(lower, strings.ToLower(name)) || descFile == "") {
 			descFile = f.Name()
@@ -381,10 +422,11 @@ func loadDescAndThumbOrCreate(basePath, host, category, name string, shortDesc *
 	// If desc.txt doesn't exist, create it
 	if descFile == "" {
 		descFile = "desc.txt"
-		descPath := filepath.Join(basePath, descFile)
 		*shortDesc = name
 		*longDesc = name
-		_ = os.WriteFile(descPath, []byte(name+"\n"+name), 0644)
+		_ = generate(basePath, segments, descFile, "", func(descPath string) error {
+			return os.WriteFile(descPath, []byte(name+"\n"+name), 0644)
+		})
 	} else {
 		b, err := os.ReadFile(filepath.Join(basePath, descFile))
 		if err == nil {
@@ -398,16 +440,19 @@ func loadDescAndThumbOrCreate(basePath, host, category, name string, shortDesc *
 	// If thumb does not exist, create it (try to use a video frame, else make a default color jpg)
 	if thumbFile == "" {
 		thumbFile = "thumb.jpg"
-		thumbPath := filepath.Join(basePath, thumbFile)
+		videoPath := ""
 		if videoFile != "" {
-			videoPath := filepath.Join(basePath, videoFile)
-			_ = extractFrameAsJPG(videoPath, thumbPath)
-		} else {
-			createDefaultJPG(thumbPath, name)
+			videoPath = filepath.Join(basePath, videoFile)
 		}
+		_ = generate(basePath, segments, thumbFile, videoPath, func(thumbPath string) error {
+			if videoPath != "" {
+				return extractFrameAsJPG(videoPath, thumbPath)
+			}
+			createDefaultJPG(thumbPath, name)
+			return nil
+		})
 	}
-	segments := []string{category, name, thumbFile}
-	*thumbUrl = "http://" + host + "/content/" + encodeContentPath(segments...)
+	*thumbUrl = contentURL(base, append(segments, thumbFile)...)
 }
 
 // encodeContentPath encodes each path segment for a valid URL path, used under /content/
@@ -420,17 +465,17 @@ func encodeContentPath(segments ...string) string {
 
 // probeDuration returns the video duration in seconds if ffprobe is available, else 0.
 func probeDuration(videoPath string) int {
-	cmd := exec.Command("ffprobe", "-v", "error", "-show_entries", "format=duration", "-of",
+	cmd := exec.Command(ffprobePath, "-v", "error", "-show_entries", "format=duration", "-of",
 		"default=noprint_wrappers=1:nokey=1", videoPath)
-	output, err := cmd.Output()
+	output, err := runTool("ffprobe", cmd)
 	if err != nil {
-		log.Printf("Warning: Could not probe duration for %s: %v", videoPath, err)
+		logFor("tools").Warn("could not probe duration", "video", videoPath, "err", err)
 		return 0
 	}
 	str := strings.TrimSpace(string(output))
 	dur, err := strconv.ParseFloat(str, 64)
 	if err != nil {
-		log.Printf("Warning: Could not parse ffprobe output for %s: %v", videoPath, err)
+		logFor("tools").Warn("could not parse ffprobe output", "video", videoPath, "err", err)
 		return 0
 	}
 	return int(dur + 0.5)
@@ -450,8 +495,53 @@ func dirHasVideo(dir string) bool {
 	return false
 }
 
-// Utility for removing a directory tree (used in admin UI for delete actions)
+// isHiddenName reports whether a directory entry is internal to the server
+// (upload staging and similar) and must never show up in feeds or listings.
+func isHiddenName(name string) bool {
+	return strings.HasPrefix(name, ".")
+}
+
+// contentHandler serves the library under /content/, refusing any path that
+// reaches into a hidden directory.
+func contentHandler(root string) http.Handler {
+	fs := http.StripPrefix("/content/", http.FileServer(http.Dir(root)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rel := strings.TrimPrefix(path.Clean(r.URL.Path), "/content/")
+		for _, seg := range strings.Split(rel, "/") {
+			if isHiddenName(seg) {
+				http.NotFound(w, r)
+				return
+			}
+		}
+		// Activated devices may also fetch content with their key
+		if signContentURLs && !validContentSignature(r) && devices.lookup(r.Header.Get("X-Device-Key"), r) == nil {
+			http.Error(w, "Forbidden: invalid or expired link", http.StatusForbidden)
+			return
+		}
+		// Symlinks inside the library must not lead out of it
+		if err := checkInsideRoot(root, filepath.Join(root, filepath.FromSlash(rel))); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		cw := &countingWriter{ResponseWriter: w}
+		defer func() { contentBytes.add(float64(cw.n)) }()
+		if strings.HasSuffix(strings.ToLower(rel), ".mp4") {
+			activeStreams.add(1)
+			defer activeStreams.add(-1)
+		}
+		if serveCached(cw, r, root, rel) {
+			return
+		}
+		fs.ServeHTTP(cw, r)
+	})
+}
+
+// Utility for removing a directory tree (used in admin UI for delete actions).
+// With the trash set up the tree is moved there instead.
 func removeTree(path string) error {
+	if trash.root != "" {
+		return trash.put(path)
+	}
 	return os.RemoveAll(path)
 }
 
@@ -0,0 +1,25 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+const handoffSupported = false
+
+func listenOn(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+func handoffDone() {}
+
+func handoffSignals() []os.Signal { return nil }
+
+func isHandoffSignal(sig os.Signal) bool { return false }
+
+func handoff(running []*runningServer) error {
+	return errors.New("not supported on this system")
+}
@@ -0,0 +1,149 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// Set for the new process on SIGHUP: the addresses of the listeners
+	// passed as fd 3 onwards, and the fd to report it is serving on.
+	listenFDsEnv = configEnvPrefix + "LISTEN_FDS"
+	readyFDEnv   = configEnvPrefix + "READY_FD"
+
+	handoffSupported = true
+)
+
+// inherited are the listeners handed over by the previous process, by
+// address, until listenOn claims them.
+var inherited = inheritedListeners()
+
+func inheritedListeners() map[string]*os.File {
+	out := make(map[string]*os.File)
+	v := os.Getenv(listenFDsEnv)
+	if v == "" {
+		return out
+	}
+	for i, addr := range strings.Split(v, ",") {
+		out[addr] = os.NewFile(uintptr(3+i), addr)
+	}
+	return out
+}
+
+// listenOn returns the listener the previous process handed over for
+// addr, or a new one.
+func listenOn(addr string) (net.Listener, error) {
+	if f, ok := inherited[addr]; ok {
+		delete(inherited, addr)
+		defer f.Close()
+		return net.FileListener(f)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// handoffDone tells the previous process, if there is one, that we're
+// serving, and lets go of listeners it passed that we no longer use.
+func handoffDone() {
+	for _, f := range inherited {
+		f.Close()
+	}
+	inherited = nil
+	fd, err := strconv.Atoi(os.Getenv(readyFDEnv))
+	if err != nil {
+		return
+	}
+	f := os.NewFile(uintptr(fd), "ready")
+	f.Write([]byte{1})
+	f.Close()
+	logFor("server").Info("took over from the previous process", "pid", os.Getppid())
+}
+
+func handoffSignals() []os.Signal {
+	if !handoffEnabled {
+		return nil
+	}
+	return []os.Signal{syscall.SIGHUP}
+}
+
+func isHandoffSignal(sig os.Signal) bool {
+	return sig == syscall.SIGHUP
+}
+
+// handoff starts the executable again with our listeners and waits until
+// it serves on them.
+func handoff(running []*runningServer) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	var addrs []string
+	for _, rs := range running {
+		tl, ok := rs.ln.(*net.TCPListener)
+		if !ok {
+			return errors.New("can't pass on listener for " + rs.addr)
+		}
+		f, err := tl.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+		addrs = append(addrs, rs.addr)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var env []string
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, listenFDsEnv+"=") && !strings.HasPrefix(e, readyFDEnv+"=") {
+			env = append(env, e)
+		}
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, w)
+	cmd.Env = append(env,
+		listenFDsEnv+"="+strings.Join(addrs, ","),
+		readyFDEnv+"="+strconv.Itoa(3+len(files)))
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return err
+	}
+	logFor("server").Info("started new process, waiting for it to take over", "pid", cmd.Process.Pid)
+
+	// The pipe ends without a byte if the new process exits first
+	ready := make(chan bool, 1)
+	go func() {
+		n, _ := r.Read(make([]byte, 1))
+		ready <- n == 1
+	}()
+	select {
+	case ok := <-ready:
+		if !ok {
+			cmd.Wait()
+			return errors.New("new process exited before serving")
+		}
+		return nil
+	case <-time.After(handoffStartTimeout):
+		cmd.Process.Kill()
+		cmd.Wait()
+		return errors.New("new process didn't start serving in time")
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ==== HEALTH AND DIAGNOSTICS ====
+//
+// /healthz answers whether the server is alive and can read its library;
+// /readyz runs every check and fails when devices would get an empty or
+// broken feed. Both are served to devices too, so a monitor can use the
+// public address, and so only say {"status": "ok"|"warn"|"fail"}, failing
+// with 503. What each check found, which includes paths and tool versions,
+// is on /admin/diagnostics.
+
+const (
+	checkOK   = "ok"
+	checkWarn = "warn"
+	checkFail = "fail"
+
+	toolVersionTTL = 5 * time.Minute
+)
+
+var (
+	minFreeDisk int64 = 1 << 30
+	startedAt         = time.Now()
+)
+
+type healthCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+}
+
+// feedStatus remembers the last feed built for a device.
+var feedStatus struct {
+	sync.Mutex
+	at       time.Time
+	took     time.Duration
+	err      error
+	items    int
+	attempts int
+}
+
+func noteFeedBuild(start time.Time, items int, err error) {
+	feedStatus.Lock()
+	defer feedStatus.Unlock()
+	feedStatus.at, feedStatus.took = start, time.Since(start)
+	feedStatus.items, feedStatus.err = items, err
+	feedStatus.attempts++
+}
+
+// Tool versions are cached so probes don't start ffmpeg every few seconds.
+var toolVersions = struct {
+	sync.Mutex
+	m map[string]toolVersion
+}{m: make(map[string]toolVersion)}
+
+type toolVersion struct {
+	checked time.Time
+	version string
+	err     error
+}
+
+// toolVersionOf returns the first line of `tool -version`.
+func toolVersionOf(tool string) (string, error) {
+	toolVersions.Lock()
+	v, ok := toolVersions.m[tool]
+	toolVersions.Unlock()
+	if ok && time.Since(v.checked) < toolVersionTTL {
+		return v.version, v.err
+	}
+	out, err := exec.Command(tool, "-version").Output()
+	v = toolVersion{checked: time.Now(), err: err}
+	if err == nil {
+		v.version = strings.TrimSpace(string(bytes.SplitN(out, []byte("\n"), 2)[0]))
+	}
+	toolVersions.Lock()
+	toolVersions.m[tool] = v
+	toolVersions.Unlock()
+	return v.version, v.err
+}
+
+func checkRoot(root string) healthCheck {
+	c := healthCheck{Name: "root", Status: checkOK, Detail: root}
+	if _, err := os.ReadDir(root); err != nil {
+		c.Status, c.Detail = checkFail, err.Error()
+	}
+	return c
+}
+
+// healthChecks runs the readiness checks. The liveness check is only the
+// first one.
+func healthChecks(root string) []healthCheck {
+	checks := []healthCheck{checkRoot(root)}
+	if draining.Load() {
+		checks = append(checks, healthCheck{Name: "server", Status: checkFail, Detail: "shutting down"})
+	}
+
+	disk := healthCheck{Name: "disk", Status: checkOK}
+	if free, err := freeDiskSpace(root); err != nil {
+		disk.Status, disk.Detail = checkWarn, "can't tell free space: "+err.Error()
+	} else {
+		disk.Detail = formatSize(int64(free)) + " free"
+		if int64(free) < minFreeDisk {
+			disk.Status = checkFail
+			disk.Detail += ", below " + formatSize(minFreeDisk)
+		}
+	}
+	checks = append(checks, disk)
+
+	for _, t := range []struct{ name, path, without string }{
+		{"ffmpeg", ffmpegPath, "thumbnails can't be generated"},
+		{"ffprobe", ffprobePath, "videos have no duration"},
+	} {
+		c := healthCheck{Name: t.name, Status: checkOK}
+		if v, err := toolVersionOf(t.path); err != nil {
+			c.Status, c.Detail = checkWarn, t.path+" not usable, "+t.without+": "+err.Error()
+		} else {
+			c.Detail = v
+		}
+		checks = append(checks, c)
+	}
+
+	feed := healthCheck{Name: "feed", Status: checkOK}
+	feedStatus.Lock()
+	switch {
+	case feedStatus.attempts == 0:
+		feed.Detail = "not requested since start"
+	case feedStatus.err != nil:
+		feed.Status = checkFail
+		feed.Detail = "last build at " + feedStatus.at.Format(time.RFC3339) + " failed: " + feedStatus.err.Error()
+	case feedStatus.items == 0:
+		feed.Status = checkWarn
+		feed.Detail = "last build at " + feedStatus.at.Format(time.RFC3339) + " had no videos"
+	default:
+		feed.Detail = "last build at " + feedStatus.at.Format(time.RFC3339) + " took " +
+			feedStatus.took.Round(time.Millisecond).String() + " with " + strconv.Itoa(feedStatus.items) + " videos"
+	}
+	feedStatus.Unlock()
+	checks = append(checks, feed)
+
+	toolsRunning.mu.Lock()
+	running := int(toolsRunning.values["ffmpeg"])
+	toolsRunning.mu.Unlock()
+	checks = append(checks, healthCheck{Name: "ffmpeg_running", Status: checkOK, Detail: strconv.Itoa(running) + " in flight"})
+	return checks
+}
+
+// overallStatus is the worst of the checks.
+func overallStatus(checks []healthCheck) string {
+	status := checkOK
+	for _, c := range checks {
+		if c.Status == checkFail {
+			return checkFail
+		}
+		if c.Status == checkWarn {
+			status = checkWarn
+		}
+	}
+	return status
+}
+
+// writeHealth answers a probe with the overall status alone.
+func writeHealth(w http.ResponseWriter, checks []healthCheck) {
+	status := overallStatus(checks)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if status == checkFail {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": status})
+}
+
+func healthzHandler(root string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, []healthCheck{checkRoot(root)})
+	}
+}
+
+func readyzHandler(root string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, healthChecks(root))
+	}
+}
+
+// registerHealth adds the health endpoints for a server on root.
+func registerHealth(root string) {
+	http.HandleFunc("/healthz", healthzHandler(root))
+	http.HandleFunc("/readyz", readyzHandler(root))
+}
+
+var diagnosticsPage = template.Must(template.New("diagnostics").Parse(`
+<html><head><title>Diagnostics - Admin</title>` + css + `</head><body>
+<nav>
+  <a href="/admin">Dashboard</a>
+  <a href="/admin/users">Users</a>
+  <a href="/logout">Logout</a>
+</nav>
+<div class="card">
+<h2>Diagnostics</h2>
+<p>Overall: <b>{{.Status}}</b>. Monitors can poll <a href="/readyz">/readyz</a>, which gives the overall status only.</p>
+<table>
+  <tr><th>Check</th><th>Status</th><th>Detail</th></tr>
+  {{range .Checks}}
+    <tr><td>{{.Name}}</td><td>{{if eq .Status "fail"}}<b>FAIL</b>{{else if eq .Status "warn"}}Warning{{else}}OK{{end}}</td><td>{{.Detail}}</td></tr>
+  {{end}}
+</table>
+<h3>Server</h3>
+<table>
+  {{range .Info}}<tr><td>{{index . 0}}</td><td>{{index . 1}}</td></tr>{{end}}
+</table>
+</div>
+</body></html>
+`))
+
+func diagnosticsHandler(root string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		checks := healthChecks(root)
+		info := [][2]string{
+			{"Mode", cfg.Mode},
+			{"Library", root},
+			{"Data directory", dataDir},
+			{"Listening on", cfg.Addr},
+			{"Started", startedAt.Format("2006-01-02 15:04:05") + " (up " + time.Since(startedAt).Round(time.Second).String() + ")"},
+			{"Go", runtime.Version() + " " + runtime.GOOS + "/" + runtime.GOARCH},
+		}
+		if cfg.AdminAddr != "" {
+			info = append(info, [2]string{"Admin UI on", cfg.AdminAddr})
+		}
+		if readOnlyLibrary {
+			info = append(info, [2]string{"Read-only library, cache in", cacheDir})
+		}
+		renderPage(w, r, diagnosticsPage, map[string]interface{}{
+			"Status": overallStatus(checks),
+			"Checks": checks,
+			"Info":   info,
+		})
+	}
+}
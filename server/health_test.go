@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withHealth gives the test its own feed status, tool paths and shutdown
+// flags, with free disk space never counted against it.
+func withHealth(t *testing.T) {
+	t.Helper()
+	freshShutdown(t)
+	keepSettings(t)
+	minFreeDisk = 0
+	feedStatus.Lock()
+	at, took, err, items, attempts := feedStatus.at, feedStatus.took, feedStatus.err, feedStatus.items, feedStatus.attempts
+	feedStatus.attempts = 0
+	feedStatus.Unlock()
+	toolVersions.Lock()
+	oldVersions := toolVersions.m
+	toolVersions.m = make(map[string]toolVersion)
+	toolVersions.Unlock()
+	t.Cleanup(func() {
+		feedStatus.Lock()
+		feedStatus.at, feedStatus.took, feedStatus.err, feedStatus.items, feedStatus.attempts = at, took, err, items, attempts
+		feedStatus.Unlock()
+		toolVersions.Lock()
+		toolVersions.m = oldVersions
+		toolVersions.Unlock()
+	})
+}
+
+// probe calls a health handler and returns its status code and the
+// status it reported.
+func probe(t *testing.T, h http.HandlerFunc) (int, string) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/", nil))
+	var body map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("health body: %v: %s", err, w.Body)
+	}
+	// Paths and versions are for /admin/diagnostics only
+	if len(body) != 1 {
+		t.Errorf("health body has more than the status: %s", w.Body)
+	}
+	status, _ := body["status"].(string)
+	return w.Code, status
+}
+
+func TestReadyzFailsWhileDraining(t *testing.T) {
+	s := newTestServer(t)
+	withHealth(t)
+
+	if code, _ := probe(t, readyzHandler(s.root)); code != 200 {
+		t.Fatalf("/readyz before shutdown: %d", code)
+	}
+	draining.Store(true)
+	if code, _ := probe(t, readyzHandler(s.root)); code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz while draining: %d, want 503", code)
+	}
+	// Liveness is unaffected: the server still answers what's in flight
+	if code, _ := probe(t, healthzHandler(s.root)); code != 200 {
+		t.Errorf("/healthz while draining: %d", code)
+	}
+}
+
+func TestReadyzChecks(t *testing.T) {
+	s := newTestServer(t)
+	withHealth(t)
+	tools := filepath.Join(s.outside, "tools")
+
+	tests := []struct {
+		name       string
+		change     func()
+		wantCode   int
+		wantStatus string
+	}{
+		{"unreadable root", func() { s.root = filepath.Join(s.outside, "secret.txt") }, 503, checkFail},
+		{"failed feed", func() { noteFeedBuild(time.Now(), 0, errors.New("boom")) }, 503, checkFail},
+		{"empty feed", func() { noteFeedBuild(time.Now(), 0, nil) }, 200, checkWarn},
+		{"missing tools", func() { ffmpegPath, ffprobePath = filepath.Join(tools, "ffmpeg"), filepath.Join(tools, "ffprobe") }, 200, checkWarn},
+	}
+	root := s.root
+	for _, tt := range tests {
+		s.root = root
+		feedStatus.Lock()
+		feedStatus.attempts, feedStatus.err = 0, nil
+		feedStatus.Unlock()
+		tt.change()
+		code, status := probe(t, readyzHandler(s.root))
+		if code != tt.wantCode || status != tt.wantStatus {
+			t.Errorf("%s: /readyz got %d %q, want %d %q", tt.name, code, status, tt.wantCode, tt.wantStatus)
+		}
+		// /healthz only looks at the root
+		wantLive := 200
+		if s.root != root {
+			wantLive = 503
+		}
+		if code, _ := probe(t, healthzHandler(s.root)); code != wantLive {
+			t.Errorf("%s: /healthz got %d, want %d", tt.name, code, wantLive)
+		}
+	}
+}
+
+func TestHealthBodyHidesDetails(t *testing.T) {
+	s := newTestServer(t)
+	withHealth(t)
+	ffmpegPath = filepath.Join(s.outside, "no-ffmpeg")
+	noteFeedBuild(time.Now(), 0, errors.New("open "+s.root+": permission denied"))
+	for _, h := range []http.HandlerFunc{readyzHandler(s.root), healthzHandler(s.root)} {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", "/", nil))
+		for _, secret := range []string{s.root, s.outside, "no-ffmpeg", "permission denied", "version"} {
+			if strings.Contains(w.Body.String(), secret) {
+				t.Errorf("health body gives away %q: %s", secret, w.Body)
+			}
+		}
+	}
+}
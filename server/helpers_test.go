@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testServer is a library from newTestTree with an admin signed in.
+type testServer struct {
+	root, outside string
+	cookie        *http.Cookie
+	csrf          string
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	root, outside := newTestTree(t)
+
+	// Keep accounts and logs out of the working directory
+	data := t.TempDir()
+	oldDataDir, oldRoot, oldUploads, oldTrash := dataDir, cfg.Root, uploads, trash.root
+	oldPaths := []string{users.path, sessions.path, apiTokens.path, devices.path, auditLog.path, auditLog.root}
+	oldSessions, oldTokens, oldDevices := sessions.byID, apiTokens.byHash, devices.byHash
+	t.Cleanup(func() {
+		dataDir, cfg.Root, uploads, trash.root = oldDataDir, oldRoot, oldUploads, oldTrash
+		sessions.byID, apiTokens.byHash, devices.byHash = oldSessions, oldTokens, oldDevices
+		users.path, sessions.path, apiTokens.path = oldPaths[0], oldPaths[1], oldPaths[2]
+		devices.path, auditLog.path, auditLog.root = oldPaths[3], oldPaths[4], oldPaths[5]
+	})
+	dataDir = data
+	users.path = filepath.Join(data, userFile)
+	sessions.path = filepath.Join(data, sessionFile)
+	apiTokens.path = filepath.Join(data, apiTokenFile)
+	devices.path = filepath.Join(data, deviceFile)
+	auditLog.path = filepath.Join(data, auditFile)
+	auditLog.root = root
+	sessions.byID = make(map[string]*session)
+	apiTokens.byHash = make(map[string]*apiToken)
+	devices.byHash = make(map[string]*device)
+	cfg.Root = root
+	trash.root = ""
+	if err := users.load(); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.add("admin", "correct horse battery", RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	if uploads, err = newTusStore(root); err != nil {
+		t.Fatal(err)
+	}
+
+	token := sessions.create("admin", false, httptest.NewRequest("GET", "/login", nil))
+	sessions.mu.Lock()
+	csrf := sessions.byID[hashToken(token)].CSRF
+	sessions.mu.Unlock()
+	return &testServer{
+		root:    root,
+		outside: outside,
+		cookie:  &http.Cookie{Name: "session", Value: token},
+		csrf:    csrf,
+	}
+}
+
+// as adds a user with the given role and returns a copy of s signed in as
+// them.
+func (s *testServer) as(t *testing.T, name string, role Role) *testServer {
+	t.Helper()
+	if err := users.add(name, "correct horse battery", role); err != nil {
+		t.Fatal(err)
+	}
+	token := sessions.create(name, false, httptest.NewRequest("GET", "/login", nil))
+	sessions.mu.Lock()
+	csrf := sessions.byID[hashToken(token)].CSRF
+	sessions.mu.Unlock()
+	other := *s
+	other.cookie = &http.Cookie{Name: "session", Value: token}
+	other.csrf = csrf
+	return &other
+}
+
+// snapshot records both the library and the folder next to it.
+func (s *testServer) snapshot(t *testing.T) map[string]int64 {
+	t.Helper()
+	return snapshotTree(t, s.root, s.outside)
+}
+
+// do sends a signed in request to the admin handler for its path. The
+// handlers are called directly, as the default mux would redirect unclean
+// paths before they got there.
+func (s *testServer) do(r *http.Request) *httptest.ResponseRecorder {
+	r.AddCookie(s.cookie)
+	r.Header.Set("X-CSRF-Token", s.csrf)
+	w := httptest.NewRecorder()
+	switch {
+	case r.URL.Path == "/admin/delcat":
+		requirePerm(permDelete, delCatHandler(s.root))(w, r)
+	case r.URL.Path == "/admin/activate":
+		requirePerm(permUsers, devicesHandler)(w, r)
+	case r.URL.Path == "/admin/users":
+		requirePerm(permUsers, usersHandler)(w, r)
+	case r.URL.Path == "/admin/account":
+		requireLogin(browserOnly(accountHandler))(w, r)
+	case r.URL.Path == "/admin/audit":
+		requirePerm(permUsers, auditHandler)(w, r)
+	case r.URL.Path == "/admin/validate":
+		requirePerm(permView, validateHandler(s.root))(w, r)
+	case strings.HasPrefix(r.URL.Path, apiBase):
+		apiAuth(apiHandler(s.root))(w, r)
+	default:
+		requireLogin(catRouter(s.root))(w, r)
+	}
+	return w
+}
+
+func (s *testServer) get(t *testing.T, target string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest("GET", "http://localhost/", nil)
+	r.URL.Path = target
+	return s.do(r)
+}
+
+// api sends a JSON request to the API with the session's cookie.
+func (s *testServer) api(t *testing.T, method, target, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, "http://localhost/", strings.NewReader(body))
+	r.URL.Path = target
+	r.Header.Set("Content-Type", "application/json")
+	return s.do(r)
+}
+
+func (s *testServer) postForm(t *testing.T, target string, form url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest("POST", "http://localhost/", strings.NewReader(form.Encode()))
+	r.URL.Path = target
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Referer", "/admin")
+	return s.do(r)
+}
+
+// formPart is a multipart field, sent as a file when filename is set.
+type formPart struct {
+	name, filename, body string
+}
+
+func (s *testServer) postMultipart(t *testing.T, target string, parts []formPart) *httptest.ResponseRecorder {
+	t.Helper()
+	body, ct := multipartBody(t, parts)
+	r := httptest.NewRequest("POST", "http://localhost/", bytes.NewReader(body))
+	r.URL.Path = target
+	r.Header.Set("Content-Type", ct)
+	return s.do(r)
+}
+
+// multipartBody encodes parts in order and returns the body and its
+// content type.
+func multipartBody(t *testing.T, parts []formPart) ([]byte, string) {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, p := range parts {
+		var w io.Writer
+		var err error
+		if p.filename != "" {
+			w, err = mw.CreateFormFile(p.name, p.filename)
+		} else {
+			w, err = mw.CreateFormField(p.name)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, p.body)
+	}
+	mw.Close()
+	return body.Bytes(), mw.FormDataContentType()
+}
+
+// badNames are refused wherever a form names a folder.
+var badNames = []string{
+	"..",
+	"../outside",
+	"../../outside",
+	"Film/../..",
+	"a/b",
+	`a\b`,
+	"/tmp",
+	".uploads",
+	".channelforge",
+	".hidden",
+	"CON",
+	"nul.txt",
+	"trailing.",
+	"Escape",
+}
+
+// assertOutsideUntouched checks the folder next to the library still only
+// has the secret in it.
+func assertOutsideUntouched(t *testing.T, s *testServer) {
+	t.Helper()
+	entries, err := os.ReadDir(s.outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "secret.txt" {
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		t.Errorf("outside the library now has %q", names)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(s.root)); len(entries) != 2 {
+		t.Errorf("something was written next to the library")
+	}
+}
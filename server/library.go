@@ -0,0 +1,295 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ==== LIBRARY OPERATIONS ====
+//
+// The storage operations shared by the admin pages and the JSON API.
+// Callers pass a trusted parent directory; names from requests are checked
+// here through resolvePath.
+
+var (
+	errNotFound = errors.New("not found")
+	errExists   = errors.New("already exists")
+)
+
+// inputError is a problem with what the client sent, as opposed to a
+// failure on the server.
+type inputError struct{ msg string }
+
+func (e *inputError) Error() string { return e.msg }
+
+func badInput(format string, a ...interface{}) error {
+	return &inputError{fmt.Sprintf(format, a...)}
+}
+
+func isInputError(err error) bool {
+	var ie *inputError
+	return errors.As(err, &ie)
+}
+
+// libPath resolves a single user supplied name below parent.
+func libPath(parent, name string) (string, error) {
+	full, err := resolvePath(parent, name)
+	if err != nil {
+		return "", badInput("%v", err)
+	}
+	return full, nil
+}
+
+// libraryFailed answers an admin request whose library operation failed.
+func libraryFailed(w http.ResponseWriter, err error) {
+	if isInputError(err) {
+		badPath(w, err)
+		return
+	}
+	http.Error(w, "Operation failed: "+err.Error(), http.StatusInternalServerError)
+}
+
+// createFolder makes a new category, series or season folder.
+func createFolder(parent, name string) (string, error) {
+	full, err := libPath(parent, strings.TrimSpace(name))
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(full); err == nil {
+		return full, errExists
+	}
+	return full, os.MkdirAll(full, 0755)
+}
+
+// deleteFolder removes a category, series, season, movie or episode along
+// with everything in it.
+func deleteFolder(parent, name string) error {
+	full, err := libPath(parent, name)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(full); err != nil {
+		return errNotFound
+	}
+	return removeTree(full)
+}
+
+// listFolders returns the visible folders below dir, like listSubDirs but
+// reporting a missing dir as errNotFound.
+func listFolders(dir string) ([]string, error) {
+	names, err := listSubDirs(dir)
+	if os.IsNotExist(err) {
+		return nil, errNotFound
+	}
+	var out []string
+	for _, n := range names {
+		if !isHiddenName(n) {
+			out = append(out, n)
+		}
+	}
+	return out, err
+}
+
+// itemUpload is what's needed to store a movie or an episode.
+type itemUpload struct {
+	UploadID  string    // finished tus upload holding the video
+	Owner     string    // user the tus upload must belong to
+	Video     io.Reader // used when UploadID is empty
+	VideoName string
+	Thumb     io.Reader // optional
+	ThumbName string
+	ShortDesc string
+	LongDesc  string
+}
+
+// saveItem stores a movie or episode folder called name inside parent.
+// Files that already exist are replaced.
+func saveItem(parent, name string, up itemUpload) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", badInput("name is required")
+	}
+	dir, err := libPath(parent, name)
+	if err != nil {
+		return "", err
+	}
+	if up.UploadID == "" && up.Video == nil {
+		return "", badInput("missing video")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create folder: %w", err)
+	}
+	var vpath, tpath string
+	if up.UploadID == "" {
+		if vpath, err = resolveUpload(dir, up.VideoName); err != nil {
+			return "", badInput("invalid video file name: %v", err)
+		}
+	}
+	if up.Thumb != nil {
+		if tpath, err = resolveUpload(dir, up.ThumbName); err != nil {
+			return "", badInput("invalid thumbnail file name: %v", err)
+		}
+	}
+	if up.UploadID != "" {
+		if _, err := uploads.finish(up.UploadID, up.Owner, dir); err != nil {
+			return "", fmt.Errorf("failed to save video: %w", err)
+		}
+	} else if err := saveUploadedFile(up.Video, vpath); err != nil {
+		return "", fmt.Errorf("failed to save video: %w", err)
+	}
+	if up.Thumb != nil {
+		if err := saveUploadedFile(up.Thumb, tpath); err != nil {
+			return "", fmt.Errorf("failed to save thumbnail: %w", err)
+		}
+	}
+	if up.ShortDesc != "" || up.LongDesc != "" {
+		if err := setDescription(dir, up.ShortDesc, up.LongDesc); err != nil {
+			return "", fmt.Errorf("failed to save description: %w", err)
+		}
+	}
+	if info, err := readItem(dir); err == nil {
+		uploadSizes.observe(float64(info.VideoSize))
+	}
+	return dir, nil
+}
+
+// itemInfo describes what's stored in a movie, episode, series or season
+// folder. The feed picks files the same way.
+type itemInfo struct {
+	Name      string    `json:"name"`
+	Video     string    `json:"video,omitempty"`
+	VideoSize int64     `json:"video_size,omitempty"`
+	Thumbnail string    `json:"thumbnail,omitempty"`
+	ShortDesc string    `json:"short_description"`
+	LongDesc  string    `json:"long_description"`
+	Modified  time.Time `json:"modified"`
+
+	descFile string
+}
+
+func readItem(dir string) (*itemInfo, error) {
+	fi, err := os.Stat(dir)
+	if err != nil || !fi.IsDir() {
+		return nil, errNotFound
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	info := &itemInfo{Name: filepath.Base(dir), Modified: fi.ModTime()}
+	for _, f := range files {
+		// Hidden files are temporary ones, like an upload or thumbnail
+		// that isn't finished yet
+		if f.IsDir() || isHiddenName(f.Name()) {
+			continue
+		}
+		lower := strings.ToLower(f.Name())
+		switch {
+		case strings.HasSuffix(lower, ".mp4"):
+			info.Video = f.Name()
+			if vi, err := f.Info(); err == nil {
+				info.VideoSize = vi.Size()
+				info.Modified = vi.ModTime()
+			}
+		case strings.HasSuffix(lower, ".jpg") || strings.HasSuffix(lower, ".png"):
+			info.Thumbnail = f.Name()
+		case strings.HasSuffix(lower, ".txt"):
+			info.descFile = f.Name()
+		}
+	}
+	if info.descFile != "" {
+		b, err := os.ReadFile(filepath.Join(dir, info.descFile))
+		if err == nil {
+			lines := strings.SplitN(string(b), "\n", 2)
+			info.ShortDesc = strings.TrimSpace(lines[0])
+			if len(lines) > 1 {
+				info.LongDesc = strings.TrimSpace(lines[1])
+			}
+		}
+	}
+	return info, nil
+}
+
+// setDescription writes the short and long description of a folder,
+// reusing its existing description file if there is one.
+func setDescription(dir, short, long string) error {
+	name := "desc.txt"
+	if info, err := readItem(dir); err == nil && info.descFile != "" {
+		name = info.descFile
+	}
+	return os.WriteFile(filepath.Join(dir, name), []byte(short+"\n"+long), 0644)
+}
+
+// setThumbnail replaces a folder's artwork. Older images are removed so the
+// feed can't pick one of them up instead.
+func setThumbnail(dir, filename string, img io.Reader) error {
+	ext := strings.ToLower(filepath.Ext(filename))
+	if ext != ".jpg" && ext != ".jpeg" && ext != ".png" {
+		return badInput("thumbnail must be a .jpg or .png file")
+	}
+	if ext == ".jpeg" {
+		ext = ".jpg"
+	}
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		return errNotFound
+	}
+	tmp := filepath.Join(dir, ".thumb.tmp")
+	if err := saveUploadedFile(img, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	files, _ := os.ReadDir(dir)
+	for _, f := range files {
+		lower := strings.ToLower(f.Name())
+		if !f.IsDir() && (strings.HasSuffix(lower, ".jpg") || strings.HasSuffix(lower, ".png")) {
+			os.Remove(filepath.Join(dir, f.Name()))
+		}
+	}
+	return os.Rename(tmp, filepath.Join(dir, "thumb"+ext))
+}
+
+// Kinds of library folders, as walkLibrary reports them.
+const (
+	kindMovie   = "movie"
+	kindSeries  = "series"
+	kindSeason  = "season"
+	kindEpisode = "episode"
+)
+
+// walkLibrary calls fn with every movie, series, season and episode folder
+// below root, laid out the way the feed reads them, along with the path
+// segments naming it (category first).
+func walkLibrary(root string, fn func(dir, kind string, names []string)) error {
+	cats, err := listFolders(root)
+	if err != nil {
+		return err
+	}
+	for _, cat := range cats {
+		catPath := filepath.Join(root, cat)
+		items, _ := listFolders(catPath)
+		for _, item := range items {
+			itemPath := filepath.Join(catPath, item)
+			if strings.EqualFold(cat, "movies") {
+				fn(itemPath, kindMovie, []string{cat, item})
+				continue
+			}
+			fn(itemPath, kindSeries, []string{cat, item})
+			seasons, _ := listFolders(itemPath)
+			for _, season := range seasons {
+				seasonPath := filepath.Join(itemPath, season)
+				fn(seasonPath, kindSeason, []string{cat, item, season})
+				episodes, _ := listFolders(seasonPath)
+				for _, ep := range episodes {
+					fn(filepath.Join(seasonPath, ep), kindEpisode, []string{cat, item, season, ep})
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ==== LOGGING ====
+//
+// Logs are structured (log/slog), as logfmt or JSON lines. Every message
+// belongs to a subsystem whose level can be set on its own with log.levels,
+// e.g. "access=warn,tools=debug". Each request gets an ID, returned in
+// X-Request-ID and added to whatever is logged while handling it. Requests
+// for /feed.xml and /content/ are written to the access log; everything
+// else is too, at debug level. A log file is rotated when it reaches
+// log.max_size, keeping log.max_files old ones.
+
+// logSubsystems are the names log.levels accepts.
+var logSubsystems = []string{
+	"server",  // startup, listeners, configuration
+	"access",  // one line per request
+	"feed",    // building the feed
+	"tools",   // ffmpeg and ffprobe runs
+	"auth",    // logins, sessions, tokens, CSRF
+	"devices", // device keys and pairing
+	"uploads", // uploads and resumable uploads
+	"trash",   // the trash and its purging
+	"audit",   // writing the audit log
+	"api",     // the JSON API
+}
+
+var (
+	logFormat     = "logfmt"
+	logLevel      = "info"
+	logLevels     string // per subsystem, "name=level,..."
+	logFile       string // empty for standard error
+	accessLogFile string // empty for the main log
+	logMaxSize    int64  = 100 << 20
+	logMaxFiles          = 5
+)
+
+// loggers holds a logger per subsystem once setupLogging has run.
+var loggers map[string]*slog.Logger
+
+// logFor returns the logger of a subsystem.
+func logFor(subsystem string) *slog.Logger {
+	if l, ok := loggers[subsystem]; ok {
+		return l
+	}
+	return slog.Default().With("subsystem", subsystem)
+}
+
+// fatal logs an error that the server can't run with and exits.
+func fatal(subsystem, msg string, args ...any) {
+	logFor(subsystem).Error(msg, args...)
+	os.Exit(1)
+}
+
+func parseLogLevel(s string) (slog.Level, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("%q is not one of debug, info, warn or error", s)
+	}
+	return l, nil
+}
+
+// parseLogLevels reads log.levels.
+func parseLogLevels(s string) (map[string]slog.Level, error) {
+	out := make(map[string]slog.Level)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, level, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not subsystem=level", part)
+		}
+		name = strings.TrimSpace(name)
+		if !contains(logSubsystems, name) {
+			return nil, fmt.Errorf("unknown subsystem %q (known: %s)", name, strings.Join(logSubsystems, ", "))
+		}
+		l, err := parseLogLevel(strings.TrimSpace(level))
+		if err != nil {
+			return nil, err
+		}
+		out[name] = l
+	}
+	return out, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// validateLogging checks the log settings.
+func validateLogging() []string {
+	var problems []string
+	if logFormat != "logfmt" && logFormat != "json" {
+		problems = append(problems, fmt.Sprintf("log.format must be \"logfmt\" or \"json\", not %q", logFormat))
+	}
+	if _, err := parseLogLevel(logLevel); err != nil {
+		problems = append(problems, fmt.Sprintf("log.level: %v", err))
+	}
+	if _, err := parseLogLevels(logLevels); err != nil {
+		problems = append(problems, fmt.Sprintf("log.levels: %v", err))
+	}
+	if logMaxFiles < 0 {
+		problems = append(problems, "log.max_files can't be negative")
+	}
+	return problems
+}
+
+// setupLogging opens the log files and makes the subsystem loggers. The
+// standard library's log package, and so anything still using it, ends
+// up in the server subsystem.
+func setupLogging() error {
+	level, _ := parseLogLevel(logLevel)
+	levels, _ := parseLogLevels(logLevels)
+	out, err := openLog(logFile)
+	if err != nil {
+		return err
+	}
+	access := out
+	if accessLogFile != "" {
+		if access, err = openLog(accessLogFile); err != nil {
+			return err
+		}
+	}
+	loggers = make(map[string]*slog.Logger)
+	for _, name := range logSubsystems {
+		w := out
+		if name == "access" {
+			w = access
+		}
+		l, ok := levels[name]
+		if !ok {
+			l = level
+		}
+		loggers[name] = slog.New(&subsystemHandler{min: l, next: newLogHandler(w)}).With("subsystem", name)
+	}
+	slog.SetDefault(loggers["server"])
+	return nil
+}
+
+func newLogHandler(w io.Writer) slog.Handler {
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	if logFormat == "json" {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+// openLog opens a log file, relative paths being in the data directory.
+func openLog(path string) (io.Writer, error) {
+	if path == "" {
+		return os.Stderr, nil
+	}
+	if !filepath.IsAbs(path) {
+		path = dataPath(path)
+	}
+	return openRotatingFile(path, logMaxSize, logMaxFiles)
+}
+
+// subsystemHandler applies a subsystem's level and adds the request ID
+// from the context.
+type subsystemHandler struct {
+	min  slog.Level
+	next slog.Handler
+}
+
+func (h *subsystemHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	return l >= h.min && h.next.Enabled(ctx, l)
+}
+
+func (h *subsystemHandler) Handle(ctx context.Context, rec slog.Record) error {
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok {
+		rec.AddAttrs(slog.String("request_id", id))
+	}
+	return h.next.Handle(ctx, rec)
+}
+
+func (h *subsystemHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &subsystemHandler{min: h.min, next: h.next.WithAttrs(attrs)}
+}
+
+func (h *subsystemHandler) WithGroup(name string) slog.Handler {
+	return &subsystemHandler{min: h.min, next: h.next.WithGroup(name)}
+}
+
+// rotatingFile is a log file that is renamed to path.1 (path.1 to path.2,
+// and so on) once it would grow past maxSize.
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	mu       sync.Mutex
+	f        *os.File
+	size     int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	r := &rotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	return r, r.open()
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, fi.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f != nil && r.maxSize > 0 && r.size > 0 && r.size+int64(len(b)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to rotate log:", err)
+		}
+	}
+	if r.f == nil {
+		// The new file couldn't be opened: try again on every write and
+		// keep the messages on standard error meanwhile
+		if err := r.open(); err != nil {
+			return os.Stderr.Write(b)
+		}
+	}
+	n, err := r.f.Write(b)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate closes the file first, as Windows can't rename an open file.
+func (r *rotatingFile) rotate() error {
+	r.f.Close()
+	r.f = nil
+	os.Remove(fmt.Sprintf("%s.%d", r.path, r.maxFiles))
+	for i := r.maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	if r.maxFiles > 0 {
+		os.Rename(r.path, r.path+".1")
+	} else {
+		os.Remove(r.path)
+	}
+	return r.open()
+}
+
+// ---- Requests ----
+
+type requestIDKey struct{}
+
+// requestID returns the ID logRequests gave the request.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// newRequestID keeps an ID a trusted proxy already assigned.
+func newRequestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-ID"); id != "" && len(id) <= 64 && fromTrustedProxy(r) && isToken(id) {
+		return id
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func isToken(s string) bool {
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// statusWriter remembers the status and size of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	n      int64
+}
+
+func (s *statusWriter) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusWriter) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.n += int64(n)
+	return n, err
+}
+
+// ReadFrom keeps sendfile working for files served through the writer.
+func (s *statusWriter) ReadFrom(r io.Reader) (int64, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	var n int64
+	var err error
+	if rf, ok := s.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(s.ResponseWriter, r)
+	}
+	s.n += n
+	return n, err
+}
+
+// Flush lets streaming handlers flush through the writer; Unwrap alone
+// only helps those that use http.ResponseController.
+func (s *statusWriter) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		if s.status == 0 {
+			s.status = http.StatusOK
+		}
+		f.Flush()
+	}
+}
+
+func (s *statusWriter) Unwrap() http.ResponseWriter { return s.ResponseWriter }
+
+// logRequests gives each request an ID and writes the access log.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := newRequestID(r)
+		w.Header().Set("X-Request-ID", id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+
+		p := strings.TrimPrefix(r.URL.Path, basePath)
+		level := slog.LevelDebug
+		if p == "/feed.xml" || strings.HasPrefix(p, "/content/") {
+			level = slog.LevelInfo
+		}
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", status),
+			slog.Int64("bytes", sw.n),
+			slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("client_ip", clientIP(r)),
+			slog.String("user_agent", r.UserAgent()),
+		}
+		if rng := r.Header.Get("Range"); rng != "" {
+			attrs = append(attrs, slog.String("range", rng))
+		}
+		logFor("access").LogAttrs(r.Context(), level, "request", attrs...)
+	})
+}
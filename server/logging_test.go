@@ -0,0 +1,136 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readLogs returns what the log file and each of its rotated copies hold,
+// by suffix, "" being the live file.
+func readLogs(t *testing.T, path string) map[string]string {
+	t.Helper()
+	matches, _ := filepath.Glob(path + "*")
+	out := make(map[string]string)
+	for _, m := range matches {
+		b, err := os.ReadFile(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out[strings.TrimPrefix(m, path)] = string(b)
+	}
+	return out
+}
+
+func writeLog(t *testing.T, r *rotatingFile, lines ...string) {
+	t.Helper()
+	for _, l := range lines {
+		if _, err := r.Write([]byte(l)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "server.log")
+	r, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.f.Close()
+	writeLog(t, r, "one.....\n", "two.....\n", "three...\n", "four....\n")
+	want := map[string]string{"": "four....\n", ".1": "three...\n", ".2": "two.....\n"}
+	if got := readLogs(t, path); len(got) != len(want) || got[""] != want[""] || got[".1"] != want[".1"] || got[".2"] != want[".2"] {
+		t.Errorf("after four writes: %q, want %q", got, want)
+	}
+
+	// A line longer than max_size still goes into a fresh file whole
+	writeLog(t, r, strings.Repeat("x", 25)+"\n")
+	if got := readLogs(t, path); got[""] != strings.Repeat("x", 25)+"\n" || got[".1"] != "four....\n" {
+		t.Errorf("after a long line: %q", got)
+	}
+}
+
+func TestRotatingFileCountsExistingSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.log")
+	os.WriteFile(path, []byte("earlier\n"), 0640)
+	r, err := openRotatingFile(path, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.f.Close()
+	writeLog(t, r, "now\n")
+	if got := readLogs(t, path); got[""] != "now\n" || got[".1"] != "earlier\n" {
+		t.Errorf("reopened log not rotated: %q", got)
+	}
+}
+
+func TestRotatingFileNoOldFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.log")
+	r, err := openRotatingFile(path, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.f.Close()
+	writeLog(t, r, "one.....\n", "two.....\n", "three...\n")
+	if got := readLogs(t, path); len(got) != 1 || got[""] != "three...\n" {
+		t.Errorf("with max_files = 0: %q", got)
+	}
+}
+
+func TestRotatingFileFallsBackToStderr(t *testing.T) {
+	stderr, err := os.CreateTemp(t.TempDir(), "stderr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := os.Stderr
+	os.Stderr = stderr
+	t.Cleanup(func() { os.Stderr = old })
+
+	dir := filepath.Join(t.TempDir(), "logs")
+	path := filepath.Join(dir, "server.log")
+	r, err := openRotatingFile(path, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeLog(t, r, "one.....\n")
+
+	// The folder goes away, so the rotated file can't be opened
+	os.RemoveAll(dir)
+	writeLog(t, r, "two.....\n", "three...\n")
+	if r.f != nil {
+		t.Fatal("a file is open after the reopen failed")
+	}
+	b, _ := os.ReadFile(stderr.Name())
+	if !strings.Contains(string(b), "Failed to rotate log") || !strings.Contains(string(b), "two.....\nthree...\n") {
+		t.Errorf("standard error holds %q", b)
+	}
+
+	// Once it can be opened again the log carries on in the file
+	os.MkdirAll(dir, 0755)
+	writeLog(t, r, "four....\n")
+	defer r.f.Close()
+	if got := readLogs(t, path); got[""] != "four....\n" {
+		t.Errorf("after the folder came back: %q", got)
+	}
+}
+
+func TestParseLogLevels(t *testing.T) {
+	got, err := parseLogLevels(" access=warn, tools = debug ,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got["access"] != slog.LevelWarn || got["tools"] != slog.LevelDebug {
+		t.Errorf("levels = %v", got)
+	}
+	if got, err := parseLogLevels(""); err != nil || len(got) != 0 {
+		t.Errorf("empty levels = %v, %v", got, err)
+	}
+	for _, bad := range []string{"access", "nope=info", "access=loud", "=info"} {
+		if _, err := parseLogLevels(bad); err == nil {
+			t.Errorf("parseLogLevels(%q) succeeded", bad)
+		}
+	}
+}
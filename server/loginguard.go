@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ==== LOGIN BRUTE-FORCE PROTECTION ====
+//
+// Failed logins are counted per client IP and per username. Once a counter
+// passes its threshold the key is locked out, doubling the lockout with each
+// further failure. Every failure is also appended to loginFailureFile,
+// which rotates like the log files so a flood of failures can't fill the
+// disk.
+
+const loginFailureFile = "login_failures.log"
+
+var (
+	loginUserThreshold = 5
+	loginIPThreshold   = 10
+	loginBaseLockout   = 30 * time.Second
+	loginMaxLockout    = time.Hour
+	loginFailureReset  = time.Hour // failures older than this are forgotten
+	loginRecentLimit   = 200
+)
+
+type loginAttempts struct {
+	Key         string
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+type loginFailure struct {
+	Time      time.Time `json:"time"`
+	Username  string    `json:"username"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Reason    string    `json:"reason"`
+}
+
+type loginLimiter struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]*loginAttempts
+	recent  []loginFailure // newest last
+	out     *rotatingFile  // opened on the first failure
+}
+
+var loginGuard = &loginLimiter{path: loginFailureFile, entries: make(map[string]*loginAttempts)}
+
+func ipKey(ip string) string     { return "ip:" + ip }
+func userKey(name string) string { return "user:" + strings.ToLower(name) }
+
+// load reads the tail of the failure log so the admin page survives restarts.
+func (l *loginLimiter) load() error {
+	f, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var lf loginFailure
+		if json.Unmarshal(sc.Bytes(), &lf) == nil {
+			l.recent = append(l.recent, lf)
+			if len(l.recent) > loginRecentLimit {
+				l.recent = l.recent[1:]
+			}
+		}
+	}
+	return sc.Err()
+}
+
+// blocked returns how long the IP or username is still locked out for.
+func (l *loginLimiter) blocked(ip, username string) time.Duration {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var wait time.Duration
+	for _, k := range []string{ipKey(ip), userKey(username)} {
+		if a, ok := l.entries[k]; ok && a.LockedUntil.After(now) {
+			if d := a.LockedUntil.Sub(now); d > wait {
+				wait = d
+			}
+		}
+	}
+	return wait
+}
+
+// fail records a failed attempt and extends lockouts as needed.
+func (l *loginLimiter) fail(r *http.Request, username, reason string) {
+	now := time.Now()
+	ip := clientIP(r)
+	lf := loginFailure{Time: now, Username: username, IP: ip, UserAgent: r.UserAgent(), Reason: reason}
+	l.mu.Lock()
+	l.bump(ipKey(ip), loginIPThreshold, now)
+	if username != "" {
+		l.bump(userKey(username), loginUserThreshold, now)
+	}
+	l.recent = append(l.recent, lf)
+	if len(l.recent) > loginRecentLimit {
+		l.recent = l.recent[1:]
+	}
+	l.mu.Unlock()
+
+	loginFailures.inc(reason)
+	logFor("auth").WarnContext(r.Context(), "failed login", "user", username, "client_ip", ip, "reason", reason)
+	b, _ := json.Marshal(lf)
+	if err := l.appendLog(append(b, '\n')); err != nil {
+		logFor("auth").Error("failed to write login failure log", "err", err)
+	}
+}
+
+// appendLog writes a line to the failure log.
+func (l *loginLimiter) appendLog(line []byte) error {
+	l.mu.Lock()
+	if l.out == nil {
+		out, err := openRotatingFile(l.path, logMaxSize, logMaxFiles)
+		if err != nil {
+			l.mu.Unlock()
+			return err
+		}
+		l.out = out
+	}
+	out := l.out
+	l.mu.Unlock()
+	_, err := out.Write(line)
+	return err
+}
+
+func (l *loginLimiter) bump(key string, threshold int, now time.Time) {
+	a, ok := l.entries[key]
+	if !ok || now.Sub(a.LastFailure) > loginFailureReset {
+		a = &loginAttempts{Key: key}
+		l.entries[key] = a
+	}
+	a.Failures++
+	a.LastFailure = now
+	if a.Failures >= threshold {
+		lock := loginBaseLockout
+		for i := threshold; i < a.Failures && lock < loginMaxLockout; i++ {
+			lock *= 2
+		}
+		if lock > loginMaxLockout {
+			lock = loginMaxLockout
+		}
+		a.LockedUntil = now.Add(lock)
+	}
+}
+
+// succeed clears the username's counter after a successful login. The IP
+// counter is left to expire: an attacker who owns one account must not be
+// able to reset it between guesses at the others.
+func (l *loginLimiter) succeed(username string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.entries, userKey(username))
+}
+
+func (l *loginLimiter) unlock(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.entries, key)
+}
+
+// lockouts returns the keys that are currently locked.
+func (l *loginLimiter) lockouts() []loginAttempts {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var out []loginAttempts
+	for _, a := range l.entries {
+		if a.LockedUntil.After(now) {
+			out = append(out, *a)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].LockedUntil.After(out[j].LockedUntil) })
+	return out
+}
+
+// recentFailures returns logged failures, newest first.
+func (l *loginLimiter) recentFailures() []loginFailure {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make([]loginFailure, len(l.recent))
+	for i, lf := range l.recent {
+		out[len(l.recent)-1-i] = lf
+	}
+	return out
+}
+
+func (l *loginLimiter) janitor(interval time.Duration) {
+	background.every(interval, l.forgetOld)
+}
+
+// forgetOld drops counters for keys that are neither locked out nor
+// recently failed.
+func (l *loginLimiter) forgetOld() {
+	now := time.Now()
+	l.mu.Lock()
+	for k, a := range l.entries {
+		if a.LockedUntil.Before(now) && now.Sub(a.LastFailure) > loginFailureReset {
+			delete(l.entries, k)
+		}
+	}
+	l.mu.Unlock()
+}
+
+// lockoutMessage formats the error shown on the login page.
+func lockoutMessage(wait time.Duration) string {
+	return fmt.Sprintf("Too many failed attempts. Try again in %s.", wait.Round(time.Second))
+}
+
+var securityPage = template.Must(template.New("security").Parse(`
+<html><head><title>Login Security - Admin</title>` + css + `</head><body>
+<nav>
+  <a href="/admin">Dashboard</a>
+  <a href="/admin/users">Users</a>
+  <a href="/logout">Logout</a>
+</nav>
+<div class="card">
+<h2>Login Security</h2>
+<h3>Current Lockouts</h3>
+{{if .Lockouts}}
+  <table>
+    <tr><th>Who</th><th>Failures</th><th>Locked Until</th><th></th></tr>
+    {{range .Lockouts}}
+      <tr>
+        <td>{{.Key}}</td>
+        <td>{{.Failures}}</td>
+        <td>{{.LockedUntil.Format "2006-01-02 15:04:05"}}</td>
+        <td>
+          <form method="POST" action="/admin/security" style="display:inline">` + csrfInput + `
+            <input type="hidden" name="key" value="{{.Key}}">
+            <button type="submit" class="btn">Unlock</button>
+          </form>
+        </td>
+      </tr>
+    {{end}}
+  </table>
+{{else}}
+  <p>Nobody is locked out.</p>
+{{end}}
+<h3>Recent Failed Logins</h3>
+{{if .Failures}}
+  <table>
+    <tr><th>Time</th><th>Username</th><th>Address</th><th>Reason</th><th>Browser</th></tr>
+    {{range .Failures}}
+      <tr>
+        <td>{{.Time.Format "2006-01-02 15:04:05"}}</td>
+        <td>{{.Username}}</td>
+        <td>{{.IP}}</td>
+        <td>{{.Reason}}</td>
+        <td>{{.UserAgent}}</td>
+      </tr>
+    {{end}}
+  </table>
+{{else}}
+  <p>No failed logins recorded.</p>
+{{end}}
+</div>
+</body></html>
+`))
+
+func securityHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		loginGuard.unlock(r.FormValue("key"))
+		http.Redirect(w, r, "/admin/security", http.StatusSeeOther)
+		return
+	default:
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	renderPage(w, r, securityPage, map[string]interface{}{
+		"Lockouts": loginGuard.lockouts(),
+		"Failures": loginGuard.recentFailures(),
+	})
+}
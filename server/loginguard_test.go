@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newLoginGuardTest(t *testing.T) *loginLimiter {
+	t.Helper()
+	return &loginLimiter{path: filepath.Join(t.TempDir(), loginFailureFile), entries: make(map[string]*loginAttempts)}
+}
+
+// lockFor returns how long key was locked for by its last failure.
+func lockFor(l *loginLimiter, key string) time.Duration {
+	a, ok := l.entries[key]
+	if !ok || a.LockedUntil.IsZero() {
+		return 0
+	}
+	return a.LockedUntil.Sub(a.LastFailure)
+}
+
+func TestLoginLockoutEscalates(t *testing.T) {
+	l := newLoginGuardTest(t)
+	r := httptest.NewRequest("POST", "/login", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+
+	for i := 1; i < loginUserThreshold; i++ {
+		l.fail(r, "alice", "bad password")
+	}
+	if wait := l.blocked("192.0.2.9", "alice"); wait != 0 {
+		t.Fatalf("locked out after %d failures for %v", loginUserThreshold-1, wait)
+	}
+	want := loginBaseLockout
+	for i := loginUserThreshold; i < loginUserThreshold+4; i++ {
+		l.fail(r, "alice", "bad password")
+		if got := lockFor(l, userKey("alice")); got != want {
+			t.Errorf("after %d failures locked for %v, want %v", i, got, want)
+		}
+		want *= 2
+	}
+	// Usernames are matched without regard to case
+	if wait := l.blocked("192.0.2.9", "ALICE"); wait <= 0 {
+		t.Error("another address could still try the locked username")
+	}
+	for i := 0; i < 20; i++ {
+		l.fail(r, "alice", "bad password")
+	}
+	if got := lockFor(l, userKey("alice")); got != loginMaxLockout {
+		t.Errorf("lockout grew to %v, want at most %v", got, loginMaxLockout)
+	}
+
+	// The address was locked at its own threshold
+	if got := l.entries[ipKey("192.0.2.1")].Failures; got != loginUserThreshold+23 {
+		t.Errorf("address counted %d failures", got)
+	}
+	if wait := l.blocked("192.0.2.1", "bob"); wait <= 0 {
+		t.Error("the address could still try other usernames")
+	}
+	if len(l.lockouts()) != 2 {
+		t.Errorf("lockouts = %v", l.lockouts())
+	}
+}
+
+func TestLoginIPThreshold(t *testing.T) {
+	l := newLoginGuardTest(t)
+	r := httptest.NewRequest("POST", "/login", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	for i := 1; i < loginIPThreshold; i++ {
+		l.fail(r, "", "bad password")
+	}
+	if l.blocked("192.0.2.1", "") != 0 {
+		t.Fatal("address locked before its threshold")
+	}
+	l.fail(r, "", "bad password")
+	if got := lockFor(l, ipKey("192.0.2.1")); got != loginBaseLockout {
+		t.Errorf("address locked for %v, want %v", got, loginBaseLockout)
+	}
+}
+
+func TestLoginSucceedKeepsIPCounter(t *testing.T) {
+	l := newLoginGuardTest(t)
+	r := httptest.NewRequest("POST", "/login", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	for i := 0; i < 3; i++ {
+		l.fail(r, "alice", "bad password")
+	}
+	l.succeed("Alice")
+	if _, ok := l.entries[userKey("alice")]; ok {
+		t.Error("the username's counter survived a login")
+	}
+	if a := l.entries[ipKey("192.0.2.1")]; a == nil || a.Failures != 3 {
+		t.Fatalf("the address counter was reset: %+v", a)
+	}
+
+	// Old failures are forgotten
+	l.entries[ipKey("192.0.2.1")].LastFailure = time.Now().Add(-loginFailureReset - time.Minute)
+	l.fail(r, "bob", "bad password")
+	if a := l.entries[ipKey("192.0.2.1")]; a.Failures != 1 {
+		t.Errorf("stale failures were still counted: %d", a.Failures)
+	}
+}
+
+func TestLoginFailureLog(t *testing.T) {
+	l := newLoginGuardTest(t)
+	r := httptest.NewRequest("POST", "/login", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	l.fail(r, "alice", "bad password")
+	l.fail(r, "bob", "bad code")
+
+	reloaded := &loginLimiter{path: l.path, entries: make(map[string]*loginAttempts)}
+	if err := reloaded.load(); err != nil {
+		t.Fatal(err)
+	}
+	got := reloaded.recentFailures()
+	if len(got) != 2 || got[0].Username != "bob" || got[1].Username != "alice" || got[0].IP != "192.0.2.1" {
+		t.Errorf("reloaded failures = %+v", got)
+	}
+}
+
+func TestLoginFailureLogRotates(t *testing.T) {
+	oldSize, oldFiles := logMaxSize, logMaxFiles
+	t.Cleanup(func() { logMaxSize, logMaxFiles = oldSize, oldFiles })
+	logMaxSize, logMaxFiles = 1000, 2
+
+	l := newLoginGuardTest(t)
+	r := httptest.NewRequest("POST", "/login", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	for i := 0; i < 100; i++ {
+		l.fail(r, "alice", "bad password")
+	}
+	var total int64
+	for _, name := range []string{l.path, l.path + ".1", l.path + ".2"} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() > logMaxSize {
+			t.Errorf("%s is %d bytes, over the %d limit", filepath.Base(name), fi.Size(), logMaxSize)
+		}
+		total += fi.Size()
+	}
+	if _, err := os.Stat(l.path + ".3"); !os.IsNotExist(err) {
+		t.Error("kept more than log.max_files old failure logs")
+	}
+	if total > logMaxSize*3 {
+		t.Errorf("failure logs take %d bytes", total)
+	}
+}
@@ -1,43 +1,54 @@
 package main
 
 import (
-	"flag"
 	"fmt"
 	"os"
+	"strings"
 )
 
 func printUsage() {
 	fmt.Println("Usage:")
 	fmt.Println("  server --file   # Serve feeds from a directory structure (filesystem mode)")
 	fmt.Println("  server --web    # Start the web UI for uploading/managing content (web mode)")
+	fmt.Println("  server --combined --admin-addr 127.0.0.1:8081   # Feed on --addr, web UI on its own address")
+	fmt.Println("  server --config channelforge.toml   # Take the mode and other settings from a file")
+	fmt.Println()
+	fmt.Println("Commands (run without a server; see server COMMAND --help):")
+	for _, c := range commands {
+		fmt.Printf("  server %-28s # %s\n", strings.TrimSpace(c.name+" "+c.args), c.help)
+	}
 	fmt.Println()
 	fmt.Println("Note: Both modes use the same directory structure and on-disk storage for content.")
 	fmt.Println("      Web mode simply provides an admin panel for browser-based management.")
 }
 
 func main() {
-	fileMode := flag.Bool("file", false, "Serve feeds from a directory structure (filesystem mode)")
-	webMode := flag.Bool("web", false, "Start the web UI for uploads and management")
-	rootDir := flag.String("root", ".", "Root directory for content (used in both modes)")
-	addr := flag.String("addr", "0.0.0.0:8080", "Address to listen on")
-
-	flag.Parse()
-
-	if (*fileMode && *webMode) || (!*fileMode && !*webMode) {
-		fmt.Println("You must specify exactly one mode.")
-		printUsage()
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+	if err := loadConfig(); err != nil {
+		fmt.Println(err)
+		if cfg.Mode == "" {
+			printUsage()
+		}
 		os.Exit(1)
 	}
 
-	if *fileMode {
-		fmt.Printf("Starting in filesystem mode. Serving content from: %s\n", *rootDir)
-		ServeFeedFromDir(*rootDir, *addr)
+	if cfg.Mode == "file" {
+		logFor("server").Info("starting in filesystem mode", "root", cfg.Root)
+		ServeFeedFromDir(cfg.Root, cfg.Addr)
 		return
 	}
 
-	if *webMode {
-		fmt.Println("Starting in web mode. You'll be prompted to create your admin account.")
-		StartWebServer(*addr, *rootDir)
+	if cfg.Mode == "combined" {
+		logFor("server").Info("starting in combined mode", "root", cfg.Root, "addr", cfg.Addr, "admin_addr", cfg.AdminAddr)
+		StartWebServer(cfg.Addr, cfg.Root)
 		return
 	}
-}
\ No newline at end of file
+
+	if cfg.Mode == "web" {
+		logFor("server").Info("starting in web mode", "root", cfg.Root)
+		StartWebServer(cfg.Addr, cfg.Root)
+		return
+	}
+}
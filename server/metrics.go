@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ==== METRICS ====
+//
+// With metrics.enabled set, /metrics exposes counters and gauges in the
+// Prometheus text format. The few metric types needed are implemented here
+// rather than pulling in the client library. Set metrics.token to require
+// "Authorization: Bearer <token>" from the scraper; without one, only
+// combined mode keeps /metrics off the listener devices use.
+
+var (
+	metricsEnabled bool
+	metricsToken   string
+)
+
+// metricVec is a counter or gauge with zero or more labels.
+type metricVec struct {
+	name, help, kind string
+	labels           []string
+	mu               sync.Mutex
+	values           map[string]float64 // keyed by the label values joined with \xff
+}
+
+// histogram counts observations into cumulative buckets.
+type histogram struct {
+	name, help string
+	buckets    []float64
+	mu         sync.Mutex
+	counts     []uint64
+	sum        float64
+	count      uint64
+}
+
+// gaugeFunc is a gauge read when scraped.
+type gaugeFunc struct {
+	name, help string
+	label      string
+	collect    func() map[string]float64
+}
+
+type metricWriter interface {
+	writeTo(w io.Writer)
+}
+
+var metricsRegistry []metricWriter
+
+func newCounter(name, help string, labels ...string) *metricVec {
+	return newMetricVec("counter", name, help, labels)
+}
+
+func newGauge(name, help string, labels ...string) *metricVec {
+	return newMetricVec("gauge", name, help, labels)
+}
+
+func newMetricVec(kind, name, help string, labels []string) *metricVec {
+	m := &metricVec{name: name, help: help, kind: kind, labels: labels, values: make(map[string]float64)}
+	metricsRegistry = append(metricsRegistry, m)
+	return m
+}
+
+func newHistogram(name, help string, buckets ...float64) *histogram {
+	h := &histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+	metricsRegistry = append(metricsRegistry, h)
+	return h
+}
+
+func newGaugeFunc(name, help, label string, collect func() map[string]float64) {
+	metricsRegistry = append(metricsRegistry, &gaugeFunc{name: name, help: help, label: label, collect: collect})
+}
+
+func (m *metricVec) add(v float64, labelValues ...string) {
+	m.mu.Lock()
+	m.values[strings.Join(labelValues, "\xff")] += v
+	m.mu.Unlock()
+}
+
+func (m *metricVec) inc(labelValues ...string) { m.add(1, labelValues...) }
+
+// replace swaps in a whole new set of values for a one-label gauge, so
+// label values that went away disappear.
+func (m *metricVec) replace(values map[string]float64) {
+	m.mu.Lock()
+	m.values = values
+	m.mu.Unlock()
+}
+
+func (m *metricVec) writeTo(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	if len(m.labels) == 0 && len(m.values) == 0 {
+		fmt.Fprintf(w, "%s 0\n", m.name)
+		return
+	}
+	keys := make([]string, 0, len(m.values))
+	for k := range m.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", m.name, labelPairs(m.labels, strings.Split(k, "\xff")), formatMetric(m.values[k]))
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for i, b := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, formatMetric(b), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n%s_sum %s\n%s_count %d\n", h.name, h.count, h.name, formatMetric(h.sum), h.name, h.count)
+}
+
+func (g *gaugeFunc) writeTo(w io.Writer) {
+	values := g.collect()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, labelPairs([]string{g.label}, []string{k}), formatMetric(values[k]))
+	}
+}
+
+func labelPairs(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, n := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		v = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+		fmt.Fprintf(&b, `%s="%s"`, n, v)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatMetric(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+var (
+	feedBuildSeconds = newHistogram("channelforge_feed_build_seconds",
+		"Time taken to build the feed.", 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30)
+	feedItems = newGauge("channelforge_feed_items",
+		"Videos per category in the last feed built.", "category")
+	toolRuns = newCounter("channelforge_tool_runs_total",
+		"ffmpeg and ffprobe invocations.", "tool")
+	toolFailures = newCounter("channelforge_tool_failures_total",
+		"ffmpeg and ffprobe invocations that failed.", "tool")
+	// Reported as part of channelforge_job_queue_depth
+	toolsRunning = &metricVec{values: make(map[string]float64)}
+	contentBytes = newCounter("channelforge_content_bytes_total",
+		"Bytes sent from /content/.")
+	activeStreams = newGauge("channelforge_active_streams",
+		"Videos being sent from /content/ right now.")
+	uploadSizes = newHistogram("channelforge_upload_size_bytes",
+		"Size of uploaded videos.", 10<<20, 100<<20, 500<<20, 1<<30, 4<<30, 10<<30, 50<<30)
+	loginFailures = newCounter("channelforge_login_failures_total",
+		"Failed logins by reason.", "reason")
+)
+
+func init() {
+	for _, tool := range []string{"ffmpeg", "ffprobe"} {
+		toolRuns.add(0, tool)
+		toolFailures.add(0, tool)
+	}
+	newGaugeFunc("channelforge_job_queue_depth",
+		"Work waiting or in progress: unfinished resumable uploads and running ffmpeg/ffprobe processes.", "queue",
+		func() map[string]float64 {
+			out := map[string]float64{"uploads": float64(pendingUploads()), "ffmpeg": 0, "ffprobe": 0}
+			toolsRunning.mu.Lock()
+			for k, v := range toolsRunning.values {
+				out[k] = v
+			}
+			toolsRunning.mu.Unlock()
+			return out
+		})
+}
+
+// pendingUploads counts the resumable uploads that haven't finished.
+func pendingUploads() int {
+	if uploads == nil {
+		return 0
+	}
+	entries, err := os.ReadDir(uploads.dir)
+	if err != nil {
+		return 0
+	}
+	n := 0
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".info") {
+			n++
+		}
+	}
+	return n
+}
+
+// runTool runs ffmpeg or ffprobe, counting the run, and returns its
+// standard output. Like cmd.Output, a failed run's standard error is in
+// the *exec.ExitError.
+func runTool(tool string, cmd *exec.Cmd) ([]byte, error) {
+	toolRuns.inc(tool)
+	toolsRunning.add(1, tool)
+	start := time.Now()
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	done, err := startTool(cmd)
+	if err == nil {
+		err = cmd.Wait()
+		done()
+	}
+	if ee, ok := err.(*exec.ExitError); ok {
+		ee.Stderr = stderr.Bytes()
+	}
+	out := stdout.Bytes()
+	toolsRunning.add(-1, tool)
+	if err != nil {
+		toolFailures.inc(tool)
+	}
+	logFor("tools").Debug("ran "+tool, "args", cmd.Args[1:], "took", time.Since(start), "err", err)
+	return out, err
+}
+
+// recordFeedBuild notes how long a feed took and what it held.
+func recordFeedBuild(start time.Time, feed *Feed, err error) {
+	feedBuildSeconds.observe(time.Since(start).Seconds())
+	if err != nil {
+		noteFeedBuild(start, 0, err)
+		return
+	}
+	total := 0
+	items := make(map[string]float64)
+	for _, c := range feed.Categories {
+		n := len(c.Items)
+		for _, s := range c.Series {
+			for _, se := range s.Seasons {
+				n += len(se.Items)
+			}
+		}
+		items[c.Name] = float64(n)
+		total += n
+	}
+	feedItems.replace(items)
+	noteFeedBuild(start, total, nil)
+}
+
+// countingWriter counts the bytes of a response body.
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.ResponseWriter.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// ReadFrom keeps sendfile working for files served through the writer.
+func (c *countingWriter) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	var err error
+	if rf, ok := c.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(c.ResponseWriter, r)
+	}
+	c.n += n
+	return n, err
+}
+
+// registerMetrics adds /metrics if it's enabled. public says whether the
+// listener is the one devices use.
+func registerMetrics(public bool) {
+	if !metricsEnabled {
+		return
+	}
+	if public && metricsToken == "" {
+		logFor("metrics").Warn("/metrics is open to anyone who can reach the server; set metrics.token")
+	}
+	http.HandleFunc("/metrics", metricsHandler)
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if metricsToken != "" {
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(metricsToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range metricsRegistry {
+		m.writeTo(w)
+	}
+}
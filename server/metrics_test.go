@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scrape reads one sample from /metrics; line is the metric name with its
+// labels as they are written.
+func scrape(t *testing.T, line string) float64 {
+	t.Helper()
+	w := httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != 200 {
+		t.Fatalf("/metrics: %d", w.Code)
+	}
+	sc := bufio.NewScanner(w.Body)
+	for sc.Scan() {
+		if v, ok := strings.CutPrefix(sc.Text(), line+" "); ok {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return f
+		}
+	}
+	return 0
+}
+
+func TestMetricsMoveAfterContentRequest(t *testing.T) {
+	s := newTestServer(t)
+	film := filepath.Join(s.root, "Movies", "Film", "film.mp4")
+	if err := os.WriteFile(film, []byte("0123456789"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	before := scrape(t, "channelforge_content_bytes_total")
+
+	w := httptest.NewRecorder()
+	contentHandler(s.root).ServeHTTP(w, httptest.NewRequest("GET", "/content/Movies/Film/film.mp4", nil))
+	if w.Code != 200 {
+		t.Fatalf("content: %d", w.Code)
+	}
+	if got := scrape(t, "channelforge_content_bytes_total") - before; got != 10 {
+		t.Errorf("content bytes grew by %v, want 10", got)
+	}
+	if got := scrape(t, "channelforge_active_streams"); got != 0 {
+		t.Errorf("active streams after the request = %v", got)
+	}
+}
+
+func TestMetricsToken(t *testing.T) {
+	old := metricsToken
+	metricsToken = "scrape-secret"
+	t.Cleanup(func() { metricsToken = old })
+
+	w := httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != 401 {
+		t.Errorf("without token: %d", w.Code)
+	}
+	r := httptest.NewRequest("GET", "/metrics", nil)
+	r.Header.Set("Authorization", "Bearer scrape-secret")
+	w = httptest.NewRecorder()
+	metricsHandler(w, r)
+	if w.Code != 200 {
+		t.Errorf("with token: %d", w.Code)
+	}
+}
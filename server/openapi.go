@@ -0,0 +1,196 @@
+package main
+
+// openAPISpec describes the /api/v1/ endpoints. It is served at
+// /api/v1/openapi.json with the server URL filled in; keep it in step with
+// api.go.
+const openAPISpec = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "ChannelForge API",
+    "version": "1.0.0",
+    "description": "Manage the ChannelForge library. Authenticate with a personal API token from the admin UI (Authorization: Bearer <token>). Token scopes and the owner's role decide what is allowed. Movie categories (named \"Movies\") hold movies; every other category holds series, which hold seasons, which hold episodes."
+  },
+  "servers": [{"url": "/api/v1"}],
+  "security": [{"bearerAuth": []}],
+  "paths": {
+    "/": {
+      "get": {
+        "summary": "API information",
+        "responses": {"200": {"description": "Version and the signed in user"}, "401": {"$ref": "#/components/responses/Error"}}
+      }
+    },
+    "/categories": {
+      "get": {
+        "summary": "List categories",
+        "responses": {
+          "200": {"description": "Categories", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Category"}}}}},
+          "401": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "post": {
+        "summary": "Create a category",
+        "description": "Needs the create scope.",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/NewFolder"}}}},
+        "responses": {
+          "201": {"description": "Created", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Category"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/categories/{category}": {
+      "parameters": [{"$ref": "#/components/parameters/category"}],
+      "get": {
+        "summary": "Get a category with the names of its movies or series",
+        "responses": {"200": {"description": "Category; has a movies or a series array depending on its type"}, "404": {"$ref": "#/components/responses/Error"}}
+      },
+      "delete": {
+        "summary": "Delete a category and everything in it",
+        "description": "Needs the delete scope. Deleted folders go to the trash and can be restored from the admin UI until they are purged.",
+        "responses": {"204": {"description": "Deleted"}, "403": {"$ref": "#/components/responses/Error"}, "404": {"$ref": "#/components/responses/Error"}}
+      }
+    },
+    "/categories/{category}/movies": {
+      "parameters": [{"$ref": "#/components/parameters/category"}],
+      "get": {
+        "summary": "List movies",
+        "responses": {"200": {"description": "Movies", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Item"}}}}}}
+      },
+      "post": {
+        "summary": "Add a movie",
+        "description": "Needs the upload scope. Send the video in the form, or upload it first through /uploads/ and pass its upload_id.",
+        "requestBody": {"$ref": "#/components/requestBodies/NewItem"},
+        "responses": {
+          "201": {"description": "Created", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Item"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/categories/{category}/movies/{movie}": {
+      "parameters": [{"$ref": "#/components/parameters/category"}, {"name": "movie", "in": "path", "required": true, "schema": {"type": "string"}}],
+      "get": {"summary": "Get a movie", "responses": {"200": {"description": "Movie", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Item"}}}}, "404": {"$ref": "#/components/responses/Error"}}},
+      "delete": {"summary": "Delete a movie", "description": "Needs the delete scope.", "responses": {"204": {"description": "Deleted"}, "404": {"$ref": "#/components/responses/Error"}}}
+    },
+    "/categories/{category}/movies/{movie}/metadata": {
+      "parameters": [{"$ref": "#/components/parameters/category"}, {"name": "movie", "in": "path", "required": true, "schema": {"type": "string"}}],
+      "get": {"summary": "Get descriptions", "responses": {"200": {"$ref": "#/components/responses/Metadata"}}},
+      "put": {"summary": "Replace descriptions", "requestBody": {"$ref": "#/components/requestBodies/Metadata"}, "responses": {"200": {"$ref": "#/components/responses/Metadata"}}},
+      "patch": {"summary": "Update some descriptions", "requestBody": {"$ref": "#/components/requestBodies/Metadata"}, "responses": {"200": {"$ref": "#/components/responses/Metadata"}}}
+    },
+    "/categories/{category}/movies/{movie}/thumbnail": {
+      "parameters": [{"$ref": "#/components/parameters/category"}, {"name": "movie", "in": "path", "required": true, "schema": {"type": "string"}}],
+      "get": {"summary": "Download the thumbnail", "responses": {"200": {"description": "Image"}, "404": {"$ref": "#/components/responses/Error"}}},
+      "put": {"summary": "Replace the thumbnail", "requestBody": {"$ref": "#/components/requestBodies/Thumbnail"}, "responses": {"200": {"description": "Updated item", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Item"}}}}}}
+    },
+    "/categories/{category}/series": {
+      "parameters": [{"$ref": "#/components/parameters/category"}],
+      "get": {"summary": "List series", "responses": {"200": {"description": "Series", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Item"}}}}}}},
+      "post": {"summary": "Create a series", "description": "Needs the create scope.", "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/NewFolder"}}}}, "responses": {"201": {"description": "Created"}, "409": {"$ref": "#/components/responses/Error"}}}
+    },
+    "/categories/{category}/series/{series}": {
+      "parameters": [{"$ref": "#/components/parameters/category"}, {"$ref": "#/components/parameters/series"}],
+      "get": {"summary": "Get a series with its season names", "responses": {"200": {"description": "Series", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Node"}}}}}},
+      "delete": {"summary": "Delete a series", "responses": {"204": {"description": "Deleted"}}}
+    },
+    "/categories/{category}/series/{series}/seasons": {
+      "parameters": [{"$ref": "#/components/parameters/category"}, {"$ref": "#/components/parameters/series"}],
+      "get": {"summary": "List seasons", "responses": {"200": {"description": "Seasons"}}},
+      "post": {"summary": "Create a season", "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/NewFolder"}}}}, "responses": {"201": {"description": "Created"}}}
+    },
+    "/categories/{category}/series/{series}/seasons/{season}": {
+      "parameters": [{"$ref": "#/components/parameters/category"}, {"$ref": "#/components/parameters/series"}, {"$ref": "#/components/parameters/season"}],
+      "get": {"summary": "Get a season with its episode names", "responses": {"200": {"description": "Season", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Node"}}}}}},
+      "delete": {"summary": "Delete a season", "responses": {"204": {"description": "Deleted"}}}
+    },
+    "/categories/{category}/series/{series}/seasons/{season}/episodes": {
+      "parameters": [{"$ref": "#/components/parameters/category"}, {"$ref": "#/components/parameters/series"}, {"$ref": "#/components/parameters/season"}],
+      "get": {"summary": "List episodes", "responses": {"200": {"description": "Episodes", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Item"}}}}}}},
+      "post": {"summary": "Add an episode", "requestBody": {"$ref": "#/components/requestBodies/NewItem"}, "responses": {"201": {"description": "Created", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Item"}}}}, "409": {"$ref": "#/components/responses/Error"}}}
+    },
+    "/categories/{category}/series/{series}/seasons/{season}/episodes/{episode}": {
+      "parameters": [{"$ref": "#/components/parameters/category"}, {"$ref": "#/components/parameters/series"}, {"$ref": "#/components/parameters/season"}, {"name": "episode", "in": "path", "required": true, "schema": {"type": "string"}}],
+      "get": {"summary": "Get an episode", "responses": {"200": {"description": "Episode", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Item"}}}}}},
+      "delete": {"summary": "Delete an episode", "responses": {"204": {"description": "Deleted"}}}
+    },
+    "/uploads/": {
+      "post": {
+        "summary": "Start a resumable upload (tus 1.0.0)",
+        "description": "Implements the tus creation, expiration and termination extensions. Send the video with PATCH requests to the returned Location, then pass its id as upload_id when adding a movie or episode. The .../metadata and .../thumbnail endpoints also exist for series and seasons.",
+        "parameters": [
+          {"name": "Tus-Resumable", "in": "header", "required": true, "schema": {"type": "string", "enum": ["1.0.0"]}},
+          {"name": "Upload-Length", "in": "header", "required": true, "schema": {"type": "integer"}},
+          {"name": "Upload-Metadata", "in": "header", "schema": {"type": "string"}}
+        ],
+        "responses": {"201": {"description": "Created; see the Location header"}}
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {"bearerAuth": {"type": "http", "scheme": "bearer"}},
+    "parameters": {
+      "category": {"name": "category", "in": "path", "required": true, "schema": {"type": "string"}},
+      "series": {"name": "series", "in": "path", "required": true, "schema": {"type": "string"}},
+      "season": {"name": "season", "in": "path", "required": true, "schema": {"type": "string"}}
+    },
+    "schemas": {
+      "Error": {"type": "object", "properties": {"error": {"type": "string"}, "status": {"type": "integer"}}},
+      "Category": {"type": "object", "properties": {"name": {"type": "string"}, "type": {"type": "string", "enum": ["movies", "series"]}}},
+      "NewFolder": {"type": "object", "required": ["name"], "properties": {"name": {"type": "string"}, "short_description": {"type": "string"}, "long_description": {"type": "string"}}},
+      "Item": {
+        "type": "object",
+        "properties": {
+          "name": {"type": "string"},
+          "video": {"type": "string", "description": "File name of the video"},
+          "video_size": {"type": "integer"},
+          "thumbnail": {"type": "string", "description": "File name of the thumbnail"},
+          "short_description": {"type": "string"},
+          "long_description": {"type": "string"},
+          "modified": {"type": "string", "format": "date-time"}
+        }
+      },
+      "Node": {"allOf": [{"$ref": "#/components/schemas/Item"}, {"type": "object", "properties": {"children": {"type": "array", "items": {"type": "string"}}}}]},
+      "Metadata": {"type": "object", "properties": {"short_description": {"type": "string"}, "long_description": {"type": "string"}}}
+    },
+    "requestBodies": {
+      "NewItem": {
+        "required": true,
+        "content": {
+          "multipart/form-data": {
+            "schema": {
+              "type": "object",
+              "required": ["name"],
+              "properties": {
+                "name": {"type": "string"},
+                "video": {"type": "string", "format": "binary"},
+                "upload_id": {"type": "string"},
+                "thumbnail": {"type": "string", "format": "binary"},
+                "short_description": {"type": "string"},
+                "long_description": {"type": "string"}
+              }
+            }
+          },
+          "application/json": {
+            "schema": {"type": "object", "required": ["name", "upload_id"], "properties": {"name": {"type": "string"}, "upload_id": {"type": "string"}, "short_description": {"type": "string"}, "long_description": {"type": "string"}}}
+          }
+        }
+      },
+      "Metadata": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Metadata"}}}},
+      "Thumbnail": {
+        "required": true,
+        "content": {
+          "image/jpeg": {"schema": {"type": "string", "format": "binary"}},
+          "image/png": {"schema": {"type": "string", "format": "binary"}},
+          "multipart/form-data": {"schema": {"type": "object", "properties": {"thumbnail": {"type": "string", "format": "binary"}}}}
+        }
+      }
+    },
+    "responses": {
+      "Error": {"description": "Error", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+      "Metadata": {"description": "Descriptions", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Metadata"}}}}
+    }
+  }
+}
+`
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ==== DEVICE ACTIVATION ====
+//
+// A Roku without a key asks POST /activate/code for a short code, shows it
+// on screen and polls /activate/poll with the secret poll token it got along
+// with it. Once an admin enters the code on /admin/activate, the next poll
+// hands the device its key, which it keeps for good.
+
+const (
+	activationAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789" // no 0/O or 1/I
+	activationLifetime = 10 * time.Minute
+	activationInterval = 5 // seconds between polls
+	activationMaxPerIP = 5
+)
+
+var errActivationUnknown = errors.New("unknown or expired code")
+
+type activation struct {
+	Code      string
+	Model     string
+	IP        string
+	Created   time.Time
+	Expires   time.Time
+	DeviceKey string // set once approved, until the device collects it
+}
+
+var activations = struct {
+	sync.Mutex
+	byPoll map[string]*activation // poll token hash -> activation
+}{byPoll: make(map[string]*activation)}
+
+func newActivationCode() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	for i := range b {
+		b[i] = activationAlphabet[int(b[i])%len(activationAlphabet)]
+	}
+	return string(b[:4]) + "-" + string(b[4:])
+}
+
+// normalizeCode accepts codes typed in lower case or without the dash.
+func normalizeCode(code string) string {
+	code = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	if len(code) != 8 {
+		return code
+	}
+	return code[:4] + "-" + code[4:]
+}
+
+// purgeActivationsLocked drops expired codes.
+func purgeActivationsLocked(now time.Time) {
+	for h, a := range activations.byPoll {
+		if now.After(a.Expires) {
+			delete(activations.byPoll, h)
+		}
+	}
+}
+
+// approveActivation turns a pending code into a registered device.
+func approveActivation(code, name string) error {
+	code = normalizeCode(code)
+	now := time.Now()
+	activations.Lock()
+	defer activations.Unlock()
+	purgeActivationsLocked(now)
+	for _, a := range activations.byPoll {
+		if a.Code == code && a.DeviceKey == "" {
+			if name == "" {
+				name = a.Model
+			}
+			a.DeviceKey = devices.create(name)
+			// Give the device time to poll even if the code was nearly expired
+			a.Expires = now.Add(activationLifetime)
+			logFor("devices").Info("activated device", "name", name, "code", code)
+			return nil
+		}
+	}
+	return errActivationUnknown
+}
+
+// denyActivation throws a pending code away.
+func denyActivation(code string) {
+	code = normalizeCode(code)
+	activations.Lock()
+	defer activations.Unlock()
+	for h, a := range activations.byPoll {
+		if a.Code == code {
+			delete(activations.byPoll, h)
+		}
+	}
+}
+
+// pendingActivations lists codes waiting for approval, oldest first.
+func pendingActivations() []activation {
+	activations.Lock()
+	defer activations.Unlock()
+	purgeActivationsLocked(time.Now())
+	var out []activation
+	for _, a := range activations.byPoll {
+		if a.DeviceKey == "" {
+			out = append(out, *a)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Created.Before(out[j].Created) })
+	return out
+}
+
+// activateCodeHandler serves POST /activate/code.
+func activateCodeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	ip := clientIP(r)
+	model := strings.TrimSpace(r.FormValue("model"))
+	if len(model) > 64 {
+		model = model[:64]
+	}
+	if model == "" {
+		model = "Roku"
+	}
+	now := time.Now()
+	activations.Lock()
+	purgeActivationsLocked(now)
+	n := 0
+	for _, a := range activations.byPoll {
+		if a.IP == ip {
+			n++
+		}
+	}
+	if n >= activationMaxPerIP {
+		activations.Unlock()
+		apiError(w, http.StatusTooManyRequests, "too many pending codes from this address")
+		return
+	}
+	poll := newSessionToken()
+	a := &activation{
+		Code:    newActivationCode(),
+		Model:   model,
+		IP:      ip,
+		Created: now,
+		Expires: now.Add(activationLifetime),
+	}
+	activations.byPoll[hashToken(poll)] = a
+	activations.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"code":           a.Code,
+		"poll_token":     poll,
+		"expires_in":     int(activationLifetime.Seconds()),
+		"interval":       activationInterval,
+		"activation_url": adminURL(r) + "/admin/activate",
+	})
+}
+
+// activatePollHandler serves GET /activate/poll?token=...
+func activatePollHandler(w http.ResponseWriter, r *http.Request) {
+	h := hashToken(r.FormValue("token"))
+	activations.Lock()
+	purgeActivationsLocked(time.Now())
+	a, ok := activations.byPoll[h]
+	if ok && a.DeviceKey != "" {
+		// The key is handed out exactly once
+		delete(activations.byPoll, h)
+	}
+	activations.Unlock()
+
+	switch {
+	case !ok:
+		writeJSON(w, http.StatusNotFound, map[string]string{"status": "expired"})
+	case a.DeviceKey == "":
+		writeJSON(w, http.StatusOK, map[string]string{"status": "pending"})
+	default:
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusOK, map[string]string{"status": "approved", "device_key": a.DeviceKey})
+	}
+}
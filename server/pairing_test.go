@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// newActivationTest starts pairing with no codes pending.
+func newActivationTest(t *testing.T) *testServer {
+	t.Helper()
+	s := newTestServer(t)
+	old := activations.byPoll
+	t.Cleanup(func() { activations.byPoll = old })
+	activations.byPoll = make(map[string]*activation)
+	return s
+}
+
+// requestCode asks for an activation code the way a Roku does.
+func requestCode(t *testing.T, ip string) (code, poll string, status int) {
+	t.Helper()
+	r := httptest.NewRequest("POST", "/activate/code", strings.NewReader("model=Roku+Ultra"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.RemoteAddr = ip + ":1234"
+	w := httptest.NewRecorder()
+	activateCodeHandler(w, r)
+	var resp struct {
+		Code      string `json:"code"`
+		PollToken string `json:"poll_token"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return resp.Code, resp.PollToken, w.Code
+}
+
+// pollCode returns the poll status and the device key, if handed out.
+func pollCode(t *testing.T, poll string) (status, key string) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	activatePollHandler(w, httptest.NewRequest("GET", "/activate/poll?token="+url.QueryEscape(poll), nil))
+	var resp struct {
+		Status    string `json:"status"`
+		DeviceKey string `json:"device_key"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("poll: %v: %s", err, w.Body)
+	}
+	return resp.Status, resp.DeviceKey
+}
+
+func TestActivationApprove(t *testing.T) {
+	s := newActivationTest(t)
+	code, poll, status := requestCode(t, "192.0.2.1")
+	if status != http.StatusOK || code == "" || poll == "" {
+		t.Fatalf("code request: %d %q %q", status, code, poll)
+	}
+	if got, _ := pollCode(t, poll); got != "pending" {
+		t.Fatalf("before approval: %q", got)
+	}
+
+	// Only admins may approve
+	viewer := s.as(t, "viewer", RoleViewer)
+	if w := viewer.postForm(t, "/admin/activate", url.Values{"action": {"approve"}, "code": {code}}); w.Code != http.StatusForbidden {
+		t.Errorf("viewer approving: got %d, want 403", w.Code)
+	}
+	if got, _ := pollCode(t, poll); got != "pending" {
+		t.Fatalf("after the viewer's attempt: %q", got)
+	}
+
+	// Codes may be typed in lower case and without the dash
+	typed := strings.ToLower(strings.Replace(code, "-", "", 1))
+	w := s.postForm(t, "/admin/activate", url.Values{"action": {"approve"}, "code": {typed}, "name": {"Den"}})
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Device activated") {
+		t.Fatalf("approve: got %d: %s", w.Code, w.Body)
+	}
+	got, key := pollCode(t, poll)
+	if got != "approved" || key == "" {
+		t.Fatalf("after approval: %q %q", got, key)
+	}
+	if d := devices.lookup(key, httptest.NewRequest("GET", "/feed.xml", nil)); d == nil || d.Name != "Den" {
+		t.Errorf("device not registered: %+v", d)
+	}
+
+	// The key is handed out once
+	if got, key := pollCode(t, poll); got != "expired" || key != "" {
+		t.Errorf("second poll: %q %q", got, key)
+	}
+	if err := approveActivation(code, ""); err == nil {
+		t.Error("a collected code was approved again")
+	}
+}
+
+func TestActivationDeny(t *testing.T) {
+	s := newActivationTest(t)
+	code, poll, _ := requestCode(t, "192.0.2.1")
+	if w := s.postForm(t, "/admin/activate", url.Values{"action": {"deny"}, "code": {code}}); w.Code != http.StatusOK {
+		t.Fatalf("deny: got %d", w.Code)
+	}
+	if got, key := pollCode(t, poll); got != "expired" || key != "" {
+		t.Errorf("poll after deny: %q %q", got, key)
+	}
+	if err := approveActivation(code, ""); err == nil {
+		t.Error("a denied code was approved")
+	}
+	if len(devices.list()) != 0 {
+		t.Error("denying registered a device")
+	}
+}
+
+func TestActivationLimitPerIP(t *testing.T) {
+	newActivationTest(t)
+	for i := 0; i < activationMaxPerIP; i++ {
+		if _, _, status := requestCode(t, "192.0.2.1"); status != http.StatusOK {
+			t.Fatalf("code %d: got %d", i+1, status)
+		}
+	}
+	if _, _, status := requestCode(t, "192.0.2.1"); status != http.StatusTooManyRequests {
+		t.Errorf("one code too many: got %d, want 429", status)
+	}
+	if _, _, status := requestCode(t, "192.0.2.2"); status != http.StatusOK {
+		t.Errorf("another address: got %d", status)
+	}
+}
+
+func TestActivationRequiresFeedKey(t *testing.T) {
+	keepSettings(t)
+	s := newActivationTest(t)
+	oldGuard := loginGuard.path
+	t.Cleanup(func() { loginGuard.path = oldGuard })
+	cfg.DataDir, cfg.Activation = dataDir, true
+	if err := finishConfig(nil); err != nil {
+		t.Fatal(err)
+	}
+	if !feedKeyRequired || !signContentURLs {
+		t.Fatalf("activation on: feed keys required %v, links signed %v", feedKeyRequired, signContentURLs)
+	}
+
+	feed := func(key string) int {
+		w := httptest.NewRecorder()
+		feedHandler(s.root).ServeHTTP(w, httptest.NewRequest("GET", "/feed.xml?key="+url.QueryEscape(key), nil))
+		return w.Code
+	}
+	if got := feed(""); got != http.StatusUnauthorized {
+		t.Errorf("feed without a key: got %d, want 401", got)
+	}
+	code, poll, _ := requestCode(t, "192.0.2.1")
+	if err := approveActivation(code, "Den"); err != nil {
+		t.Fatal(err)
+	}
+	_, key := pollCode(t, poll)
+	if got := feed(key); got == http.StatusUnauthorized {
+		t.Error("feed refused the paired device's key")
+	}
+}
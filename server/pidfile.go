@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ==== SERVER PID FILE ====
+//
+// A running server keeps accounts, sessions, tokens and devices in memory
+// and writes them back over the files, so the commands that change them
+// refuse to run while serverPIDFile in the data directory names a live
+// process. After a SIGHUP handoff the new process writes its own PID over
+// the old one's.
+
+const serverPIDFile = "server.pid"
+
+// writePIDFile records this process as the one serving the data directory.
+func writePIDFile() {
+	if err := os.WriteFile(dataPath(serverPIDFile), []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		logFor("server").Warn("failed to write PID file; commands can't tell the server is running", "err", err)
+	}
+}
+
+// removePIDFile removes the PID file unless another process has taken it.
+func removePIDFile() {
+	if pid, _ := readPIDFile(); pid == os.Getpid() {
+		os.Remove(dataPath(serverPIDFile))
+	}
+}
+
+func readPIDFile() (int, error) {
+	b, err := os.ReadFile(dataPath(serverPIDFile))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
+
+// requireStoppedServer fails when a server is running on the data
+// directory. A PID file left behind by a crash is ignored once its process
+// is gone.
+func requireStoppedServer() error {
+	pid, err := readPIDFile()
+	if err != nil || pid == os.Getpid() || !processAlive(pid) {
+		return nil
+	}
+	return fmt.Errorf("the server (pid %d) is running and would overwrite this change; stop it first, or remove %s if that process is not the server",
+		pid, dataPath(serverPIDFile))
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// ==== REVERSE PROXIES AND SUB-PATHS ====
+//
+// Behind nginx or similar, the address the Roku and browsers use is not the
+// one we listen on. Links come from --base-url when it's set, otherwise from
+// the request, where X-Forwarded-Proto/Host/Prefix/For are believed only
+// from --trusted-proxies.
+//
+// Everything can also live under a sub-path such as /media. The proxy may
+// pass that path on or strip it (and say so in X-Forwarded-Prefix); either
+// way handlers only ever see paths like /admin, and mountHandler puts the
+// prefix back into links, redirects and cookies on the way out.
+
+var (
+	trustedProxies []*net.IPNet
+	basePath       string // e.g. "/media", no trailing slash
+)
+
+// configureBaseURL checks --base-url and --base-path and makes them agree.
+func configureBaseURL() error {
+	p, err := cleanBasePath(basePath)
+	if err != nil {
+		return errors.New("--base-path must look like /media")
+	}
+	basePath = p
+	if publicBaseURL == "" {
+		return nil
+	}
+	u, err := url.Parse(publicBaseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" {
+		return errors.New("--base-url must be an absolute http:// or https:// URL")
+	}
+	urlPath, err := cleanBasePath(u.Path)
+	if err != nil {
+		return errors.New("--base-url has an invalid path")
+	}
+	switch {
+	case basePath == "":
+		basePath = urlPath
+	case urlPath == "":
+	case urlPath != basePath:
+		return errors.New("--base-url and --base-path disagree")
+	}
+	publicBaseURL = u.Scheme + "://" + u.Host + basePath
+	return nil
+}
+
+// setTrustedProxies parses a comma separated list of addresses and CIDRs.
+func setTrustedProxies(list string) error {
+	trustedProxies = nil
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return errors.New("invalid proxy address " + s)
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			trustedProxies = append(trustedProxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return err
+		}
+		trustedProxies = append(trustedProxies, n)
+	}
+	return nil
+}
+
+// cleanBasePath normalises a sub-path to "/name" form, or "" for the root.
+func cleanBasePath(p string) (string, error) {
+	p = strings.TrimRight(strings.TrimSpace(p), "/")
+	if p == "" {
+		return "", nil
+	}
+	if !validPrefix.MatchString(p) {
+		return "", errors.New("invalid base path " + p)
+	}
+	return p, nil
+}
+
+// validPrefix keeps forwarded prefixes to plain path segments, since they
+// end up inside HTML and headers.
+var validPrefix = regexp.MustCompile(`^(/[A-Za-z0-9._~-]+)+$`)
+
+func isTrustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+func fromTrustedProxy(r *http.Request) bool {
+	if len(trustedProxies) == 0 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return isTrustedProxy(host)
+}
+
+// forwarded returns the first value of a X-Forwarded-* header set by a
+// trusted proxy.
+func forwarded(r *http.Request, name string) string {
+	if !fromTrustedProxy(r) {
+		return ""
+	}
+	v := r.Header.Get(name)
+	if i := strings.IndexByte(v, ','); i >= 0 {
+		v = v[:i]
+	}
+	return strings.TrimSpace(v)
+}
+
+// forwardedClientIP walks X-Forwarded-For from the right, skipping our own
+// proxies, to find the address the request really came from.
+func forwardedClientIP(r *http.Request, peer string) string {
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(hops[i])
+		if net.ParseIP(ip) == nil {
+			break
+		}
+		if !isTrustedProxy(ip) {
+			return ip
+		}
+		peer = ip
+	}
+	return peer
+}
+
+// requestPrefix is the sub-path the client sees this server under.
+func requestPrefix(r *http.Request) string {
+	if basePath != "" {
+		return basePath
+	}
+	p, err := cleanBasePath(forwarded(r, "X-Forwarded-Prefix"))
+	if err != nil {
+		return ""
+	}
+	return p
+}
+
+// baseURL is the scheme, host and sub-path that links handed to clients
+// start with.
+func baseURL(r *http.Request) string {
+	// In combined mode the public URL is the device listener's, not ours
+	if publicBaseURL != "" && !isAdminRequest(r) {
+		return publicBaseURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if p := forwarded(r, "X-Forwarded-Proto"); p == "http" || p == "https" {
+		scheme = p
+	}
+	host := r.Host
+	if h := forwarded(r, "X-Forwarded-Host"); h != "" {
+		host = h
+	}
+	return scheme + "://" + host + requestPrefix(r)
+}
+
+// mountHandler serves next below the request's sub-path.
+func mountHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if basePath != "" {
+			switch {
+			case r.URL.Path == basePath:
+				http.Redirect(w, r, basePath+"/", http.StatusMovedPermanently)
+				return
+			case strings.HasPrefix(r.URL.Path, basePath+"/"):
+				// Proxies that strip the prefix themselves are fine too
+				r.URL.Path = strings.TrimPrefix(r.URL.Path, basePath)
+				r.URL.RawPath = strings.TrimPrefix(r.URL.RawPath, basePath)
+			}
+		}
+		prefix := requestPrefix(r)
+		// Devices get absolute links and never a page or a cookie
+		if prefix == "" || r.URL.Path == "/feed.xml" || strings.HasPrefix(r.URL.Path, "/content/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		pw := &prefixWriter{ResponseWriter: w, prefix: prefix}
+		next.ServeHTTP(pw, r)
+		pw.finish()
+	})
+}
+
+// prefixWriter adds the sub-path to redirects, cookie paths and the links
+// in HTML pages. Anything else passes straight through once its headers
+// are out, so videos keep sendfile and streams can flush.
+type prefixWriter struct {
+	http.ResponseWriter
+	prefix      string
+	wroteHeader bool
+	status      int
+	html        bool
+	buf         bytes.Buffer
+}
+
+func (p *prefixWriter) WriteHeader(code int) {
+	if p.wroteHeader {
+		return
+	}
+	p.wroteHeader = true
+	h := p.Header()
+	if loc := h.Get("Location"); strings.HasPrefix(loc, "/") && !strings.HasPrefix(loc, "//") {
+		h.Set("Location", p.prefix+loc)
+	}
+	if cookies := h.Values("Set-Cookie"); len(cookies) > 0 {
+		h.Del("Set-Cookie")
+		for _, c := range cookies {
+			h.Add("Set-Cookie", strings.Replace(c, "; Path=/", "; Path="+p.prefix+"/", 1))
+		}
+	}
+	if strings.HasPrefix(h.Get("Content-Type"), "text/html") {
+		// Pages are small; hold them back to rewrite the links
+		p.html = true
+		p.status = code
+		h.Del("Content-Length")
+		return
+	}
+	p.ResponseWriter.WriteHeader(code)
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	if !p.wroteHeader {
+		if p.Header().Get("Content-Type") == "" {
+			p.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		p.WriteHeader(http.StatusOK)
+	}
+	if p.html {
+		return p.buf.Write(b)
+	}
+	return p.ResponseWriter.Write(b)
+}
+
+// ReadFrom keeps sendfile working for files served through the writer.
+func (p *prefixWriter) ReadFrom(r io.Reader) (int64, error) {
+	if !p.wroteHeader && p.Header().Get("Content-Type") != "" {
+		p.WriteHeader(http.StatusOK)
+	}
+	if rf, ok := p.ResponseWriter.(io.ReaderFrom); ok && p.wroteHeader && !p.html {
+		return rf.ReadFrom(r)
+	}
+	// Still to be sniffed, or a page to rewrite
+	return io.Copy(writerOnly{p}, r)
+}
+
+// writerOnly hides ReadFrom so io.Copy doesn't call it again.
+type writerOnly struct{ io.Writer }
+
+// Flush sends what's written so far, except for a page still being held back.
+func (p *prefixWriter) Flush() {
+	if p.html {
+		return
+	}
+	if f, ok := p.ResponseWriter.(http.Flusher); ok {
+		if !p.wroteHeader {
+			p.WriteHeader(http.StatusOK)
+		}
+		f.Flush()
+	}
+}
+
+func (p *prefixWriter) Unwrap() http.ResponseWriter { return p.ResponseWriter }
+
+// rootLinks matches root-relative URLs in href, src and action attributes.
+// Scripts get the sub-path from the page (BasePath) instead.
+var rootLinks = regexp.MustCompile(`(\b(?:href|src|action)=")(/(?:[^/]|$))`)
+
+func (p *prefixWriter) finish() {
+	if !p.html {
+		return
+	}
+	p.ResponseWriter.WriteHeader(p.status)
+	p.ResponseWriter.Write(rootLinks.ReplaceAll(p.buf.Bytes(), []byte("${1}"+p.prefix+"${2}")))
+}
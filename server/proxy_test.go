@@ -0,0 +1,230 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPrefixWriterRewritesAttributesOnly(t *testing.T) {
+	old := basePath
+	basePath = "/media"
+	defer func() { basePath = old }()
+
+	page := `<a href="/admin">x</a><a href="/">home</a><a href="//cdn.example/x">cdn</a>` +
+		`<form action="/admin/upload"></form><img src="/admin/thumb">` +
+		`<script>var s = 'a/' + '/'; fetch('/admin/x');</script>`
+	h := mountHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, page)
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/media/admin", nil))
+	want := `<a href="/media/admin">x</a><a href="/media/">home</a><a href="//cdn.example/x">cdn</a>` +
+		`<form action="/media/admin/upload"></form><img src="/media/admin/thumb">` +
+		`<script>var s = 'a/' + '/'; fetch('/admin/x');</script>`
+	if got := w.Body.String(); got != want {
+		t.Errorf("page rewritten to\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestUploadScriptGetsBasePath(t *testing.T) {
+	old := basePath
+	basePath = "/media"
+	defer func() { basePath = old }()
+
+	r := httptest.NewRequest("GET", "/admin/cat/Movies", nil)
+	w := httptest.NewRecorder()
+	renderPage(w, r, catPage, map[string]interface{}{"Category": "Movies", "IsMovies": true})
+	if !strings.Contains(w.Body.String(), `var BASE = "/media";`) {
+		t.Error("upload script lacks the sub-path")
+	}
+}
+
+// flushRecorder tells whether the writer below prefixWriter was reached.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	readFrom bool
+}
+
+func (f *flushRecorder) ReadFrom(r io.Reader) (int64, error) {
+	f.readFrom = true
+	return io.Copy(f.ResponseRecorder, r)
+}
+
+func TestPrefixWriterPassesThrough(t *testing.T) {
+	rec := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	p := &prefixWriter{ResponseWriter: rec, prefix: "/media"}
+	p.Header().Set("Content-Type", "video/mp4")
+	if _, err := p.ReadFrom(strings.NewReader("video")); err != nil {
+		t.Fatal(err)
+	}
+	p.Flush()
+	if !rec.readFrom {
+		t.Error("ReadFrom did not reach the underlying writer")
+	}
+	if !rec.Flushed {
+		t.Error("Flush did not reach the underlying writer")
+	}
+	if rec.Body.String() != "video" {
+		t.Errorf("body = %q", rec.Body)
+	}
+	if http.NewResponseController(p).Flush() != nil {
+		t.Error("the response controller can't flush through the writer")
+	}
+
+	// A page is held back until finish, however often it's flushed
+	rec = &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	p = &prefixWriter{ResponseWriter: rec, prefix: "/media"}
+	p.Header().Set("Content-Type", "text/html")
+	p.ReadFrom(strings.NewReader(`<a href="/admin">`))
+	p.Flush()
+	if rec.Flushed || rec.readFrom || rec.Body.Len() != 0 {
+		t.Error("page was sent before it was rewritten")
+	}
+	p.finish()
+	if rec.Body.String() != `<a href="/media/admin">` {
+		t.Errorf("page = %q", rec.Body)
+	}
+}
+
+// withTrustedProxies trusts list for the rest of the test.
+func withTrustedProxies(t *testing.T, list string) {
+	t.Helper()
+	keepSettings(t)
+	old := trustedProxies
+	t.Cleanup(func() { trustedProxies = old })
+	if err := setTrustedProxies(list); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	withTrustedProxies(t, "127.0.0.1, 10.0.0.0/8")
+	basePath, publicBaseURL = "", ""
+	forwardedHeaders := map[string]string{
+		"X-Forwarded-Proto":  "https",
+		"X-Forwarded-Host":   "media.example.com",
+		"X-Forwarded-Prefix": "/tv",
+		"X-Forwarded-For":    "203.0.113.7",
+	}
+	tests := []struct {
+		name    string
+		peer    string
+		headers map[string]string
+		wantURL string
+		wantIP  string
+	}{
+		{"untrusted peer", "192.0.2.1", forwardedHeaders, "http://tv.lan:8080", "192.0.2.1"},
+		{"trusted address", "127.0.0.1", forwardedHeaders, "https://media.example.com/tv", "203.0.113.7"},
+		{"trusted range", "10.1.2.3", forwardedHeaders, "https://media.example.com/tv", "203.0.113.7"},
+		{"spoofed leftmost hop", "10.1.2.3", map[string]string{"X-Forwarded-For": "6.6.6.6, 203.0.113.7, 10.0.0.9"},
+			"http://tv.lan:8080", "203.0.113.7"},
+		{"all hops ours", "10.1.2.3", map[string]string{"X-Forwarded-For": "10.0.0.8, 10.0.0.9"},
+			"http://tv.lan:8080", "10.0.0.8"},
+		{"garbage hop", "10.1.2.3", map[string]string{"X-Forwarded-For": "203.0.113.7, unknown"},
+			"http://tv.lan:8080", "10.1.2.3"},
+		{"first of several values", "10.1.2.3", map[string]string{"X-Forwarded-Proto": "https, http", "X-Forwarded-Host": "a.example, b.example"},
+			"https://a.example", "10.1.2.3"},
+		{"unknown scheme", "10.1.2.3", map[string]string{"X-Forwarded-Proto": "gopher"}, "http://tv.lan:8080", "10.1.2.3"},
+		{"invalid prefix", "10.1.2.3", map[string]string{"X-Forwarded-Prefix": `/tv"><script>`}, "http://tv.lan:8080", "10.1.2.3"},
+		{"relative prefix", "10.1.2.3", map[string]string{"X-Forwarded-Prefix": "tv"}, "http://tv.lan:8080", "10.1.2.3"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/feed.xml", nil)
+		r.Host = "tv.lan:8080"
+		r.RemoteAddr = tt.peer + ":40000"
+		for k, v := range tt.headers {
+			r.Header.Set(k, v)
+		}
+		if got := baseURL(r); got != tt.wantURL {
+			t.Errorf("%s: baseURL = %q, want %q", tt.name, got, tt.wantURL)
+		}
+		if got := clientIP(r); got != tt.wantIP {
+			t.Errorf("%s: clientIP = %q, want %q", tt.name, got, tt.wantIP)
+		}
+	}
+}
+
+func TestPublicBaseURLOnDeviceListenerOnly(t *testing.T) {
+	withTrustedProxies(t, "")
+	basePath, publicBaseURL = "", "https://media.example.com/tv"
+	r := httptest.NewRequest("GET", "/feed.xml", nil)
+	r.Host = "127.0.0.1:8081"
+	if got := baseURL(r); got != publicBaseURL {
+		t.Errorf("device listener: baseURL = %q, want %q", got, publicBaseURL)
+	}
+	var got string
+	onAdminListener(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = baseURL(r)
+	})).ServeHTTP(httptest.NewRecorder(), r)
+	if got != "http://127.0.0.1:8081" {
+		t.Errorf("admin listener: baseURL = %q, want the request's own", got)
+	}
+}
+
+func TestConfigureBaseURL(t *testing.T) {
+	keepSettings(t)
+	tests := []struct {
+		url, path         string
+		wantURL, wantPath string
+		wantErr           string
+	}{
+		{"", "", "", "", ""},
+		{"", "/media/", "", "/media", ""},
+		{"https://media.example.com", "", "https://media.example.com", "", ""},
+		{"https://media.example.com/tv/", "", "https://media.example.com/tv", "/tv", ""},
+		{"https://media.example.com", "/tv", "https://media.example.com/tv", "/tv", ""},
+		{"https://media.example.com/tv", "/tv", "https://media.example.com/tv", "/tv", ""},
+		{"https://media.example.com/tv", "/media", "", "", "disagree"},
+		{"", "media", "", "", "--base-path"},
+		{"", "/a b", "", "", "--base-path"},
+		{"media.example.com", "", "", "", "absolute"},
+		{"ftp://media.example.com", "", "", "", "absolute"},
+		{"https://media.example.com/?x=1", "", "", "", "absolute"},
+		{"https://media.example.com/a%20b", "", "", "", "invalid path"},
+	}
+	for _, tt := range tests {
+		publicBaseURL, basePath = tt.url, tt.path
+		err := configureBaseURL()
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%q %q: got %v, want an error about %q", tt.url, tt.path, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || publicBaseURL != tt.wantURL || basePath != tt.wantPath {
+			t.Errorf("%q %q: got %q %q %v, want %q %q", tt.url, tt.path, publicBaseURL, basePath, err, tt.wantURL, tt.wantPath)
+		}
+	}
+}
+
+func TestMountHandler(t *testing.T) {
+	keepSettings(t)
+	basePath = "/media"
+	var seen string
+	h := mountHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.URL.Path
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/media", nil))
+	if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "/media/" {
+		t.Errorf("/media: got %d %q, want a 301 to /media/", w.Code, w.Header().Get("Location"))
+	}
+	for path, want := range map[string]string{
+		"/media/":         "/",
+		"/media/admin":    "/admin",
+		"/media/feed.xml": "/feed.xml",
+		"/admin":          "/admin", // the proxy stripped the prefix already
+		"/mediaX/admin":   "/mediaX/admin",
+	} {
+		seen = ""
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+		if seen != want {
+			t.Errorf("%s reached the handler as %q, want %q", path, seen, want)
+		}
+	}
+}
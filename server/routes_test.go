@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDeleteRoutesRefuseBadNames(t *testing.T) {
+	s := newTestServer(t)
+	routes := []struct {
+		target, field string
+	}{
+		{"/admin/delcat", "category"},
+		{"/admin/cat/Movies/delmovie", "moviename"},
+		{"/admin/cat/TV/delseries", "seriesname"},
+		{"/admin/cat/TV/series/Show/delseason", "seasonname"},
+		{"/admin/cat/TV/series/Show/season/Season 1/delepisode", "epname"},
+	}
+	for _, rt := range routes {
+		for _, name := range badNames {
+			before := s.snapshot(t)
+			w := s.postForm(t, rt.target, url.Values{rt.field: {name}})
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("%s %s=%q: got %d, want 400", rt.target, rt.field, name, w.Code)
+			}
+			assertUnchanged(t, before, s.snapshot(t))
+		}
+	}
+
+	// The delete routes still work for real names
+	w := s.postForm(t, "/admin/cat/TV/series/Show/season/Season 1/delepisode", url.Values{"epname": {"Episode 1"}})
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("deleting an episode: got %d", w.Code)
+	}
+	if _, err := os.Stat(filepath.Join(s.root, "TV", "Show", "Season 1", "Episode 1")); !os.IsNotExist(err) {
+		t.Errorf("episode still there: %v", err)
+	}
+}
+
+func TestRouteSegmentsRefuseBadNames(t *testing.T) {
+	s := newTestServer(t)
+	targets := []struct {
+		target, field, value string
+	}{
+		{"/admin/cat/../delmovie", "moviename", "outside"},
+		{"/admin/cat/Escape/delmovie", "moviename", "secret.txt"},
+		{"/admin/cat/.uploads/delmovie", "moviename", "x"},
+		{"/admin/cat/TV/series/../delseason", "seasonname", "Movies"},
+		{"/admin/cat/TV/series/Escape/delseason", "seasonname", "secret.txt"},
+		{"/admin/cat/TV/series/Show/season/../delepisode", "epname", "Season 1"},
+		{"/admin/cat/TV/series/Show/season/Escape/delepisode", "epname", "secret.txt"},
+		{"/admin/cat/TV/series/Show/season/CON/delepisode", "epname", "x"},
+	}
+	for _, tt := range targets {
+		before := s.snapshot(t)
+		w := s.postForm(t, tt.target, url.Values{tt.field: {tt.value}})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", tt.target, w.Code)
+		}
+		assertUnchanged(t, before, s.snapshot(t))
+	}
+}
+
+func TestUploadRoutesRefuseBadNames(t *testing.T) {
+	s := newTestServer(t)
+	routes := []struct {
+		target, field string
+	}{
+		{"/admin/cat/Movies/upload", "moviename"},
+		{"/admin/cat/TV/series/Show/season/Season 1/uploadep", "epname"},
+	}
+	for _, rt := range routes {
+		for _, name := range badNames {
+			before := s.snapshot(t)
+			w := s.postMultipart(t, rt.target, []formPart{
+				{name: rt.field, body: name},
+				{name: "video", filename: "video.mp4", body: "video"},
+			})
+			if w.Code == http.StatusSeeOther {
+				t.Errorf("%s %s=%q was accepted", rt.target, rt.field, name)
+			}
+			assertUnchanged(t, before, s.snapshot(t))
+		}
+	}
+}
+
+func TestUploadFileNamesStayInItem(t *testing.T) {
+	s := newTestServer(t)
+	tests := []struct {
+		target, field, filename string
+		want                    string // relative to the root
+	}{
+		{"/admin/cat/Movies/upload", "moviename", "../../evil.mp4", "Movies/One/evil.mp4"},
+		{"/admin/cat/Movies/upload", "moviename", `..\..\..\evil.mp4`, "Movies/Two/evil.mp4"},
+		{"/admin/cat/Movies/upload", "moviename", "/etc/evil.mp4", "Movies/Three/evil.mp4"},
+		{"/admin/cat/TV/series/Show/season/Season 1/uploadep", "epname", "../../../evil.mp4", "TV/Show/Season 1/Four/evil.mp4"},
+	}
+	for _, tt := range tests {
+		name := filepath.Base(filepath.Dir(filepath.FromSlash(tt.want)))
+		w := s.postMultipart(t, tt.target, []formPart{
+			{name: tt.field, body: name},
+			{name: "video", filename: tt.filename, body: "video"},
+		})
+		if w.Code != http.StatusSeeOther {
+			t.Errorf("%s with %q: got %d: %s", tt.target, tt.filename, w.Code, w.Body)
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(s.root, filepath.FromSlash(tt.want))); err != nil {
+			t.Errorf("%s with %q: %v", tt.target, tt.filename, err)
+		}
+	}
+	assertOutsideUntouched(t, s)
+	if _, err := os.Stat(filepath.Join(s.root, "evil.mp4")); err == nil {
+		t.Error("upload landed in the root")
+	}
+}
+
+func TestContentRefusesEscapes(t *testing.T) {
+	s := newTestServer(t)
+	if _, err := uploads.create(5, nil, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	h := contentHandler(s.root)
+	for _, p := range []string{
+		"/content/Escape/secret.txt",
+		"/content/Movies/Escape/secret.txt",
+		"/content/TV/Show/Season%201/Escape/secret.txt",
+		"/content/../outside/secret.txt",
+		"/content/Movies/../../outside/secret.txt",
+		"/content/%2e%2e/outside/secret.txt",
+		"/content/.uploads/",
+		"/content/Movies/Dangling",
+	} {
+		r := httptest.NewRequest("GET", "http://localhost/", nil)
+		r.URL.Path, _ = url.PathUnescape(p)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code == http.StatusOK || strings.Contains(w.Body.String(), "secret") || strings.Contains(w.Body.String(), ".info") {
+			t.Errorf("GET %s: got %d: %q", p, w.Code, w.Body)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/content/Movies/Film/film.mp4", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != "film" {
+		t.Errorf("GET a movie: got %d: %q", w.Code, w.Body)
+	}
+}
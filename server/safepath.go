@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ==== SAFE PATHS ====
+//
+// Every name that arrives from a request (URL segments, form fields, upload
+// filenames) must go through resolvePath before it touches the filesystem.
+
+var errPathEscape = errors.New("path leaves the content root")
+
+// Device names Windows refuses to create files under, with or without an
+// extension. Rejected everywhere so a library stays portable.
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// safeName checks a single path component supplied by a user.
+func safeName(name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("name is empty")
+	case name == "." || name == "..":
+		return fmt.Errorf("invalid name %q", name)
+	case len(name) > 255:
+		return fmt.Errorf("name is too long")
+	case strings.ContainsAny(name, "/\\"):
+		return fmt.Errorf("name %q contains a path separator", name)
+	case isHiddenName(name):
+		return fmt.Errorf("name %q is reserved", name)
+	case strings.HasSuffix(name, " ") || strings.HasSuffix(name, "."):
+		return fmt.Errorf("name %q ends with a space or dot", name)
+	}
+	for _, c := range name {
+		if c < 0x20 || c == 0x7f {
+			return fmt.Errorf("name %q contains control characters", name)
+		}
+	}
+	base, _, _ := strings.Cut(name, ".")
+	if reservedNames[strings.ToUpper(strings.TrimSpace(base))] {
+		return fmt.Errorf("name %q is reserved", name)
+	}
+	return nil
+}
+
+// resolvePath joins user supplied components onto base, which must already
+// be trusted, and makes sure the result can't leave base, either through
+// the names themselves or through symlinks on disk.
+func resolvePath(base string, parts ...string) (string, error) {
+	for _, p := range parts {
+		if err := safeName(p); err != nil {
+			return "", err
+		}
+	}
+	full := filepath.Join(append([]string{base}, parts...)...)
+	if err := checkInsideRoot(base, full); err != nil {
+		return "", err
+	}
+	return full, nil
+}
+
+// checkInsideRoot resolves symlinks in the deepest existing ancestor of full
+// and verifies it still lies within root.
+func checkInsideRoot(root, full string) error {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+	p := full
+	for {
+		real, err := filepath.EvalSymlinks(p)
+		if err == nil {
+			if !pathWithin(realRoot, real) {
+				return errPathEscape
+			}
+			return nil
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		// A dangling symlink would be followed by os.Create
+		if fi, lerr := os.Lstat(p); lerr == nil && fi.Mode()&os.ModeSymlink != 0 {
+			return errPathEscape
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return err
+		}
+		p = parent
+	}
+}
+
+func pathWithin(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
+
+// resolveUpload returns where an uploaded file should be stored in dir,
+// dropping any directory part the browser sent with its name.
+func resolveUpload(dir, filename string) (string, error) {
+	return resolvePath(dir, filepath.Base(strings.ReplaceAll(filename, "\\", "/")))
+}
+
+// badPath answers a request whose names failed resolvePath.
+func badPath(w http.ResponseWriter, err error) {
+	http.Error(w, "Invalid name: "+err.Error(), http.StatusBadRequest)
+}
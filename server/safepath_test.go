@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestTree makes a library next to a folder it must never reach:
+//
+//	base/library/Movies/Film/film.mp4
+//	base/library/TV/Show/Season 1/Episode 1/ep.mp4
+//	base/outside/secret.txt
+//
+// with symlinks named Escape at every level of the library pointing at
+// outside, and a dangling one named Dangling in Movies.
+func newTestTree(t *testing.T) (root, outside string) {
+	t.Helper()
+	base := t.TempDir()
+	root = filepath.Join(base, "library")
+	outside = filepath.Join(base, "outside")
+	for _, dir := range []string{
+		filepath.Join(root, "Movies", "Film"),
+		filepath.Join(root, "TV", "Show", "Season 1", "Episode 1"),
+		outside,
+	} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, body := range map[string]string{
+		filepath.Join(root, "Movies", "Film", "film.mp4"):                    "film",
+		filepath.Join(root, "TV", "Show", "Season 1", "Episode 1", "ep.mp4"): "episode",
+		filepath.Join(outside, "secret.txt"):                                 "secret",
+	} {
+		if err := os.WriteFile(name, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, dir := range []string{
+		root,
+		filepath.Join(root, "Movies"),
+		filepath.Join(root, "TV"),
+		filepath.Join(root, "TV", "Show"),
+		filepath.Join(root, "TV", "Show", "Season 1"),
+	} {
+		if err := os.Symlink(outside, filepath.Join(dir, "Escape")); err != nil {
+			t.Skip("symlinks not available:", err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(outside, "new.txt"), filepath.Join(root, "Movies", "Dangling")); err != nil {
+		t.Fatal(err)
+	}
+	return root, outside
+}
+
+// snapshotTree lists every path below dirs with its size, without
+// following symlinks.
+func snapshotTree(t *testing.T, dirs ...string) map[string]int64 {
+	t.Helper()
+	out := make(map[string]int64)
+	for _, dir := range dirs {
+		err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			out[p] = fi.Size()
+			if fi.IsDir() {
+				out[p] = 0
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return out
+}
+
+func assertUnchanged(t *testing.T, before, after map[string]int64) {
+	t.Helper()
+	for p, size := range before {
+		if got, ok := after[p]; !ok {
+			t.Errorf("%s was removed", p)
+		} else if got != size {
+			t.Errorf("%s changed size from %d to %d", p, size, got)
+		}
+	}
+	for p := range after {
+		if _, ok := before[p]; !ok {
+			t.Errorf("%s was created", p)
+		}
+	}
+}
+
+func TestSafeName(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"Film", true},
+		{"Season 1", true},
+		{"Movie (2020)", true},
+		{"Ünïcode", true},
+		{"film.mp4", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"../outside", false},
+		{"a/b", false},
+		{`a\b`, false},
+		{"/abs", false},
+		{".hidden", false},
+		{".channelforge", false},
+		{".uploads", false},
+		{"trailing ", false},
+		{"trailing.", false},
+		{"tab\there", false},
+		{"nul\x00byte", false},
+		{"del\x7f", false},
+		{"CON", false},
+		{"con", false},
+		{"Con.txt", false},
+		{"LPT9.mp4", false},
+		{"COM1 ", false},
+		{"CONSOLE", true},
+		{strings.Repeat("a", 255), true},
+		{strings.Repeat("a", 256), false},
+	}
+	for _, tt := range tests {
+		if err := safeName(tt.name); (err == nil) != tt.ok {
+			t.Errorf("safeName(%q) = %v, want ok=%v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestResolvePath(t *testing.T) {
+	root, outside := newTestTree(t)
+	tests := []struct {
+		parts  []string
+		want   string // relative to root, empty when it must fail
+		escape bool   // fails with errPathEscape
+	}{
+		{[]string{"Movies"}, "Movies", false},
+		{[]string{"Movies", "Film"}, "Movies/Film", false},
+		{[]string{"Movies", "New Film"}, "Movies/New Film", false},
+		{[]string{"TV", "Show", "Season 1", "Episode 1"}, "TV/Show/Season 1/Episode 1", false},
+		{[]string{".."}, "", false},
+		{[]string{"Movies", ".."}, "", false},
+		{[]string{"../outside"}, "", false},
+		{[]string{"Movies/../../outside"}, "", false},
+		{[]string{"Movies", "Film/film.mp4"}, "", false},
+		{[]string{`Movies\Film`}, "", false},
+		{[]string{".channelforge"}, "", false},
+		{[]string{"Movies", ".hidden"}, "", false},
+		{[]string{"Movies", "NUL"}, "", false},
+		{[]string{""}, "", false},
+		{[]string{"Escape"}, "", true},
+		{[]string{"Escape", "secret.txt"}, "", true},
+		{[]string{"Movies", "Escape"}, "", true},
+		{[]string{"Movies", "Escape", "new"}, "", true},
+		{[]string{"TV", "Show", "Escape"}, "", true},
+		{[]string{"TV", "Show", "Season 1", "Escape", "x"}, "", true},
+		{[]string{"Movies", "Dangling"}, "", true},
+	}
+	for _, tt := range tests {
+		got, err := resolvePath(root, tt.parts...)
+		switch {
+		case tt.want == "" && err == nil:
+			t.Errorf("resolvePath(%q) = %q, want an error", tt.parts, got)
+		case tt.want == "":
+			if tt.escape && !errors.Is(err, errPathEscape) {
+				t.Errorf("resolvePath(%q) = %v, want %v", tt.parts, err, errPathEscape)
+			}
+		case err != nil:
+			t.Errorf("resolvePath(%q): %v", tt.parts, err)
+		case got != filepath.Join(root, filepath.FromSlash(tt.want)):
+			t.Errorf("resolvePath(%q) = %q, want %q", tt.parts, got, tt.want)
+		}
+	}
+	if _, err := resolvePath(filepath.Join(root, "Escape")); err != nil {
+		// A trusted base is taken as is, even through a symlink
+		t.Errorf("resolvePath on a symlinked base: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "new.txt")); err == nil {
+		t.Error("resolving created a file outside the root")
+	}
+}
+
+func TestCheckInsideRoot(t *testing.T) {
+	root, outside := newTestTree(t)
+	tests := []struct {
+		path string
+		ok   bool
+	}{
+		{root, true},
+		{filepath.Join(root, "Movies", "Film", "film.mp4"), true},
+		{filepath.Join(root, "Movies", "not there", "deeper"), true},
+		{filepath.Join(root, "Escape", "secret.txt"), false},
+		{filepath.Join(root, "TV", "Show", "Escape"), false},
+		{filepath.Join(root, "Movies", "Dangling"), false},
+		{filepath.Join(root, "..", "outside", "secret.txt"), false},
+		{outside, false},
+	}
+	for _, tt := range tests {
+		if err := checkInsideRoot(root, tt.path); (err == nil) != tt.ok {
+			t.Errorf("checkInsideRoot(%q) = %v, want ok=%v", tt.path, err, tt.ok)
+		}
+	}
+}
+
+func TestResolveUpload(t *testing.T) {
+	root, _ := newTestTree(t)
+	dir := filepath.Join(root, "Movies", "Film")
+	tests := []struct {
+		filename string
+		want     string // base name in dir, empty when it must fail
+	}{
+		{"film.mp4", "film.mp4"},
+		{"../../evil.mp4", "evil.mp4"},
+		{`..\..\evil.mp4`, "evil.mp4"},
+		{`C:\Users\me\Videos\clip.mp4`, "clip.mp4"},
+		{"/etc/passwd", "passwd"},
+		{"folder/", "folder"},
+		{".hidden.jpg", ""},
+		{"..", ""},
+		{"", ""},
+		{"CON.mp4", ""},
+		{"clip.mp4.", ""},
+	}
+	for _, tt := range tests {
+		got, err := resolveUpload(dir, tt.filename)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("resolveUpload(%q) = %q, want an error", tt.filename, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("resolveUpload(%q): %v", tt.filename, err)
+		} else if got != filepath.Join(dir, tt.want) {
+			t.Errorf("resolveUpload(%q) = %q, want %q", tt.filename, got, tt.want)
+		}
+	}
+}
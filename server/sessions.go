@@ -0,0 +1,289 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ==== SESSIONS ====
+
+const sessionFile = "sessions.json"
+
+var (
+	sessionIdleTimeout  = 2 * time.Hour
+	sessionMaxAge       = 12 * time.Hour
+	rememberIdleTimeout = 14 * 24 * time.Hour
+	rememberMaxAge      = 30 * 24 * time.Hour
+)
+
+type session struct {
+	ID        string    `json:"id"` // short public identifier, used for revoking
+	Username  string    `json:"username"`
+	Remember  bool      `json:"remember"`
+	Rotate    bool      `json:"rotate"` // issue a new token on the next request
+	CSRF      string    `json:"csrf"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Created   time.Time `json:"created"`
+	LastSeen  time.Time `json:"last_seen"`
+
+	// TOTPPending is a two-factor secret shown on the account page and
+	// not yet confirmed. It is never written to disk.
+	TOTPPending string `json:"-"`
+}
+
+func (s *session) expired(now time.Time) bool {
+	idle, max := sessionIdleTimeout, sessionMaxAge
+	if s.Remember {
+		idle, max = rememberIdleTimeout, rememberMaxAge
+	}
+	return now.Sub(s.LastSeen) > idle || now.Sub(s.Created) > max
+}
+
+// sessionStore maps hashed session tokens to sessions and persists them to
+// disk, so restarts don't log everyone out. Only the SHA-256 of each token is
+// stored, so the file can't be used to hijack a session.
+type sessionStore struct {
+	mu   sync.Mutex
+	path string
+	byID map[string]*session // token hash -> session
+}
+
+var sessions = &sessionStore{path: sessionFile, byID: make(map[string]*session)}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *sessionStore) load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	byID := make(map[string]*session)
+	if err := json.Unmarshal(b, &byID); err != nil {
+		return err
+	}
+	s.byID = byID
+	return nil
+}
+
+func (s *sessionStore) saveLocked() {
+	if !storeWritable() {
+		return
+	}
+	b, err := json.MarshalIndent(s.byID, "", "  ")
+	if err == nil {
+		tmp := s.path + ".tmp"
+		if err = os.WriteFile(tmp, b, 0600); err == nil {
+			err = os.Rename(tmp, s.path)
+		}
+	}
+	if err != nil {
+		logFor("auth").Error("failed to save sessions", "err", err)
+	}
+}
+
+// create starts a new session for username and returns its token.
+func (s *sessionStore) create(username string, remember bool, r *http.Request) string {
+	token := newSessionToken()
+	h := hashToken(token)
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byID[h] = &session{
+		ID:        h[:16],
+		Username:  username,
+		Remember:  remember,
+		CSRF:      newSessionToken(),
+		IP:        clientIP(r),
+		UserAgent: r.UserAgent(),
+		Created:   now,
+		LastSeen:  now,
+	}
+	s.saveLocked()
+	return token
+}
+
+// lookup returns a copy of the live session for token and marks it as used.
+func (s *sessionStore) lookup(token string) *session {
+	if token == "" {
+		return nil
+	}
+	h := hashToken(token)
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.byID[h]
+	if !ok {
+		return nil
+	}
+	if sess.expired(now) {
+		delete(s.byID, h)
+		s.saveLocked()
+		return nil
+	}
+	dirty := false
+	// Sessions saved by older versions have no CSRF token yet
+	if sess.CSRF == "" {
+		sess.CSRF = newSessionToken()
+		dirty = true
+	}
+	// Writing on every request is wasteful; a minute of slack is fine.
+	if now.Sub(sess.LastSeen) > time.Minute {
+		sess.LastSeen = now
+		dirty = true
+	}
+	if dirty {
+		s.saveLocked()
+	}
+	c := *sess
+	return &c
+}
+
+// rotate replaces token with a fresh one, keeping the session itself.
+func (s *sessionStore) rotate(token string) string {
+	old := hashToken(token)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.byID[old]
+	if !ok {
+		return ""
+	}
+	newToken := newSessionToken()
+	h := hashToken(newToken)
+	delete(s.byID, old)
+	sess.ID = h[:16]
+	sess.Rotate = false
+	s.byID[h] = sess
+	s.saveLocked()
+	return newToken
+}
+
+// setTOTPPending keeps secret with the session for token until two-factor
+// login is turned on; "" drops it.
+func (s *sessionStore) setTOTPPending(token, secret string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.byID[hashToken(token)]
+	if ok {
+		sess.TOTPPending = secret
+	}
+	return ok
+}
+
+func (s *sessionStore) revokeToken(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.byID, hashToken(token))
+	s.saveLocked()
+}
+
+// revoke ends the session with the given public ID if it belongs to username.
+func (s *sessionStore) revoke(username, id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for h, sess := range s.byID {
+		if sess.ID == id && sess.Username == username {
+			delete(s.byID, h)
+			s.saveLocked()
+			return true
+		}
+	}
+	return false
+}
+
+// revokeUser ends all of a user's sessions except the one with ID keep.
+func (s *sessionStore) revokeUser(username, keep string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for h, sess := range s.byID {
+		if sess.Username == username && sess.ID != keep {
+			delete(s.byID, h)
+		}
+	}
+	s.saveLocked()
+}
+
+// markRotate asks every session of username to get a new token on its next
+// request, used after the user's privileges change.
+func (s *sessionStore) markRotate(username string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sess := range s.byID {
+		if sess.Username == username {
+			sess.Rotate = true
+		}
+	}
+	s.saveLocked()
+}
+
+// listFor returns the user's sessions, most recently used first.
+func (s *sessionStore) listFor(username string) []session {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []session
+	for _, sess := range s.byID {
+		if sess.Username == username && !sess.expired(now) {
+			out = append(out, *sess)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].LastSeen.After(out[j].LastSeen) })
+	return out
+}
+
+func (s *sessionStore) purgeExpired() {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := len(s.byID)
+	for h, sess := range s.byID {
+		if sess.expired(now) {
+			delete(s.byID, h)
+		}
+	}
+	if len(s.byID) != n {
+		s.saveLocked()
+	}
+}
+
+func (s *sessionStore) janitor(interval time.Duration) {
+	background.every(interval, s.purgeExpired)
+}
+
+func setSessionCookie(w http.ResponseWriter, token string, remember bool) {
+	c := &http.Cookie{
+		Name:     "session",
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   tlsEnabled(),
+		SameSite: http.SameSiteStrictMode,
+	}
+	if remember {
+		c.MaxAge = int(rememberMaxAge.Seconds())
+	}
+	http.SetCookie(w, c)
+}
+
+// currentSession returns the session for the request's cookie, or nil.
+func currentSession(r *http.Request) *session {
+	cookie, err := r.Cookie("session")
+	if err != nil {
+		return nil
+	}
+	return sessions.lookup(cookie.Value)
+}
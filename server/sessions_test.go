@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sessionCookie returns the session token set by a response, or "".
+func sessionCookie(w *httptest.ResponseRecorder) string {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "session" {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+// ageSession moves the session for token back in time.
+func ageSession(token string, idle, age time.Duration) {
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+	sess := sessions.byID[hashToken(token)]
+	sess.LastSeen = time.Now().Add(-idle)
+	sess.Created = time.Now().Add(-age)
+}
+
+func TestLoginStartsFreshPersistedSession(t *testing.T) {
+	s := newTestServer(t)
+	form := url.Values{"username": {"admin"}, "password": {"correct horse battery"}}
+	r := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(s.cookie) // a token the browser brought along
+	w := httptest.NewRecorder()
+	loginHandler(w, r)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("login: got %d", w.Code)
+	}
+	token := sessionCookie(w)
+	if token == "" || token == s.cookie.Value {
+		t.Fatalf("login kept or set no session token: %q", token)
+	}
+	if sessions.lookup(s.cookie.Value) != nil {
+		t.Error("the token sent along with the login still works")
+	}
+
+	// A restart reads the session back from disk
+	reloaded := &sessionStore{path: sessions.path, byID: make(map[string]*session)}
+	if err := reloaded.load(); err != nil {
+		t.Fatal(err)
+	}
+	if sess := reloaded.lookup(token); sess == nil || sess.Username != "admin" {
+		t.Errorf("session not persisted: %+v", sess)
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	newTestServer(t)
+	r := httptest.NewRequest("GET", "/login", nil)
+	tests := []struct {
+		name      string
+		remember  bool
+		idle, age time.Duration
+		live      bool
+	}{
+		{"fresh", false, 0, 0, true},
+		{"idle", false, sessionIdleTimeout + time.Minute, sessionIdleTimeout + time.Minute, false},
+		{"too old", false, time.Minute, sessionMaxAge + time.Minute, false},
+		{"remembered idle", true, sessionIdleTimeout + time.Minute, sessionIdleTimeout + time.Minute, true},
+		{"remembered too idle", true, rememberIdleTimeout + time.Minute, rememberIdleTimeout + time.Minute, false},
+		{"remembered too old", true, time.Minute, rememberMaxAge + time.Minute, false},
+	}
+	for _, tt := range tests {
+		token := sessions.create("admin", tt.remember, r)
+		ageSession(token, tt.idle, tt.age)
+		if live := sessions.lookup(token) != nil; live != tt.live {
+			t.Errorf("%s session: live = %v, want %v", tt.name, live, tt.live)
+		}
+	}
+	// Expired sessions are dropped, not just refused
+	token := sessions.create("admin", false, r)
+	ageSession(token, sessionIdleTimeout+time.Minute, sessionIdleTimeout+time.Minute)
+	sessions.lookup(token)
+	sessions.mu.Lock()
+	_, kept := sessions.byID[hashToken(token)]
+	sessions.mu.Unlock()
+	if kept {
+		t.Error("expired session still stored")
+	}
+}
+
+func TestSessionRotatesAfterRoleChange(t *testing.T) {
+	s := newTestServer(t)
+	editor := s.as(t, "editor", RoleEditor)
+	if err := users.setRole("editor", RoleViewer); err != nil {
+		t.Fatal(err)
+	}
+	sessions.markRotate("editor")
+
+	w := editor.get(t, "/admin/cat/TV")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET after role change: got %d", w.Code)
+	}
+	token := sessionCookie(w)
+	if token == "" || token == editor.cookie.Value {
+		t.Fatalf("no new token after a role change: %q", token)
+	}
+	if sessions.lookup(editor.cookie.Value) != nil {
+		t.Error("old token still works after rotation")
+	}
+	if sess := sessions.lookup(token); sess == nil || sess.Rotate {
+		t.Errorf("rotated session: %+v", sess)
+	}
+	if w := editor.get(t, "/admin/cat/TV"); sessionCookie(w) != "" {
+		t.Error("token rotated again without a change")
+	}
+}
+
+func TestPasswordChangeRevokesOthers(t *testing.T) {
+	s := newTestServer(t)
+	other := sessions.create("admin", true, httptest.NewRequest("GET", "/login", nil))
+	token := apiTokens.create("admin", "script", []string{"read-library"}, 0)
+
+	form := url.Values{"current": {"correct horse battery"}, "password": {"a new password"}}
+	r := httptest.NewRequest("POST", "/admin/account", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("X-CSRF-Token", s.csrf)
+	r.AddCookie(s.cookie)
+	w := httptest.NewRecorder()
+	requireLogin(browserOnly(accountHandler))(w, r)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Password changed") {
+		t.Fatalf("password change: got %d: %s", w.Code, w.Body)
+	}
+	if users.authenticate("admin", "a new password") == nil {
+		t.Fatal("new password not set")
+	}
+	if sessions.lookup(other) != nil {
+		t.Error("other session survived the password change")
+	}
+	if apiTokens.lookup(token) != nil {
+		t.Error("API token survived the password change")
+	}
+	// This browser stays signed in, on a fresh token
+	fresh := sessionCookie(w)
+	if fresh == "" || sessions.lookup(s.cookie.Value) != nil || sessions.lookup(fresh) == nil {
+		t.Errorf("current session not moved to a fresh token: %q", fresh)
+	}
+}
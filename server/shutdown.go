@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ==== SHUTDOWN AND RESTART ====
+//
+// SIGTERM or SIGINT stops the server taking new connections and lets the
+// requests in progress finish, so streams and uploads aren't cut off, for
+// up to server.drain_timeout; /readyz fails meanwhile. Connections still
+// open then are closed: resumable uploads keep what reached the disk and
+// running ffmpeg/ffprobe processes are killed without leaving partial
+// files. A janitor in the middle of a pass gets to finish it. A second
+// signal stops waiting.
+//
+// With server.handoff set (Unix only), SIGHUP starts the executable again
+// and hands it the listening sockets. Once the new process is serving, the
+// old one stops its janitors and leaves the account, session, token and
+// device files to the new one, then drains the same way for up to
+// server.handoff_drain_timeout. Players cut off after that reconnect to
+// the new process and pick up where they were, as do resumable uploads.
+
+const (
+	handoffStartTimeout = time.Minute
+	jobStopTimeout      = 10 * time.Second
+)
+
+var (
+	readHeaderTimeout   = 10 * time.Second
+	idleTimeout         = 2 * time.Minute
+	writeTimeout        time.Duration // a whole movie can take hours to send
+	drainTimeout        = 30 * time.Second
+	handoffEnabled      bool
+	handoffDrainTimeout = 10 * time.Minute
+)
+
+var (
+	// draining is set once the server has started shutting down.
+	draining atomic.Bool
+
+	// handedOver is set once a new process has taken over. Both would
+	// otherwise rewrite the same store files.
+	handedOver     atomic.Bool
+	saveSkipLogged atomic.Bool
+)
+
+var errHandedOver = errors.New("the server is restarting; try again in a moment")
+
+// storeWritable reports whether the stores may still save their files.
+func storeWritable() bool {
+	if !handedOver.Load() {
+		return true
+	}
+	if saveSkipLogged.CompareAndSwap(false, true) {
+		logFor("server").Warn("not saving changes made while draining; the new process owns the data files")
+	}
+	return false
+}
+
+// listenerSpec is an address to serve handler on.
+type listenerSpec struct {
+	addr    string
+	handler http.Handler
+	tls     bool
+}
+
+type runningServer struct {
+	addr string
+	srv  *http.Server
+	ln   net.Listener
+}
+
+// runServers serves every listener until told to stop by a signal.
+func runServers(specs []listenerSpec, certFile, keyFile string) {
+	var running []*runningServer
+	for _, s := range specs {
+		ln, err := listenOn(s.addr)
+		if err != nil {
+			fatal("server", "failed to listen", "addr", s.addr, "err", err)
+		}
+		srv := &http.Server{
+			Handler:           s.handler,
+			ReadHeaderTimeout: readHeaderTimeout,
+			IdleTimeout:       idleTimeout,
+			WriteTimeout:      writeTimeout,
+			ErrorLog:          slog.NewLogLogger(logFor("server").Handler(), slog.LevelWarn),
+		}
+		if s.tls {
+			srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+		running = append(running, &runningServer{addr: s.addr, srv: srv, ln: ln})
+		go func(addr string, useTLS bool) {
+			var err error
+			if useTLS {
+				err = srv.ServeTLS(ln, certFile, keyFile)
+			} else {
+				err = srv.Serve(ln)
+			}
+			if !errors.Is(err, http.ErrServerClosed) {
+				fatal("server", "listener failed", "addr", addr, "err", err)
+			}
+		}(s.addr, s.tls)
+	}
+	writePIDFile()
+	defer removePIDFile()
+	handoffDone()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, append([]os.Signal{os.Interrupt, syscall.SIGTERM}, handoffSignals()...)...)
+	for sig := range sigs {
+		if isHandoffSignal(sig) {
+			if err := handoff(running); err != nil {
+				logFor("server").Error("restart failed, carrying on", "err", err)
+				continue
+			}
+			handedOver.Store(true)
+			if !background.stop(jobStopTimeout) {
+				logFor("server").Warn("background jobs still running after handoff")
+			}
+			logFor("server").Info("new process took over, draining", "drain_timeout", handoffDrainTimeout)
+			shutdown(running, handoffDrainTimeout, sigs)
+			return
+		}
+		logFor("server").Info("shutting down, draining", "signal", sig.String(), "drain_timeout", drainTimeout)
+		shutdown(running, drainTimeout, sigs)
+		return
+	}
+}
+
+// shutdown waits up to timeout for open requests, then closes whatever is
+// left and stops the background work.
+func shutdown(running []*runningServer, timeout time.Duration, sigs <-chan os.Signal) {
+	draining.Store(true)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go func() {
+		select {
+		case sig := <-sigs:
+			logFor("server").Warn("closing open connections now", "signal", sig.String())
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for _, rs := range running {
+		wg.Add(1)
+		go func(rs *runningServer) {
+			defer wg.Done()
+			if err := rs.srv.Shutdown(ctx); err != nil {
+				logFor("server").Warn("closing connections still open", "addr", rs.addr, "err", err)
+				rs.srv.Close()
+			}
+		}(rs)
+	}
+	wg.Wait()
+
+	if !background.stop(jobStopTimeout) {
+		logFor("server").Warn("background jobs still running at exit")
+	}
+	if n := killTools(); n > 0 {
+		logFor("tools").Warn("stopped running ffmpeg/ffprobe processes", "count", n)
+	}
+	logFor("server").Info("stopped")
+}
+
+// ---- Background jobs ----
+
+// jobRunner runs the periodic janitors. Stopping it lets a run in
+// progress finish rather than cutting it off half way.
+type jobRunner struct {
+	mu      sync.Mutex
+	stopped bool
+	stopCh  chan struct{}
+	wg      sync.WaitGroup
+}
+
+var background = &jobRunner{stopCh: make(chan struct{})}
+
+// every runs fn now and then every interval until the runner stops.
+func (j *jobRunner) every(interval time.Duration, fn func()) {
+	for j.run(fn) {
+		select {
+		case <-j.stopCh:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// run runs fn unless the runner has stopped, reporting whether it did.
+func (j *jobRunner) run(fn func()) bool {
+	j.mu.Lock()
+	if j.stopped {
+		j.mu.Unlock()
+		return false
+	}
+	j.wg.Add(1)
+	j.mu.Unlock()
+	defer j.wg.Done()
+	fn()
+	return true
+}
+
+// stop waits up to timeout for running jobs, reporting whether they
+// finished.
+func (j *jobRunner) stop(timeout time.Duration) bool {
+	j.mu.Lock()
+	if !j.stopped {
+		j.stopped = true
+		close(j.stopCh)
+	}
+	j.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		j.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// ---- Tool processes ----
+
+var toolProcs = struct {
+	sync.Mutex
+	m map[*os.Process]bool
+}{m: make(map[*os.Process]bool)}
+
+// startTool starts cmd, keeping track of it until the returned function
+// is called.
+func startTool(cmd *exec.Cmd) (func(), error) {
+	toolProcs.Lock()
+	defer toolProcs.Unlock()
+	if draining.Load() {
+		return nil, errors.New("shutting down")
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	p := cmd.Process
+	toolProcs.m[p] = true
+	return func() {
+		toolProcs.Lock()
+		delete(toolProcs.m, p)
+		toolProcs.Unlock()
+	}, nil
+}
+
+// killTools kills the ffmpeg and ffprobe processes still running and
+// returns how many there were.
+func killTools() int {
+	toolProcs.Lock()
+	defer toolProcs.Unlock()
+	for p := range toolProcs.m {
+		p.Kill()
+	}
+	return len(toolProcs.m)
+}
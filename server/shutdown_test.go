@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// freshShutdown gives the test its own background runner and clears the
+// shutdown flags afterwards.
+func freshShutdown(t *testing.T) {
+	t.Helper()
+	old := background
+	background = &jobRunner{stopCh: make(chan struct{})}
+	t.Cleanup(func() {
+		background = old
+		draining.Store(false)
+		handedOver.Store(false)
+		saveSkipLogged.Store(false)
+	})
+}
+
+// serveLocal starts handler on a local port.
+func serveLocal(t *testing.T, handler http.Handler) *runningServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: handler}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return &runningServer{addr: ln.Addr().String(), srv: srv, ln: ln}
+}
+
+// slowHandler answers once release is closed, after telling started.
+func slowHandler(started chan<- struct{}, release <-chan struct{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		io.WriteString(w, "done")
+	})
+}
+
+type getResult struct {
+	body string
+	err  error
+}
+
+func getAsync(url string) <-chan getResult {
+	out := make(chan getResult, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			out <- getResult{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		out <- getResult{string(b), err}
+	}()
+	return out
+}
+
+func TestShutdownDrainsRequests(t *testing.T) {
+	freshShutdown(t)
+	started, release := make(chan struct{}), make(chan struct{})
+	rs := serveLocal(t, slowHandler(started, release))
+	got := getAsync("http://" + rs.addr + "/")
+	<-started
+
+	stopped := make(chan struct{})
+	go func() {
+		shutdown([]*runningServer{rs}, 5*time.Second, nil)
+		close(stopped)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-stopped:
+		t.Fatal("shutdown returned with a request in progress")
+	default:
+	}
+	if !draining.Load() {
+		t.Error("draining not set")
+	}
+	if _, err := net.DialTimeout("tcp", rs.addr, time.Second); err == nil {
+		t.Error("new connections still accepted while draining")
+	}
+
+	close(release)
+	if r := <-got; r.err != nil || r.body != "done" {
+		t.Errorf("request in progress got %q, %v", r.body, r.err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown didn't return after the request finished")
+	}
+}
+
+func TestShutdownCutsOffAfterTimeout(t *testing.T) {
+	freshShutdown(t)
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	rs := serveLocal(t, slowHandler(started, release))
+	got := getAsync("http://" + rs.addr + "/")
+	<-started
+
+	begin := time.Now()
+	shutdown([]*runningServer{rs}, 100*time.Millisecond, nil)
+	if took := time.Since(begin); took > 3*time.Second {
+		t.Errorf("shutdown took %v with a 100ms drain timeout", took)
+	}
+	if r := <-got; r.err == nil {
+		t.Errorf("request still open at the timeout got %q", r.body)
+	}
+}
+
+func TestJobRunnerStopWaits(t *testing.T) {
+	j := &jobRunner{stopCh: make(chan struct{})}
+	started, release := make(chan struct{}), make(chan struct{})
+	runs := 0
+	returned := make(chan struct{})
+	go func() {
+		j.every(time.Hour, func() {
+			runs++
+			started <- struct{}{}
+			<-release
+		})
+		close(returned)
+	}()
+	<-started
+
+	// A pass in progress holds stop up until the timeout
+	if j.stop(50 * time.Millisecond) {
+		t.Fatal("stop reported done with a job running")
+	}
+	stopped := make(chan bool, 1)
+	go func() { stopped <- j.stop(5 * time.Second) }()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-stopped:
+		t.Fatal("stop returned with a job running")
+	default:
+	}
+	close(release)
+	if !<-stopped {
+		t.Error("stop timed out after the job finished")
+	}
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("every kept going after stop")
+	}
+	if runs != 1 {
+		t.Errorf("job ran %d times", runs)
+	}
+	if j.run(func() { t.Error("job ran after stop") }) {
+		t.Error("run reported running after stop")
+	}
+}
+
+func TestStoresStopSavingAfterHandover(t *testing.T) {
+	freshShutdown(t)
+	dir := t.TempDir()
+	us := &userStore{path: filepath.Join(dir, userFile)}
+	ss := &sessionStore{path: filepath.Join(dir, sessionFile), byID: make(map[string]*session)}
+	ts := &apiTokenStore{path: filepath.Join(dir, apiTokenFile), byHash: make(map[string]*apiToken)}
+	ds := &deviceStore{path: filepath.Join(dir, deviceFile), byHash: make(map[string]*device)}
+	if err := us.load(); err != nil {
+		t.Fatal(err)
+	}
+	if err := us.add("admin", "correct horse battery", RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	r, _ := http.NewRequest("GET", "/", nil)
+	ss.create("admin", false, r)
+	ts.create("admin", "script", nil, 0)
+	ds.create("Living Room")
+
+	files := []string{us.path, ss.path, ts.path, ds.path}
+	before := make(map[string]string)
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		before[f] = string(b)
+	}
+
+	handedOver.Store(true)
+	if err := us.add("other", "correct horse battery", RoleViewer); !errors.Is(err, errHandedOver) {
+		t.Errorf("adding a user after handover: %v, want %v", err, errHandedOver)
+	}
+	ss.create("admin", false, r)
+	ts.create("admin", "another", nil, 0)
+	ds.create("Bedroom")
+	for _, f := range files {
+		if b, _ := os.ReadFile(f); string(b) != before[f] {
+			t.Errorf("%s was written after handover", filepath.Base(f))
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// withFeedAuth turns on signed links and device keys, with a fresh signing
+// key and device store for the test.
+func withFeedAuth(t *testing.T) {
+	t.Helper()
+	oldSign, oldRequired, oldSecret, oldDevices, oldDataDir := signContentURLs, feedKeyRequired, urlSecret, devices, dataDir
+	t.Cleanup(func() {
+		signContentURLs, feedKeyRequired, urlSecret, devices, dataDir = oldSign, oldRequired, oldSecret, oldDevices, oldDataDir
+	})
+	dataDir = t.TempDir()
+	signContentURLs, feedKeyRequired = true, true
+	devices = &deviceStore{path: dataPath(deviceFile), byHash: make(map[string]*device)}
+	if err := loadURLSecret(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// getContent requests a /content/ URL and returns the status and body.
+func getContent(t *testing.T, root, target string, header map[string]string) (int, string) {
+	t.Helper()
+	u, err := url.Parse(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", u.RequestURI(), nil)
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	contentHandler(root).ServeHTTP(w, r)
+	return w.Code, w.Body.String()
+}
+
+func TestSignedURLRoundTrip(t *testing.T) {
+	root, _ := newTestTree(t)
+	withFeedAuth(t)
+	for _, segs := range [][]string{
+		{"Movies", "Film", "film.mp4"},
+		{"TV", "Show", "Season 1", "Episode 1", "ep.mp4"},
+	} {
+		u := contentURL("http://tv.example", segs...)
+		if code, _ := getContent(t, root, u, nil); code != http.StatusOK {
+			t.Errorf("GET %s: got %d", u, code)
+		}
+	}
+
+	// Without signing the links are plain
+	signContentURLs = false
+	if u := contentURL("http://tv.example", "TV", "Show", "Season 1"); u != "http://tv.example/content/TV/Show/Season%201" {
+		t.Errorf("unsigned link = %s", u)
+	}
+}
+
+func TestSignedURLRefusesTampering(t *testing.T) {
+	root, _ := newTestTree(t)
+	withFeedAuth(t)
+	good, _ := url.Parse(contentURL("http://tv.example", "Movies", "Film", "film.mp4"))
+	exp, sig := good.Query().Get("exp"), good.Query().Get("sig")
+	link := func(path, exp, sig string) string {
+		v := url.Values{}
+		if exp != "" {
+			v.Set("exp", exp)
+		}
+		if sig != "" {
+			v.Set("sig", sig)
+		}
+		return path + "?" + v.Encode()
+	}
+
+	changed := "A" + sig[1:]
+	if sig[0] == 'A' {
+		changed = "B" + sig[1:]
+	}
+	later := strconv.FormatInt(time.Now().Add(48*time.Hour).Unix(), 10)
+	realSecret := urlSecret
+	urlSecret = bytes.Repeat([]byte("k"), 32)
+	expN, _ := strconv.ParseInt(exp, 10, 64)
+	otherKey := urlSignature(good.Path, expN)
+	urlSecret = realSecret
+
+	for name, target := range map[string]string{
+		"other path":    link("/content/TV/Show/Season%201/Episode%201/ep.mp4", exp, sig),
+		"longer expiry": link(good.Path, later, sig),
+		"changed sig":   link(good.Path, exp, changed),
+		"no sig":        link(good.Path, exp, ""),
+		"no exp":        link(good.Path, "", sig),
+		"other key":     link(good.Path, exp, otherKey),
+	} {
+		if code, body := getContent(t, root, target, nil); code != http.StatusForbidden {
+			t.Errorf("%s: got %d: %q", name, code, body)
+		}
+	}
+}
+
+func TestSignedURLExpires(t *testing.T) {
+	root, _ := newTestTree(t)
+	withFeedAuth(t)
+	old := signedURLLifetime
+	signedURLLifetime = -time.Second
+	defer func() { signedURLLifetime = old }()
+
+	if code, _ := getContent(t, root, contentURL("http://tv.example", "Movies", "Film", "film.mp4"), nil); code != http.StatusForbidden {
+		t.Errorf("expired link: got %d", code)
+	}
+}
+
+func TestURLSecretKept(t *testing.T) {
+	withFeedAuth(t)
+	first := append([]byte(nil), urlSecret...)
+	if err := loadURLSecret(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first, urlSecret) {
+		t.Error("signing key changed on reload; every link handed out would break")
+	}
+	if fi, err := os.Stat(dataPath(urlSecretFile)); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("key file: %v, %v", fi, err)
+	}
+}
+
+func TestDeviceKeys(t *testing.T) {
+	root, _ := newTestTree(t)
+	withFeedAuth(t)
+	key := devices.create("Living Room")
+	feed := requireDeviceKey(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("feed"))
+	}))
+	getFeed := func(target string, header map[string]string) int {
+		r := httptest.NewRequest("GET", target, nil)
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		feed.ServeHTTP(w, r)
+		return w.Code
+	}
+	bare := "/content/Movies/Film/film.mp4"
+
+	if code := getFeed("/feed.xml?key="+url.QueryEscape(key), nil); code != http.StatusOK {
+		t.Errorf("feed with the key in the query: got %d", code)
+	}
+	if code := getFeed("/feed.xml", map[string]string{"X-Device-Key": key}); code != http.StatusOK {
+		t.Errorf("feed with the key in the header: got %d", code)
+	}
+	if code, _ := getContent(t, root, bare, map[string]string{"X-Device-Key": key}); code != http.StatusOK {
+		t.Errorf("content with the key in the header: got %d", code)
+	}
+	for name, code := range map[string]int{
+		"feed without a key":    getFeed("/feed.xml", nil),
+		"feed with a wrong key": getFeed("/feed.xml?key=nope", nil),
+		"feed with a device ID": getFeed("/feed.xml?key="+devices.list()[0].ID, nil),
+	} {
+		if code != http.StatusUnauthorized {
+			t.Errorf("%s: got %d", name, code)
+		}
+	}
+	// Links in the feed are signed, so content never takes a key in the query
+	if code, _ := getContent(t, root, bare+"?key="+url.QueryEscape(key), nil); code != http.StatusForbidden {
+		t.Errorf("content with the key in the query: got %d", code)
+	}
+
+	d := devices.list()[0]
+	if d.LastSeen.IsZero() || d.LastIP == "" {
+		t.Errorf("use not recorded: %+v", d)
+	}
+	if !devices.revoke(d.ID) {
+		t.Fatal("revoke failed")
+	}
+	if code := getFeed("/feed.xml", map[string]string{"X-Device-Key": key}); code != http.StatusUnauthorized {
+		t.Errorf("feed with a revoked key: got %d", code)
+	}
+	if code, _ := getContent(t, root, bare, map[string]string{"X-Device-Key": key}); code != http.StatusForbidden {
+		t.Errorf("content with a revoked key: got %d", code)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ==== HTTPS ====
+//
+// The server can listen with a certificate the user provides, or with one
+// signed by a CA it generates itself on first start. The CA is kept so
+// browsers (and channels that bundle it) only need to trust it once; the
+// server certificate is reissued on every start for the current addresses.
+// An extra plain HTTP listener can keep serving the feed to devices while
+// sending browsers to HTTPS.
+
+const (
+	tlsDir        = "tls"
+	tlsCAFile     = "ca.pem"
+	tlsCAKeyFile  = "ca.key"
+	tlsCertOut    = "server.pem"
+	tlsKeyOut     = "server.key"
+	caLifetime    = 10 * 365 * 24 * time.Hour
+	leafLifetime  = 397 * 24 * time.Hour // the most browsers accept
+	caCertURLPath = "/tls/ca.pem"
+)
+
+var (
+	tlsCertFile   string
+	tlsKeyFile    string
+	tlsSelfSigned bool
+	plainHTTPAddr string // optional HTTP listener next to the HTTPS one
+	publicBaseURL string // e.g. https://media.example.com, overrides the request
+)
+
+func tlsEnabled() bool {
+	return tlsSelfSigned || tlsCertFile != ""
+}
+
+// serve runs the server on addr until it is stopped. In combined mode addr
+// only answers devices and the admin UI gets a listener of its own.
+func serve(addr string) {
+	certFile, keyFile := tlsCertFile, tlsKeyFile
+	if tlsSelfSigned {
+		var err error
+		if certFile, keyFile, err = selfSignedCert(); err != nil {
+			fatal("server", "failed to create self-signed certificate", "err", err)
+		}
+		http.HandleFunc(caCertURLPath, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/x-pem-file")
+			http.ServeFile(w, r, filepath.Join(dataPath(tlsDir), tlsCAFile))
+		})
+		logFor("server").Info("using self-signed certificate; trust the CA to avoid warnings",
+			"ca", filepath.Join(dataPath(tlsDir), tlsCAFile), "url", caCertURLPath)
+	}
+	runServers(listenerSpecs(http.DefaultServeMux, addr, certFile != ""), certFile, keyFile)
+}
+
+// listenerSpecs lays out the listeners serving mux: addr, the plain HTTP
+// one next to it and, in combined mode, the admin listener.
+func listenerSpecs(mux http.Handler, addr string, useTLS bool) []listenerSpec {
+	handler := logRequests(mountHandler(mux))
+	public := handler
+	if cfg.Mode == "combined" {
+		public = logRequests(mountHandler(devicesOnly(mux)))
+	}
+	listeners := []listenerSpec{{addr: addr, handler: public, tls: useTLS}}
+	if plainHTTPAddr != "" {
+		// Browsers belong on the admin listener when there is one
+		browserAddr := addr
+		if cfg.Mode == "combined" {
+			browserAddr = cfg.AdminAddr
+		}
+		logFor("server").Info("plain HTTP listener for the feed, browsers are redirected", "addr", plainHTTPAddr)
+		listeners = append(listeners, listenerSpec{addr: plainHTTPAddr, handler: redirectToHTTPS(browserAddr, public)})
+	}
+	if cfg.Mode == "combined" {
+		listeners = append(listeners, listenerSpec{addr: cfg.AdminAddr, handler: onAdminListener(handler), tls: useTLS})
+	}
+	return listeners
+}
+
+// listenScheme is the scheme the main listener speaks, for log messages.
+func listenScheme() string {
+	if tlsEnabled() {
+		return "https"
+	}
+	return "http"
+}
+
+// isDevicePath reports whether a request belongs to the feed side, which
+// plain HTTP keeps serving since many players can't check our certificate.
+func isDevicePath(p string) bool {
+	return p == "/feed.xml" || strings.HasPrefix(p, "/content/") ||
+		strings.HasPrefix(p, "/activate/") || p == caCertURLPath ||
+		p == "/healthz" || p == "/readyz"
+}
+
+// redirectToHTTPS sends everything but device requests to the HTTPS
+// listener on tlsAddr.
+func redirectToHTTPS(tlsAddr string, next http.Handler) http.Handler {
+	_, port, _ := net.SplitHostPort(tlsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isDevicePath(strings.TrimPrefix(r.URL.Path, basePath)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// selfSignedCert makes sure the CA exists and issues a fresh server
+// certificate from it, returning the certificate and key file paths.
+func selfSignedCert() (string, string, error) {
+	if err := os.MkdirAll(dataPath(tlsDir), 0700); err != nil {
+		return "", "", err
+	}
+	ca, caKey, err := loadOrCreateCA()
+	if err != nil {
+		return "", "", err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: "ChannelForge"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(leafLifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	tmpl.DNSNames, tmpl.IPAddresses = certNames()
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return "", "", err
+	}
+	certPath := filepath.Join(dataPath(tlsDir), tlsCertOut)
+	keyPath := filepath.Join(dataPath(tlsDir), tlsKeyOut)
+	if err := writePEM(certPath, "CERTIFICATE", der, 0644); err != nil {
+		return "", "", err
+	}
+	kb, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+	if err := writePEM(keyPath, "EC PRIVATE KEY", kb, 0600); err != nil {
+		return "", "", err
+	}
+	return certPath, keyPath, nil
+}
+
+func loadOrCreateCA() (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certPath := filepath.Join(dataPath(tlsDir), tlsCAFile)
+	keyPath := filepath.Join(dataPath(tlsDir), tlsCAKeyFile)
+	cb, certErr := os.ReadFile(certPath)
+	kb, keyErr := os.ReadFile(keyPath)
+	// Only a CA that is missing altogether may be replaced: devices and
+	// browsers have been told to trust the one there
+	switch {
+	case certErr != nil && !os.IsNotExist(certErr):
+		return nil, nil, certErr
+	case keyErr != nil && !os.IsNotExist(keyErr):
+		return nil, nil, keyErr
+	case (certErr == nil) != (keyErr == nil):
+		return nil, nil, fmt.Errorf("only one of %s and %s exists in %s; restore the other, or remove both to create a new CA",
+			tlsCAFile, tlsCAKeyFile, dataPath(tlsDir))
+	case certErr == nil:
+		cp, _ := pem.Decode(cb)
+		kp, _ := pem.Decode(kb)
+		if cp == nil || kp == nil {
+			return nil, nil, errors.New("unreadable CA files in " + dataPath(tlsDir))
+		}
+		ca, err := x509.ParseCertificate(cp.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		key, err := x509.ParseECPrivateKey(kp.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		if time.Now().Before(ca.NotAfter) {
+			return ca, key, nil
+		}
+		logFor("server").Info("self-signed CA has expired, creating a new one")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	host, _ := os.Hostname()
+	tmpl := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{CommonName: fmt.Sprintf("ChannelForge CA (%s)", host)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(caLifetime),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := writePEM(keyPath, "EC PRIVATE KEY", keyDER, 0600); err != nil {
+		return nil, nil, err
+	}
+	if err := writePEM(certPath, "CERTIFICATE", der, 0644); err != nil {
+		return nil, nil, err
+	}
+	logFor("server").Info("created self-signed CA", "path", certPath)
+	return ca, key, nil
+}
+
+// certNames lists the names and addresses this machine can be reached by.
+func certNames() ([]string, []net.IP) {
+	names := []string{"localhost"}
+	if h, err := os.Hostname(); err == nil && h != "" {
+		names = append(names, h, h+".local")
+	}
+	ips := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && !n.IP.IsLoopback() && !n.IP.IsLinkLocalUnicast() {
+				ips = append(ips, n.IP)
+			}
+		}
+	}
+	if u, err := url.Parse(publicBaseURL); err == nil && u.Hostname() != "" {
+		if ip := net.ParseIP(u.Hostname()); ip != nil {
+			ips = append(ips, ip)
+		} else {
+			names = append(names, u.Hostname())
+		}
+	}
+	return names, ips
+}
+
+func randomSerial() *big.Int {
+	n, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+func writePEM(path, typ string, der []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// withTLSDir gives the test a data directory of its own for certificates.
+func withTLSDir(t *testing.T) string {
+	t.Helper()
+	keepSettings(t)
+	old := dataDir
+	t.Cleanup(func() { dataDir = old })
+	dataDir = t.TempDir()
+	return dataPath(tlsDir)
+}
+
+func readCert(t *testing.T, path string) *x509.Certificate {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		t.Fatalf("%s holds no PEM", path)
+	}
+	c, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestSelfSignedCertKeepsCA(t *testing.T) {
+	dir := withTLSDir(t)
+	publicBaseURL = "https://media.example.com/tv"
+
+	var leaves []*x509.Certificate
+	var cas []string
+	for i := 0; i < 2; i++ {
+		certPath, _, err := selfSignedCert()
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaves = append(leaves, readCert(t, certPath))
+		b, _ := os.ReadFile(filepath.Join(dir, tlsCAFile))
+		cas = append(cas, string(b))
+	}
+	if cas[0] != cas[1] {
+		t.Fatal("a second start made a new CA")
+	}
+	ca := readCert(t, filepath.Join(dir, tlsCAFile))
+	if leaves[0].SerialNumber.Cmp(leaves[1].SerialNumber) == 0 {
+		t.Error("the server certificate was not reissued")
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	names, ips := certNames()
+	for i, leaf := range leaves {
+		if _, err := leaf.Verify(x509.VerifyOptions{Roots: roots, DNSName: "media.example.com"}); err != nil {
+			t.Errorf("certificate %d doesn't chain to the kept CA: %v", i+1, err)
+		}
+	}
+	leaf := leaves[1]
+	for _, n := range names {
+		if !slices.Contains(leaf.DNSNames, n) {
+			t.Errorf("certificate lacks name %q: %q", n, leaf.DNSNames)
+		}
+	}
+	if !slices.Contains(leaf.DNSNames, "media.example.com") {
+		t.Errorf("certificate lacks the base URL's host: %q", leaf.DNSNames)
+	}
+	for _, ip := range ips {
+		if !slices.ContainsFunc(leaf.IPAddresses, ip.Equal) {
+			t.Errorf("certificate lacks address %s", ip)
+		}
+	}
+}
+
+func TestSelfSignedCertNeverReplacesCA(t *testing.T) {
+	dir := withTLSDir(t)
+	if _, _, err := selfSignedCert(); err != nil {
+		t.Fatal(err)
+	}
+	caPath, keyPath := filepath.Join(dir, tlsCAFile), filepath.Join(dir, tlsCAKeyFile)
+	ca, _ := os.ReadFile(caPath)
+	key, _ := os.ReadFile(keyPath)
+
+	// A key that can't be read, here because it's a directory
+	os.Remove(keyPath)
+	os.Mkdir(keyPath, 0700)
+	if _, _, err := selfSignedCert(); err == nil {
+		t.Error("an unreadable CA key was replaced")
+	}
+	if b, _ := os.ReadFile(caPath); string(b) != string(ca) {
+		t.Error("CA certificate changed after a key read error")
+	}
+
+	// Only one of the pair
+	os.Remove(keyPath)
+	if _, _, err := selfSignedCert(); err == nil || !strings.Contains(err.Error(), "only one of") {
+		t.Errorf("CA certificate without its key: %v", err)
+	}
+	if b, _ := os.ReadFile(caPath); string(b) != string(ca) {
+		t.Error("CA certificate replaced while its key was missing")
+	}
+	os.WriteFile(keyPath, key, 0600)
+	os.Remove(caPath)
+	if _, _, err := selfSignedCert(); err == nil || !strings.Contains(err.Error(), "only one of") {
+		t.Errorf("CA key without its certificate: %v", err)
+	}
+	if b, _ := os.ReadFile(keyPath); string(b) != string(key) {
+		t.Error("CA key replaced while its certificate was missing")
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	keepSettings(t)
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "served")
+	})
+	tests := []struct {
+		base, tlsAddr, host, path string
+		want                      string // redirect target, or "" when served
+	}{
+		{"", ":8443", "tv.lan:8080", "/feed.xml", ""},
+		{"", ":8443", "tv.lan:8080", "/content/Movies/Film/film.mp4", ""},
+		{"", ":8443", "tv.lan:8080", "/activate/code", ""},
+		{"", ":8443", "tv.lan:8080", caCertURLPath, ""},
+		{"", ":8443", "tv.lan:8080", "/admin?x=1", "https://tv.lan:8443/admin?x=1"},
+		{"", "0.0.0.0:443", "tv.lan:8080", "/admin", "https://tv.lan/admin"},
+		{"", ":443", "tv.lan", "/login", "https://tv.lan/login"},
+		{"/media", ":8443", "tv.lan", "/media/feed.xml", ""},
+		{"/media", ":8443", "tv.lan", "/media/content/Movies/Film/film.mp4", ""},
+		{"/media", ":8443", "tv.lan", "/media/activate/poll", ""},
+		{"/media", ":8443", "tv.lan", "/media" + caCertURLPath, ""},
+		{"/media", ":8443", "tv.lan", "/media/admin", "https://tv.lan:8443/media/admin"},
+	}
+	for _, tt := range tests {
+		basePath = tt.base
+		r := httptest.NewRequest("GET", tt.path, nil)
+		r.Host = tt.host
+		w := httptest.NewRecorder()
+		redirectToHTTPS(tt.tlsAddr, next).ServeHTTP(w, r)
+		if tt.want == "" {
+			if w.Code != http.StatusOK || w.Body.String() != "served" {
+				t.Errorf("%s%s: got %d %s, want it served", tt.host, tt.path, w.Code, w.Header().Get("Location"))
+			}
+			continue
+		}
+		if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != tt.want {
+			t.Errorf("%s%s to %s: got %d %q, want a 301 to %q", tt.host, tt.path, tt.tlsAddr, w.Code, w.Header().Get("Location"), tt.want)
+		}
+	}
+}
+
+func TestListenerSpecsWithPlainHTTP(t *testing.T) {
+	keepSettings(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/feed.xml", func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "feed") })
+	mux.HandleFunc("/admin", func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "admin") })
+	plainHTTPAddr = ":8080"
+
+	tests := []struct {
+		mode      string
+		addrs     []string
+		tls       []bool
+		adminGoes string // where the plain listener sends /admin
+	}{
+		{"web", []string{":8443", ":8080"}, []bool{true, false}, "https://tv.lan:8443/admin"},
+		{"combined", []string{":8443", ":8080", "127.0.0.1:8444"}, []bool{true, false, true}, "https://tv.lan:8444/admin"},
+	}
+	for _, tt := range tests {
+		cfg.Mode, cfg.AdminAddr = tt.mode, "127.0.0.1:8444"
+		specs := listenerSpecs(mux, ":8443", true)
+		if len(specs) != len(tt.addrs) {
+			t.Fatalf("%s: %d listeners, want %d", tt.mode, len(specs), len(tt.addrs))
+		}
+		for i, s := range specs {
+			if s.addr != tt.addrs[i] || s.tls != tt.tls[i] {
+				t.Errorf("%s listener %d: %s tls=%v, want %s tls=%v", tt.mode, i, s.addr, s.tls, tt.addrs[i], tt.tls[i])
+			}
+		}
+
+		plain := specs[1].handler
+		r := httptest.NewRequest("GET", "/feed.xml", nil)
+		r.Host = "tv.lan:8080"
+		w := httptest.NewRecorder()
+		plain.ServeHTTP(w, r)
+		if w.Code != http.StatusOK || w.Body.String() != "feed" {
+			t.Errorf("%s: plain /feed.xml got %d %q", tt.mode, w.Code, w.Body)
+		}
+		r = httptest.NewRequest("GET", "/admin", nil)
+		r.Host = "tv.lan:8080"
+		w = httptest.NewRecorder()
+		plain.ServeHTTP(w, r)
+		if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != tt.adminGoes {
+			t.Errorf("%s: plain /admin got %d %q, want %q", tt.mode, w.Code, w.Header().Get("Location"), tt.adminGoes)
+		}
+	}
+}
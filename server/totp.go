@@ -0,0 +1,295 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ==== TWO-FACTOR LOGIN (TOTP) ====
+//
+// Time-based one-time passwords as described in RFC 6238, compatible with
+// the usual authenticator apps. Codes are checked locally; no outside
+// service is involved.
+
+const (
+	totpIssuer = "ChannelForge"
+	totpStep   = 30 * time.Second
+	totpDigits = 6
+	totpSkew   = 1 // accept codes one step either side of now
+
+	twoFactorCookie  = "login2fa"
+	twoFactorTimeout = 5 * time.Minute
+	twoFactorTries   = 5
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func newTOTPSecret() string {
+	b := make([]byte, 20)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		panic(err)
+	}
+	return totpEncoding.EncodeToString(b)
+}
+
+// totpURI is what authenticator apps expect, usually via a QR code.
+func totpURI(username, secret string) string {
+	label := url.PathEscape(totpIssuer + ":" + username)
+	v := url.Values{"secret": {secret}, "issuer": {totpIssuer}}
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// totpCode computes the code for one time step (RFC 4226 truncation).
+func totpCode(key []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	off := sum[len(sum)-1] & 0x0f
+	n := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, n%mod)
+}
+
+// validTOTPSecret reports whether secret decodes to a key of at least the
+// 80 bits RFC 4226 asks for.
+func validTOTPSecret(secret string) bool {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	return err == nil && len(key) >= 10
+}
+
+// totpCheck returns the time step code matched, or false.
+func totpCheck(secret, code string, now time.Time) (uint64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	cur := uint64(now.Unix()) / uint64(totpStep/time.Second)
+	for i := -totpSkew; i <= totpSkew; i++ {
+		c := cur + uint64(i)
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, c)), []byte(code)) == 1 {
+			return c, true
+		}
+	}
+	return 0, false
+}
+
+// A code may only be used once, so a shoulder-surfed code is worthless.
+var totpUsed = struct {
+	sync.Mutex
+	last map[string]uint64
+}{last: make(map[string]uint64)}
+
+// verifyTOTP checks code against the user's secret and burns it.
+func verifyTOTP(u *User, code string) bool {
+	if u == nil || u.TOTPSecret == "" {
+		return false
+	}
+	c, ok := totpCheck(u.TOTPSecret, code, time.Now())
+	return ok && burnTOTPStep(u.Username, c)
+}
+
+// burnTOTPStep records step as used by username, refusing it and any
+// earlier step once a code has been accepted.
+func burnTOTPStep(username string, step uint64) bool {
+	totpUsed.Lock()
+	defer totpUsed.Unlock()
+	if step <= totpUsed.last[username] {
+		return false
+	}
+	totpUsed.last[username] = step
+	return true
+}
+
+// totpAccountAction handles setting up and turning off two-factor login
+// from the account page. The secret being set up stays with the session
+// rather than in the form, so the browser can't swap in its own.
+func totpAccountAction(me *User, data map[string]interface{}, r *http.Request) {
+	cookie, err := r.Cookie("session")
+	sess := currentSession(r)
+	if err != nil || sess == nil {
+		data["Error"] = "Sign in again to change two-factor login."
+		return
+	}
+	switch r.FormValue("action") {
+	case "totp-setup":
+		secret := newTOTPSecret()
+		sessions.setTOTPPending(cookie.Value, secret)
+		data["TOTPSetup"] = secret
+		data["TOTPURI"] = totpURI(me.Username, secret)
+	case "totp-enable":
+		secret := sess.TOTPPending
+		if !validTOTPSecret(secret) {
+			data["Error"] = "The setup has expired. Start it again."
+			return
+		}
+		data["TOTPSetup"] = secret
+		data["TOTPURI"] = totpURI(me.Username, secret)
+		if users.authenticate(me.Username, r.FormValue("current")) == nil {
+			data["Error"] = "Current password is wrong"
+			return
+		}
+		step, ok := totpCheck(secret, r.FormValue("code"), time.Now())
+		if !ok || !burnTOTPStep(me.Username, step) {
+			data["Error"] = "That code didn't match. Check your device's clock and try again."
+			return
+		}
+		if err := users.setTOTP(me.Username, secret); err != nil {
+			data["Error"] = "Failed to enable two-factor login: " + err.Error()
+			return
+		}
+		sessions.setTOTPPending(cookie.Value, "")
+		delete(data, "TOTPSetup")
+		delete(data, "TOTPURI")
+		data["Message"] = "Two-factor login is now on."
+	case "totp-disable":
+		if !verifyTOTP(me, r.FormValue("code")) {
+			data["Error"] = "Invalid code"
+			return
+		}
+		if err := users.setTOTP(me.Username, ""); err != nil {
+			data["Error"] = "Failed to turn off two-factor login: " + err.Error()
+			return
+		}
+		data["Message"] = "Two-factor login is now off."
+	}
+}
+
+// ==== SECOND LOGIN STEP ====
+
+// pendingLogin is a password-verified login still waiting for its code.
+type pendingLogin struct {
+	Username string
+	Remember bool
+	Expires  time.Time
+	Tries    int
+}
+
+var pendingLogins = struct {
+	sync.Mutex
+	byToken map[string]*pendingLogin
+}{byToken: make(map[string]*pendingLogin)}
+
+// startTwoFactor remembers a password-verified login and sends the browser
+// to the code page.
+func startTwoFactor(w http.ResponseWriter, r *http.Request, username string, remember bool) {
+	token := newSessionToken()
+	now := time.Now()
+	pendingLogins.Lock()
+	for t, p := range pendingLogins.byToken {
+		if now.After(p.Expires) {
+			delete(pendingLogins.byToken, t)
+		}
+	}
+	pendingLogins.byToken[hashToken(token)] = &pendingLogin{
+		Username: username,
+		Remember: remember,
+		Expires:  now.Add(twoFactorTimeout),
+	}
+	pendingLogins.Unlock()
+	http.SetCookie(w, &http.Cookie{
+		Name:     twoFactorCookie,
+		Value:    token,
+		Path:     "/login",
+		MaxAge:   int(twoFactorTimeout.Seconds()),
+		HttpOnly: true,
+		Secure:   tlsEnabled(),
+		SameSite: http.SameSiteStrictMode,
+	})
+	http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
+}
+
+func clearTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(twoFactorCookie); err == nil {
+		pendingLogins.Lock()
+		delete(pendingLogins.byToken, hashToken(c.Value))
+		pendingLogins.Unlock()
+	}
+	http.SetCookie(w, &http.Cookie{Name: twoFactorCookie, Path: "/login", MaxAge: -1, HttpOnly: true})
+}
+
+// currentPending returns the pending login for the request, or nil.
+func currentPending(r *http.Request) *pendingLogin {
+	c, err := r.Cookie(twoFactorCookie)
+	if err != nil {
+		return nil
+	}
+	pendingLogins.Lock()
+	defer pendingLogins.Unlock()
+	p, ok := pendingLogins.byToken[hashToken(c.Value)]
+	if !ok || time.Now().After(p.Expires) {
+		return nil
+	}
+	return p
+}
+
+var twoFactorPage = template.Must(template.New("2fa").Parse(`
+<html><head><title>Login</title>` + css + `</head><body>
+<div class="card">
+<h2>Two-Factor Login</h2>
+{{if .Error}}<div class="error">{{.Error}}</div>{{end}}
+<p>Enter the code from your authenticator app.</p>
+<form method="POST" action="/login/2fa">
+  <label>Code <input name="code" required autofocus inputmode="numeric" autocomplete="one-time-code"></label>
+  <button type="submit">Verify</button>
+</form>
+<a href="/login">Start over</a>
+</div>
+</body></html>`))
+
+func twoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	p := currentPending(r)
+	if p == nil {
+		clearTwoFactor(w, r)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		twoFactorPage.Execute(w, nil)
+	case "POST":
+		ip := clientIP(r)
+		if wait := loginGuard.blocked(ip, p.Username); wait > 0 {
+			clearTwoFactor(w, r)
+			w.WriteHeader(http.StatusTooManyRequests)
+			loginPage.Execute(w, map[string]string{"Error": lockoutMessage(wait)})
+			return
+		}
+		if !verifyTOTP(users.get(p.Username), r.FormValue("code")) {
+			loginGuard.fail(r, p.Username, "invalid two-factor code")
+			pendingLogins.Lock()
+			p.Tries++
+			tries := p.Tries
+			pendingLogins.Unlock()
+			if tries >= twoFactorTries {
+				clearTwoFactor(w, r)
+				loginPage.Execute(w, map[string]string{"Error": "Too many wrong codes. Sign in again."})
+				return
+			}
+			twoFactorPage.Execute(w, map[string]string{"Error": "Invalid code"})
+			return
+		}
+		clearTwoFactor(w, r)
+		loginGuard.succeed(p.Username)
+		startSession(w, r, p.Username, p.Remember)
+	default:
+		http.Error(w, "Method not allowed", 405)
+	}
+}
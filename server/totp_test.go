@@ -0,0 +1,174 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The SHA1 test vectors of RFC 6238, appendix B, cut to our six digits.
+func TestTOTPCode(t *testing.T) {
+	key := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	secret := totpEncoding.EncodeToString(key)
+	for _, tt := range tests {
+		step := uint64(tt.unix) / uint64(totpStep/time.Second)
+		if got := totpCode(key, step); got != tt.want {
+			t.Errorf("totpCode at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+		if got, ok := totpCheck(secret, tt.want, time.Unix(tt.unix, 0)); !ok || got != step {
+			t.Errorf("totpCheck(%s) at %d = %d, %v; want %d", tt.want, tt.unix, got, ok, step)
+		}
+	}
+}
+
+func TestTOTPCheckSkew(t *testing.T) {
+	key := []byte("12345678901234567890")
+	secret := totpEncoding.EncodeToString(key)
+	now := time.Unix(1111111111, 0)
+	step := uint64(now.Unix()) / uint64(totpStep/time.Second)
+	for _, off := range []int{-1, 0, 1} {
+		code := totpCode(key, step+uint64(off))
+		if _, ok := totpCheck(secret, code, now); !ok {
+			t.Errorf("code %+d steps from now was refused", off)
+		}
+		// Apps may show the code split in two
+		if _, ok := totpCheck(strings.ToLower(secret), " "+code[:3]+" "+code[3:], now); !ok {
+			t.Errorf("spaced code %+d steps from now was refused", off)
+		}
+	}
+	for _, off := range []int{-3, -2, 2, 3} {
+		if _, ok := totpCheck(secret, totpCode(key, step+uint64(off)), now); ok {
+			t.Errorf("code %+d steps from now was accepted", off)
+		}
+	}
+	for _, bad := range []string{"", "12345", "1234567", "abcdef"} {
+		if _, ok := totpCheck(secret, bad, now); ok {
+			t.Errorf("code %q was accepted", bad)
+		}
+	}
+	if _, ok := totpCheck("not base32!", totpCode(key, step), now); ok {
+		t.Error("a broken secret matched")
+	}
+}
+
+func TestVerifyTOTPReplay(t *testing.T) {
+	u := &User{Username: "replay-test", TOTPSecret: newTOTPSecret()}
+	t.Cleanup(func() {
+		totpUsed.Lock()
+		delete(totpUsed.last, u.Username)
+		totpUsed.Unlock()
+	})
+	key, _ := totpEncoding.DecodeString(u.TOTPSecret)
+	step := uint64(time.Now().Unix()) / uint64(totpStep/time.Second)
+
+	if !verifyTOTP(u, totpCode(key, step)) {
+		t.Fatal("current code refused")
+	}
+	if verifyTOTP(u, totpCode(key, step)) {
+		t.Error("the same code was accepted twice")
+	}
+	if verifyTOTP(u, totpCode(key, step-1)) {
+		t.Error("an older code was accepted after a newer one")
+	}
+	if !verifyTOTP(u, totpCode(key, step+1)) {
+		t.Error("the next code was refused")
+	}
+	if verifyTOTP(&User{Username: "no-secret"}, "123456") {
+		t.Error("a user without two-factor login passed")
+	}
+}
+
+func TestValidTOTPSecret(t *testing.T) {
+	for _, tt := range []struct {
+		secret string
+		ok     bool
+	}{
+		{newTOTPSecret(), true},
+		{"GEZDGNBVGY3TQOJQ", true},
+		{"gezdgnbvgy3tqojq", true},
+		{"GEZDGNBV", false}, // 40 bits
+		{"", false},
+		{"GEZDGNBVGY3TQOJ1", false},
+	} {
+		if validTOTPSecret(tt.secret) != tt.ok {
+			t.Errorf("validTOTPSecret(%q) = %v, want %v", tt.secret, !tt.ok, tt.ok)
+		}
+	}
+}
+
+// currentTOTP returns the code an authenticator app shows now for secret.
+func currentTOTP(t *testing.T, secret string) string {
+	t.Helper()
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return totpCode(key, uint64(time.Now().Unix())/uint64(totpStep/time.Second))
+}
+
+func (s *testServer) account(form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/admin/account", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("X-CSRF-Token", s.csrf)
+	r.AddCookie(s.cookie)
+	w := httptest.NewRecorder()
+	requireLogin(accountHandler)(w, r)
+	return w
+}
+
+func TestTOTPEnable(t *testing.T) {
+	s := newTestServer(t)
+	t.Cleanup(func() {
+		totpUsed.Lock()
+		delete(totpUsed.last, "admin")
+		totpUsed.Unlock()
+	})
+	if w := s.account(url.Values{"action": {"totp-setup"}}); w.Code != http.StatusOK {
+		t.Fatalf("setup: got %d", w.Code)
+	}
+	secret := sessions.lookup(s.cookie.Value).TOTPPending
+	if !validTOTPSecret(secret) {
+		t.Fatalf("no secret kept with the session: %q", secret)
+	}
+
+	// A secret sent along with the form is ignored
+	forged := newTOTPSecret()
+	s.account(url.Values{"action": {"totp-enable"}, "secret": {forged}, "current": {"correct horse battery"}, "code": {currentTOTP(t, forged)}})
+	if users.get("admin").TOTPSecret != "" {
+		t.Fatal("two-factor login turned on with a secret from the form")
+	}
+
+	code := currentTOTP(t, secret)
+	s.account(url.Values{"action": {"totp-enable"}, "current": {"wrong password"}, "code": {code}})
+	if users.get("admin").TOTPSecret != "" {
+		t.Fatal("two-factor login turned on without the password")
+	}
+
+	s.account(url.Values{"action": {"totp-enable"}, "current": {"correct horse battery"}, "code": {code}})
+	if users.get("admin").TOTPSecret != secret {
+		t.Fatal("two-factor login was not turned on")
+	}
+	if sessions.lookup(s.cookie.Value).TOTPPending != "" {
+		t.Error("pending secret kept after setup")
+	}
+	if verifyTOTP(users.get("admin"), code) {
+		t.Error("the code that turned two-factor login on was accepted again")
+	}
+	if e := lastAudit(t); e.Action != "user-totp-enable" || stateField(e.After, "two_factor") != true {
+		t.Errorf("turning two-factor login on logged %s %v", e.Action, e.After)
+	}
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ==== TRASH ====
+//
+// Deleted folders are moved to .trash under the library root instead of
+// being removed. Each one gets its own directory holding the folder itself
+// and an info.json saying where it came from. Being hidden, .trash never
+// shows up in the feed, the admin pages or /content/. Entries older than
+// the retention period are purged by a janitor. A folder on a different
+// filesystem than the root (something mounted inside the library) can't be
+// renamed into .trash, so it is copied there and then removed.
+
+const (
+	trashDirName  = ".trash"
+	trashInfoFile = "info.json"
+	trashItemName = "item"
+)
+
+var trashIDPattern = regexp.MustCompile(`^[0-9]{8}-[0-9]{6}-[0-9a-f]{8}$`)
+
+type trashEntry struct {
+	ID      string    `json:"-"`
+	Path    string    `json:"path"` // original location, relative to the root
+	Deleted time.Time `json:"deleted"`
+	Size    int64     `json:"size"`
+}
+
+type trashStore struct {
+	mu        sync.Mutex
+	root      string // empty until the web server sets it: deletes are final
+	retention time.Duration
+}
+
+var trash = &trashStore{retention: 30 * 24 * time.Hour}
+
+func (t *trashStore) dir() string {
+	return filepath.Join(t.root, trashDirName)
+}
+
+// put moves path into the trash.
+func (t *trashStore) put(path string) error {
+	rel, err := filepath.Rel(t.root, path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return fmt.Errorf("%s is not inside the library", path)
+	}
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	e := trashEntry{
+		ID:      time.Now().UTC().Format("20060102-150405") + "-" + hex.EncodeToString(b),
+		Path:    filepath.ToSlash(rel),
+		Deleted: time.Now(),
+		Size:    treeSize(path),
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	dir := filepath.Join(t.dir(), e.ID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	info, _ := json.MarshalIndent(e, "", "  ")
+	if err := os.WriteFile(filepath.Join(dir, trashInfoFile), info, 0644); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	if err := moveTree(path, filepath.Join(dir, trashItemName)); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	return nil
+}
+
+func (t *trashStore) readLocked(id string) (*trashEntry, error) {
+	if !trashIDPattern.MatchString(id) {
+		return nil, errNotFound
+	}
+	b, err := os.ReadFile(filepath.Join(t.dir(), id, trashInfoFile))
+	if err != nil {
+		return nil, errNotFound
+	}
+	var e trashEntry
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, err
+	}
+	e.ID = id
+	return &e, nil
+}
+
+// list returns everything in the trash, most recently deleted first.
+func (t *trashStore) list() ([]trashEntry, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	dirs, err := os.ReadDir(t.dir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var out []trashEntry
+	for _, d := range dirs {
+		if e, err := t.readLocked(d.Name()); err == nil {
+			out = append(out, *e)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Deleted.After(out[j].Deleted) })
+	return out, nil
+}
+
+func (t *trashStore) get(id string) (*trashEntry, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.readLocked(id)
+}
+
+// restore moves an entry back where it was deleted from.
+func (t *trashStore) restore(id string) (*trashEntry, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, err := t.readLocked(id)
+	if err != nil {
+		return nil, err
+	}
+	target := filepath.Join(t.root, filepath.FromSlash(e.Path))
+	if err := checkInsideRoot(t.root, target); err != nil {
+		return nil, badInput("%v", err)
+	}
+	if _, err := os.Stat(target); err == nil {
+		return nil, errExists
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return nil, err
+	}
+	if err := moveTree(filepath.Join(t.dir(), id, trashItemName), target); err != nil {
+		return nil, err
+	}
+	return e, os.RemoveAll(filepath.Join(t.dir(), id))
+}
+
+// purge deletes an entry for good.
+func (t *trashStore) purge(id string) (*trashEntry, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, err := t.readLocked(id)
+	if err != nil {
+		return nil, err
+	}
+	return e, os.RemoveAll(filepath.Join(t.dir(), id))
+}
+
+// purgeExpired deletes entries older than the retention period.
+func (t *trashStore) purgeExpired() {
+	if t.retention <= 0 {
+		return
+	}
+	entries, err := t.list()
+	if err != nil {
+		logFor("trash").Error("failed to read trash", "err", err)
+		return
+	}
+	cutoff := time.Now().Add(-t.retention)
+	for _, e := range entries {
+		if e.Deleted.Before(cutoff) {
+			if _, err := t.purge(e.ID); err != nil {
+				logFor("trash").Error("failed to purge from trash", "path", e.Path, "err", err)
+			} else {
+				logFor("trash").Info("purged from trash", "path", e.Path)
+			}
+		}
+	}
+}
+
+func (t *trashStore) janitor(interval time.Duration) {
+	background.every(interval, t.purgeExpired)
+}
+
+// moveTree renames src to dst, falling back to copying and removing src
+// when they are on different filesystems.
+func moveTree(src, dst string) error {
+	err := os.Rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	if err := copyTree(src, dst); err != nil {
+		os.RemoveAll(dst)
+		return fmt.Errorf("copying %s across filesystems: %w", src, err)
+	}
+	return os.RemoveAll(src)
+}
+
+// copyTree copies the folder src to dst, keeping modes, file modification
+// times and symlinks.
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case fi.IsDir():
+			if err := os.MkdirAll(target, fi.Mode().Perm()); err != nil {
+				return err
+			}
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case fi.Mode().IsRegular():
+			if err := copyFile(p, target, fi.Mode().Perm()); err != nil {
+				return err
+			}
+			return os.Chtimes(target, fi.ModTime(), fi.ModTime())
+		}
+		return nil
+	})
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// treeSize adds up the size of the files below path.
+func treeSize(path string) int64 {
+	var n int64
+	filepath.Walk(path, func(_ string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			n += fi.Size()
+		}
+		return nil
+	})
+	return n
+}
+
+// trashAccess reports whether u may see an entry, by the category and
+// series or movie it was deleted from.
+func trashAccess(u *User, e *trashEntry) bool {
+	parts := strings.SplitN(e.Path, "/", 3)
+	item := ""
+	if len(parts) > 1 {
+		item = parts[1]
+	}
+	return u.canAccess(parts[0], item)
+}
+
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+var trashPage = template.Must(template.New("trash").Funcs(template.FuncMap{
+	"size": formatSize,
+}).Parse(`
+<html><head><title>Trash - Admin</title>` + css + `</head><body>
+<nav>
+  <a href="/admin">Dashboard</a>
+  <a href="/logout">Logout</a>
+</nav>
+<div class="card">
+<h2>Trash</h2>
+<p>Deleted items are kept here{{if .Retention}} for {{.Retention}} days{{end}} before they are removed for good.</p>
+{{if .Error}}<div class="error">{{.Error}}</div>{{end}}
+{{if .Entries}}
+  <table>
+    <tr><th>Item</th><th>Deleted</th><th>Size</th><th></th></tr>
+    {{range .Entries}}
+      <tr>
+        <td>{{.Path}}</td>
+        <td>{{.Deleted.Format "2006-01-02 15:04"}}</td>
+        <td>{{size .Size}}</td>
+        <td>
+          <form method="POST" action="/admin/trash" style="display:inline">` + csrfInput + `
+            <input type="hidden" name="action" value="restore">
+            <input type="hidden" name="id" value="{{.ID}}">
+            <button type="submit" class="btn">Restore</button>
+          </form>
+          <form method="POST" action="/admin/trash" style="display:inline">` + csrfInput + `
+            <input type="hidden" name="action" value="purge">
+            <input type="hidden" name="id" value="{{.ID}}">
+            <button type="submit" class="btn" onclick="return confirm('Delete {{.Path}} for good? This cannot be undone.')">Delete Forever</button>
+          </form>
+        </td>
+      </tr>
+    {{end}}
+  </table>
+  <form method="POST" action="/admin/trash">` + csrfInput + `
+    <input type="hidden" name="action" value="empty">
+    <button type="submit" onclick="return confirm('Delete everything listed here for good?')">Empty Trash</button>
+  </form>
+{{else}}
+  <p>The trash is empty.</p>
+{{end}}
+</div>
+</body></html>
+`))
+
+func trashHandler(w http.ResponseWriter, r *http.Request) {
+	me := currentUser(r)
+	data := map[string]interface{}{"Retention": int(trash.retention.Hours() / 24)}
+	switch r.Method {
+	case "GET":
+	case "POST":
+		var failed error
+		var ids []string
+		if r.FormValue("action") == "empty" {
+			entries, err := trash.list()
+			if err != nil {
+				failed = err
+			}
+			for _, e := range entries {
+				if trashAccess(me, &e) {
+					ids = append(ids, e.ID)
+				}
+			}
+		} else {
+			ids = []string{r.FormValue("id")}
+		}
+		for _, id := range ids {
+			e, err := trash.get(id)
+			if err != nil {
+				failed = err
+				break
+			}
+			if !trashAccess(me, e) {
+				forbidden(w)
+				return
+			}
+			switch r.FormValue("action") {
+			case "restore":
+				if _, err = trash.restore(id); err == nil {
+					audit(r, "restore", e.Path, nil, itemState(filepath.Join(trash.root, filepath.FromSlash(e.Path))))
+				}
+			case "purge", "empty":
+				if _, err = trash.purge(id); err == nil {
+					audit(r, "purge", e.Path, nil, nil)
+				}
+			default:
+				err = errors.New("unknown action")
+			}
+			if err != nil {
+				failed = err
+				break
+			}
+		}
+		switch {
+		case failed == nil:
+			http.Redirect(w, r, "/admin/trash", http.StatusSeeOther)
+			return
+		case errors.Is(failed, errExists):
+			data["Error"] = "Something with that name has been created since; delete or rename it first."
+		case errors.Is(failed, errNotFound):
+			data["Error"] = "That item is no longer in the trash."
+		default:
+			data["Error"] = failed.Error()
+		}
+	default:
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	entries, err := trash.list()
+	if err != nil {
+		data["Error"] = "Failed to read trash: " + err.Error()
+	}
+	var visible []trashEntry
+	for _, e := range entries {
+		if trashAccess(me, &e) {
+			visible = append(visible, e)
+		}
+	}
+	data["Entries"] = visible
+	renderPage(w, r, trashPage, data)
+}
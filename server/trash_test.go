@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func newTrashTest(t *testing.T) (*trashStore, string) {
+	t.Helper()
+	root, _ := newTestTree(t)
+	return &trashStore{root: root, retention: time.Hour}, root
+}
+
+func TestTrashPutRestore(t *testing.T) {
+	tr, root := newTrashTest(t)
+	film := filepath.Join(root, "Movies", "Film")
+	if err := tr.put(film); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(film); err == nil {
+		t.Fatal("deleted folder is still in the library")
+	}
+	entries, err := tr.list()
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("list = %v, %v", entries, err)
+	}
+	e := entries[0]
+	if e.Path != "Movies/Film" || e.Size != int64(len("film")) || !trashIDPattern.MatchString(e.ID) {
+		t.Errorf("entry = %+v", e)
+	}
+
+	if _, err := tr.restore(e.ID); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(filepath.Join(film, "film.mp4")); err != nil || string(b) != "film" {
+		t.Errorf("restored file: %q, %v", b, err)
+	}
+	if entries, _ := tr.list(); len(entries) != 0 {
+		t.Errorf("trash still lists %v", entries)
+	}
+	if _, err := os.Stat(filepath.Join(tr.dir(), e.ID)); err == nil {
+		t.Error("the entry's folder was left in the trash")
+	}
+}
+
+func TestTrashRestoreConflict(t *testing.T) {
+	tr, root := newTrashTest(t)
+	film := filepath.Join(root, "Movies", "Film")
+	if err := tr.put(film); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := tr.list()
+	if err := os.Mkdir(film, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tr.restore(entries[0].ID); !errors.Is(err, errExists) {
+		t.Fatalf("restore over a new folder: %v, want %v", err, errExists)
+	}
+	if _, err := os.Stat(filepath.Join(tr.dir(), entries[0].ID, trashItemName, "film.mp4")); err != nil {
+		t.Errorf("the entry was lost: %v", err)
+	}
+	if dir, _ := os.ReadDir(film); len(dir) != 0 {
+		t.Error("restore wrote into the new folder")
+	}
+}
+
+func TestTrashRefusesBadPaths(t *testing.T) {
+	tr, root := newTrashTest(t)
+	for _, p := range []string{root, filepath.Dir(root), filepath.Join(filepath.Dir(root), "outside")} {
+		if err := tr.put(p); err == nil {
+			t.Errorf("put(%s) succeeded", p)
+		}
+	}
+	for _, id := range []string{"", "..", "../library", "20260101-000000-0000000g", "20260101-000000-00000000/.."} {
+		if _, err := tr.get(id); !errors.Is(err, errNotFound) {
+			t.Errorf("get(%q) = %v, want %v", id, err, errNotFound)
+		}
+		if _, err := tr.restore(id); !errors.Is(err, errNotFound) {
+			t.Errorf("restore(%q) = %v, want %v", id, err, errNotFound)
+		}
+	}
+}
+
+// backdate rewrites an entry's deletion time.
+func backdate(t *testing.T, tr *trashStore, id string, age time.Duration) {
+	t.Helper()
+	e, err := tr.get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Deleted = time.Now().Add(-age)
+	b, _ := json.Marshal(e)
+	if err := os.WriteFile(filepath.Join(tr.dir(), id, trashInfoFile), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTrashPurgeExpired(t *testing.T) {
+	tr, root := newTrashTest(t)
+	for _, p := range []string{filepath.Join(root, "Movies", "Film"), filepath.Join(root, "TV", "Show")} {
+		if err := tr.put(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, _ := tr.list()
+	var old trashEntry
+	for _, e := range entries {
+		if e.Path == "Movies/Film" {
+			old = e
+		}
+	}
+	backdate(t, tr, old.ID, 2*time.Hour)
+
+	// Without a retention period nothing expires
+	tr.retention = 0
+	tr.purgeExpired()
+	if entries, _ := tr.list(); len(entries) != 2 {
+		t.Fatalf("purged with no retention: %v", entries)
+	}
+
+	tr.retention = time.Hour
+	tr.purgeExpired()
+	entries, _ = tr.list()
+	if len(entries) != 1 || entries[0].Path != "TV/Show" {
+		t.Errorf("after the purge the trash holds %v", entries)
+	}
+	if _, err := os.Stat(filepath.Join(tr.dir(), old.ID)); err == nil {
+		t.Error("the expired entry's folder was left")
+	}
+}
+
+func TestMoveTreeAcrossFilesystems(t *testing.T) {
+	shm, err := os.MkdirTemp("/dev/shm", "trash-test")
+	if err != nil {
+		t.Skip("no /dev/shm:", err)
+	}
+	defer os.RemoveAll(shm)
+	dst := t.TempDir()
+	probe := filepath.Join(shm, "probe")
+	os.WriteFile(probe, nil, 0644)
+	if err := os.Rename(probe, filepath.Join(dst, "probe")); !errors.Is(err, syscall.EXDEV) {
+		t.Skip("/dev/shm and the temporary directory are on the same filesystem")
+	}
+
+	src := filepath.Join(shm, "Film")
+	os.MkdirAll(filepath.Join(src, "extras"), 0755)
+	os.WriteFile(filepath.Join(src, "film.mp4"), []byte("film"), 0600)
+	os.WriteFile(filepath.Join(src, "extras", "notes.txt"), []byte("notes"), 0644)
+	os.Symlink("film.mp4", filepath.Join(src, "link.mp4"))
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	os.Chtimes(filepath.Join(src, "film.mp4"), mtime, mtime)
+
+	target := filepath.Join(dst, "Film")
+	if err := moveTree(src, target); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(src); err == nil {
+		t.Error("the source was left behind")
+	}
+	fi, err := os.Stat(filepath.Join(target, "film.mp4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.ModTime().Equal(mtime) || fi.Mode().Perm() != 0600 {
+		t.Errorf("film.mp4 copied with %v, %v", fi.ModTime(), fi.Mode())
+	}
+	if b, _ := os.ReadFile(filepath.Join(target, "extras", "notes.txt")); string(b) != "notes" {
+		t.Errorf("extras/notes.txt holds %q", b)
+	}
+	if link, err := os.Readlink(filepath.Join(target, "link.mp4")); err != nil || link != "film.mp4" {
+		t.Errorf("symlink copied as %q, %v", link, err)
+	}
+
+	// A failed copy leaves the source alone and cleans up after itself
+	src2 := filepath.Join(shm, "Show")
+	os.MkdirAll(src2, 0755)
+	os.WriteFile(filepath.Join(src2, "ep.mp4"), []byte("ep"), 0644)
+	os.MkdirAll(filepath.Join(dst, "Show", "ep.mp4"), 0755) // in the way
+	if err := moveTree(src2, filepath.Join(dst, "Show")); err == nil {
+		t.Fatal("copy onto an existing folder succeeded")
+	}
+	if b, _ := os.ReadFile(filepath.Join(src2, "ep.mp4")); string(b) != "ep" {
+		t.Error("the source was damaged by a failed copy")
+	}
+}
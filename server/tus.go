@@ -0,0 +1,478 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resumable uploads following the tus 1.0.0 protocol (https://tus.io/protocols/resumable-upload).
+// Supported extensions: creation, expiration and termination.
+//
+// Upload data is streamed into <root>/.uploads/<id>.bin next to a small JSON
+// .info file. Once an upload is complete, the admin form that started it
+// submits the upload ID and the file is moved into the library.
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,expiration,termination"
+	tusUploadDir  = ".uploads"
+	tusBasePath   = "/admin/tus/"
+)
+
+var (
+	maxUploadSize int64 = 50 << 30 // 50GB, for tus and form uploads
+	tusLifetime         = 24 * time.Hour
+)
+
+var (
+	errUploadBusy   = errors.New("upload is locked by another request")
+	errUploadOffset = errors.New("Upload-Offset mismatch")
+)
+
+type tusUpload struct {
+	ID        string            `json:"id"`
+	Length    int64             `json:"length"`
+	Metadata  map[string]string `json:"metadata"`
+	Owner     string            `json:"owner"`
+	CreatedAt time.Time         `json:"created_at"`
+	ExpiresAt time.Time         `json:"expires_at"`
+}
+
+type tusStore struct {
+	dir    string
+	mu     sync.Mutex
+	locked map[string]bool
+}
+
+func newTusStore(root string) (*tusStore, error) {
+	dir := filepath.Join(root, tusUploadDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &tusStore{dir: dir, locked: make(map[string]bool)}, nil
+}
+
+func (s *tusStore) binPath(id string) string  { return filepath.Join(s.dir, id+".bin") }
+func (s *tusStore) infoPath(id string) string { return filepath.Join(s.dir, id+".info") }
+
+// validUploadID guards against IDs that could address files outside the upload dir.
+func validUploadID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *tusStore) lock(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.locked[id] {
+		return false
+	}
+	s.locked[id] = true
+	return true
+}
+
+func (s *tusStore) unlock(id string) {
+	s.mu.Lock()
+	delete(s.locked, id)
+	s.mu.Unlock()
+}
+
+func (s *tusStore) create(length int64, meta map[string]string, owner string) (*tusUpload, error) {
+	now := time.Now()
+	u := &tusUpload{
+		ID:        newSessionToken()[:32],
+		Length:    length,
+		Metadata:  meta,
+		Owner:     owner,
+		CreatedAt: now,
+		ExpiresAt: now.Add(tusLifetime),
+	}
+	f, err := os.Create(s.binPath(u.ID))
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	if err := s.saveInfo(u); err != nil {
+		os.Remove(s.binPath(u.ID))
+		return nil, err
+	}
+	return u, nil
+}
+
+func (s *tusStore) saveInfo(u *tusUpload) error {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.infoPath(u.ID), b, 0644)
+}
+
+// get loads an upload and its current offset. Expired uploads are reported as missing.
+func (s *tusStore) get(id string) (*tusUpload, int64, error) {
+	if !validUploadID(id) {
+		return nil, 0, os.ErrNotExist
+	}
+	b, err := os.ReadFile(s.infoPath(id))
+	if err != nil {
+		return nil, 0, err
+	}
+	var u tusUpload
+	if err := json.Unmarshal(b, &u); err != nil {
+		return nil, 0, err
+	}
+	if time.Now().After(u.ExpiresAt) {
+		return nil, 0, os.ErrNotExist
+	}
+	fi, err := os.Stat(s.binPath(id))
+	if err != nil {
+		return nil, 0, err
+	}
+	return &u, fi.Size(), nil
+}
+
+// write appends body to the upload starting at offset and returns the new
+// offset. The offset is checked against the file once the upload is locked:
+// the one the handler read may be stale by then.
+func (s *tusStore) write(u *tusUpload, offset int64, body io.Reader) (int64, error) {
+	if !s.lock(u.ID) {
+		return offset, errUploadBusy
+	}
+	defer s.unlock(u.ID)
+	f, err := os.OpenFile(s.binPath(u.ID), os.O_WRONLY, 0644)
+	if err != nil {
+		return offset, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return offset, err
+	}
+	if fi.Size() != offset {
+		return fi.Size(), errUploadOffset
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return offset, err
+	}
+	n, err := io.Copy(f, io.LimitReader(body, u.Length-offset))
+	// Whatever made it to disk counts, so a dropped connection can resume from here.
+	u.ExpiresAt = time.Now().Add(tusLifetime)
+	if serr := s.saveInfo(u); err == nil {
+		err = serr
+	}
+	return offset + n, err
+}
+
+func (s *tusStore) remove(id string) {
+	os.Remove(s.binPath(id))
+	os.Remove(s.infoPath(id))
+}
+
+// finish moves a completed upload into dir, named after the filename the
+// client announced, and returns the final path.
+func (s *tusStore) finish(id, owner, dir string) (string, error) {
+	u, offset, err := s.get(id)
+	if err != nil || u.Owner != owner {
+		return "", badInput("upload not found")
+	}
+	if offset != u.Length {
+		return "", badInput("upload is incomplete")
+	}
+	if !s.lock(id) {
+		return "", errUploadBusy
+	}
+	defer s.unlock(id)
+	target, err := resolveUpload(dir, u.Metadata["filename"])
+	if err != nil {
+		target, err = resolveUpload(dir, "video.mp4")
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := os.Rename(s.binPath(id), target); err != nil {
+		return "", err
+	}
+	os.Remove(s.infoPath(id))
+	return target, nil
+}
+
+// purgeExpired removes uploads whose expiry has passed.
+func (s *tusStore) purgeExpired() {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".info")
+		if !ok {
+			continue
+		}
+		var u tusUpload
+		b, err := os.ReadFile(filepath.Join(s.dir, e.Name()))
+		if err == nil {
+			err = json.Unmarshal(b, &u)
+		}
+		if err != nil || now.After(u.ExpiresAt) {
+			logFor("uploads").Info("removing stale upload", "id", id)
+			s.remove(id)
+		}
+	}
+}
+
+func (s *tusStore) janitor(interval time.Duration) {
+	background.every(interval, s.purgeExpired)
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma separated
+// "key base64value" pairs, where the value may be omitted.
+func parseTusMetadata(h string) (map[string]string, error) {
+	meta := make(map[string]string)
+	if strings.TrimSpace(h) == "" {
+		return meta, nil
+	}
+	for _, pair := range strings.Split(h, ",") {
+		key, val, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, fmt.Errorf("empty metadata key")
+		}
+		dec, err := base64.StdEncoding.DecodeString(val)
+		if err != nil {
+			return nil, fmt.Errorf("invalid metadata value for %q", key)
+		}
+		meta[key] = string(dec)
+	}
+	return meta, nil
+}
+
+func encodeTusMetadata(meta map[string]string) string {
+	var parts []string
+	for k, v := range meta {
+		parts = append(parts, k+" "+base64.StdEncoding.EncodeToString([]byte(v)))
+	}
+	return strings.Join(parts, ",")
+}
+
+// tusHandler serves the tus endpoint at base and base{id}.
+func tusHandler(store *tusStore, base string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", tusVersion)
+		w.Header().Set("Cache-Control", "no-store")
+
+		if r.Method == "OPTIONS" {
+			w.Header().Set("Tus-Version", tusVersion)
+			w.Header().Set("Tus-Extension", tusExtensions)
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(maxUploadSize, 10))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if r.Header.Get("Tus-Resumable") != tusVersion {
+			w.Header().Set("Tus-Version", tusVersion)
+			http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+			return
+		}
+
+		id := strings.TrimPrefix(r.URL.Path, base)
+		owner := checkSession(r)
+		if id == "" {
+			if r.Method != "POST" {
+				http.Error(w, "Method not allowed", 405)
+				return
+			}
+			tusCreate(store, base, owner, w, r)
+			return
+		}
+
+		u, offset, err := store.get(id)
+		if err != nil || u.Owner != owner {
+			http.NotFound(w, r)
+			return
+		}
+		switch r.Method {
+		case "HEAD":
+			w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+			w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+			w.Header().Set("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+			if len(u.Metadata) > 0 {
+				w.Header().Set("Upload-Metadata", encodeTusMetadata(u.Metadata))
+			}
+			w.WriteHeader(http.StatusOK)
+		case "PATCH":
+			tusPatch(store, u, offset, w, r)
+		case "DELETE":
+			if !store.lock(id) {
+				http.Error(w, errUploadBusy.Error(), http.StatusLocked)
+				return
+			}
+			store.remove(id)
+			store.unlock(id)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "Method not allowed", 405)
+		}
+	}
+}
+
+func tusCreate(store *tusStore, base, owner string, w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if length > maxUploadSize {
+		http.Error(w, "Upload too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	meta, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, "Invalid Upload-Metadata: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	u, err := store.create(length, meta, owner)
+	if err != nil {
+		logFor("uploads").ErrorContext(r.Context(), "failed to create upload", "err", err)
+		http.Error(w, "Failed to create upload", 500)
+		return
+	}
+	w.Header().Set("Location", base+u.ID)
+	w.Header().Set("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func tusPatch(store *tusStore, u *tusUpload, offset int64, w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Invalid Content-Type", http.StatusUnsupportedMediaType)
+		return
+	}
+	clientOffset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || clientOffset != offset {
+		http.Error(w, errUploadOffset.Error(), http.StatusConflict)
+		return
+	}
+	newOffset, err := store.write(u, offset, r.Body)
+	if err == errUploadBusy {
+		http.Error(w, err.Error(), http.StatusLocked)
+		return
+	}
+	if err == errUploadOffset {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		logFor("uploads").ErrorContext(r.Context(), "failed to write upload", "id", u.ID, "err", err)
+		http.Error(w, "Failed to write upload", 500)
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(newOffset, 10))
+	w.Header().Set("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// uploadJS is a minimal tus client for the admin upload forms. It sends the
+// selected video in chunks, shows progress, resumes after a dropped
+// connection or page reload, then submits the form with the upload ID in
+// place of the file.
+var uploadJS = `<script>
+(function() {
+  var CHUNK = 8 * 1024 * 1024;
+  var BASE = {{.BasePath}};
+  function req(method, url, headers, body, onprogress) {
+    return new Promise(function(resolve, reject) {
+      var x = new XMLHttpRequest();
+      x.open(method, url);
+      x.setRequestHeader('Tus-Resumable', '` + tusVersion + `');
+      x.setRequestHeader('X-CSRF-Token', document.querySelector('input[name=` + csrfField + `]').value);
+      for (var k in headers) x.setRequestHeader(k, headers[k]);
+      if (onprogress) x.upload.onprogress = onprogress;
+      x.onload = function() { resolve(x); };
+      x.onerror = function() { reject(new Error('network error')); };
+      x.send(body);
+    });
+  }
+  function meta(obj) {
+    return Object.keys(obj).map(function(k) {
+      return k + ' ' + btoa(unescape(encodeURIComponent(obj[k])));
+    }).join(',');
+  }
+  async function upload(file, bar, label) {
+    var key = 'tus:' + file.name + ':' + file.size + ':' + file.lastModified;
+    var url = localStorage.getItem(key), offset = 0;
+    if (url) {
+      var h = await req('HEAD', url, {});
+      if (h.status === 200) offset = parseInt(h.getResponseHeader('Upload-Offset'), 10);
+      else url = null;
+    }
+    if (!url) {
+      var c = await req('POST', BASE + '` + tusBasePath + `', {
+        'Upload-Length': file.size,
+        'Upload-Metadata': meta({filename: file.name, filetype: file.type})
+      });
+      if (c.status !== 201) throw new Error(c.responseText || 'create failed');
+      url = c.getResponseHeader('Location');
+      localStorage.setItem(key, url);
+    }
+    var retries = 0;
+    while (offset < file.size) {
+      try {
+        var p = await req('PATCH', url, {
+          'Content-Type': 'application/offset+octet-stream',
+          'Upload-Offset': offset
+        }, file.slice(offset, offset + CHUNK), function(e) {
+          var pct = Math.floor((offset + e.loaded) * 100 / file.size);
+          bar.value = pct; label.textContent = pct + '%';
+        });
+        if (p.status === 204) {
+          offset = parseInt(p.getResponseHeader('Upload-Offset'), 10);
+          retries = 0;
+          continue;
+        }
+        if (p.status !== 409 && p.status !== 423) throw new Error(p.responseText || 'upload failed');
+      } catch (e) {
+        if (++retries > 5) throw e;
+      }
+      await new Promise(function(r) { setTimeout(r, 1000 * retries); });
+      var h = await req('HEAD', url, {});
+      if (h.status !== 200) { localStorage.removeItem(key); throw new Error('upload expired, please retry'); }
+      offset = parseInt(h.getResponseHeader('Upload-Offset'), 10);
+    }
+    bar.value = 100; label.textContent = '100%';
+    localStorage.removeItem(key);
+    return url.substring(url.lastIndexOf('/') + 1);
+  }
+  document.querySelectorAll('form[data-tus]').forEach(function(form) {
+    form.addEventListener('submit', async function(ev) {
+      var input = form.querySelector('input[name=video]');
+      if (!window.XMLHttpRequest || !window.Promise || !input.files.length) return;
+      ev.preventDefault();
+      var box = form.querySelector('.progress');
+      var bar = box.querySelector('progress'), label = box.querySelector('span');
+      box.style.display = 'block';
+      form.querySelectorAll('button').forEach(function(b) { b.disabled = true; });
+      try {
+        form.querySelector('input[name=upload_id]').value = await upload(input.files[0], bar, label);
+        input.disabled = true;
+        form.submit();
+      } catch (e) {
+        label.textContent = 'Error: ' + e.message;
+        form.querySelectorAll('button').forEach(function(b) { b.disabled = false; });
+      }
+    });
+  });
+})();
+</script>`
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTusTest returns an upload store in a temporary root and its handler.
+// Without a session every request belongs to the same (empty) owner.
+func newTusTest(t *testing.T) (*tusStore, http.HandlerFunc) {
+	t.Helper()
+	store, err := newTusStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, tusHandler(store, tusBasePath)
+}
+
+func tusRequest(h http.HandlerFunc, method, path string, headers map[string]string, body io.Reader) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, body)
+	r.Header.Set("Tus-Resumable", tusVersion)
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+// tusStart creates an upload through the handler and returns its URL.
+func tusStart(t *testing.T, h http.HandlerFunc, length int) string {
+	t.Helper()
+	w := tusRequest(h, "POST", tusBasePath, map[string]string{
+		"Upload-Length":   strconv.Itoa(length),
+		"Upload-Metadata": encodeTusMetadata(map[string]string{"filename": "film.mp4"}),
+	}, nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: got %d: %s", w.Code, w.Body)
+	}
+	return w.Header().Get("Location")
+}
+
+func tusPatchAt(h http.HandlerFunc, url string, offset int64, body io.Reader) *httptest.ResponseRecorder {
+	return tusRequest(h, "PATCH", url, map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": strconv.FormatInt(offset, 10),
+	}, body)
+}
+
+func tusContent(t *testing.T, store *tusStore, url string) string {
+	t.Helper()
+	b, err := os.ReadFile(store.binPath(strings.TrimPrefix(url, tusBasePath)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestTusPatchSameOffset(t *testing.T) {
+	store, h := newTusTest(t)
+	url := tusStart(t, h, 10)
+
+	w := tusPatchAt(h, url, 0, strings.NewReader("hello"))
+	if w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != "5" {
+		t.Fatalf("first PATCH: got %d, offset %q", w.Code, w.Header().Get("Upload-Offset"))
+	}
+	w = tusPatchAt(h, url, 0, strings.NewReader("HELLO"))
+	if w.Code != http.StatusConflict {
+		t.Errorf("second PATCH at the same offset: got %d, want 409", w.Code)
+	}
+	if got := tusContent(t, store, url); got != "hello" {
+		t.Errorf("upload holds %q, want %q", got, "hello")
+	}
+
+	// Two requests that both read offset 0 before either got the lock
+	u, _, err := store.get(strings.TrimPrefix(url, tusBasePath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := store.write(u, 0, strings.NewReader("HELLO")); !errors.Is(err, errUploadOffset) || n != 5 {
+		t.Errorf("write at a stale offset = %d, %v; want 5, %v", n, err, errUploadOffset)
+	}
+	if got := tusContent(t, store, url); got != "hello" {
+		t.Errorf("upload holds %q after a stale write, want %q", got, "hello")
+	}
+}
+
+// droppedBody sends some bytes, then fails like a connection cut off.
+type droppedBody struct {
+	data string
+	sent bool
+}
+
+func (d *droppedBody) Read(p []byte) (int, error) {
+	if d.sent {
+		return 0, io.ErrUnexpectedEOF
+	}
+	d.sent = true
+	return copy(p, d.data), nil
+}
+
+func TestTusResumeAfterDroppedBody(t *testing.T) {
+	store, h := newTusTest(t)
+	url := tusStart(t, h, 11)
+
+	tusPatchAt(h, url, 0, &droppedBody{data: "hello"})
+	w := tusRequest(h, "HEAD", url, nil, nil)
+	if w.Header().Get("Upload-Offset") != "5" {
+		t.Fatalf("offset after a dropped body: %q, want 5", w.Header().Get("Upload-Offset"))
+	}
+	if w := tusPatchAt(h, url, 0, strings.NewReader("hello world")); w.Code != http.StatusConflict {
+		t.Errorf("restarting from 0: got %d, want 409", w.Code)
+	}
+	w = tusPatchAt(h, url, 5, strings.NewReader(" world"))
+	if w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != "11" {
+		t.Fatalf("resume: got %d, offset %q", w.Code, w.Header().Get("Upload-Offset"))
+	}
+	if got := tusContent(t, store, url); got != "hello world" {
+		t.Errorf("upload holds %q", got)
+	}
+}
+
+func TestTusCreate(t *testing.T) {
+	store, h := newTusTest(t)
+	oldMax := maxUploadSize
+	maxUploadSize = 100
+	defer func() { maxUploadSize = oldMax }()
+
+	w := tusRequest(h, "OPTIONS", tusBasePath, nil, nil)
+	if w.Code != http.StatusNoContent || w.Header().Get("Tus-Max-Size") != "100" || w.Header().Get("Tus-Extension") != tusExtensions {
+		t.Errorf("OPTIONS: got %d, %v", w.Code, w.Header())
+	}
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    int
+	}{
+		{"no length", map[string]string{}, http.StatusBadRequest},
+		{"negative length", map[string]string{"Upload-Length": "-1"}, http.StatusBadRequest},
+		{"too large", map[string]string{"Upload-Length": "101"}, http.StatusRequestEntityTooLarge},
+		{"bad metadata", map[string]string{"Upload-Length": "5", "Upload-Metadata": "filename !!!"}, http.StatusBadRequest},
+		{"empty key", map[string]string{"Upload-Length": "5", "Upload-Metadata": " ,filename eA=="}, http.StatusBadRequest},
+		{"old version", map[string]string{"Upload-Length": "5", "Tus-Resumable": "0.2.2"}, http.StatusPreconditionFailed},
+		{"good", map[string]string{"Upload-Length": "100", "Upload-Metadata": "filename ZmlsbS5tcDQ=,flag"}, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		w := tusRequest(h, "POST", tusBasePath, tt.headers, nil)
+		if w.Code != tt.want {
+			t.Errorf("%s: got %d, want %d: %s", tt.name, w.Code, tt.want, w.Body)
+		}
+	}
+
+	entries, _ := os.ReadDir(store.dir)
+	if len(entries) != 2 {
+		t.Fatalf("upload dir holds %d files, want a .bin and an .info", len(entries))
+	}
+	w = tusRequest(h, "POST", tusBasePath, map[string]string{"Upload-Length": "0"}, nil)
+	url := w.Header().Get("Location")
+	if !strings.HasPrefix(url, tusBasePath) || w.Header().Get("Upload-Expires") == "" {
+		t.Errorf("create: Location %q, Upload-Expires %q", url, w.Header().Get("Upload-Expires"))
+	}
+}
+
+func TestTusHead(t *testing.T) {
+	_, h := newTusTest(t)
+	url := tusStart(t, h, 10)
+	tusPatchAt(h, url, 0, strings.NewReader("abc"))
+
+	w := tusRequest(h, "HEAD", url, nil, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("HEAD: got %d", w.Code)
+	}
+	if w.Header().Get("Upload-Offset") != "3" || w.Header().Get("Upload-Length") != "10" {
+		t.Errorf("HEAD: offset %q, length %q", w.Header().Get("Upload-Offset"), w.Header().Get("Upload-Length"))
+	}
+	if meta, err := parseTusMetadata(w.Header().Get("Upload-Metadata")); err != nil || meta["filename"] != "film.mp4" {
+		t.Errorf("HEAD metadata = %v, %v", meta, err)
+	}
+	for _, bad := range []string{tusBasePath + "nothere", tusBasePath + "..%2f..%2fsecret", tusBasePath + "a/b"} {
+		if w := tusRequest(h, "HEAD", bad, nil, nil); w.Code != http.StatusNotFound {
+			t.Errorf("HEAD %s: got %d, want 404", bad, w.Code)
+		}
+	}
+}
+
+func TestTusPatch(t *testing.T) {
+	store, h := newTusTest(t)
+	url := tusStart(t, h, 5)
+	id := strings.TrimPrefix(url, tusBasePath)
+
+	w := tusRequest(h, "PATCH", url, map[string]string{"Upload-Offset": "0"}, strings.NewReader("video"))
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("PATCH without the offset content type: got %d", w.Code)
+	}
+	if w := tusPatchAt(h, url, 2, strings.NewReader("video")); w.Code != http.StatusConflict {
+		t.Errorf("PATCH at the wrong offset: got %d", w.Code)
+	}
+
+	store.lock(id)
+	if w := tusPatchAt(h, url, 0, strings.NewReader("video")); w.Code != http.StatusLocked {
+		t.Errorf("PATCH of a locked upload: got %d", w.Code)
+	}
+	store.unlock(id)
+
+	// Anything past the announced length is dropped
+	w = tusPatchAt(h, url, 0, strings.NewReader("video and more"))
+	if w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != "5" {
+		t.Errorf("PATCH: got %d, offset %q", w.Code, w.Header().Get("Upload-Offset"))
+	}
+	if got := tusContent(t, store, url); got != "video" {
+		t.Errorf("upload holds %q", got)
+	}
+}
+
+func TestTusDelete(t *testing.T) {
+	store, h := newTusTest(t)
+	url := tusStart(t, h, 5)
+	if w := tusRequest(h, "DELETE", url, nil, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE: got %d", w.Code)
+	}
+	if entries, _ := os.ReadDir(store.dir); len(entries) != 0 {
+		t.Errorf("upload dir still holds %d files", len(entries))
+	}
+	if w := tusRequest(h, "HEAD", url, nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("HEAD after DELETE: got %d", w.Code)
+	}
+}
+
+func TestTusExpiry(t *testing.T) {
+	store, h := newTusTest(t)
+	expired, err := store.create(5, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired.ExpiresAt = time.Now().Add(-time.Minute)
+	store.saveInfo(expired)
+	live, err := store.create(5, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(store.dir, "broken.info"), []byte("{"), 0644)
+
+	if _, _, err := store.get(expired.ID); !os.IsNotExist(err) {
+		t.Errorf("get of an expired upload: %v, want not found", err)
+	}
+	if w := tusPatchAt(h, tusBasePath+expired.ID, 0, strings.NewReader("video")); w.Code != http.StatusNotFound {
+		t.Errorf("PATCH of an expired upload: got %d", w.Code)
+	}
+
+	store.purgeExpired()
+	for _, name := range []string{expired.ID + ".bin", expired.ID + ".info", "broken.info"} {
+		if _, err := os.Stat(filepath.Join(store.dir, name)); err == nil {
+			t.Errorf("%s survived the purge", name)
+		}
+	}
+	if _, _, err := store.get(live.ID); err != nil {
+		t.Errorf("live upload was purged: %v", err)
+	}
+
+	// Writing pushes the expiry back
+	live.ExpiresAt = time.Now().Add(time.Minute)
+	store.saveInfo(live)
+	if _, err := store.write(live, 0, strings.NewReader("vi")); err != nil {
+		t.Fatal(err)
+	}
+	if u, _, _ := store.get(live.ID); time.Until(u.ExpiresAt) < tusLifetime-time.Minute {
+		t.Errorf("expiry not extended: %v", u.ExpiresAt)
+	}
+}
+
+func TestTusFinish(t *testing.T) {
+	store, _ := newTusTest(t)
+	dir := t.TempDir()
+	u, err := store.create(5, map[string]string{"filename": "clip.mp4"}, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.finish(u.ID, "alice", dir); err == nil {
+		t.Error("finished an incomplete upload")
+	}
+	store.write(u, 0, strings.NewReader("video"))
+	if _, err := store.finish(u.ID, "bob", dir); err == nil {
+		t.Error("finished someone else's upload")
+	}
+	if _, err := store.finish("../"+u.ID, "alice", dir); err == nil {
+		t.Error("finished an upload by a bad ID")
+	}
+
+	store.lock(u.ID)
+	if _, err := store.finish(u.ID, "alice", dir); !errors.Is(err, errUploadBusy) {
+		t.Errorf("finish of a locked upload: %v", err)
+	}
+	store.unlock(u.ID)
+
+	target, err := store.finish(u.ID, "alice", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != filepath.Join(dir, "clip.mp4") {
+		t.Errorf("finished at %s", target)
+	}
+	if b, _ := os.ReadFile(target); string(b) != "video" {
+		t.Errorf("finished file holds %q", b)
+	}
+	if entries, _ := os.ReadDir(store.dir); len(entries) != 0 {
+		t.Errorf("upload dir still holds %d files", len(entries))
+	}
+	if _, err := store.finish(u.ID, "alice", dir); err == nil {
+		t.Error("finished the same upload twice")
+	}
+}
+
+func TestParseTusMetadata(t *testing.T) {
+	tests := []struct {
+		header string
+		want   map[string]string // nil when it must fail
+	}{
+		{"", map[string]string{}},
+		{"filename ZmlsbS5tcDQ=", map[string]string{"filename": "film.mp4"}},
+		{"filename ZmlsbS5tcDQ=, flag", map[string]string{"filename": "film.mp4", "flag": ""}},
+		{"filename 8J+OrC5tcDQ=", map[string]string{"filename": "🎬.mp4"}},
+		{"filename film.mp4", nil},
+		{",filename ZmlsbS5tcDQ=", nil},
+	}
+	for _, tt := range tests {
+		got, err := parseTusMetadata(tt.header)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("parseTusMetadata(%q) = %v, want an error", tt.header, got)
+			}
+			continue
+		}
+		if err != nil || len(got) != len(tt.want) {
+			t.Errorf("parseTusMetadata(%q) = %v, %v; want %v", tt.header, got, err, tt.want)
+			continue
+		}
+		for k, v := range tt.want {
+			if got[k] != v {
+				t.Errorf("parseTusMetadata(%q)[%q] = %q, want %q", tt.header, k, got[k], v)
+			}
+		}
+	}
+	meta := map[string]string{"filename": "a b,c.mp4", "filetype": "video/mp4"}
+	if got, err := parseTusMetadata(encodeTusMetadata(meta)); err != nil || got["filename"] != meta["filename"] || got["filetype"] != meta["filetype"] {
+		t.Errorf("round trip = %v, %v", got, err)
+	}
+}
+
+// The admin upload forms take a finished tus upload by its ID.
+
+func TestTusFinishStaysInItem(t *testing.T) {
+	s := newTestServer(t)
+	start := func(filename string) string {
+		t.Helper()
+		u, err := uploads.create(5, map[string]string{"filename": filename}, "admin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := uploads.write(u, 0, strings.NewReader("video")); err != nil {
+			t.Fatal(err)
+		}
+		return u.ID
+	}
+
+	// A bad folder name leaves the upload where it is
+	for _, name := range badNames {
+		id := start("video.mp4")
+		before := s.snapshot(t)
+		w := s.postMultipart(t, "/admin/cat/Movies/upload", []formPart{
+			{name: "moviename", body: name},
+			{name: "upload_id", body: id},
+		})
+		if w.Code == http.StatusSeeOther {
+			t.Errorf("tus upload into %q was accepted", name)
+		}
+		assertUnchanged(t, before, s.snapshot(t))
+	}
+
+	tests := []struct {
+		filename, movie, want string
+	}{
+		{"../../evil.mp4", "One", "evil.mp4"},
+		{`..\..\evil.mp4`, "Two", "evil.mp4"},
+		{".hidden.mp4", "Three", "video.mp4"},
+		{"..", "Four", "video.mp4"},
+		{"AUX.mp4", "Five", "video.mp4"},
+	}
+	for _, tt := range tests {
+		w := s.postMultipart(t, "/admin/cat/Movies/upload", []formPart{
+			{name: "moviename", body: tt.movie},
+			{name: "upload_id", body: start(tt.filename)},
+		})
+		if w.Code != http.StatusSeeOther {
+			t.Errorf("tus upload of %q: got %d: %s", tt.filename, w.Code, w.Body)
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(s.root, "Movies", tt.movie, tt.want)); err != nil {
+			t.Errorf("tus upload of %q: %v", tt.filename, err)
+		}
+	}
+	assertOutsideUntouched(t, s)
+}
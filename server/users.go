@@ -0,0 +1,723 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ==== USERS AND ROLES ====
+
+type Role string
+
+const (
+	RoleAdmin    Role = "admin"    // everything, including user management
+	RoleEditor   Role = "editor"   // create, upload and delete content
+	RoleUploader Role = "uploader" // create series/seasons and upload, no deletes
+	RoleViewer   Role = "viewer"   // browse the admin pages only
+)
+
+var allRoles = []Role{RoleAdmin, RoleEditor, RoleUploader, RoleViewer}
+
+type permission int
+
+const (
+	permView permission = iota
+	permUpload
+	permCreate
+	permDelete
+	permUsers
+)
+
+var rolePerms = map[Role][]permission{
+	RoleAdmin:    {permView, permUpload, permCreate, permDelete, permUsers},
+	RoleEditor:   {permView, permUpload, permCreate, permDelete},
+	RoleUploader: {permView, permUpload, permCreate},
+	RoleViewer:   {permView},
+}
+
+type User struct {
+	Username     string   `json:"username"`
+	PasswordHash string   `json:"password_hash"`
+	Role         Role     `json:"role"`
+	Access       []string `json:"access,omitempty"`      // "Category" or "Category/Series"; empty means everything
+	TOTPSecret   string   `json:"totp_secret,omitempty"` // base32; set when two-factor login is enabled
+
+	scopes []string // set when acting through an API token
+}
+
+func (u *User) can(p permission) bool {
+	if u == nil {
+		return false
+	}
+	if u.scopes != nil && !scopeAllows(u.scopes, p) {
+		return false
+	}
+	for _, have := range rolePerms[u.Role] {
+		if have == p {
+			return true
+		}
+	}
+	return false
+}
+
+func validRole(r Role) bool {
+	_, ok := rolePerms[r]
+	return ok
+}
+
+var (
+	errUserExists   = errors.New("user already exists")
+	errUserNotFound = errors.New("user not found")
+	errLastAdmin    = errors.New("cannot remove the last admin")
+)
+
+// userStore keeps all accounts in memory and writes them back to userFile
+// on every change.
+type userStore struct {
+	mu    sync.Mutex
+	path  string
+	users map[string]*User
+}
+
+var users = &userStore{path: userFile}
+
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+
+// userFileData is the on-disk format. Older versions stored a single User
+// object instead, which load migrates.
+type userFileData struct {
+	Users []*User `json:"users"`
+}
+
+func (s *userStore) load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users = make(map[string]*User)
+	b, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var data userFileData
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+	if data.Users == nil {
+		var single User
+		if err := json.Unmarshal(b, &single); err != nil {
+			return err
+		}
+		if single.Username != "" {
+			single.Role = RoleAdmin
+			data.Users = []*User{&single}
+			logFor("auth").Info("migrating single-user file", "path", s.path, "admin", single.Username)
+			defer s.saveLocked()
+		}
+	}
+	for _, u := range data.Users {
+		if !validRole(u.Role) {
+			u.Role = RoleViewer
+		}
+		s.users[u.Username] = u
+	}
+	return nil
+}
+
+func (s *userStore) saveLocked() error {
+	if !storeWritable() {
+		return errHandedOver
+	}
+	data := userFileData{Users: s.listLocked()}
+	b, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *userStore) listLocked() []*User {
+	var out []*User
+	for _, u := range s.users {
+		out = append(out, u)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Username < out[j].Username })
+	return out
+}
+
+// list returns copies of all users sorted by name.
+func (s *userStore) list() []User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []User
+	for _, u := range s.listLocked() {
+		out = append(out, *u)
+	}
+	return out
+}
+
+func (s *userStore) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.users)
+}
+
+// get returns a copy of the named user, or nil.
+func (s *userStore) get(name string) *User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[name]
+	if !ok {
+		return nil
+	}
+	c := *u
+	return &c
+}
+
+func (s *userStore) add(name, password string, role Role) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[name]; ok {
+		return errUserExists
+	}
+	s.users[name] = &User{Username: name, PasswordHash: string(hash), Role: role}
+	return s.saveLocked()
+}
+
+func (s *userStore) setPassword(name, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[name]
+	if !ok {
+		return errUserNotFound
+	}
+	u.PasswordHash = string(hash)
+	return s.saveLocked()
+}
+
+func (s *userStore) setRole(name string, role Role) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[name]
+	if !ok {
+		return errUserNotFound
+	}
+	if u.Role == RoleAdmin && role != RoleAdmin && s.adminCountLocked() == 1 {
+		return errLastAdmin
+	}
+	u.Role = role
+	return s.saveLocked()
+}
+
+func (s *userStore) setAccess(name string, access []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[name]
+	if !ok {
+		return errUserNotFound
+	}
+	u.Access = access
+	return s.saveLocked()
+}
+
+func (s *userStore) setTOTP(name, secret string) error {
+	if secret != "" && !validTOTPSecret(secret) {
+		return badInput("invalid two-factor secret")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[name]
+	if !ok {
+		return errUserNotFound
+	}
+	u.TOTPSecret = secret
+	return s.saveLocked()
+}
+
+func (s *userStore) remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[name]
+	if !ok {
+		return errUserNotFound
+	}
+	if u.Role == RoleAdmin && s.adminCountLocked() == 1 {
+		return errLastAdmin
+	}
+	delete(s.users, name)
+	return s.saveLocked()
+}
+
+func (s *userStore) adminCountLocked() int {
+	n := 0
+	for _, u := range s.users {
+		if u.Role == RoleAdmin {
+			n++
+		}
+	}
+	return n
+}
+
+// authenticate checks a username and password and returns the user on success.
+func (s *userStore) authenticate(name, password string) *User {
+	u := s.get(name)
+	if u == nil {
+		// Compare anyway so unknown names take as long as wrong passwords.
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil
+	}
+	if bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) != nil {
+		return nil
+	}
+	return u
+}
+
+// currentUser returns the logged-in user for the request, or nil. Requests
+// made with an API token get the token's scopes applied.
+func currentUser(r *http.Request) *User {
+	if t := currentAPIToken(r); t != nil {
+		u := users.get(t.Username)
+		if u != nil {
+			u.scopes = t.Scopes
+		}
+		return u
+	}
+	name := checkSession(r)
+	if name == "" {
+		return nil
+	}
+	return users.get(name)
+}
+
+func forbidden(w http.ResponseWriter) {
+	http.Error(w, "Forbidden: your role does not allow this action", http.StatusForbidden)
+}
+
+// requirePerm wraps requireLogin and additionally checks the user's role.
+func requirePerm(p permission, next http.HandlerFunc) http.HandlerFunc {
+	return requireLogin(func(w http.ResponseWriter, r *http.Request) {
+		if !currentUser(r).can(p) {
+			forbidden(w)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// ==== CATEGORY ACCESS ====
+
+// restricted reports whether the user is limited to the entries in Access.
+// Admins always see everything.
+func (u *User) restricted() bool {
+	return u != nil && u.Role != RoleAdmin && len(u.Access) > 0
+}
+
+// canAccess reports whether the user may work on a category, or on a single
+// series or movie inside it when item is set. Access to a whole category
+// covers everything in it.
+func (u *User) canAccess(cat, item string) bool {
+	if u == nil {
+		return false
+	}
+	if !u.restricted() {
+		return true
+	}
+	for _, a := range u.Access {
+		c, i, _ := strings.Cut(a, "/")
+		if c == cat && (i == "" || i == item) {
+			return true
+		}
+	}
+	return false
+}
+
+// canSeeCategory reports whether the user has access to the category or to
+// anything inside it.
+func (u *User) canSeeCategory(cat string) bool {
+	if u == nil {
+		return false
+	}
+	if !u.restricted() {
+		return true
+	}
+	for _, a := range u.Access {
+		if c, _, _ := strings.Cut(a, "/"); c == cat {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAccess splits the comma separated access field from the users page.
+func parseAccess(s string) []string {
+	var out []string
+	for _, a := range strings.Split(s, ",") {
+		a = strings.Trim(strings.TrimSpace(a), "/")
+		if a != "" {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// ==== USER MANAGEMENT PAGES ====
+
+var usersPage = template.Must(template.New("users").Funcs(template.FuncMap{
+	"join": strings.Join,
+}).Parse(`
+<html><head><title>Users - Admin</title>` + css + `</head><body>
+<nav>
+  <a href="/admin">Dashboard</a>
+  <a href="/admin/account">My Account</a>
+  <a href="/admin/security">Login Security</a>
+  <a href="/admin/audit">Audit Log</a>
+  <a href="/admin/devices">Devices</a>
+  <a href="/admin/diagnostics">Diagnostics</a>
+  <a href="/logout">Logout</a>
+</nav>
+<div class="card">
+<h2>Users</h2>
+{{if .Error}}<div class="error">{{.Error}}</div>{{end}}
+<table>
+  <tr><th>Username</th><th>Role</th><th>Access</th><th>Actions</th></tr>
+  {{range .Users}}
+    <tr>
+      <td>{{.Username}}</td>
+      <td>
+        <form method="POST" action="/admin/users" style="display:inline">` + csrfInput + `
+          <input type="hidden" name="action" value="role">
+          <input type="hidden" name="username" value="{{.Username}}">
+          <select name="role" onchange="this.form.submit()" style="width:auto;margin:0">
+            {{$role := .Role}}
+            {{range $.Roles}}<option value="{{.}}"{{if eq . $role}} selected{{end}}>{{.}}</option>{{end}}
+          </select>
+        </form>
+      </td>
+      <td>
+        {{if eq .Role "admin"}}Everything{{else}}
+        <form method="POST" action="/admin/users" style="display:inline">` + csrfInput + `
+          <input type="hidden" name="action" value="access">
+          <input type="hidden" name="username" value="{{.Username}}">
+          <input name="access" value="{{join .Access ", "}}" placeholder="Everything" style="width:auto;margin:0">
+          <button type="submit" class="btn">Save</button>
+        </form>
+        {{end}}
+      </td>
+      <td>
+        <form method="POST" action="/admin/users" style="display:inline">` + csrfInput + `
+          <input type="hidden" name="action" value="reset">
+          <input type="hidden" name="username" value="{{.Username}}">
+          <input type="password" name="password" placeholder="New password" required autocomplete="new-password" style="width:auto;margin:0">
+          <button type="submit" class="btn">Reset Password</button>
+        </form>
+        {{if .TOTPSecret}}
+        <form method="POST" action="/admin/users" style="display:inline">` + csrfInput + `
+          <input type="hidden" name="action" value="reset2fa">
+          <input type="hidden" name="username" value="{{.Username}}">
+          <button type="submit" class="btn" onclick="return confirm('Turn off two-factor login for {{.Username}}?')">Reset 2FA</button>
+        </form>
+        {{end}}
+        <form method="POST" action="/admin/users" style="display:inline">` + csrfInput + `
+          <input type="hidden" name="action" value="signout">
+          <input type="hidden" name="username" value="{{.Username}}">
+          <button type="submit" class="btn">Sign Out Everywhere</button>
+        </form>
+        {{if ne .Username $.Me}}
+        <form method="POST" action="/admin/users" style="display:inline">` + csrfInput + `
+          <input type="hidden" name="action" value="delete">
+          <input type="hidden" name="username" value="{{.Username}}">
+          <button type="submit" class="btn" onclick="return confirm('Delete user {{.Username}}?')">Delete</button>
+        </form>
+        {{end}}
+      </td>
+    </tr>
+  {{end}}
+</table>
+<h3>Add User</h3>
+<form method="POST" action="/admin/users">` + csrfInput + `
+  <input type="hidden" name="action" value="add">
+  <label>Username <input name="username" required autocomplete="off"></label>
+  <label>Password <input type="password" name="password" required autocomplete="new-password"></label>
+  <label>Role
+    <select name="role">{{range .Roles}}<option value="{{.}}">{{.}}</option>{{end}}</select>
+  </label>
+  <label>Access (comma separated categories or Category/Series, empty for everything)
+    <input name="access" placeholder="e.g. Kids, TV Shows/Cartoons">
+  </label>
+  <button type="submit">Add User</button>
+</form>
+</div>
+</body></html>
+`))
+
+var accountPage = template.Must(template.New("account").Parse(`
+<html><head><title>My Account</title>` + css + `</head><body>
+<nav>
+  <a href="/admin">Dashboard</a>
+  {{if .IsAdmin}}<a href="/admin/users">Users</a>{{end}}
+  <a href="/admin/tokens">API Tokens</a>
+  <a href="/logout">Logout</a>
+</nav>
+<div class="card">
+<h2>My Account</h2>
+{{if .Error}}<div class="error">{{.Error}}</div>{{end}}
+{{if .Message}}<p>{{.Message}}</p>{{end}}
+<p>Signed in as <b>{{.User.Username}}</b> ({{.User.Role}})</p>
+{{if .User.Access}}<p>Access limited to: {{range $i, $a := .User.Access}}{{if $i}}, {{end}}{{$a}}{{end}}</p>{{end}}
+<h3>Change Password</h3>
+<form method="POST" action="/admin/account">` + csrfInput + `
+  <input type="hidden" name="action" value="password">
+  <label>Current Password <input type="password" name="current" required autocomplete="current-password"></label>
+  <label>New Password <input type="password" name="password" required autocomplete="new-password"></label>
+  <button type="submit">Change Password</button>
+</form>
+<h3>Two-Factor Login</h3>
+{{if .User.TOTPSecret}}
+  <p>Two-factor login is <b>on</b>. Signing in asks for a code from your authenticator app.</p>
+  <form method="POST" action="/admin/account">` + csrfInput + `
+    <input type="hidden" name="action" value="totp-disable">
+    <label>Current Code <input name="code" required inputmode="numeric" autocomplete="one-time-code"></label>
+    <button type="submit">Turn Off</button>
+  </form>
+{{else if .TOTPSetup}}
+  <p>Add this account to your authenticator app, then enter the code it shows to finish.</p>
+  <p>Secret: <code>{{.TOTPSetup}}</code></p>
+  <p><small>{{.TOTPURI}}</small></p>
+  <form method="POST" action="/admin/account">` + csrfInput + `
+    <input type="hidden" name="action" value="totp-enable">
+    <label>Current Password <input type="password" name="current" required autocomplete="current-password"></label>
+    <label>Code <input name="code" required inputmode="numeric" autocomplete="one-time-code"></label>
+    <button type="submit">Turn On</button>
+  </form>
+{{else}}
+  <p>Two-factor login is off.{{if .IsAdmin}} It is strongly recommended for admin accounts.{{end}}</p>
+  <form method="POST" action="/admin/account">` + csrfInput + `
+    <input type="hidden" name="action" value="totp-setup">
+    <button type="submit">Set Up</button>
+  </form>
+{{end}}
+<h3>Active Sessions</h3>
+<table>
+  <tr><th>Signed In</th><th>Last Active</th><th>Address</th><th>Browser</th><th></th></tr>
+  {{range .Sessions}}
+    <tr>
+      <td>{{.Created.Format "2006-01-02 15:04"}}{{if .Remember}} (remembered){{end}}</td>
+      <td>{{.LastSeen.Format "2006-01-02 15:04"}}</td>
+      <td>{{.IP}}</td>
+      <td>{{.UserAgent}}</td>
+      <td>
+        {{if eq .ID $.Current}}This session{{else}}
+        <form method="POST" action="/admin/account" style="display:inline">` + csrfInput + `
+          <input type="hidden" name="action" value="revoke">
+          <input type="hidden" name="id" value="{{.ID}}">
+          <button type="submit" class="btn">Revoke</button>
+        </form>
+        {{end}}
+      </td>
+    </tr>
+  {{end}}
+</table>
+</div>
+</body></html>
+`))
+
+func usersHandler(w http.ResponseWriter, r *http.Request) {
+	me := currentUser(r)
+	render := func(errMsg string) {
+		renderPage(w, r, usersPage, map[string]interface{}{
+			"Users": users.list(),
+			"Roles": allRoles,
+			"Me":    me.Username,
+			"Error": errMsg,
+		})
+	}
+	if r.Method == "GET" {
+		render("")
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	name := strings.TrimSpace(r.FormValue("username"))
+	password := r.FormValue("password")
+	role := Role(r.FormValue("role"))
+	action := r.FormValue("action")
+	before := userAuditState(name)
+	var err error
+	switch action {
+	case "add":
+		if len(name) < 3 || len(password) < 5 {
+			render("Username or password too short.")
+			return
+		}
+		if !validRole(role) {
+			render("Invalid role")
+			return
+		}
+		if err = users.add(name, password, role); err == nil {
+			err = users.setAccess(name, parseAccess(r.FormValue("access")))
+		}
+	case "access":
+		if err = users.setAccess(name, parseAccess(r.FormValue("access"))); err == nil {
+			sessions.markRotate(name)
+		}
+	case "role":
+		if !validRole(role) {
+			render("Invalid role")
+			return
+		}
+		if err = users.setRole(name, role); err == nil {
+			sessions.markRotate(name)
+		}
+	case "reset":
+		if len(password) < 5 {
+			render("Password too short.")
+			return
+		}
+		// Whoever knew the old password may have made tokens with it
+		if err = users.setPassword(name, password); err == nil {
+			sessions.revokeUser(name, "")
+			apiTokens.revokeUser(name)
+		}
+	case "reset2fa":
+		if err = users.setTOTP(name, ""); err == nil {
+			sessions.revokeUser(name, "")
+		}
+	case "signout":
+		sessions.revokeUser(name, "")
+	case "delete":
+		if name == me.Username {
+			render("You cannot delete your own account")
+			return
+		}
+		if err = users.remove(name); err == nil {
+			sessions.revokeUser(name, "")
+			apiTokens.revokeUser(name)
+		}
+	default:
+		render("Unknown action")
+		return
+	}
+	if err != nil {
+		render(err.Error())
+		return
+	}
+	audit(r, "user-"+action, "user:"+name, before, userAuditState(name))
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+func accountHandler(w http.ResponseWriter, r *http.Request) {
+	me := currentUser(r)
+	current := currentSession(r)
+	data := map[string]interface{}{"User": me, "IsAdmin": me.can(permUsers)}
+	switch r.Method {
+	case "GET":
+	case "POST":
+		switch r.FormValue("action") {
+		case "revoke":
+			if !sessions.revoke(me.Username, r.FormValue("id")) {
+				data["Error"] = "Session not found"
+			}
+		case "totp-setup", "totp-enable", "totp-disable":
+			before := userAuditState(me.Username)
+			totpAccountAction(me, data, r)
+			me = users.get(me.Username)
+			if action := r.FormValue("action"); action != "totp-setup" && data["Error"] == nil {
+				audit(r, "user-"+action, "user:"+me.Username, before, userAuditState(me.Username))
+			}
+			data["User"] = me
+		default:
+			password := r.FormValue("password")
+			if users.authenticate(me.Username, r.FormValue("current")) == nil {
+				data["Error"] = "Current password is wrong"
+			} else if len(password) < 5 {
+				data["Error"] = "Password too short."
+			} else if err := users.setPassword(me.Username, password); err != nil {
+				data["Error"] = "Failed to change password: " + err.Error()
+			} else {
+				// Log out everywhere else and move this browser to a fresh
+				// token. Tokens made with the old password go too, as on reset.
+				sessions.revokeUser(me.Username, current.ID)
+				apiTokens.revokeUser(me.Username)
+				audit(r, "user-password", "user:"+me.Username, nil, nil)
+				cookie, _ := r.Cookie("session")
+				if token := sessions.rotate(cookie.Value); token != "" {
+					setSessionCookie(w, token, current.Remember)
+					current = sessions.lookup(token)
+				}
+				data["Message"] = "Password changed. Other sessions have been signed out and your API tokens revoked."
+			}
+		}
+	default:
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	data["Sessions"] = sessions.listFor(me.Username)
+	data["Current"] = current.ID
+	renderPage(w, r, accountPage, data)
+}
+
+// catRoutePerm maps a request under /admin/cat/ to the permission the action
+// catRouter runs for it needs.
+func catRoutePerm(r *http.Request, action string) permission {
+	if r.Method != "POST" {
+		return permView
+	}
+	switch action {
+	case "upload", "uploadep", "bulkupload":
+		return permUpload
+	case "newseries", "newseason":
+		return permCreate
+	case "delmovie", "delseries", "delseason", "delepisode":
+		return permDelete
+	}
+	return permView
+}
+
+// catRouteAction returns the action segment catRouter acts on for the path
+// parts after /admin/cat/, or false when the path has empty or extra
+// segments that no route accepts.
+func catRouteAction(parts []string) (string, bool) {
+	for _, p := range parts {
+		if p == "" {
+			return "", false
+		}
+	}
+	switch {
+	case len(parts) == 2: // {cat}/{action}
+		return parts[1], true
+	case parts[1] != "series":
+		return "", false
+	case len(parts) == 3: // {cat}/series/{series}
+		return "", true
+	case len(parts) == 4: // {cat}/series/{series}/{action}
+		return parts[3], true
+	case parts[3] != "season" || len(parts) > 6:
+		return "", false
+	case len(parts) == 5: // {cat}/series/{series}/season/{season}
+		return "", true
+	}
+	return parts[5], true // {cat}/series/{series}/season/{season}/{action}
+}
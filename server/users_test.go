@@ -0,0 +1,203 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// catActions are the mutating routes under /admin/cat/ with the field that
+// names what they act on.
+var catActions = []struct {
+	target, field, value string
+}{
+	{"/admin/cat/Movies/upload", "moviename", "New"},
+	{"/admin/cat/Movies/bulkupload", "", ""},
+	{"/admin/cat/Movies/delmovie", "moviename", "Film"},
+	{"/admin/cat/TV/bulkupload", "", ""},
+	{"/admin/cat/TV/newseries", "seriesname", "New Show"},
+	{"/admin/cat/TV/delseries", "seriesname", "Show"},
+	{"/admin/cat/TV/series/Show/newseason", "seasonname", "Season 2"},
+	{"/admin/cat/TV/series/Show/delseason", "seasonname", "Season 1"},
+	{"/admin/cat/TV/series/Show/season/Season 1/uploadep", "epname", "Episode 2"},
+	{"/admin/cat/TV/series/Show/season/Season 1/bulkupload", "", ""},
+	{"/admin/cat/TV/series/Show/season/Season 1/delepisode", "epname", "Episode 1"},
+}
+
+func TestViewerRefusedCatActions(t *testing.T) {
+	s := newTestServer(t)
+	viewer := s.as(t, "viewer", RoleViewer)
+	for _, a := range catActions {
+		form := url.Values{}
+		if a.field != "" {
+			form.Set(a.field, a.value)
+		}
+		for _, target := range []string{a.target, a.target + "/", a.target + "/x"} {
+			before := s.snapshot(t)
+			w := viewer.postForm(t, target, form)
+			want := http.StatusForbidden
+			if target != a.target {
+				want = http.StatusNotFound
+			}
+			if w.Code != want {
+				t.Errorf("viewer POST %s: got %d, want %d", target, w.Code, want)
+			}
+			assertUnchanged(t, before, s.snapshot(t))
+		}
+	}
+}
+
+func TestCatRouteRejectsEmptySegments(t *testing.T) {
+	s := newTestServer(t)
+	for _, target := range []string{
+		"/admin/cat/TV//delseries",
+		"/admin/cat/TV/series//delseason",
+		"/admin/cat/TV/series/Show/season//delepisode",
+		"/admin/cat/TV/series/Show/season/Season 1/delepisode//",
+		"/admin/cat/Movies/delmovie/extra/segments",
+	} {
+		before := s.snapshot(t)
+		if w := s.postForm(t, target, url.Values{"seriesname": {"Show"}, "seasonname": {"Season 1"}, "epname": {"Episode 1"}, "moviename": {"Film"}}); w.Code != http.StatusNotFound {
+			t.Errorf("POST %s: got %d, want 404", target, w.Code)
+		}
+		assertUnchanged(t, before, s.snapshot(t))
+	}
+}
+
+func TestRolesOnAdminAndAPI(t *testing.T) {
+	s := newTestServer(t)
+	viewer := s.as(t, "viewer", RoleViewer)
+	uploader := s.as(t, "uploader", RoleUploader)
+	editor := s.as(t, "editor", RoleEditor)
+
+	// Everyone may look
+	for _, u := range []*testServer{viewer, uploader, editor} {
+		for _, target := range []string{"/admin/cat/TV/series/Show", "/admin/validate"} {
+			if w := u.get(t, target); w.Code != http.StatusOK {
+				t.Errorf("GET %s: got %d", target, w.Code)
+			}
+		}
+		if w := u.api(t, "GET", apiBase+"categories/TV/series", ""); w.Code != http.StatusOK {
+			t.Errorf("API list series: got %d", w.Code)
+		}
+	}
+
+	tests := []struct {
+		who  *testServer
+		name string
+		send func(u *testServer) int
+		want int
+	}{
+		{viewer, "viewer new season", func(u *testServer) int {
+			return u.postForm(t, "/admin/cat/TV/series/Show/newseason", url.Values{"seasonname": {"Season 2"}}).Code
+		}, http.StatusForbidden},
+		{viewer, "viewer validate fix", func(u *testServer) int {
+			return u.postForm(t, "/admin/validate", url.Values{"action": {"description"}, "path": {"Movies/Film"}, "shortdesc": {"x"}}).Code
+		}, http.StatusForbidden},
+		{viewer, "viewer API create", func(u *testServer) int {
+			return u.api(t, "POST", apiBase+"categories/TV/series", `{"name":"New Show"}`).Code
+		}, http.StatusForbidden},
+		{uploader, "uploader new season", func(u *testServer) int {
+			return u.postForm(t, "/admin/cat/TV/series/Show/newseason", url.Values{"seasonname": {"Season 2"}}).Code
+		}, http.StatusSeeOther},
+		{uploader, "uploader delete season", func(u *testServer) int {
+			return u.postForm(t, "/admin/cat/TV/series/Show/delseason", url.Values{"seasonname": {"Season 1"}}).Code
+		}, http.StatusForbidden},
+		{uploader, "uploader API create", func(u *testServer) int {
+			return u.api(t, "POST", apiBase+"categories/TV/series", `{"name":"New Show"}`).Code
+		}, http.StatusCreated},
+		{uploader, "uploader API delete", func(u *testServer) int {
+			return u.api(t, "DELETE", apiBase+"categories/Movies/movies/Film", "").Code
+		}, http.StatusForbidden},
+		{editor, "editor API delete", func(u *testServer) int {
+			return u.api(t, "DELETE", apiBase+"categories/Movies/movies/Film", "").Code
+		}, http.StatusNoContent},
+		{editor, "editor delete season", func(u *testServer) int {
+			return u.postForm(t, "/admin/cat/TV/series/Show/delseason", url.Values{"seasonname": {"Season 1"}}).Code
+		}, http.StatusSeeOther},
+	}
+	for _, tt := range tests {
+		if got := tt.send(tt.who); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+	for path, want := range map[string]bool{
+		"TV/Show/Season 2": true,
+		"TV/New Show":      true,
+		"TV/Show/Season 1": false,
+		"Movies/Film":      false,
+	} {
+		_, err := os.Stat(filepath.Join(s.root, filepath.FromSlash(path)))
+		if (err == nil) != want {
+			t.Errorf("%s exists = %v, want %v", path, err == nil, want)
+		}
+	}
+}
+
+func TestCategoryRestrictedUser(t *testing.T) {
+	s := newTestServer(t)
+	if err := os.MkdirAll(filepath.Join(s.root, "TV", "Other", "Season 1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	u := s.as(t, "editor", RoleEditor)
+	if err := users.setAccess("editor", []string{"TV/Show"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for target, want := range map[string]int{
+		"/admin/cat/Movies":                    http.StatusForbidden,
+		"/admin/cat/TV":                        http.StatusOK,
+		"/admin/cat/TV/series/Show":            http.StatusOK,
+		"/admin/cat/TV/series/Other":           http.StatusForbidden,
+		apiBase + "categories/Movies":          http.StatusForbidden,
+		apiBase + "categories/TV/series/Other": http.StatusForbidden,
+	} {
+		var code int
+		if strings.HasPrefix(target, apiBase) {
+			code = u.api(t, "GET", target, "").Code
+		} else {
+			code = u.get(t, target).Code
+		}
+		if code != want {
+			t.Errorf("GET %s: got %d, want %d", target, code, want)
+		}
+	}
+
+	// Lists only show what the user may work on
+	w := u.api(t, "GET", apiBase+"categories", "")
+	if body := w.Body.String(); strings.Contains(body, "Movies") || !strings.Contains(body, "TV") {
+		t.Errorf("categories: %s", body)
+	}
+	w = u.api(t, "GET", apiBase+"categories/TV", "")
+	if body := w.Body.String(); strings.Contains(body, "Other") || !strings.Contains(body, "Show") {
+		t.Errorf("TV: %s", body)
+	}
+	if w := u.get(t, "/admin/cat/TV"); strings.Contains(w.Body.String(), "Other") {
+		t.Error("the category page lists a series the user has no access to")
+	}
+
+	// Changes outside the access list are refused, inside they work
+	before := s.snapshot(t)
+	for _, code := range []int{
+		u.postForm(t, "/admin/cat/TV/delseries", url.Values{"seriesname": {"Other"}}).Code,
+		u.postForm(t, "/admin/cat/TV/series/Other/delseason", url.Values{"seasonname": {"Season 1"}}).Code,
+		u.postForm(t, "/admin/cat/Movies/delmovie", url.Values{"moviename": {"Film"}}).Code,
+		u.postForm(t, "/admin/cat/TV/newseries", url.Values{"seriesname": {"Third"}}).Code,
+		u.api(t, "POST", apiBase+"categories", `{"name":"Docs"}`).Code,
+		u.api(t, "DELETE", apiBase+"categories/TV", "").Code,
+	} {
+		if code != http.StatusForbidden {
+			t.Errorf("change outside the access list: got %d, want 403", code)
+		}
+	}
+	assertUnchanged(t, before, s.snapshot(t))
+	if w := u.postForm(t, "/admin/cat/TV/series/Show/delseason", url.Values{"seasonname": {"Season 1"}}); w.Code != http.StatusSeeOther {
+		t.Errorf("deleting a season of an allowed series: got %d", w.Code)
+	}
+	if _, err := os.Stat(filepath.Join(s.root, "TV", "Show", "Season 1")); !os.IsNotExist(err) {
+		t.Error("season of an allowed series still there")
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"image"
+	_ "image/png"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// ==== LIBRARY VALIDATION ====
+//
+// validateLibrary walks the library the way the feed does and reports
+// everything that would make an item disappear from the feed or misbehave
+// on a Roku. `server validate` prints the report and /admin/validate shows
+// it with a way to fix each problem.
+
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+
+	maxThumbBytes  = 1 << 20
+	maxThumbWidth  = 1920
+	maxThumbHeight = 1080
+	aspectSlack    = 0.05 // how far a thumbnail may stray from 16:9
+)
+
+// Codecs Roku players decode in an MP4.
+var (
+	rokuVideoCodecs = map[string]bool{"h264": true, "hevc": true, "vp9": true, "av1": true}
+	rokuAudioCodecs = map[string]bool{"aac": true, "ac3": true, "eac3": true, "mp3": true, "flac": true, "alac": true, "opus": true, "pcm_s16le": true}
+)
+
+// Ways the admin page offers to fix an issue.
+const (
+	fixUpload      = "upload"      // upload the video again
+	fixThumbnail   = "thumbnail"   // replace the artwork
+	fixDescription = "description" // rewrite the description
+	fixOpen        = "open"        // look at the folder
+)
+
+type libraryIssue struct {
+	Names    []string // category first, down to the folder
+	Kind     string
+	Severity string
+	Problem  string
+	Fix      string
+}
+
+func (i libraryIssue) Path() string { return strings.Join(i.Names, "/") }
+
+// FolderURL is the admin page listing the folder.
+func (i libraryIssue) FolderURL() string {
+	seg := make([]string, len(i.Names))
+	for n, s := range i.Names {
+		seg[n] = url.PathEscape(s)
+	}
+	switch i.Kind {
+	case kindSeries:
+		return "/admin/cat/" + seg[0] + "/series/" + seg[1]
+	case kindSeason, kindEpisode:
+		return "/admin/cat/" + seg[0] + "/series/" + seg[1] + "/season/" + seg[2]
+	}
+	return "/admin/cat/" + seg[0]
+}
+
+// validateLibrary returns the problems found below root.
+func validateLibrary(root string) ([]libraryIssue, error) {
+	var issues []libraryIssue
+	add := func(names []string, kind, severity, fix, format string, a ...interface{}) {
+		issues = append(issues, libraryIssue{
+			Names:    append([]string(nil), names...),
+			Kind:     kind,
+			Severity: severity,
+			Problem:  fmt.Sprintf(format, a...),
+			Fix:      fix,
+		})
+	}
+	_, probeErr := exec.LookPath(ffprobePath)
+	if probeErr != nil {
+		issues = append(issues, libraryIssue{
+			Severity: severityWarning,
+			Problem:  fmt.Sprintf("%s not found, so durations and codecs weren't checked", ffprobePath),
+		})
+	}
+
+	type folder struct {
+		names []string
+		kind  string
+	}
+	var seasons, series []folder
+	episodes := make(map[string]int) // videos per season or series
+	ids := make(map[string][][]string)
+	err := walkLibrary(root, func(dir, kind string, names []string) {
+		info, err := readItem(dir)
+		if err != nil {
+			add(names, kind, severityError, fixOpen, "can't be read: %v", err)
+			return
+		}
+		checkDescription(dir, info, func(severity, format string, a ...interface{}) {
+			add(names, kind, severity, fixDescription, format, a...)
+		})
+		if info.Thumbnail != "" {
+			checkThumbnail(filepath.Join(dir, info.Thumbnail), func(severity, format string, a ...interface{}) {
+				add(names, kind, severity, fixThumbnail, format, a...)
+			})
+		}
+		switch kind {
+		case kindSeries:
+			series = append(series, folder{names, kind})
+			return
+		case kindSeason:
+			seasons = append(seasons, folder{names, kind})
+			return
+		}
+		if info.Video == "" {
+			add(names, kind, severityError, fixUpload, "no video, so it's left out of the feed")
+			return
+		}
+		if kind == kindEpisode {
+			episodes[strings.Join(names[:3], "/")]++
+			episodes[strings.Join(names[:2], "/")]++
+		}
+		ids[info.Name] = append(ids[info.Name], names)
+		if probeErr != nil {
+			return
+		}
+		p, err := probeVideo(filepath.Join(dir, info.Video))
+		switch {
+		case err != nil:
+			add(names, kind, severityError, fixUpload, "%s can't read %s: %v", ffprobePath, info.Video, err)
+			return
+		case p.VideoCodec == "":
+			add(names, kind, severityError, fixUpload, "%s has no video stream", info.Video)
+		case !rokuVideoCodecs[p.VideoCodec]:
+			add(names, kind, severityError, fixUpload, "%s uses the %s video codec, which Roku can't play", info.Video, p.VideoCodec)
+		}
+		if p.AudioCodec != "" && !rokuAudioCodecs[p.AudioCodec] {
+			add(names, kind, severityWarning, fixUpload, "%s uses the %s audio codec, which Roku may not play", info.Video, p.AudioCodec)
+		}
+		if p.Duration < 0.5 {
+			add(names, kind, severityError, fixUpload, "%s has no duration", info.Video)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range seasons {
+		if episodes[strings.Join(s.names, "/")] == 0 {
+			add(s.names, s.kind, severityWarning, fixOpen, "empty season, devices show nothing here")
+		}
+	}
+	for _, s := range series {
+		if episodes[strings.Join(s.names, "/")] == 0 {
+			add(s.names, s.kind, severityWarning, fixOpen, "no episodes with a video")
+		}
+	}
+	for id, where := range ids {
+		if len(where) < 2 {
+			continue
+		}
+		for _, names := range where {
+			kind := kindMovie
+			if len(names) == 4 {
+				kind = kindEpisode
+			}
+			add(names, kind, severityWarning, fixOpen,
+				"ID %q is used by %d items; devices may mix up their progress and bookmarks", id, len(where))
+		}
+	}
+	sort.SliceStable(issues, func(i, j int) bool { return issues[i].Path() < issues[j].Path() })
+	return issues, nil
+}
+
+func checkDescription(dir string, info *itemInfo, add func(severity, format string, a ...interface{})) {
+	if info.descFile == "" {
+		return
+	}
+	b, err := os.ReadFile(filepath.Join(dir, info.descFile))
+	switch {
+	case err != nil:
+		add(severityError, "description %s can't be read: %v", info.descFile, err)
+	case !utf8.Valid(b):
+		add(severityWarning, "description %s isn't UTF-8 text", info.descFile)
+	case info.ShortDesc == "":
+		add(severityWarning, "description %s has an empty first line", info.descFile)
+	}
+}
+
+func checkThumbnail(path string, add func(severity, format string, a ...interface{})) {
+	name := filepath.Base(path)
+	f, err := os.Open(path)
+	if err != nil {
+		add(severityError, "thumbnail %s can't be read: %v", name, err)
+		return
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err == nil && fi.Size() > maxThumbBytes {
+		add(severityWarning, "thumbnail %s is %s; keep it under %s", name, formatSize(fi.Size()), formatSize(maxThumbBytes))
+	}
+	c, _, err := image.DecodeConfig(f)
+	if err != nil {
+		add(severityError, "thumbnail %s isn't a readable JPEG or PNG", name)
+		return
+	}
+	if c.Width > maxThumbWidth || c.Height > maxThumbHeight {
+		add(severityWarning, "thumbnail %s is %dx%d; Roku needs at most %dx%d", name, c.Width, c.Height, maxThumbWidth, maxThumbHeight)
+	}
+	if c.Height > 0 {
+		ratio := float64(c.Width) / float64(c.Height)
+		if ratio < 16.0/9*(1-aspectSlack) || ratio > 16.0/9*(1+aspectSlack) {
+			add(severityWarning, "thumbnail %s is %dx%d, not 16:9, so it will be stretched", name, c.Width, c.Height)
+		}
+	}
+}
+
+// videoProbe is what ffprobe tells us about a video.
+type videoProbe struct {
+	Duration   float64
+	VideoCodec string
+	AudioCodec string
+}
+
+// Probes are remembered until the file changes, so the admin page doesn't
+// run ffprobe over the whole library on every visit.
+var probeCache = struct {
+	sync.Mutex
+	m map[string]probeCacheEntry
+}{m: make(map[string]probeCacheEntry)}
+
+type probeCacheEntry struct {
+	size  int64
+	mtime time.Time
+	probe *videoProbe
+	err   error
+}
+
+func probeVideo(path string) (*videoProbe, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	probeCache.Lock()
+	e, ok := probeCache.m[path]
+	probeCache.Unlock()
+	if ok && e.size == fi.Size() && e.mtime.Equal(fi.ModTime()) {
+		return e.probe, e.err
+	}
+	p, err := runProbe(path)
+	probeCache.Lock()
+	probeCache.m[path] = probeCacheEntry{fi.Size(), fi.ModTime(), p, err}
+	probeCache.Unlock()
+	return p, err
+}
+
+func runProbe(path string) (*videoProbe, error) {
+	cmd := exec.Command(ffprobePath, "-v", "error", "-show_entries",
+		"format=duration:stream=codec_type,codec_name", "-of", "json", path)
+	out, err := runTool("ffprobe", cmd)
+	if err != nil {
+		var ee *exec.ExitError
+		if errors.As(err, &ee) && len(ee.Stderr) > 0 {
+			return nil, errors.New(strings.TrimSpace(strings.SplitN(string(ee.Stderr), "\n", 2)[0]))
+		}
+		return nil, err
+	}
+	var res struct {
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+		Streams []struct {
+			CodecType string `json:"codec_type"`
+			CodecName string `json:"codec_name"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(out, &res); err != nil {
+		return nil, fmt.Errorf("unexpected ffprobe output: %v", err)
+	}
+	p := &videoProbe{}
+	p.Duration, _ = strconv.ParseFloat(res.Format.Duration, 64)
+	for _, s := range res.Streams {
+		switch {
+		case s.CodecType == "video" && p.VideoCodec == "":
+			p.VideoCodec = s.CodecName
+		case s.CodecType == "audio" && p.AudioCodec == "":
+			p.AudioCodec = s.CodecName
+		}
+	}
+	return p, nil
+}
+
+var validatePage = template.Must(template.New("validate").Parse(`
+<html><head><title>Library Check - Admin</title>` + css + `</head><body>
+<nav>
+  <a href="/admin">Dashboard</a>
+  <a href="/logout">Logout</a>
+</nav>
+<div class="card">
+<h2>Library Check</h2>
+{{if .Error}}<div class="error">{{.Error}}</div>{{end}}
+{{if .Issues}}
+  <p>{{.Errors}} errors and {{.Warnings}} warnings. Errors keep an item out of the feed or stop it playing.</p>
+  <table>
+    <tr><th></th><th>Item</th><th>Problem</th><th>Fix</th></tr>
+    {{range .Issues}}
+      <tr>
+        <td>{{if eq .Severity "error"}}<b>Error</b>{{else}}Warning{{end}}</td>
+        <td>{{if .Names}}<a href="{{.FolderURL}}">{{.Path}}</a>{{end}}</td>
+        <td>{{.Problem}}</td>
+        <td>
+          {{if and (eq .Fix "thumbnail") $.CanEdit}}
+            <form method="POST" action="/admin/validate" enctype="multipart/form-data">` + csrfInput + `
+              <input type="hidden" name="action" value="thumbnail">
+              <input type="hidden" name="path" value="{{.Path}}">
+              <input type="file" name="thumb" accept=".jpg,.jpeg,.png" required>
+              <button type="submit" class="btn">Replace</button>
+            </form>
+          {{else if and (eq .Fix "description") $.CanEdit}}
+            <form method="POST" action="/admin/validate">` + csrfInput + `
+              <input type="hidden" name="action" value="description">
+              <input type="hidden" name="path" value="{{.Path}}">
+              <input name="shortdesc" placeholder="Short description" required>
+              <input name="longdesc" placeholder="Long description">
+              <button type="submit" class="btn">Save</button>
+            </form>
+          {{else if eq .Fix "upload"}}
+            <a href="{{.FolderURL}}" class="btn">Upload again</a>
+          {{else if eq .Fix "open"}}
+            <a href="{{.FolderURL}}" class="btn">Open</a>
+          {{end}}
+        </td>
+      </tr>
+    {{end}}
+  </table>
+{{else if not .Error}}
+  <p>No problems found.</p>
+{{end}}
+</div>
+</body></html>
+`))
+
+// validateHandler shows the library check and applies the thumbnail and
+// description fixes offered there.
+func validateHandler(root string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		me := currentUser(r)
+		data := map[string]interface{}{"CanEdit": me.can(permUpload)}
+		switch r.Method {
+		case "GET":
+		case "POST":
+			if !me.can(permUpload) {
+				forbidden(w)
+				return
+			}
+			names := strings.Split(r.FormValue("path"), "/")
+			item := ""
+			if len(names) > 1 {
+				item = names[1]
+			}
+			if !me.canAccess(names[0], item) {
+				forbidden(w)
+				return
+			}
+			dir, err := resolvePath(root, names...)
+			if err != nil {
+				badPath(w, err)
+				return
+			}
+			switch r.FormValue("action") {
+			case "thumbnail":
+				f, head, ferr := r.FormFile("thumb")
+				if ferr != nil {
+					err = badInput("choose an image")
+					break
+				}
+				err = audited(r).setThumbnail(dir, head.Filename, f)
+				f.Close()
+			case "description":
+				err = audited(r).setDescription(dir, strings.TrimSpace(r.FormValue("shortdesc")), strings.TrimSpace(r.FormValue("longdesc")))
+			default:
+				err = badInput("unknown action")
+			}
+			if err == nil {
+				http.Redirect(w, r, "/admin/validate", http.StatusSeeOther)
+				return
+			}
+			data["Error"] = err.Error()
+		default:
+			http.Error(w, "Method not allowed", 405)
+			return
+		}
+		issues, err := validateLibrary(root)
+		if err != nil {
+			data["Error"] = "Failed to read the library: " + err.Error()
+		}
+		var visible []libraryIssue
+		errs, warnings := 0, 0
+		for _, i := range issues {
+			if len(i.Names) > 0 {
+				item := ""
+				if len(i.Names) > 1 {
+					item = i.Names[1]
+				}
+				if !me.canAccess(i.Names[0], item) {
+					continue
+				}
+			}
+			visible = append(visible, i)
+			if i.Severity == severityError {
+				errs++
+			} else {
+				warnings++
+			}
+		}
+		data["Issues"] = visible
+		data["Errors"] = errs
+		data["Warnings"] = warnings
+		renderPage(w, r, validatePage, data)
+	}
+}
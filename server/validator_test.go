@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// filmIssues returns the problems validateLibrary finds with Movies/Film
+// by the fix it offers.
+func filmIssues(t *testing.T, root string) map[string]string {
+	t.Helper()
+	issues, err := validateLibrary(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make(map[string]string)
+	for _, i := range issues {
+		if i.Path() == "Movies/Film" {
+			out[i.Fix] = i.Problem
+		}
+	}
+	return out
+}
+
+func TestValidateThumbnailAndDescription(t *testing.T) {
+	s := newTestServer(t)
+	old := ffprobePath
+	t.Cleanup(func() { ffprobePath = old })
+	ffprobePath = filepath.Join(t.TempDir(), "no-ffprobe")
+	film := filepath.Join(s.root, "Movies", "Film")
+	if err := os.WriteFile(filepath.Join(film, "thumb.png"), []byte("not an image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(film, "desc.txt"), []byte("\nOnly a long description"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	found := filmIssues(t, s.root)
+	if !strings.Contains(found[fixThumbnail], "isn't a readable JPEG or PNG") {
+		t.Errorf("broken thumbnail: %q", found[fixThumbnail])
+	}
+	if !strings.Contains(found[fixDescription], "empty first line") {
+		t.Errorf("empty description: %q", found[fixDescription])
+	}
+
+	// Viewers see the report but not the fixes
+	viewer := s.as(t, "viewer", RoleViewer)
+	w := viewer.get(t, "/admin/validate")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "empty first line") {
+		t.Fatalf("viewer's report: %d", w.Code)
+	}
+	if strings.Contains(w.Body.String(), `value="description"`) {
+		t.Error("viewer is offered a fix")
+	}
+	describe := url.Values{"action": {"description"}, "path": {"Movies/Film"}, "shortdesc": {"A film"}}
+	if w := viewer.postForm(t, "/admin/validate", describe); w.Code != http.StatusForbidden {
+		t.Errorf("viewer fixing: got %d, want 403", w.Code)
+	}
+
+	// Uploaders limited to other categories can't fix these either
+	tvOnly := s.as(t, "tv", RoleUploader)
+	if err := users.setAccess("tv", []string{"TV"}); err != nil {
+		t.Fatal(err)
+	}
+	if w := tvOnly.postForm(t, "/admin/validate", describe); w.Code != http.StatusForbidden {
+		t.Errorf("restricted uploader fixing: got %d, want 403", w.Code)
+	}
+	if w := tvOnly.get(t, "/admin/validate"); strings.Contains(w.Body.String(), "Movies/Film") {
+		t.Error("restricted uploader sees issues outside their categories")
+	}
+	if len(filmIssues(t, s.root)) != 2 {
+		t.Fatal("a refused fix changed something")
+	}
+
+	uploader := s.as(t, "uploader", RoleUploader)
+	bad := url.Values{"action": {"description"}, "path": {"../outside"}, "shortdesc": {"x"}}
+	if w := uploader.postForm(t, "/admin/validate", bad); w.Code != http.StatusBadRequest {
+		t.Errorf("fix outside the library: got %d, want 400", w.Code)
+	}
+	assertOutsideUntouched(t, s)
+
+	if w := uploader.postForm(t, "/admin/validate", describe); w.Code != http.StatusSeeOther {
+		t.Fatalf("description fix: got %d: %s", w.Code, w.Body)
+	}
+	var img bytes.Buffer
+	png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 160, 90)))
+	w = uploader.postMultipart(t, "/admin/validate", []formPart{
+		{name: "action", body: "thumbnail"},
+		{name: "path", body: "Movies/Film"},
+		{name: "thumb", filename: "new.png", body: img.String()},
+	})
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("thumbnail fix: got %d: %s", w.Code, w.Body)
+	}
+	if left := filmIssues(t, s.root); len(left) != 0 {
+		t.Errorf("issues left after the fixes: %v", left)
+	}
+}
@@ -3,32 +3,23 @@ package main
 import (
 	"crypto/rand"
 	"encoding/base64"
-	"encoding/json"
 	"encoding/xml"
-	"golang.org/x/crypto/bcrypt"
+	"errors"
 	"html/template"
 	"io"
-	"log"
-	"mime/multipart"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
-	"sync"
+	"time"
 )
 
 const userFile = "webuser.json"
 
-type User struct {
-	Username     string `json:"username"`
-	PasswordHash string `json:"password_hash"`
-}
-
-var (
-	sessionMu sync.Mutex
-	sessions  = make(map[string]string) // sessionToken -> username
-)
+// uploads holds in-progress resumable uploads for the admin forms.
+var uploads *tusStore
 
 var css = `<style>
 body {
@@ -117,6 +108,11 @@ tr:nth-child(odd) { background: #23244a; }
 table { width: 100%; border-collapse: collapse; margin-bottom: 2em;}
 a.action { color: #ffb66c; font-weight: bold; margin-left: 0.7em; }
 a.action:hover { text-decoration: underline; }
+.progress { display: none; margin-bottom: 1em; }
+.progress progress { width: 80%; vertical-align: middle; }
+.progress span { margin-left: 0.7em; }
+.dropzone { border: 2px dashed #5976ff; border-radius: 8px; padding: 1.5em; margin: 1em 0; text-align: center; color: #97b4ff; }
+.dropzone.over { background: #2a2c58; }
 </style>`
 
 var (
@@ -140,6 +136,7 @@ var (
 <form method="POST" action="/login">
   <label>Username <input name="username" required autocomplete="username"></label>
   <label>Password <input type="password" name="password" required autocomplete="current-password"></label>
+  <label><input type="checkbox" name="remember" value="1"> Remember me</label>
   <button type="submit">Login</button>
 </form>
 </div>
@@ -153,6 +150,9 @@ var adminPage = template.Must(template.New("admin").Funcs(template.FuncMap{
 <nav>
   <a href="/admin">Dashboard</a>
   <a href="/admin/newcat">+ New Category</a>
+  <a href="/admin/validate">Library Check</a>
+  {{if .Trash}}<a href="/admin/trash">Trash</a>{{end}}
+  <a href="/admin/account">My Account</a>
   <a href="/logout">Logout</a>
 </nav>
 <div class="card">
@@ -169,9 +169,9 @@ var adminPage = template.Must(template.New("admin").Funcs(template.FuncMap{
         </td>
         <td>
           <a href="/admin/cat/{{.Name}}" class="btn">Browse/Edit</a>
-          <form method="POST" action="/admin/delcat" style="display:inline">
+          <form method="POST" action="/admin/delcat" style="display:inline">` + csrfInput + `
             <input type="hidden" name="category" value="{{.Name}}">
-            <button type="submit" class="btn" onclick="return confirm('Delete category {{.Name}}? This cannot be undone.')">Delete</button>
+            <button type="submit" class="btn" onclick="return confirm('Delete category {{.Name}}?{{if $.Trash}} It can be restored from the trash.{{end}}')">Delete</button>
           </form>
         </td>
       </tr>
@@ -192,7 +192,7 @@ var newCatPage = template.Must(template.New("newcat").Parse(`
 </nav>
 <div class="card">
 <h2>New Category</h2>
-<form method="POST" action="/admin/newcat">
+<form method="POST" action="/admin/newcat">` + csrfInput + `
   <label>Category Name
     <input name="catname" required maxlength="60" pattern="[^/]+" placeholder="e.g. Movies, TV Shows, Documentaries">
   </label>
@@ -209,6 +209,7 @@ var catPage = template.Must(template.New("cat").Funcs(template.FuncMap{
 <nav>
   <a href="/admin">Dashboard</a>
   <a href="/admin/newcat">+ New Category</a>
+  <a href="/admin/account">My Account</a>
   <a href="/logout">Logout</a>
 </nav>
 <div class="card">
@@ -216,14 +217,21 @@ var catPage = template.Must(template.New("cat").Funcs(template.FuncMap{
 {{if .Error}}<div class="error">{{.Error}}</div>{{end}}
 {{if .IsMovies}}
   <h3>Add Movie</h3>
-  <form method="POST" action="/admin/cat/{{.Category}}/upload" enctype="multipart/form-data">
+  <form method="POST" action="/admin/cat/{{.Category}}/upload" enctype="multipart/form-data" data-tus>` + csrfInput + `
+    <input type="hidden" name="upload_id">
     <label>Movie Name <input name="moviename" required maxlength="60"></label>
     <label>Short Description <input name="shortdesc" maxlength="200"></label>
     <label>Long Description <textarea name="longdesc" rows="3"></textarea></label>
     <label>Video File (.mp4) <input type="file" name="video" accept="video/mp4" required></label>
     <label>Thumbnail (jpg/png, optional) <input type="file" name="thumb" accept="image/*"></label>
+    <div class="progress"><progress max="100" value="0"></progress><span>0%</span></div>
     <button type="submit">Add Movie</button>
   </form>
+  <h3>Bulk Add Movies</h3>
+  <p>Each video becomes a movie named after its file. Matching .jpg/.png/.txt/.srt files are kept with it.</p>
+  <form method="POST" action="/admin/cat/{{.Category}}/bulkupload" enctype="multipart/form-data" data-bulk>` + csrfInput + `
+` + bulkForm + `
+  </form>
   <h3>Movies</h3>
   {{if .Movies}}
     <table>
@@ -232,7 +240,7 @@ var catPage = template.Must(template.New("cat").Funcs(template.FuncMap{
         <tr>
           <td>{{.}}</td>
           <td>
-            <form method="POST" action="/admin/cat/{{$.Category}}/delmovie" style="display:inline">
+            <form method="POST" action="/admin/cat/{{$.Category}}/delmovie" style="display:inline">` + csrfInput + `
               <input type="hidden" name="moviename" value="{{.}}">
               <button type="submit" class="btn" onclick="return confirm('Delete movie {{.}}?')">Delete</button>
             </form>
@@ -245,10 +253,15 @@ var catPage = template.Must(template.New("cat").Funcs(template.FuncMap{
   {{end}}
 {{else}}
   <h3>Add Series</h3>
-  <form method="POST" action="/admin/cat/{{.Category}}/newseries">
+  <form method="POST" action="/admin/cat/{{.Category}}/newseries">` + csrfInput + `
     <label>Series Name <input name="seriesname" required maxlength="60"></label>
     <button type="submit">Create Series</button>
   </form>
+  <h3>Bulk Upload Series</h3>
+  <p>Drop whole series folders (Series/Season/episode files). Episode names and numbers come from the filenames.</p>
+  <form method="POST" action="/admin/cat/{{.Category}}/bulkupload" enctype="multipart/form-data" data-bulk>` + csrfInput + `
+` + bulkForm + `
+  </form>
   <h3>Series</h3>
   {{if .Series}}
     <table>
@@ -258,7 +271,7 @@ var catPage = template.Must(template.New("cat").Funcs(template.FuncMap{
           <td>{{.}}</td>
           <td>
             <a href="/admin/cat/{{$.Category}}/series/{{.}}" class="btn">Browse/Edit</a>
-            <form method="POST" action="/admin/cat/{{$.Category}}/delseries" style="display:inline">
+            <form method="POST" action="/admin/cat/{{$.Category}}/delseries" style="display:inline">` + csrfInput + `
               <input type="hidden" name="seriesname" value="{{.}}">
               <button type="submit" class="btn" onclick="return confirm('Delete series {{.}}?')">Delete</button>
             </form>
@@ -271,6 +284,7 @@ var catPage = template.Must(template.New("cat").Funcs(template.FuncMap{
   {{end}}
 {{end}}
 </div>
+` + uploadJS + bulkJS + `
 </body></html>
 `))
 
@@ -285,7 +299,7 @@ var seriesPage = template.Must(template.New("series").Parse(`
 <h2>Series: {{.Series}}</h2>
 {{if .Error}}<div class="error">{{.Error}}</div>{{end}}
 <h3>Add Season</h3>
-<form method="POST" action="/admin/cat/{{.Category}}/series/{{.Series}}/newseason">
+<form method="POST" action="/admin/cat/{{.Category}}/series/{{.Series}}/newseason">` + csrfInput + `
   <label>Season Name <input name="seasonname" required maxlength="60" placeholder="e.g. Season 1"></label>
   <button type="submit">Create Season</button>
 </form>
@@ -298,7 +312,7 @@ var seriesPage = template.Must(template.New("series").Parse(`
         <td>{{.}}</td>
         <td>
           <a href="/admin/cat/{{$.Category}}/series/{{$.Series}}/season/{{.}}" class="btn">Browse/Edit</a>
-          <form method="POST" action="/admin/cat/{{$.Category}}/series/{{$.Series}}/delseason" style="display:inline">
+          <form method="POST" action="/admin/cat/{{$.Category}}/series/{{$.Series}}/delseason" style="display:inline">` + csrfInput + `
             <input type="hidden" name="seasonname" value="{{.}}">
             <button type="submit" class="btn" onclick="return confirm('Delete season {{.}}?')">Delete</button>
           </form>
@@ -325,14 +339,21 @@ var seasonPage = template.Must(template.New("season").Parse(`
 <h2>{{.Season}} ({{.Series}})</h2>
 {{if .Error}}<div class="error">{{.Error}}</div>{{end}}
 <h3>Add Episode</h3>
-<form method="POST" action="/admin/cat/{{.Category}}/series/{{.Series}}/season/{{.Season}}/uploadep" enctype="multipart/form-data">
+<form method="POST" action="/admin/cat/{{.Category}}/series/{{.Series}}/season/{{.Season}}/uploadep" enctype="multipart/form-data" data-tus>` + csrfInput + `
+  <input type="hidden" name="upload_id">
   <label>Episode Name <input name="epname" required maxlength="60"></label>
   <label>Short Description <input name="shortdesc" maxlength="200"></label>
   <label>Long Description <textarea name="longdesc" rows="3"></textarea></label>
   <label>Video File (.mp4) <input type="file" name="video" accept="video/mp4" required></label>
   <label>Thumbnail (jpg/png, optional) <input type="file" name="thumb" accept="image/*"></label>
+  <div class="progress"><progress max="100" value="0"></progress><span>0%</span></div>
   <button type="submit">Add Episode</button>
 </form>
+<h3>Bulk Add Episodes</h3>
+<p>Each video becomes an episode named from its file (e.g. S01E02, 1x02). Matching .jpg/.png/.txt/.srt files are kept with it.</p>
+<form method="POST" action="/admin/cat/{{.Category}}/series/{{.Series}}/season/{{.Season}}/bulkupload" enctype="multipart/form-data" data-bulk>` + csrfInput + `
+` + bulkForm + `
+</form>
 <h3>Episodes</h3>
 {{if .Episodes}}
   <table>
@@ -341,7 +362,7 @@ var seasonPage = template.Must(template.New("season").Parse(`
       <tr>
         <td>{{.}}</td>
         <td>
-          <form method="POST" action="/admin/cat/{{$.Category}}/series/{{$.Series}}/season/{{$.Season}}/delepisode" style="display:inline">
+          <form method="POST" action="/admin/cat/{{$.Category}}/series/{{$.Series}}/season/{{$.Season}}/delepisode" style="display:inline">` + csrfInput + `
             <input type="hidden" name="epname" value="{{.}}">
             <button type="submit" class="btn" onclick="return confirm('Delete episode {{.}}?')">Delete</button>
           </form>
@@ -353,12 +374,30 @@ var seasonPage = template.Must(template.New("season").Parse(`
   <p>No episodes found.</p>
 {{end}}
 </div>
+` + uploadJS + bulkJS + `
 </body></html>
 `))
 
 func StartWebServer(addr string, rootDir string) {
-	http.HandleFunc("/admin", requireLogin(func(w http.ResponseWriter, r *http.Request) {
+	if err := users.load(); err != nil {
+		fatal("auth", "failed to load users", "err", err)
+	}
+	if err := sessions.load(); err != nil {
+		fatal("auth", "failed to load sessions", "err", err)
+	}
+	go sessions.janitor(10 * time.Minute)
+	if err := loginGuard.load(); err != nil {
+		logFor("auth").Error("failed to read login failure log", "err", err)
+	}
+	go loginGuard.janitor(10 * time.Minute)
+	if err := apiTokens.load(); err != nil {
+		fatal("auth", "failed to load API tokens", "err", err)
+	}
+	auditLog.root = rootDir
+
+	http.HandleFunc("/admin", requirePerm(permView, func(w http.ResponseWriter, r *http.Request) {
 		cats, err := listCategories(rootDir)
+		me := currentUser(r)
 		typeinfo := func(name string) string {
 			n := strings.ToLower(name)
 			if n == "movies" {
@@ -373,65 +412,101 @@ func StartWebServer(addr string, rootDir string) {
 			Type string
 		}
 		for _, c := range cats {
+			if !me.canSeeCategory(c) {
+				continue
+			}
 			out = append(out, struct{ Name, Type string }{c, typeinfo(c)})
 		}
-		adminPage.Execute(w, map[string]interface{}{"Categories": out, "Error": err})
+		renderPage(w, r, adminPage, map[string]interface{}{"Categories": out, "Error": err, "Trash": cfg.Trash})
 	}))
 
-	http.HandleFunc("/admin/newcat", requireLogin(newCatHandler(rootDir)))
-	http.HandleFunc("/admin/delcat", requireLogin(delCatHandler(rootDir)))
+	http.HandleFunc("/admin/newcat", requirePerm(permCreate, newCatHandler(rootDir)))
+	http.HandleFunc("/admin/delcat", requirePerm(permDelete, delCatHandler(rootDir)))
+	http.HandleFunc("/admin/users", requirePerm(permUsers, usersHandler))
+	http.HandleFunc("/admin/account", requireLogin(browserOnly(accountHandler)))
+	http.HandleFunc("/admin/tokens", requireLogin(browserOnly(tokensHandler)))
+	http.HandleFunc("/admin/security", requirePerm(permUsers, securityHandler))
+	http.HandleFunc("/admin/audit", requirePerm(permUsers, auditHandler))
+	if cfg.Trash {
+		trash.root = rootDir
+		go trash.janitor(time.Hour)
+		http.HandleFunc("/admin/trash", requirePerm(permDelete, trashHandler))
+	}
+	http.HandleFunc("/admin/validate", requirePerm(permView, validateHandler(rootDir)))
+	http.HandleFunc("/admin/diagnostics", requirePerm(permUsers, diagnosticsHandler(rootDir)))
 
-	http.HandleFunc("/admin/cat/", requireLogin(catHandler(rootDir)))
+	http.HandleFunc("/admin/cat/", requireLogin(catRouter(rootDir)))
 
-	http.HandleFunc("/feed.xml", func(w http.ResponseWriter, r *http.Request) {
-		feed, err := BuildFeed(rootDir, r.Host)
-		if err != nil {
-			http.Error(w, "Feed error: "+err.Error(), 500)
-			return
-		}
-		w.Header().Set("Content-Type", "application/xml")
-		enc := xml.NewEncoder(w)
-		enc.Indent("", "  ")
-		if err := enc.Encode(feed); err != nil {
-			log.Println("XML encode error:", err)
-		}
-	})
+	store, err := newTusStore(rootDir)
+	if err != nil {
+		fatal("uploads", "failed to prepare upload directory", "err", err)
+	}
+	uploads = store
+	go uploads.janitor(time.Hour)
+	http.HandleFunc(tusBasePath, requirePerm(permUpload, tusHandler(uploads, tusBasePath)))
+
+	if cfg.API {
+		http.HandleFunc(apiBase+"openapi.json", openAPIHandler)
+		http.HandleFunc(apiBase+"uploads/", apiPerm(permUpload, tusHandler(uploads, apiBase+"uploads/")))
+		http.HandleFunc(apiBase, apiAuth(apiHandler(rootDir)))
+	}
+
+	loadFeedAuth()
+	http.Handle("/feed.xml", feedHandler(rootDir))
+	http.HandleFunc("/admin/devices", requirePerm(permUsers, devicesHandler))
+	http.HandleFunc("/admin/activate", requirePerm(permUsers, devicesHandler))
+	if cfg.Activation {
+		http.HandleFunc("/activate/code", activateCodeHandler)
+		http.HandleFunc("/activate/poll", activatePollHandler)
+	}
 
 	// Auth routes
 	http.HandleFunc("/login", loginHandler)
+	http.HandleFunc("/login/2fa", twoFactorHandler)
 	http.HandleFunc("/logout", logoutHandler)
 	http.HandleFunc("/setup", setupHandler)
 	http.HandleFunc("/", rootHandler)
 
 	// Serve all files under /content/
-	fs := http.FileServer(http.Dir(rootDir))
-	http.Handle("/content/", http.StripPrefix("/content/", fs))
+	http.Handle("/content/", contentHandler(rootDir))
+	registerHealth(rootDir)
+	registerMetrics(cfg.Mode != "combined")
 
-	log.Printf("Web server running at: http://%s/", addr)
-	log.Fatal(http.ListenAndServe(addr, nil))
+	if cfg.Mode == "combined" {
+		logFor("server").Info("serving feed", "url", listenScheme()+"://"+addr+"/feed.xml")
+		logFor("server").Info("serving admin UI", "url", listenScheme()+"://"+cfg.AdminAddr+"/")
+	} else {
+		logFor("server").Info("serving admin UI", "url", listenScheme()+"://"+addr+"/")
+	}
+	serve(addr)
 }
 
 // ==== ADMIN HANDLERS ====
 
 func newCatHandler(root string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if currentUser(r).restricted() {
+			forbidden(w)
+			return
+		}
 		if r.Method == "GET" {
-			newCatPage.Execute(w, nil)
+			renderPage(w, r, newCatPage, nil)
 			return
 		}
 		if r.Method == "POST" {
 			name := strings.TrimSpace(r.FormValue("catname"))
-			if len(name) < 2 || strings.ContainsAny(name, "/\\") {
-				newCatPage.Execute(w, map[string]string{"Error": "Invalid name"})
+			if len(name) < 2 {
+				renderPage(w, r, newCatPage, map[string]interface{}{"Error": "Invalid name"})
 				return
 			}
-			full := filepath.Join(root, name)
-			if _, err := os.Stat(full); err == nil {
-				newCatPage.Execute(w, map[string]string{"Error": "Category exists"})
-				return
-			}
-			if err := os.MkdirAll(full, 0755); err != nil {
-				newCatPage.Execute(w, map[string]string{"Error": err.Error()})
+			if _, err := audited(r).createFolder(root, name); err != nil {
+				msg := err.Error()
+				if errors.Is(err, errExists) {
+					msg = "Category exists"
+				} else if isInputError(err) {
+					msg = "Invalid name: " + msg
+				}
+				renderPage(w, r, newCatPage, map[string]interface{}{"Error": msg})
 				return
 			}
 			http.Redirect(w, r, "/admin", http.StatusSeeOther)
@@ -452,9 +527,16 @@ func delCatHandler(root string) http.HandlerFunc {
 			http.Redirect(w, r, "/admin", http.StatusSeeOther)
 			return
 		}
-		full := filepath.Join(root, name)
-		if err := os.RemoveAll(full); err != nil {
-			adminPage.Execute(w, map[string]interface{}{"Error": "Failed to delete: " + err.Error()})
+		if !currentUser(r).canAccess(name, "") {
+			forbidden(w)
+			return
+		}
+		if err := audited(r).deleteFolder(root, name); err != nil && !errors.Is(err, errNotFound) {
+			if isInputError(err) {
+				badPath(w, err)
+				return
+			}
+			renderPage(w, r, adminPage, map[string]interface{}{"Error": "Failed to delete: " + err.Error()})
 			return
 		}
 		http.Redirect(w, r, "/admin", http.StatusSeeOther)
@@ -471,17 +553,37 @@ func catHandler(root string) http.HandlerFunc {
 			return
 		}
 		cat := path
-		catPath := filepath.Join(root, cat)
+		me := currentUser(r)
+		if !me.canSeeCategory(cat) {
+			forbidden(w)
+			return
+		}
+		catPath, err := resolvePath(root, cat)
+		if err != nil {
+			badPath(w, err)
+			return
+		}
 		fi, err := os.Stat(catPath)
 		if err != nil || !fi.IsDir() {
-			adminPage.Execute(w, map[string]interface{}{"Error": "Category not found"})
+			renderPage(w, r, adminPage, map[string]interface{}{"Error": "Category not found"})
 			return
 		}
+		// Hide what a restricted user cannot touch
+		visible := func(names []string) []string {
+			var out []string
+			for _, n := range names {
+				if me.canAccess(cat, n) {
+					out = append(out, n)
+				}
+			}
+			return out
+		}
 		isMovies := strings.EqualFold(cat, "movies")
 		if isMovies {
 			// Movie folders
 			movies, _ := listSubDirs(catPath)
-			catPage.Execute(w, map[string]interface{}{
+			movies = visible(movies)
+			renderPage(w, r, catPage, map[string]interface{}{
 				"Category": cat,
 				"IsMovies": true,
 				"Movies":   movies,
@@ -489,7 +591,8 @@ func catHandler(root string) http.HandlerFunc {
 		} else {
 			// Series folders
 			series, _ := listSubDirs(catPath)
-			catPage.Execute(w, map[string]interface{}{
+			series = visible(series)
+			renderPage(w, r, catPage, map[string]interface{}{
 				"Category": cat,
 				"IsMovies": false,
 				"Series":   series,
@@ -504,13 +607,43 @@ func catRouter(root string) http.HandlerFunc {
 		trim := strings.TrimPrefix(r.URL.Path, "/admin/cat/")
 		parts := strings.Split(trim, "/")
 		if len(parts) < 2 {
-			http.NotFound(w, r) // Let catHandler deal with /admin/cat/{cat}
+			catHandler(root)(w, r) // Let catHandler deal with /admin/cat/{cat}
+			return
+		}
+
+		routeAction, ok := catRouteAction(parts)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		me := currentUser(r)
+		if !me.can(catRoutePerm(r, routeAction)) {
+			forbidden(w)
 			return
 		}
 
 		cat := parts[0]
 		action := parts[1]
-		catPath := filepath.Join(root, cat)
+		catPath, err := resolvePath(root, cat)
+		if err != nil {
+			badPath(w, err)
+			return
+		}
+
+		// Work out which series or movie the request touches, if any
+		item := ""
+		switch {
+		case action == "series" && len(parts) >= 3:
+			item = parts[2]
+		case action == "delseries" && r.Method == "POST":
+			item = r.FormValue("seriesname")
+		case action == "delmovie" && r.Method == "POST":
+			item = r.FormValue("moviename")
+		}
+		if !me.canAccess(cat, item) {
+			forbidden(w)
+			return
+		}
 
 		// /admin/cat/{cat}/upload or /admin/cat/{cat}/delmovie
 		if len(parts) == 2 {
@@ -519,21 +652,33 @@ func catRouter(root string) http.HandlerFunc {
 					handleMovieUpload(catPath, w, r, cat)
 					return
 				}
+				if action == "bulkupload" && r.Method == "POST" {
+					handleBulkUpload(bulkMovies, catPath, "/admin/cat/"+cat, w, r)
+					return
+				}
 				if action == "delmovie" && r.Method == "POST" {
 					movie := r.FormValue("moviename")
 					if movie != "" {
-						moviePath := filepath.Join(catPath, movie)
-						_ = os.RemoveAll(moviePath)
+						if err := audited(r).deleteFolder(catPath, movie); err != nil && !errors.Is(err, errNotFound) {
+							libraryFailed(w, err)
+							return
+						}
 					}
 					http.Redirect(w, r, "/admin/cat/"+cat, http.StatusSeeOther)
 					return
 				}
 			} else { // It's a series category
+				if action == "bulkupload" && r.Method == "POST" {
+					handleBulkUpload(bulkSeries, catPath, "/admin/cat/"+cat, w, r)
+					return
+				}
 				if action == "newseries" && r.Method == "POST" {
 					name := strings.TrimSpace(r.FormValue("seriesname"))
-					if len(name) > 1 && !strings.ContainsAny(name, "/\\") {
-						full := filepath.Join(catPath, name)
-						_ = os.MkdirAll(full, 0755)
+					if len(name) > 1 {
+						if _, err := audited(r).createFolder(catPath, name); err != nil && !errors.Is(err, errExists) {
+							libraryFailed(w, err)
+							return
+						}
 					}
 					http.Redirect(w, r, "/admin/cat/"+cat, http.StatusSeeOther)
 					return
@@ -541,8 +686,10 @@ func catRouter(root string) http.HandlerFunc {
 				if action == "delseries" && r.Method == "POST" {
 					series := r.FormValue("seriesname")
 					if series != "" {
-						seriesPath := filepath.Join(catPath, series)
-						_ = os.RemoveAll(seriesPath)
+						if err := audited(r).deleteFolder(catPath, series); err != nil && !errors.Is(err, errNotFound) {
+							libraryFailed(w, err)
+							return
+						}
 					}
 					http.Redirect(w, r, "/admin/cat/"+cat, http.StatusSeeOther)
 					return
@@ -553,11 +700,15 @@ func catRouter(root string) http.HandlerFunc {
 		// Handle deeper routes like /admin/cat/{cat}/series/{series_name}/...
 		if len(parts) >= 3 && action == "series" {
 			series := parts[2]
-			seriesPath := filepath.Join(catPath, series)
+			seriesPath, err := resolvePath(catPath, series)
+			if err != nil {
+				badPath(w, err)
+				return
+			}
 
 			if len(parts) == 3 { // It's the series page itself
 				seasons, _ := listSubDirs(seriesPath)
-				seriesPage.Execute(w, map[string]interface{}{
+				renderPage(w, r, seriesPage, map[string]interface{}{
 					"Category": cat,
 					"Series":   series,
 					"Seasons":  seasons,
@@ -571,15 +722,21 @@ func catRouter(root string) http.HandlerFunc {
 				switch seriesAction {
 				case "newseason":
 					name := strings.TrimSpace(r.FormValue("seasonname"))
-					if len(name) > 1 && !strings.ContainsAny(name, "/\\") {
-						_ = os.MkdirAll(filepath.Join(seriesPath, name), 0755)
+					if len(name) > 1 {
+						if _, err := audited(r).createFolder(seriesPath, name); err != nil && !errors.Is(err, errExists) {
+							libraryFailed(w, err)
+							return
+						}
 					}
 					http.Redirect(w, r, r.Referer(), http.StatusSeeOther)
 					return
 				case "delseason":
 					season := r.FormValue("seasonname")
 					if season != "" {
-						_ = os.RemoveAll(filepath.Join(seriesPath, season))
+						if err := audited(r).deleteFolder(seriesPath, season); err != nil && !errors.Is(err, errNotFound) {
+							libraryFailed(w, err)
+							return
+						}
 					}
 					http.Redirect(w, r, r.Referer(), http.StatusSeeOther)
 					return
@@ -589,11 +746,15 @@ func catRouter(root string) http.HandlerFunc {
 			// Handle season-level routes /.../season/{season_name}/...
 			if len(parts) >= 5 && seriesAction == "season" {
 				season := parts[4]
-				seasonPath := filepath.Join(seriesPath, season)
+				seasonPath, err := resolvePath(seriesPath, season)
+				if err != nil {
+					badPath(w, err)
+					return
+				}
 
 				if len(parts) == 5 { // It's the season page
 					episodes, _ := listSubDirs(seasonPath)
-					seasonPage.Execute(w, map[string]interface{}{
+					renderPage(w, r, seasonPage, map[string]interface{}{
 						"Category": cat,
 						"Series":   series,
 						"Season":   season,
@@ -608,10 +769,16 @@ func catRouter(root string) http.HandlerFunc {
 					case "uploadep":
 						handleEpisodeUpload(seasonPath, w, r, cat, series, season)
 						return
+					case "bulkupload":
+						handleBulkUpload(bulkSeason, seasonPath, "/admin/cat/"+cat+"/series/"+series+"/season/"+season, w, r)
+						return
 					case "delepisode":
 						ep := r.FormValue("epname")
 						if ep != "" {
-							_ = os.RemoveAll(filepath.Join(seasonPath, ep))
+							if err := audited(r).deleteFolder(seasonPath, ep); err != nil && !errors.Is(err, errNotFound) {
+								libraryFailed(w, err)
+								return
+							}
 						}
 						http.Redirect(w, r, r.Referer(), http.StatusSeeOther)
 						return
@@ -627,102 +794,70 @@ func catRouter(root string) http.HandlerFunc {
 // ==== UPLOAD HANDLERS ====
 
 func handleMovieUpload(catPath string, w http.ResponseWriter, r *http.Request, cat string) {
-	if err := r.ParseMultipartForm(100 << 20); err != nil { // 100MB
-		catPage.Execute(w, map[string]interface{}{"Category": cat, "IsMovies": true, "Error": "Error parsing form"})
-		return
-	}
-	name := strings.TrimSpace(r.FormValue("moviename"))
-	short := r.FormValue("shortdesc")
-	long := r.FormValue("longdesc")
-	if name == "" {
-		catPage.Execute(w, map[string]interface{}{"Category": cat, "IsMovies": true, "Error": "Movie name required"})
-		return
-	}
-	dir := filepath.Join(catPath, name)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		catPage.Execute(w, map[string]interface{}{"Category": cat, "IsMovies": true, "Error": "Failed to create dir"})
-		return
+	fail := func(msg string) {
+		renderPage(w, r, catPage, map[string]interface{}{"Category": cat, "IsMovies": true, "Error": msg})
 	}
-	// video file
-	video, vhead, err := r.FormFile("video")
-	if err != nil {
-		catPage.Execute(w, map[string]interface{}{"Category": cat, "IsMovies": true, "Error": "Missing video"})
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	if err := r.ParseMultipartForm(100 << 20); err != nil { // 100MB
+		fail("Error parsing form")
 		return
 	}
-	defer video.Close()
-	vpath := filepath.Join(dir, vhead.Filename)
-	if err := saveUploadedFile(video, vpath); err != nil {
-		catPage.Execute(w, map[string]interface{}{"Category": cat, "IsMovies": true, "Error": "Failed to save video: " + err.Error()})
+	up, cleanup := formItemUpload(r)
+	defer cleanup()
+	if _, err := audited(r).saveItem(catPath, r.FormValue("moviename"), up); err != nil {
+		fail("Upload failed: " + err.Error())
 		return
 	}
-
-	// thumb (optional)
-	if thumb, thead, err := r.FormFile("thumb"); err == nil && thead.Filename != "" {
-		defer thumb.Close()
-		tpath := filepath.Join(dir, thead.Filename)
-		if err := saveUploadedFile(thumb, tpath); err != nil {
-			catPage.Execute(w, map[string]interface{}{"Category": cat, "IsMovies": true, "Error": "Failed to save thumbnail: " + err.Error()})
-			return
-		}
-	}
-	// desc (txt)
-	if short != "" || long != "" {
-		txt := short + "\n" + long
-		if err := os.WriteFile(filepath.Join(dir, "desc.txt"), []byte(txt), 0644); err != nil {
-			catPage.Execute(w, map[string]interface{}{"Category": cat, "IsMovies": true, "Error": "Failed to save description: " + err.Error()})
-			return
-		}
-	}
 	http.Redirect(w, r, "/admin/cat/"+cat, http.StatusSeeOther)
 }
 
 func handleEpisodeUpload(seasonPath string, w http.ResponseWriter, r *http.Request, cat, ser, season string) {
-	if err := r.ParseMultipartForm(100 << 20); err != nil {
-		seasonPage.Execute(w, map[string]interface{}{"Category": cat, "Series": ser, "Season": season, "Error": "Form error"})
-		return
-	}
-	epname := strings.TrimSpace(r.FormValue("epname"))
-	short := r.FormValue("shortdesc")
-	long := r.FormValue("longdesc")
-	if epname == "" {
-		seasonPage.Execute(w, map[string]interface{}{"Category": cat, "Series": ser, "Season": season, "Error": "Episode name required"})
-		return
+	fail := func(msg string) {
+		renderPage(w, r, seasonPage, map[string]interface{}{"Category": cat, "Series": ser, "Season": season, "Error": msg})
 	}
-	dir := filepath.Join(seasonPath, epname)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		seasonPage.Execute(w, map[string]interface{}{"Category": cat, "Series": ser, "Season": season, "Error": "Failed to create dir"})
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	if err := r.ParseMultipartForm(100 << 20); err != nil {
+		fail("Form error")
 		return
 	}
-	video, vhead, err := r.FormFile("video")
-	if err != nil {
-		seasonPage.Execute(w, map[string]interface{}{"Category": cat, "Series": ser, "Season": season, "Error": "Missing video"})
+	up, cleanup := formItemUpload(r)
+	defer cleanup()
+	if _, err := audited(r).saveItem(seasonPath, r.FormValue("epname"), up); err != nil {
+		fail("Upload failed: " + err.Error())
 		return
 	}
-	defer video.Close()
-	vpath := filepath.Join(dir, vhead.Filename)
-	if err := saveUploadedFile(video, vpath); err != nil {
-		seasonPage.Execute(w, map[string]interface{}{"Category": cat, "Series": ser, "Season": season, "Error": "Failed to save video: " + err.Error()})
-		return
+	http.Redirect(w, r, "/admin/cat/"+cat+"/series/"+ser+"/season/"+season, http.StatusSeeOther)
+}
+
+// formItemUpload collects the fields of a parsed movie or episode form. The
+// video is either already uploaded through tus (upload_id) or sent along.
+func formItemUpload(r *http.Request) (itemUpload, func()) {
+	up := itemUpload{
+		UploadID:  strings.TrimSpace(r.FormValue("upload_id")),
+		Owner:     checkSession(r),
+		ShortDesc: r.FormValue("shortdesc"),
+		LongDesc:  r.FormValue("longdesc"),
 	}
-	if thumb, thead, err := r.FormFile("thumb"); err == nil && thead.Filename != "" {
-		defer thumb.Close()
-		tpath := filepath.Join(dir, thead.Filename)
-		if err := saveUploadedFile(thumb, tpath); err != nil {
-			seasonPage.Execute(w, map[string]interface{}{"Category": cat, "Series": ser, "Season": season, "Error": "Failed to save thumbnail: " + err.Error()})
-			return
+	var files []io.Closer
+	cleanup := func() {
+		for _, f := range files {
+			f.Close()
 		}
 	}
-	if short != "" || long != "" {
-		txt := short + "\n" + long
-		if err := os.WriteFile(filepath.Join(dir, "desc.txt"), []byte(txt), 0644); err != nil {
-			seasonPage.Execute(w, map[string]interface{}{"Category": cat, "Series": ser, "Season": season, "Error": "Failed to save description: " + err.Error()})
-			return
+	if up.UploadID == "" {
+		if video, vhead, err := r.FormFile("video"); err == nil {
+			files = append(files, video)
+			up.Video, up.VideoName = video, vhead.Filename
 		}
 	}
-	http.Redirect(w, r, "/admin/cat/"+cat+"/series/"+ser+"/season/"+season, http.StatusSeeOther)
+	if thumb, thead, err := r.FormFile("thumb"); err == nil && thead.Filename != "" {
+		files = append(files, thumb)
+		up.Thumb, up.ThumbName = thumb, thead.Filename
+	}
+	return up, cleanup
 }
 
-func saveUploadedFile(f multipart.File, target string) error {
+func saveUploadedFile(f io.Reader, target string) error {
 	out, err := os.Create(target)
 	if err != nil {
 		return err
@@ -741,7 +876,7 @@ func listCategories(root string) ([]string, error) {
 	}
 	var out []string
 	for _, e := range entries {
-		if e.IsDir() {
+		if e.IsDir() && !isHiddenName(e.Name()) {
 			out = append(out, e.Name())
 		}
 	}
@@ -749,6 +884,18 @@ func listCategories(root string) ([]string, error) {
 	return out, nil
 }
 
+// clientIP returns the address of the remote end of the request.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if isTrustedProxy(host) {
+		return forwardedClientIP(r, host)
+	}
+	return host
+}
+
 func listSubDirs(path string) ([]string, error) {
 	entries, err := os.ReadDir(path)
 	if err != nil {
@@ -767,26 +914,7 @@ func listSubDirs(path string) ([]string, error) {
 // ==== AUTH BOILERPLATE (unchanged) ====
 
 func userExists() bool {
-	_, err := os.Stat(userFile)
-	return err == nil
-}
-func saveUser(u User) error {
-	f, err := os.Create(userFile)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	return json.NewEncoder(f).Encode(u)
-}
-func loadUser() (*User, error) {
-	f, err := os.Open(userFile)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-	var u User
-	err = json.NewDecoder(f).Decode(&u)
-	return &u, err
+	return users.count() > 0
 }
 func rootHandler(w http.ResponseWriter, r *http.Request) {
 	if !userExists() {
@@ -810,13 +938,8 @@ func setupHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Username or password too short.", 400)
 			return
 		}
-		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-		if err != nil {
-			http.Error(w, "Internal error", 500)
-			return
-		}
-		u := User{Username: username, PasswordHash: string(hash)}
-		if err := saveUser(u); err != nil {
+		// The first account always gets full access.
+		if err := users.add(username, password, RoleAdmin); err != nil {
 			http.Error(w, "Failed to save user: "+err.Error(), 500)
 			return
 		}
@@ -836,37 +959,44 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 	case "POST":
 		username := r.FormValue("username")
 		password := r.FormValue("password")
-		u, err := loadUser()
-		if err != nil || username != u.Username {
-			loginPage.Execute(w, map[string]string{"Error": "Invalid username or password"})
+		ip := clientIP(r)
+		// Refuse before checking the password so a locked account can't be probed
+		if wait := loginGuard.blocked(ip, username); wait > 0 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			loginPage.Execute(w, map[string]string{"Error": lockoutMessage(wait)})
 			return
 		}
-		if bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) != nil {
+		u := users.authenticate(username, password)
+		if u == nil {
+			loginGuard.fail(r, username, "invalid username or password")
 			loginPage.Execute(w, map[string]string{"Error": "Invalid username or password"})
 			return
 		}
-		token := newSessionToken()
-		sessionMu.Lock()
-		sessions[token] = username
-		sessionMu.Unlock()
-		http.SetCookie(w, &http.Cookie{
-			Name:     "session",
-			Value:    token,
-			Path:     "/",
-			HttpOnly: true,
-			SameSite: http.SameSiteStrictMode,
-		})
-		http.Redirect(w, r, "/admin", http.StatusSeeOther)
+		remember := r.FormValue("remember") != ""
+		if u.TOTPSecret != "" {
+			startTwoFactor(w, r, u.Username, remember)
+			return
+		}
+		loginGuard.succeed(username)
+		startSession(w, r, u.Username, remember)
 	default:
 		http.Error(w, "Method not allowed", 405)
 	}
 }
+
+// startSession logs the browser in as username and goes to the dashboard.
+func startSession(w http.ResponseWriter, r *http.Request, username string, remember bool) {
+	// Never reuse a token the browser brought along
+	if old, err := r.Cookie("session"); err == nil {
+		sessions.revokeToken(old.Value)
+	}
+	setSessionCookie(w, sessions.create(username, remember, r), remember)
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
 func logoutHandler(w http.ResponseWriter, r *http.Request) {
 	cookie, err := r.Cookie("session")
 	if err == nil {
-		sessionMu.Lock()
-		delete(sessions, cookie.Value)
-		sessionMu.Unlock()
+		sessions.revokeToken(cookie.Value)
 		http.SetCookie(w, &http.Cookie{
 			Name:     "session",
 			Value:    "",
@@ -879,13 +1009,13 @@ func logoutHandler(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/login", http.StatusSeeOther)
 }
 func checkSession(r *http.Request) string {
-	cookie, err := r.Cookie("session")
-	if err != nil {
-		return ""
+	if t := currentAPIToken(r); t != nil {
+		return t.Username
 	}
-	sessionMu.Lock()
-	defer sessionMu.Unlock()
-	return sessions[cookie.Value]
+	if sess := currentSession(r); sess != nil {
+		return sess.Username
+	}
+	return ""
 }
 func newSessionToken() string {
 	b := make([]byte, 32)
@@ -896,7 +1026,36 @@ func newSessionToken() string {
 }
 func requireLogin(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if username := checkSession(r); username != "" {
+		// Tokens aren't sent automatically by browsers, so no CSRF check
+		if bearerToken(r) != "" {
+			if t := currentAPIToken(r); t != nil && users.get(t.Username) != nil {
+				next(w, r)
+				return
+			}
+			unauthorizedToken(w)
+			return
+		}
+		sess := currentSession(r)
+		if sess != nil && users.get(sess.Username) != nil {
+			if !csrfSafeMethod(r.Method) && !validCSRF(r, sess.CSRF) {
+				csrfFailed(w, r)
+				return
+			}
+			if sess.Rotate {
+				// Privileges changed since this token was issued
+				cookie, _ := r.Cookie("session")
+				if token := sessions.rotate(cookie.Value); token != "" {
+					setSessionCookie(w, token, sess.Remember)
+					cookies := r.Cookies()
+					r.Header.Del("Cookie")
+					for _, c := range cookies {
+						if c.Name == "session" {
+							c.Value = token
+						}
+						r.AddCookie(c)
+					}
+				}
+			}
 			next(w, r)
 			return
 		}